@@ -194,6 +194,52 @@ func (bind *LinuxSocketBind) SetMark(value uint32) error {
 	return nil
 }
 
+var _ BindSocketBuffers = (*LinuxSocketBind)(nil)
+
+// SetSocketBuffers implements BindSocketBuffers.
+// It asks for SO_RCVBUFFORCE and SO_SNDBUFFORCE first, which privileged processes
+// may use to exceed net.core.rmem_max and net.core.wmem_max, and falls back to
+// SO_RCVBUF and SO_SNDBUF, which are capped by those limits.
+func (bind *LinuxSocketBind) SetSocketBuffers(recv, send int) (actualRecv, actualSend int, err error) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+
+	for _, sock := range []int{bind.sock4, bind.sock6} {
+		if sock == -1 {
+			continue
+		}
+		r, err := setSocketBuffer(sock, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, recv)
+		if err != nil {
+			return 0, 0, err
+		}
+		s, err := setSocketBuffer(sock, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, send)
+		if err != nil {
+			return 0, 0, err
+		}
+		if actualRecv == 0 || r < actualRecv {
+			actualRecv = r
+		}
+		if actualSend == 0 || s < actualSend {
+			actualSend = s
+		}
+	}
+	return actualRecv, actualSend, nil
+}
+
+// setSocketBuffer sets a buffer of sock to size, unless size is 0, and returns its size.
+func setSocketBuffer(sock, forceOpt, opt, size int) (int, error) {
+	if size > 0 {
+		if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, forceOpt, size); err != nil {
+			if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, opt, size); err != nil {
+				return 0, err
+			}
+		}
+	}
+	actual, err := unix.GetsockoptInt(sock, unix.SOL_SOCKET, opt)
+	// The kernel doubles the size it is given to allow for bookkeeping overhead.
+	return actual / 2, err
+}
+
 func (bind *LinuxSocketBind) Close() error {
 	// Take a readlock to shut down the sockets...
 	bind.mu.RLock()
@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysctlInt reads an integer from /proc/sys, returning 0 if it cannot.
+func sysctlInt(name string) int {
+	b, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
+
+func TestLinuxSocketBindSetSocketBuffers(t *testing.T) {
+	bind := NewLinuxSocketBind().(*LinuxSocketBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Skipf("cannot open bind: %v", err)
+	}
+	defer bind.Close()
+
+	const size = 1 << 20
+	recv, send, err := bind.SetSocketBuffers(size, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unprivileged processes are capped by the sysctl limits.
+	for _, buf := range []struct {
+		name   string
+		actual int
+		max    int
+	}{
+		{"receive", recv, sysctlInt("net.core.rmem_max")},
+		{"send", send, sysctlInt("net.core.wmem_max")},
+	} {
+		if buf.actual != size && (buf.max == 0 || buf.actual != buf.max) {
+			t.Errorf("%s buffer is %d bytes, want %d or the limit of %d", buf.name, buf.actual, size, buf.max)
+		}
+	}
+
+	// The sizes reported are those the sockets have.
+	for _, sock := range []int{bind.sock4, bind.sock6} {
+		if sock == -1 {
+			continue
+		}
+		if got, _ := unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_RCVBUF); got/2 < recv {
+			t.Errorf("socket %d receive buffer is %d bytes, reported %d", sock, got/2, recv)
+		}
+		if got, _ := unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_SNDBUF); got/2 < send {
+			t.Errorf("socket %d send buffer is %d bytes, reported %d", sock, got/2, send)
+		}
+	}
+
+	// A size of 0 leaves the buffer alone.
+	recv2, send2, err := bind.SetSocketBuffers(0, 0)
+	if err != nil || recv2 != recv || send2 != send {
+		t.Errorf("SetSocketBuffers(0, 0) = %d, %d, %v; want %d, %d, nil", recv2, send2, err, recv, send)
+	}
+}
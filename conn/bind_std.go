@@ -131,6 +131,32 @@ again:
 	return fns, uint16(port), nil
 }
 
+var _ BindSocketBuffers = (*StdNetBind)(nil)
+
+// SetSocketBuffers implements BindSocketBuffers.
+// The sizes granted are not known, so they are reported as 0.
+func (bind *StdNetBind) SetSocketBuffers(recv, send int) (actualRecv, actualSend int, err error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	for _, conn := range []*net.UDPConn{bind.ipv4, bind.ipv6} {
+		if conn == nil {
+			continue
+		}
+		if recv > 0 {
+			if err := conn.SetReadBuffer(recv); err != nil {
+				return 0, 0, err
+			}
+		}
+		if send > 0 {
+			if err := conn.SetWriteBuffer(send); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return 0, 0, nil
+}
+
 func (bind *StdNetBind) Close() error {
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// An Impairment describes how an ImpairedBind mistreats the packets it sends.
+// The zero Impairment leaves them alone.
+type Impairment struct {
+	Seed      int64         // seeds the random choices, so that runs are reproducible
+	Drop      float64       // probability that a packet is dropped
+	Duplicate float64       // probability that a packet is sent twice
+	Delay     time.Duration // delay added to every packet
+	// Jitter is the most extra delay chosen at random for each packet.
+	// Packets sent less than Jitter apart may arrive out of order.
+	Jitter time.Duration
+}
+
+// ImpairmentStats counts what an ImpairedBind did to the packets sent through it.
+type ImpairmentStats struct {
+	Sent       uint64 // packets given to Send
+	Dropped    uint64
+	Duplicated uint64
+	Delayed    uint64 // copies sent late, counting duplicates separately
+}
+
+// An ImpairedBind wraps a Bind, dropping, duplicating and delaying
+// the packets sent through it as described by an Impairment.
+type ImpairedBind struct {
+	conn.Bind
+	impairment Impairment
+
+	mu    sync.Mutex // protects rand and stats
+	rand  *rand.Rand
+	stats ImpairmentStats
+}
+
+var _ conn.Bind = (*ImpairedBind)(nil)
+
+func NewImpairedBind(bind conn.Bind, impairment Impairment) *ImpairedBind {
+	return &ImpairedBind{
+		Bind:       bind,
+		impairment: impairment,
+		rand:       rand.New(rand.NewSource(impairment.Seed)),
+	}
+}
+
+// Stats returns what the ImpairedBind has done so far.
+func (b *ImpairedBind) Stats() ImpairmentStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// Send sends buf to ep through the wrapped Bind, unless it drops it.
+// Packets sent late are sent from another goroutine, and any error doing so is ignored.
+func (b *ImpairedBind) Send(buf []byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	b.stats.Sent++
+	if b.rand.Float64() < b.impairment.Drop {
+		b.stats.Dropped++
+		b.mu.Unlock()
+		return nil
+	}
+	delays := make([]time.Duration, 1, 2)
+	if b.rand.Float64() < b.impairment.Duplicate {
+		b.stats.Duplicated++
+		delays = append(delays, 0)
+	}
+	for i := range delays {
+		delays[i] = b.impairment.Delay
+		if b.impairment.Jitter > 0 {
+			delays[i] += time.Duration(b.rand.Int63n(int64(b.impairment.Jitter) + 1))
+		}
+		if delays[i] > 0 {
+			b.stats.Delayed++
+		}
+	}
+	b.mu.Unlock()
+
+	var err error
+	for _, delay := range delays {
+		if delay == 0 {
+			err = b.Bind.Send(buf, ep)
+			continue
+		}
+		late := append([]byte(nil), buf...)
+		time.AfterFunc(delay, func() {
+			b.Bind.Send(late, ep)
+		})
+	}
+	return err
+}
@@ -22,8 +22,8 @@ type ReceiveFunc func(b []byte) (n int, ep Endpoint, err error)
 
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
-// depending on the platform-specific implementation.
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface
+// or BindSocketBuffers, depending on the platform-specific implementation.
 type Bind interface {
 	// Open puts the Bind into a listening state on a given port and reports the actual
 	// port that it bound to. Passing zero results in a random selection.
@@ -52,6 +52,15 @@ type BindSocketToInterface interface {
 	BindSocketToInterface6(interfaceIndex uint32, blackhole bool) error
 }
 
+// BindSocketBuffers is implemented by Bind objects that support setting
+// the kernel buffer sizes of their sockets.
+type BindSocketBuffers interface {
+	// SetSocketBuffers requests receive and send buffers of the given sizes in bytes
+	// for the open sockets, leaving a buffer unchanged if its size is 0.
+	// It reports the sizes granted, which may be less, or 0 where they are unknown.
+	SetSocketBuffers(recv, send int) (actualRecv, actualSend int, err error)
+}
+
 // PeekLookAtSocketFd is implemented by Bind objects that support having their
 // file descriptor peeked at. Used by wireguard-android.
 type PeekLookAtSocketFd interface {
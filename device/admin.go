@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type adminConfig struct {
+	PublicKey  string      `json:"public_key,omitempty"`
+	ListenPort uint16      `json:"listen_port,omitempty"`
+	FwMark     uint32      `json:"fwmark,omitempty"`
+	Up         bool        `json:"up"`
+	Peers      []adminPeer `json:"peers"`
+}
+
+type adminPeer struct {
+	PublicKey                   string      `json:"public_key"`
+	HasPresharedKey             bool        `json:"has_preshared_key"`
+	Endpoint                    string      `json:"endpoint,omitempty"`
+	StickyEndpoint              bool        `json:"sticky_endpoint,omitempty"`
+	PersistentKeepaliveInterval uint32      `json:"persistent_keepalive_interval,omitempty"`
+	AllowedIPs                  []string    `json:"allowed_ips"`
+	Stats                       *adminStats `json:"stats,omitempty"`
+}
+
+type adminStats struct {
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+}
+
+// ServeHTTP serves a read-only view of the device's configuration as JSON,
+// so that an embedder can mount the device as a diagnostics endpoint.
+// Keys are base64 encoded. The private key and preshared keys are never included;
+// only whether a peer has a preshared key is. Per-peer traffic counters and
+// handshake times are included only if the request has the query parameter stats=true.
+// Only GET and HEAD are allowed.
+func (device *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var withStats bool
+	if s := r.URL.Query().Get("stats"); s != "" {
+		var err error
+		if withStats, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid stats parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	b, err := json.MarshalIndent(device.adminConfig(withStats), "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(append(b, '\n'))
+}
+
+func (device *Device) adminConfig(withStats bool) adminConfig {
+	device.ipcMutex.RLock()
+	defer device.ipcMutex.RUnlock()
+
+	device.net.RLock()
+	defer device.net.RUnlock()
+
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	cfg := adminConfig{
+		ListenPort: device.net.port,
+		FwMark:     device.net.fwmark,
+		Up:         device.isUp(),
+		Peers:      make([]adminPeer, 0, len(device.peers.keyMap)),
+	}
+	if !device.staticIdentity.privateKey.IsZero() {
+		cfg.PublicKey = base64.StdEncoding.EncodeToString(device.staticIdentity.publicKey[:])
+	}
+
+	keys := make([]NoisePublicKey, 0, len(device.peers.keyMap))
+	for key := range device.peers.keyMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	for _, key := range keys {
+		peer := device.peers.keyMap[key]
+		peer.RLock()
+		p := adminPeer{
+			PublicKey:                   base64.StdEncoding.EncodeToString(key[:]),
+			HasPresharedKey:             !isZero(peer.handshake.presharedKey[:]),
+			PersistentKeepaliveInterval: atomic.LoadUint32(&peer.persistentKeepaliveInterval),
+			AllowedIPs:                  []string{},
+		}
+		if peer.endpoint != nil {
+			p.Endpoint = peer.endpoint.DstToString()
+		}
+		p.StickyEndpoint = peer.stickyEndpoint
+		peer.RUnlock()
+		device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+			p.AllowedIPs = append(p.AllowedIPs, fmt.Sprintf("%s/%d", ip, cidr))
+			return true
+		})
+		if withStats {
+			p.Stats = &adminStats{
+				RxBytes: atomic.LoadUint64(&peer.stats.rxBytes),
+				TxBytes: atomic.LoadUint64(&peer.stats.txBytes),
+			}
+			if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+				t := time.Unix(0, nano).UTC()
+				p.Stats.LastHandshake = &t
+			}
+		}
+		cfg.Peers = append(cfg.Peers, p)
+	}
+	return cfg
+}
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTP(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	sk := dev.staticIdentity.privateKey
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	get := func(target string) (*httptest.ResponseRecorder, adminConfig) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		dev.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var cfg adminConfig
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", target, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+			t.Fatalf("GET %s: %v", target, err)
+		}
+		return w, cfg
+	}
+
+	w, cfg := get("/")
+	body := w.Body.String()
+	for _, secret := range []string{hex.EncodeToString(sk[:]), base64.StdEncoding.EncodeToString(sk[:]), "private"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response contains %q:\n%s", secret, body)
+		}
+	}
+	if len(cfg.Peers) != 1 {
+		t.Fatalf("got %d peers, want 1:\n%s", len(cfg.Peers), body)
+	}
+	peer := cfg.Peers[0]
+	if peer.PublicKey != base64.StdEncoding.EncodeToString(pk[:]) ||
+		len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0] != "1.0.0.2/32" || peer.Stats != nil {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+	if !cfg.Up || cfg.ListenPort == 0 {
+		t.Errorf("unexpected device: %+v", cfg)
+	}
+
+	_, cfg = get("/?stats=true")
+	if stats := cfg.Peers[0].Stats; stats == nil || stats.RxBytes == 0 || stats.TxBytes == 0 || stats.LastHandshake == nil {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/", strings.NewReader("private_key=")),
+		httptest.NewRequest(http.MethodGet, "/?stats=maybe", nil),
+	} {
+		w := httptest.NewRecorder()
+		dev.ServeHTTP(w, req)
+		if w.Code == http.StatusOK {
+			t.Errorf("%s %s succeeded", req.Method, req.URL)
+		}
+	}
+}
@@ -62,4 +62,8 @@ func TestDeviceAlignment(t *testing.T) {
 		)
 	}
 	checkAlignment(t, "Device.rate.underLoadUntil", unsafe.Offsetof(d.rate)+unsafe.Offsetof(d.rate.underLoadUntil))
+	checkAlignment(t, "Device.tun.writeStalls", unsafe.Offsetof(d.tun)+unsafe.Offsetof(d.tun.writeStalls))
+	checkAlignment(t, "Device.stats.configGeneration", unsafe.Offsetof(d.stats)+unsafe.Offsetof(d.stats.configGeneration))
+	checkAlignment(t, "Device.stats.upSinceNano", unsafe.Offsetof(d.stats)+unsafe.Offsetof(d.stats.upSinceNano))
+	checkAlignment(t, "Device.stats.progress", unsafe.Offsetof(d.stats)+unsafe.Offsetof(d.stats.progress))
 }
@@ -228,6 +228,42 @@ func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.IPv6 = table.IPv6.removeByPeer(peer)
 }
 
+// Remove removes ip/cidr from the allowed IPs of peer,
+// leaving the peer's other allowed IPs in place.
+// It does nothing if peer does not own ip/cidr.
+func (table *AllowedIPs) Remove(ip net.IP, cidr uint, peer *Peer) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	type entry struct {
+		ip   net.IP
+		cidr uint
+	}
+	var keep []entry
+	found := false
+	for elem := peer.trieEntries.Front(); elem != nil; elem = elem.Next() {
+		node := elem.Value.(*trieEntry)
+		if node.cidr == cidr && node.bits.Equal(ip) && len(node.bits) == len(ip) {
+			found = true
+			continue
+		}
+		keep = append(keep, entry{append(net.IP{}, node.bits...), node.cidr})
+	}
+	if !found {
+		return
+	}
+
+	table.IPv4 = table.IPv4.removeByPeer(peer)
+	table.IPv6 = table.IPv6.removeByPeer(peer)
+	for _, e := range keep {
+		if len(e.ip) == net.IPv4len {
+			table.IPv4 = table.IPv4.insert(e.ip, e.cidr, peer)
+		} else {
+			table.IPv6 = table.IPv6.insert(e.ip, e.cidr, peer)
+		}
+	}
+}
+
 func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
@@ -8,6 +8,7 @@ package device
 import (
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 // An outboundQueue is a channel of QueueOutboundElements awaiting encryption.
@@ -54,9 +55,53 @@ func newInboundQueue() *inboundQueue {
 }
 
 // A handshakeQueue is similar to an outboundQueue; see those docs.
+// When it is full, packets are dropped according to its overflow policy.
 type handshakeQueue struct {
-	c  chan QueueHandshakeElement
-	wg sync.WaitGroup
+	drops    uint64 // accessed atomically; first for 64-bit alignment
+	overflow int32  // a HandshakeQueueOverflow, accessed atomically
+	c        chan QueueHandshakeElement
+	wg       sync.WaitGroup
+}
+
+// A HandshakeQueueOverflow selects which packet is dropped
+// when a handshake packet arrives to find the handshake queue full.
+type HandshakeQueueOverflow int32
+
+const (
+	// HandshakeQueueDropNewest drops the packet that just arrived.
+	HandshakeQueueDropNewest HandshakeQueueOverflow = iota
+	// HandshakeQueueDropOldest drops the packet that has waited longest, making room for the new one.
+	HandshakeQueueDropOldest
+)
+
+// enqueue adds elem to the queue and reports whether it did.
+// If the queue is full, a packet is dropped according to the overflow policy;
+// the buffer of a dropped packet other than elem is passed to free.
+func (q *handshakeQueue) enqueue(elem QueueHandshakeElement, free func(*[MaxMessageSize]byte)) bool {
+	select {
+	case q.c <- elem:
+		return true
+	default:
+	}
+	if HandshakeQueueOverflow(atomic.LoadInt32(&q.overflow)) != HandshakeQueueDropOldest {
+		atomic.AddUint64(&q.drops, 1)
+		return false
+	}
+	select {
+	case old := <-q.c:
+		atomic.AddUint64(&q.drops, 1)
+		free(old.buffer)
+	default:
+		// the handshake workers made room meanwhile
+	}
+	select {
+	case q.c <- elem:
+		return true
+	default:
+		// another receiver filled the room first
+		atomic.AddUint64(&q.drops, 1)
+		return false
+	}
 }
 
 func newHandshakeQueue() *handshakeQueue {
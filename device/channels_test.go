@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestHandshakeQueueOverflow(t *testing.T) {
+	const size = 4
+	for _, test := range []struct {
+		policy HandshakeQueueOverflow
+		queued []int // indexes of the packets left in the queue
+		freed  []int // indexes of the packets whose buffers were freed
+	}{
+		{HandshakeQueueDropNewest, []int{0, 1, 2, 3}, nil},
+		{HandshakeQueueDropOldest, []int{2, 3, 4, 5}, []int{0, 1}},
+	} {
+		q := &handshakeQueue{c: make(chan QueueHandshakeElement, size)}
+		q.overflow = int32(test.policy)
+
+		buffers := make([]*[MaxMessageSize]byte, size+2)
+		index := make(map[*[MaxMessageSize]byte]int)
+		var freed []int
+		free := func(buffer *[MaxMessageSize]byte) {
+			freed = append(freed, index[buffer])
+		}
+		for i := range buffers {
+			buffers[i] = new([MaxMessageSize]byte)
+			index[buffers[i]] = i
+			ok := q.enqueue(QueueHandshakeElement{buffer: buffers[i]}, free)
+			if want := i < size || test.policy == HandshakeQueueDropOldest; ok != want {
+				t.Errorf("policy %d: enqueue of packet %d = %v, want %v", test.policy, i, ok, want)
+			}
+		}
+
+		if drops := q.drops; drops != 2 {
+			t.Errorf("policy %d: %d drops, want 2", test.policy, drops)
+		}
+		if !equalInts(freed, test.freed) {
+			t.Errorf("policy %d: freed %v, want %v", test.policy, freed, test.freed)
+		}
+		var queued []int
+		for len(q.c) > 0 {
+			queued = append(queued, index[(<-q.c).buffer])
+		}
+		if !equalInts(queued, test.queued) {
+			t.Errorf("policy %d: queued %v, want %v", test.policy, queued, test.queued)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
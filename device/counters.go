@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DeviceCounters is a snapshot of the device's totals.
+// The traffic counters include that of peers since removed,
+// so that they never go backwards.
+type DeviceCounters struct {
+	RxBytes    uint64 // bytes received from peers
+	TxBytes    uint64 // bytes sent to peers
+	RxPackets  uint64 // messages received from peers, handshake messages and keepalives included
+	TxPackets  uint64 // messages sent to peers, handshake messages and keepalives included
+	Handshakes uint64 // handshakes completed
+
+	TUNWriteStalls uint64 // received packets dropped because writing them to the TUN device timed out
+
+	Peers       int           // peers configured
+	ActivePeers int           // peers with a handshake in the last RejectAfterTime
+	UnderLoad   bool          // whether the device is rate limiting handshakes
+	Uptime      time.Duration // since the device last came up; zero if it is not up
+
+	// ConfigGeneration is the number of successful IPC set operations,
+	// SyncPeers included, so that it changes whenever the configuration may have.
+	ConfigGeneration uint64
+}
+
+// peerTotals holds the traffic counters of a set of peers.
+type peerTotals struct {
+	rxBytes, txBytes, rxPackets, txPackets, handshakes uint64
+}
+
+func (t *peerTotals) add(peer *Peer) {
+	t.rxBytes += atomic.LoadUint64(&peer.stats.rxBytes)
+	t.txBytes += atomic.LoadUint64(&peer.stats.txBytes)
+	t.rxPackets += atomic.LoadUint64(&peer.stats.rxPackets)
+	t.txPackets += atomic.LoadUint64(&peer.stats.txPackets)
+	t.handshakes += atomic.LoadUint64(&peer.stats.handshakes)
+}
+
+// Counters returns a snapshot of the device's totals. It sums the counters
+// of the peers, which the data path keeps anyway, so it is cheap enough to poll.
+func (device *Device) Counters() DeviceCounters {
+	now := time.Now()
+	active := now.Add(-RejectAfterTime).UnixNano()
+
+	device.peers.RLock()
+	totals := device.stats.removed
+	counters := DeviceCounters{Peers: len(device.peers.keyMap)}
+	for _, peer := range device.peers.keyMap {
+		totals.add(peer)
+		if atomic.LoadInt64(&peer.stats.lastHandshakeNano) > active {
+			counters.ActivePeers++
+		}
+	}
+	device.peers.RUnlock()
+
+	counters.RxBytes = totals.rxBytes
+	counters.TxBytes = totals.txBytes
+	counters.RxPackets = totals.rxPackets
+	counters.TxPackets = totals.txPackets
+	counters.Handshakes = totals.handshakes
+
+	// Unlike IsUnderLoad, this does not extend the time under load.
+	counters.UnderLoad = len(device.queue.handshake.c) >= QueueHandshakeSize/8 ||
+		atomic.LoadInt64(&device.rate.underLoadUntil) > now.UnixNano()
+	if device.isUp() {
+		if nano := atomic.LoadInt64(&device.stats.upSinceNano); nano != 0 {
+			counters.Uptime = now.Sub(time.Unix(0, nano))
+		}
+	}
+	counters.TUNWriteStalls = device.TUNWriteStalls()
+	counters.ConfigGeneration = atomic.LoadUint64(&device.stats.configGeneration)
+	return counters
+}
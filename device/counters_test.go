@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+// sumStatuses returns the traffic counters of a device's peers, summed.
+func sumStatuses(dev *Device) (sum DeviceCounters) {
+	for _, status := range dev.PeerStatuses() {
+		sum.RxBytes += status.RxBytes
+		sum.TxBytes += status.TxBytes
+		sum.RxPackets += status.RxPackets
+		sum.TxPackets += status.TxPackets
+		sum.Handshakes += status.Handshakes
+	}
+	return sum
+}
+
+func TestCounters(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	for i := range pair {
+		dev := pair[i].dev
+		c := dev.Counters()
+		sum := sumStatuses(dev)
+		if c.RxBytes != sum.RxBytes || c.TxBytes != sum.TxBytes || c.RxPackets != sum.RxPackets ||
+			c.TxPackets != sum.TxPackets || c.Handshakes != sum.Handshakes {
+			t.Errorf("device %d counters = %+v, want the sum of its peers' %+v", i, c, sum)
+		}
+		if c.RxPackets == 0 || c.TxPackets == 0 || c.Handshakes != 1 {
+			t.Errorf("device %d counters = %+v, want traffic both ways and one handshake", i, c)
+		}
+		if c.Peers != 1 || c.ActivePeers != 1 {
+			t.Errorf("device %d has %d peers, %d active, want 1 and 1", i, c.Peers, c.ActivePeers)
+		}
+		if c.Uptime <= 0 {
+			t.Errorf("device %d is up, but its uptime is %v", i, c.Uptime)
+		}
+	}
+
+	// Configuration bumps the generation, and removing a peer leaves the totals.
+	dev := pair[0].dev
+	before := dev.Counters()
+	if err := dev.IpcSet(uapiCfg("listen_port", "0")); err != nil {
+		t.Fatal(err)
+	}
+	if c := dev.Counters(); c.ConfigGeneration != before.ConfigGeneration+1 {
+		t.Errorf("config generation went from %d to %d, want it bumped", before.ConfigGeneration, c.ConfigGeneration)
+	}
+	if err := dev.IpcSet(uapiCfg("listen_port", "not a port")); err == nil {
+		t.Fatal("invalid configuration was accepted")
+	}
+	if c := dev.Counters(); c.ConfigGeneration != before.ConfigGeneration+1 {
+		t.Errorf("failed configuration bumped the config generation to %d", c.ConfigGeneration)
+	}
+	dev.RemoveAllPeers()
+	c := dev.Counters()
+	if c.RxBytes < before.RxBytes || c.TxBytes < before.TxBytes || c.RxPackets < before.RxPackets ||
+		c.TxPackets < before.TxPackets || c.Handshakes != before.Handshakes {
+		t.Errorf("after removing the peer, counters = %+v, want at least %+v", c, before)
+	}
+	if c.Peers != 0 || c.ActivePeers != 0 {
+		t.Errorf("after removing the peer, %d peers, %d active, want none", c.Peers, c.ActivePeers)
+	}
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if c := dev.Counters(); c.Uptime != 0 {
+		t.Errorf("device is down, but its uptime is %v", c.Uptime)
+	}
+}
@@ -6,6 +6,9 @@
 package device
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -42,8 +45,18 @@ type Device struct {
 		sync.RWMutex
 		bind          conn.Bind // bind interface
 		netlinkCancel *rwcancel.RWCancel
-		port          uint16 // listening port
-		fwmark        uint32 // mark value (0 = disabled)
+		port          uint16    // listening port
+		portRange     [2]uint16 // ports to choose the listening port from (0 = no range)
+		fwmark        uint32    // mark value (0 = disabled)
+		recvBuffer    int       // requested socket receive buffer size (0 = kernel default)
+		sendBuffer    int       // requested socket send buffer size (0 = kernel default)
+	}
+
+	stats struct {
+		configGeneration uint64                 // successful IPC set operations; accessed atomically; first for 64-bit alignment
+		upSinceNano      int64                  // when the device last came up; accessed atomically
+		progress         [watchdogStages]uint64 // elements taken by each kind of routine; accessed atomically
+		removed          peerTotals             // counters of removed peers; protected by peers
 	}
 
 	staticIdentity struct {
@@ -54,7 +67,7 @@ type Device struct {
 
 	rate struct {
 		underLoadUntil int64
-		limiter        ratelimiter.Ratelimiter
+		limiter        *ratelimiter.Ratelimiter
 	}
 
 	peers struct {
@@ -79,13 +92,62 @@ type Device struct {
 	}
 
 	tun struct {
-		device tun.Device
-		mtu    int32
+		writeStalls  uint64     // packets dropped because a write timed out; accessed atomically; first for 64-bit alignment
+		writeTimeout int64      // how long a write may block, in nanoseconds, or 0 for no limit; accessed atomically
+		writeLock    sync.Mutex // held by writes with a timeout, as the deadline is the device's, and to change writeTimeout
+		device       tun.Device
+		mtu          int32
+	}
+
+	ipcMutex   sync.RWMutex
+	closed     chan struct{}
+	log        *Logger // the Logger the device logs to, which applies logLevel
+	logger     *Logger // the Logger the device was created with
+	logLevel   int32   // accessed atomically
+	logLimiter logLimiter
+
+	trace struct {
+		sync.Mutex              // serializes SetTraceHook
+		enabled    AtomicBool   // whether hook is set
+		hook       atomic.Value // the func(TraceEvent) set by SetTraceHook
+	}
+
+	filter struct {
+		sync.Mutex              // serializes SetPacketFilter
+		enabled    AtomicBool   // whether fn is set
+		fn         atomic.Value // the func(Direction, []byte) bool set by SetPacketFilter
+	}
+
+	queuePressure struct {
+		sync.Mutex              // serializes SetQueuePressureHook
+		enabled    AtomicBool   // whether hook is set
+		hook       atomic.Value // the queuePressureHook set by SetQueuePressureHook
+	}
+
+	handshakeBackoff struct {
+		sync.RWMutex               // protects the fields below
+		rounds       int           // as set by SetHandshakeBackoff
+		max          time.Duration // as set by SetHandshakeBackoff
+	}
+
+	noRoute struct {
+		policy  uint32                   // a NoRoutePolicy, accessed atomically
+		limiter *ratelimiter.Ratelimiter // of the errors NoRouteReject sends
+	}
+
+	watchdog struct {
+		sync.Mutex               // serializes SetWatchdog
+		stop       chan struct{} // stops the running watchdog, if any
 	}
 
-	ipcMutex sync.RWMutex
-	closed   chan struct{}
-	log      *Logger
+	minPersistentKeepalive uint16     // protected by ipcMutex
+	uapiPolicy             UAPIPolicy // protected by ipcMutex
+	roamingDisabled        AtomicBool // set by SetRoamingDisabled
+
+	// rotation is the key being rotated out, or nil; see BeginKeyRotation.
+	// It is protected by staticIdentity, and is not in it to keep the
+	// fields after it 64-bit aligned.
+	rotation *previousIdentity
 }
 
 // deviceState represents the state of a Device.
@@ -128,6 +190,8 @@ func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 	device.allowedips.RemoveByPeer(peer)
 	peer.Stop()
+	device.stats.removed.add(peer)
+	device.logLimiter.forget(peer)
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
@@ -180,6 +244,7 @@ func (device *Device) upLocked() error {
 		}
 	}
 	device.peers.RUnlock()
+	atomic.StoreInt64(&device.stats.upSinceNano, time.Now().UnixNano())
 	return nil
 }
 
@@ -229,6 +294,18 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 		return nil
 	}
 
+	for _, peer := range device.setPrivateKeyLocked(sk, nil) {
+		peer.ExpireCurrentKeypairs()
+	}
+
+	return nil
+}
+
+// setPrivateKeyLocked makes sk the device's private key, and previous the one
+// that handshakes are also accepted under, if not nil. It returns the peers,
+// whose sessions the caller is to expire if it changes key outright.
+// The caller must hold device.staticIdentity.
+func (device *Device) setPrivateKeyLocked(sk NoisePrivateKey, previous *previousIdentity) []*Peer {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
@@ -253,6 +330,7 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	device.staticIdentity.privateKey = sk
 	device.staticIdentity.publicKey = publicKey
+	device.rotation = previous
 	device.cookieChecker.Init(publicKey)
 
 	// do static-static DH pre-computations
@@ -261,24 +339,29 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	for _, peer := range device.peers.keyMap {
 		handshake := &peer.handshake
 		handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
+		handshake.setPreviousStatic(previous)
+		handshake.usePrevious = previous != nil
 		expiredPeers = append(expiredPeers, peer)
 	}
 
 	for _, peer := range lockedPeers {
 		peer.handshake.mutex.RUnlock()
 	}
-	for _, peer := range expiredPeers {
-		peer.ExpireCurrentKeypairs()
-	}
 
-	return nil
+	return expiredPeers
 }
 
 func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device := new(Device)
 	device.state.state = uint32(deviceStateDown)
 	device.closed = make(chan struct{})
-	device.log = logger
+	device.logger = logger
+	device.logLevel = LogLevelVerbose
+	if logger.level != nil {
+		device.logLevel = atomic.LoadInt32(logger.level)
+	}
+	device.log = newDeviceLogger(logger, &device.logLevel)
+	device.logLimiter.init()
 	device.net.bind = bind
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -288,7 +371,8 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	}
 	device.tun.mtu = int32(mtu)
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
-	device.rate.limiter.Init()
+	device.rate.limiter = ratelimiter.New(ratelimiter.Options{})
+	device.noRoute.limiter = newNoRouteLimiter()
 	device.indexTable.Init()
 	device.PopulatePools()
 
@@ -335,6 +419,109 @@ func (device *Device) RemovePeer(key NoisePublicKey) {
 	}
 }
 
+// AddAllowedIP adds prefix to the allowed IPs of the peer with the given public key,
+// leaving the peer's existing allowed IPs in place. As with allowed_ip in the UAPI,
+// a prefix already owned by another peer is moved to this one.
+func (device *Device) AddAllowedIP(pk NoisePublicKey, prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return errors.New("invalid allowed IP prefix")
+	}
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return errors.New("no such peer")
+	}
+	prefix = prefix.Masked()
+	device.allowedips.Insert(prefix.Addr().AsSlice(), uint(prefix.Bits()), peer)
+	return nil
+}
+
+// RemoveAllowedIP removes prefix from the allowed IPs of the peer with the given public key,
+// leaving the peer's other allowed IPs in place. Removing a prefix the peer does not have is not an error.
+func (device *Device) RemoveAllowedIP(pk NoisePublicKey, prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return errors.New("invalid allowed IP prefix")
+	}
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return errors.New("no such peer")
+	}
+	prefix = prefix.Masked()
+	device.allowedips.Remove(prefix.Addr().AsSlice(), uint(prefix.Bits()), peer)
+	return nil
+}
+
+// PeerConnected reports whether the peer with the given public key
+// completed a handshake within the last within. It returns an error if there is no such peer.
+func (device *Device) PeerConnected(pk NoisePublicKey, within time.Duration) (bool, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return false, errors.New("no such peer")
+	}
+	nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	return nano != 0 && time.Since(time.Unix(0, nano)) <= within, nil
+}
+
+// ResetPeerSession discards the session with the peer with the given public key,
+// along with any handshake in progress and packets waiting for one, and starts a new handshake
+// right away rather than at the next rekey, for instance after the peer's endpoint has changed.
+// Traffic to and from the peer resumes once the new handshake completes.
+func (device *Device) ResetPeerSession(pk NoisePublicKey) error {
+	device.ipcMutex.RLock()
+	defer device.ipcMutex.RUnlock()
+
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return errors.New("no such peer")
+	}
+	peer.log.Verbosef("Resetting session")
+	peer.ZeroAndFlushAll()
+	// Allow the new initiation to be sent immediately.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	if device.isUp() && peer.isRunning.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+	return nil
+}
+
+// SetPeerEndpoints sets candidate endpoints for the peer with public key pk,
+// such as the same host behind several ports. The peer uses the first, and moves on
+// to the next each time a handshake goes unanswered, wrapping around at the end.
+// Setting a single endpoint, or setting one through IpcSet, removes the others.
+func (device *Device) SetPeerEndpoints(pk NoisePublicKey, endpoints []string) error {
+	if len(endpoints) == 0 {
+		return errors.New("no endpoints")
+	}
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return errors.New("no such peer")
+	}
+	candidates := make([]conn.Endpoint, len(endpoints))
+	for i, s := range endpoints {
+		endpoint, err := device.net.bind.ParseEndpoint(s)
+		if err != nil {
+			return fmt.Errorf("failed to set endpoint %v: %w", s, err)
+		}
+		candidates[i] = endpoint
+	}
+	peer.Lock()
+	defer peer.Unlock()
+	peer.endpoint = candidates[0]
+	peer.candidates = candidates
+	peer.candidate = 0
+	return nil
+}
+
 func (device *Device) RemoveAllPeers() {
 	device.peers.Lock()
 	defer device.peers.Unlock()
@@ -371,6 +558,7 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.noRoute.limiter.Close()
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
@@ -412,12 +600,139 @@ func closeBindLocked(device *Device) error {
 	return err
 }
 
+// openBindLocked opens the bind on the listening port. If there is a port range,
+// and the listening port is not in it or fails to bind, it uses the first port
+// of the range that binds instead.
+func (device *Device) openBindLocked() ([]conn.ReceiveFunc, uint16, error) {
+	netc := &device.net
+	lo, hi := netc.portRange[0], netc.portRange[1]
+	if lo == 0 {
+		return netc.bind.Open(netc.port)
+	}
+	if netc.port >= lo && netc.port <= hi {
+		if recvFns, port, err := netc.bind.Open(netc.port); err == nil {
+			return recvFns, port, nil
+		}
+	}
+	var err error
+	for port := uint32(lo); port <= uint32(hi); port++ {
+		var recvFns []conn.ReceiveFunc
+		var actual uint16
+		recvFns, actual, err = netc.bind.Open(uint16(port))
+		if err == nil {
+			return recvFns, actual, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no port in %d-%d could be bound: %w", lo, hi, err)
+}
+
 func (device *Device) Bind() conn.Bind {
 	device.net.Lock()
 	defer device.net.Unlock()
 	return device.net.bind
 }
 
+// ListenPort returns the UDP port the device is listening on.
+// If the device was asked for a random port, this is the port that was chosen.
+func (device *Device) ListenPort() uint16 {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.net.port
+}
+
+// SetListenPortRange makes the device listen on a port between lo and hi inclusive,
+// trying each in turn until one binds, for when a firewall allows only those.
+// ListenPort reports the port chosen. If the device is up and its port is outside
+// the range, it rebinds at once. Setting listen_port through IpcSet removes the range.
+func (device *Device) SetListenPortRange(lo, hi uint16) error {
+	if lo == 0 || lo > hi {
+		return fmt.Errorf("invalid listen port range %d-%d", lo, hi)
+	}
+	device.net.Lock()
+	device.net.portRange = [2]uint16{lo, hi}
+	if device.net.port >= lo && device.net.port <= hi {
+		device.net.Unlock()
+		return nil
+	}
+	device.net.port = 0
+	device.net.Unlock()
+	return device.BindUpdate()
+}
+
+// SetHandshakeQueueOverflow sets which packet is dropped when a handshake packet
+// arrives to find the handshake queue full. The default is HandshakeQueueDropNewest.
+// Under a sustained flood, dropping the oldest packets instead serves whoever
+// sent most recently, rather than whoever happened to get in first.
+func (device *Device) SetHandshakeQueueOverflow(policy HandshakeQueueOverflow) {
+	atomic.StoreInt32(&device.queue.handshake.overflow, int32(policy))
+}
+
+// HandshakeQueueDrops returns the number of handshake packets dropped
+// because the handshake queue was full.
+func (device *Device) HandshakeQueueDrops() uint64 {
+	return atomic.LoadUint64(&device.queue.handshake.drops)
+}
+
+// SetTUNWriteTimeout limits how long writing received packets to the TUN device
+// may block, as when whatever reads the interface has stopped. A write that times
+// out is logged, its packets are dropped and counted by TUNWriteStalls, and the
+// device carries on. As the deadline is one for the whole TUN device, writes for
+// different peers take turns while there is a timeout. A timeout of 0 removes
+// the limit. It returns an error if the TUN device does not implement
+// tun.WriteDeadlineDevice.
+func (device *Device) SetTUNWriteTimeout(timeout time.Duration) error {
+	tunDevice, ok := device.tun.device.(tun.WriteDeadlineDevice)
+	if !ok {
+		return errors.New("TUN device does not support write deadlines")
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	device.tun.writeLock.Lock()
+	defer device.tun.writeLock.Unlock()
+	atomic.StoreInt64(&device.tun.writeTimeout, int64(timeout))
+	if timeout == 0 {
+		return tunDevice.SetWriteDeadline(time.Time{})
+	}
+	return nil
+}
+
+// TUNWriteStalls returns the number of received packets dropped
+// because writing them to the TUN device timed out.
+func (device *Device) TUNWriteStalls() uint64 {
+	return atomic.LoadUint64(&device.tun.writeStalls)
+}
+
+// SetMinPersistentKeepalive sets the shortest persistent keepalive interval,
+// in seconds, that IpcSet accepts. Shorter non-zero intervals are raised to it,
+// so that one misconfigured peer cannot have the device send it a keepalive every second.
+// It applies to intervals set afterwards. The default of 0 allows any interval.
+func (device *Device) SetMinPersistentKeepalive(secs uint16) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	device.minPersistentKeepalive = secs
+}
+
+// persistentKeepalive returns the interval a peer gets when it is configured with secs,
+// which is raised to the minimum set by SetMinPersistentKeepalive unless it is 0.
+// The caller must hold ipcMutex.
+func (device *Device) persistentKeepalive(secs uint16) uint16 {
+	if secs != 0 && secs < device.minPersistentKeepalive {
+		return device.minPersistentKeepalive
+	}
+	return secs
+}
+
+// SetRoamingDisabled sets whether the device keeps every peer at the endpoint
+// it was configured with, rather than roaming to wherever its authenticated packets
+// last came from. Where peers are at fixed addresses, this stops a replayed or
+// spoofed packet that authenticates from redirecting a peer's traffic. A peer
+// with no configured endpoint then cannot be reached until it is given one.
+// Roaming is enabled by default; to pin only some peers, see sticky_endpoint.
+func (device *Device) SetRoamingDisabled(disabled bool) {
+	device.roamingDisabled.Set(disabled)
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -449,6 +764,42 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
+// SetSocketBuffers requests kernel receive and send buffers of the given sizes in bytes
+// for the device's UDP sockets, now and whenever they are reopened.
+// A size of 0 leaves that buffer's size to the kernel.
+// The kernel may grant less than requested, which is logged.
+func (device *Device) SetSocketBuffers(recv, send int) error {
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	device.net.recvBuffer, device.net.sendBuffer = recv, send
+	if device.isUp() && device.net.bind != nil {
+		return device.setSocketBuffersLocked()
+	}
+	return nil
+}
+
+// Must hold device.net.Lock()
+func (device *Device) setSocketBuffersLocked() error {
+	recv, send := device.net.recvBuffer, device.net.sendBuffer
+	if recv == 0 && send == 0 {
+		return nil
+	}
+	bind, ok := device.net.bind.(conn.BindSocketBuffers)
+	if !ok {
+		device.log.Verbosef("UDP bind does not support setting socket buffer sizes")
+		return nil
+	}
+	actualRecv, actualSend, err := bind.SetSocketBuffers(recv, send)
+	if err != nil {
+		return err
+	}
+	if actualRecv != 0 && actualRecv < recv || actualSend != 0 && actualSend < send {
+		device.log.Verbosef("UDP socket buffers limited by the kernel to %d bytes for receiving and %d for sending", actualRecv, actualSend)
+	}
+	return nil
+}
+
 func (device *Device) BindUpdate() error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -467,7 +818,7 @@ func (device *Device) BindUpdate() error {
 	var err error
 	var recvFns []conn.ReceiveFunc
 	netc := &device.net
-	recvFns, netc.port, err = netc.bind.Open(netc.port)
+	recvFns, netc.port, err = device.openBindLocked()
 	if err != nil {
 		netc.port = 0
 		return err
@@ -487,6 +838,11 @@ func (device *Device) BindUpdate() error {
 		}
 	}
 
+	// set socket buffer sizes, if asked to; this is best-effort
+	if err := device.setSocketBuffersLocked(); err != nil {
+		device.log.Errorf("Failed to set UDP socket buffer sizes: %v", err)
+	}
+
 	// clear cached source addresses
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
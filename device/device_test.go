@@ -8,12 +8,15 @@ package device
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"net/netip"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -21,6 +24,8 @@ import (
 
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -115,12 +120,19 @@ func (d SendDirection) String() string {
 
 func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}) {
 	tb.Helper()
-	p0, p1 := pair[0], pair[1]
+	pair.send(tb, ping, done, func(dst, src *testPeer) []byte {
+		return tuntest.Ping(dst.ip, src.ip)
+	})
+}
+
+func (pair *testPair) send(tb testing.TB, ping SendDirection, done chan struct{}, genPing func(dst, src *testPeer) []byte) {
+	tb.Helper()
+	p0, p1 := &pair[0], &pair[1]
 	if !ping {
 		// pong is the new ping
 		p0, p1 = p1, p0
 	}
-	msg := tuntest.Ping(p0.ip, p1.ip)
+	msg := genPing(p0, p1)
 	p1.tun.Outbound <- msg
 	timer := time.NewTimer(5 * time.Second)
 	defer timer.Stop()
@@ -129,6 +141,8 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 	case msgRecv := <-p0.tun.Inbound:
 		if !bytes.Equal(msg, msgRecv) {
 			err = fmt.Errorf("%s did not transit correctly", ping)
+		} else if _, _, err = tuntest.ParseEcho(msgRecv); err != nil {
+			err = fmt.Errorf("%s is not a valid echo request: %w", ping, err)
 		}
 	case <-timer.C:
 		err = fmt.Errorf("%s did not transit", ping)
@@ -147,14 +161,23 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 }
 
 // genTestPair creates a testPair.
+// It is for tests that need the devices' internals, which cannot use devicetest
+// without an import cycle. Tests that need only the exported API go in
+// package device_test and use devicetest.NewPair.
 func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
-	cfg, endpointCfg := genConfigs(tb)
 	var binds [2]conn.Bind
 	if realSocket {
 		binds[0], binds[1] = conn.NewDefaultBind(), conn.NewDefaultBind()
 	} else {
 		binds = bindtest.NewChannelBinds()
 	}
+	return genTestPairWithBinds(tb, binds, nil)
+}
+
+// genTestPairWithBinds creates a testPair connected by binds.
+// If wrapTUN is not nil, the devices use the TUNs it returns in place of their ChannelTUNs.
+func genTestPairWithBinds(tb testing.TB, binds [2]conn.Bind, wrapTUN func(tun.Device) tun.Device) (pair testPair) {
+	cfg, endpointCfg := genConfigs(tb)
 	// Bring up a ChannelTun for each config.
 	for i := range pair {
 		p := &pair[i]
@@ -164,7 +187,11 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 		if _, ok := tb.(*testing.B); ok && !testing.Verbose() {
 			level = LogLevelError
 		}
-		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
+		tunDevice := p.tun.TUN()
+		if wrapTUN != nil {
+			tunDevice = wrapTUN(tunDevice)
+		}
+		p.dev = NewDevice(tunDevice, binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
 		if err := p.dev.IpcSet(cfg[i]); err != nil {
 			tb.Errorf("failed to configure device %d: %v", i, err)
 			p.dev.Close()
@@ -190,15 +217,104 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 	return
 }
 
-func TestTwoDevicePing(t *testing.T) {
+// singlePacketTUN hides the ReadBatch and WriteBatch methods of a tun.BatchDevice.
+type singlePacketTUN struct {
+	tun.Device
+}
+
+func TestSinglePacketTUN(t *testing.T) {
 	goroutineLeakCheck(t)
-	pair := genTestPair(t, true)
-	t.Run("ping 1.0.0.1", func(t *testing.T) {
-		pair.Send(t, Ping, nil)
-	})
-	t.Run("ping 1.0.0.2", func(t *testing.T) {
-		pair.Send(t, Pong, nil)
+	pair := genTestPairWithBinds(t, bindtest.NewChannelBinds(), func(d tun.Device) tun.Device {
+		return singlePacketTUN{d}
 	})
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestTUNEvents(t *testing.T) {
+	goroutineLeakCheck(t)
+	ctun := tuntest.NewChannelTUN()
+	dev := NewDevice(ctun.TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, "events: "))
+	defer dev.Close()
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	mtuIs := func(mtu int32) func() bool {
+		return func() bool { return atomic.LoadInt32(&dev.tun.mtu) == mtu }
+	}
+
+	waitFor("device to come up", dev.isUp)
+	ctun.SetMTU(1280)
+	waitFor("MTU of 1280", mtuIs(1280))
+	ctun.SetMTU(MaxContentSize + 100)
+	waitFor("MTU capped at MaxContentSize", mtuIs(MaxContentSize))
+	ctun.InjectEvent(tun.EventDown)
+	waitFor("device to go down", func() bool { return !dev.isUp() })
+	ctun.InjectEvent(tun.EventUp | tun.EventMTUUpdate)
+	waitFor("device to come back up", dev.isUp)
+	// The MTU carried by a detailed event is used, not the TUN's current one.
+	ctun.InjectDetailedEvent(tun.DetailedEvent{Event: tun.EventMTUUpdate, MTU: 1300})
+	waitFor("MTU of 1300", mtuIs(1300))
+	ctun.InjectError(errors.New("interface removed"))
+	select {
+	case <-dev.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for device to close after a TUN error")
+	}
+}
+
+func TestLossyPing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for handshake retransmissions")
+	}
+	goroutineLeakCheck(t)
+	var binds [2]conn.Bind
+	var impaired [2]*bindtest.ImpairedBind
+	for i, bind := range bindtest.NewChannelBinds() {
+		impaired[i] = bindtest.NewImpairedBind(bind, bindtest.Impairment{
+			Seed:   int64(i + 5), // loses a packet without waiting on handshake retransmission
+			Drop:   0.3,
+			Jitter: time.Millisecond,
+		})
+		binds[i] = impaired[i]
+	}
+	pair := genTestPairWithBinds(t, binds, nil)
+
+	// Pings may be lost too, so keep sending until one gets through.
+	// Each lost handshake costs a RekeyTimeout.
+	for i, p := range []*testPeer{&pair[0], &pair[1]} {
+		from := &pair[i^1]
+		msg := tuntest.Ping(p.ip, from.ip)
+		deadline := time.After(4 * RekeyTimeout)
+	retry:
+		for {
+			from.tun.Outbound <- msg
+			select {
+			case got := <-p.tun.Inbound:
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("ping to %v did not transit correctly", p.ip)
+				}
+				break retry
+			case <-time.After(100 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("ping to %v did not transit: %+v %+v", p.ip, impaired[0].Stats(), impaired[1].Stats())
+			}
+		}
+	}
+
+	for i, b := range impaired {
+		stats := b.Stats()
+		t.Logf("bind %d: %+v", i, stats)
+		if stats.Sent == 0 || stats.Delayed == 0 {
+			t.Errorf("bind %d was not exercised: %+v", i, stats)
+		}
+	}
 }
 
 func TestUpDown(t *testing.T) {
@@ -238,6 +354,530 @@ func TestUpDown(t *testing.T) {
 	}
 }
 
+// TestListenPortUnchanged checks that setting the listen port
+// to the one already in use does not rebind the device.
+func TestListenPortUnchanged(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	port := dev.ListenPort()
+	if port == 0 {
+		t.Fatal("device has no listen port after coming up")
+	}
+	// The channel binds pick one of two ports at random each time they are opened,
+	// so a spurious rebind would very likely show up as a changed port.
+	for i := 0; i < 16; i++ {
+		if err := dev.IpcSet(uapiCfg("listen_port", fmt.Sprint(port))); err != nil {
+			t.Fatal(err)
+		}
+		if got := dev.ListenPort(); got != port {
+			t.Fatalf("listen port changed from %d to %d after setting it to its current value", port, got)
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestCloneConfigTo(t *testing.T) {
+	pair := genTestPair(t, false)
+	src := pair[0].dev
+	dst := NewDevice(tuntest.NilDevice("clone"), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, "clone: "))
+	defer dst.Close()
+	if err := dst.IpcSet(uapiCfg("private_key", "7777777777777777777777777777777777777777777777777777777777777777")); err != nil {
+		t.Fatal(err)
+	}
+	dstKey := dst.staticIdentity.privateKey
+
+	// peerConfig returns the peer configuration of dev, without stats.
+	peerConfig := func(dev *Device) (lines []string) {
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers := false
+		for _, line := range strings.Split(cfg, "\n") {
+			key, _, _ := strings.Cut(line, "=")
+			switch key {
+			case "public_key":
+				peers = true
+			case "last_handshake_time_sec", "last_handshake_time_nsec", "tx_bytes", "rx_bytes":
+				continue
+			}
+			if peers {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	if err := src.CloneConfigTo(dst, false); err != nil {
+		t.Fatal(err)
+	}
+	want, got := peerConfig(src), peerConfig(dst)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("cloned peers:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !dst.staticIdentity.privateKey.Equals(dstKey) {
+		t.Error("private key was copied without copyPrivateKey")
+	}
+
+	if err := src.CloneConfigTo(dst, true); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.staticIdentity.privateKey.Equals(src.staticIdentity.privateKey) {
+		t.Error("private key was not copied with copyPrivateKey")
+	}
+	if err := src.CloneConfigTo(src, false); err == nil {
+		t.Error("cloning a device onto itself succeeded")
+	}
+}
+
+func TestAddRemoveAllowedIP(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	// allowedIPs returns the allowed_ip lines of dev's IpcGet output, in order.
+	allowedIPs := func() (ips []string) {
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(cfg, "\n") {
+			if key, value, _ := strings.Cut(line, "="); key == "allowed_ip" {
+				ips = append(ips, value)
+			}
+		}
+		return ips
+	}
+	check := func(want ...string) {
+		t.Helper()
+		if got := allowedIPs(); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("allowed IPs = %v, want %v", got, want)
+		}
+	}
+
+	check("1.0.0.2/32")
+	if err := dev.AddAllowedIP(pk, netip.MustParsePrefix("10.1.2.3/16")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.AddAllowedIP(pk, netip.MustParsePrefix("fd00::/64")); err != nil {
+		t.Fatal(err)
+	}
+	check("1.0.0.2/32", "10.1.0.0/16", "fd00::/64")
+	pair.Send(t, Ping, nil)
+
+	if err := dev.RemoveAllowedIP(pk, netip.MustParsePrefix("10.1.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	check("1.0.0.2/32", "fd00::/64")
+	if err := dev.RemoveAllowedIP(pk, netip.MustParsePrefix("10.9.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	check("1.0.0.2/32", "fd00::/64")
+	pair.Send(t, Ping, nil)
+
+	var unknown NoisePublicKey
+	if err := dev.AddAllowedIP(unknown, netip.MustParsePrefix("10.2.0.0/16")); err == nil {
+		t.Error("adding an allowed IP to an unknown peer succeeded")
+	}
+	if err := dev.RemoveAllowedIP(pk, netip.Prefix{}); err == nil {
+		t.Error("removing an invalid prefix succeeded")
+	}
+}
+
+func TestIpcSetValueWithEquals(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	// A zone may contain =, and only the first = on a line ends the key.
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "[fe80::1%zone=1]:51820",
+	)); err != nil {
+		t.Errorf("endpoint with = in its zone: %v", err)
+	}
+
+	for _, test := range []struct {
+		cfg  string
+		code int64
+	}{
+		{"private_key=" + strings.Repeat("77", NoisePrivateKeySize) + "=\n", ipc.IpcErrorInvalid},
+		{"private_key\n", ipc.IpcErrorProtocol},
+	} {
+		var ipcErr *IPCError
+		err := dev.IpcSet(test.cfg)
+		if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != test.code {
+			t.Errorf("IpcSet(%q) = %v, want error code %d", test.cfg, err, test.code)
+		}
+	}
+}
+
+func TestMinPersistentKeepalive(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	dev.SetMinPersistentKeepalive(10)
+
+	for _, test := range []struct {
+		set, want string
+	}{
+		{"1", "10"},
+		{"0", "0"},
+		{"25", "25"},
+	} {
+		if err := dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pk[:]),
+			"persistent_keepalive_interval", test.set,
+		)); err != nil {
+			t.Fatal(err)
+		}
+		uapi, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "persistent_keepalive_interval=" + test.want + "\n"; !strings.Contains(uapi, want) {
+			t.Errorf("after setting an interval of %s, got:\n%s\nwant %q", test.set, uapi, want)
+		}
+	}
+}
+
+func TestPeerConnected(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	if ok, err := dev.PeerConnected(pk, time.Minute); err != nil || !ok {
+		t.Errorf("PeerConnected after ping = %v, %v, want true", ok, err)
+	}
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(idle[:]))); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dev.PeerConnected(idle, time.Minute); err != nil || ok {
+		t.Errorf("PeerConnected for a peer that never handshaked = %v, %v, want false", ok, err)
+	}
+
+	var unknown NoisePublicKey
+	if _, err := dev.PeerConnected(unknown, time.Minute); err == nil {
+		t.Error("PeerConnected for an unknown peer succeeded")
+	}
+}
+
+func TestResetPeerSession(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	remote := pair[1].dev.LookupPeer(dev.staticIdentity.publicKey)
+	old, remoteOld := peer.keypairs.Current(), remote.keypairs.Current()
+	handshake := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	// Let the responder accept another initiation so soon, as in TestRekeyAfterMessages.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := dev.ResetPeerSession(pair[1].dev.staticIdentity.publicKey); err != nil {
+		t.Fatal(err)
+	}
+	// Packets sent with the old session are now dropped, so wait for both sides
+	// to move to the new one, which the remote does on receiving data or a keepalive in it.
+	for deadline := time.Now().Add(5 * time.Second); remote.keypairs.Current() == remoteOld; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a new session")
+		}
+	}
+	if current := peer.keypairs.Current(); current == nil || current == old {
+		t.Error("the remote has a new session, but the local side does not")
+	}
+	if atomic.LoadInt64(&peer.stats.lastHandshakeNano) <= handshake {
+		t.Error("new session without a new handshake")
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var unknown NoisePublicKey
+	if err := dev.ResetPeerSession(unknown); err == nil {
+		t.Error("resetting the session of an unknown peer succeeded")
+	}
+}
+
+func TestPeerCandidateEndpoints(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+
+	// The first candidate is a socket that reads the initiation but never answers.
+	dead, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	live := fmt.Sprintf("127.0.0.1:%d", pair[1].dev.net.port)
+	if err := dev.SetPeerEndpoints(pk, []string{dead.LocalAddr().String(), live}); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := tuntest.Ping(pair[1].ip, pair[0].ip)
+	pair[0].tun.Outbound <- ping
+	dead.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxMessageSize)
+	n, _, err := dead.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no handshake initiation sent to the first candidate: %v", err)
+	}
+	if n != MessageInitiationSize || buf[0] != MessageInitiationType {
+		t.Fatalf("first candidate got a %d byte message of type %d, want an initiation", n, buf[0])
+	}
+
+	// Fail the handshake now rather than after RekeyTimeout.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	expiredRetransmitHandshake(peer)
+	select {
+	case msg := <-pair[1].tun.Inbound:
+		if !bytes.Equal(msg, ping) {
+			t.Errorf("got %s, want the ping", tuntest.Summarize(msg))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping not delivered through the second candidate")
+	}
+	peer.RLock()
+	got := peer.endpoint.DstToString()
+	peer.RUnlock()
+	if got != live {
+		t.Errorf("endpoint = %s, want %s", got, live)
+	}
+
+	var unknown NoisePublicKey
+	if err := dev.SetPeerEndpoints(unknown, []string{live}); err == nil {
+		t.Error("setting the endpoints of an unknown peer succeeded")
+	}
+}
+
+// TestStickyEndpoint checks that a peer with sticky_endpoint set keeps its endpoint
+// when packets arrive from elsewhere, and roams again once it is cleared.
+func TestStickyEndpoint(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+	endpoint := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+	roamed := endpoint()
+
+	const pinned = "127.0.0.1:9999"
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", pinned,
+		"sticky_endpoint", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := dev.IpcGet(); err != nil || !strings.Contains(cfg, "sticky_endpoint=true\n") {
+		t.Errorf("IpcGet() = %q, %v, want it to include sticky_endpoint=true", cfg, err)
+	}
+	pair.Send(t, Ping, nil)
+	if got := endpoint(); got != pinned {
+		t.Errorf("sticky endpoint = %s after a packet from %s, want %s", got, roamed, pinned)
+	}
+
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"sticky_endpoint", "false",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	if got := endpoint(); got != roamed {
+		t.Errorf("endpoint = %s after stickiness was cleared, want %s", got, roamed)
+	}
+
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"sticky_endpoint", "yes",
+	)); err == nil {
+		t.Error("sticky_endpoint=yes was accepted")
+	}
+}
+
+// TestRoamingDisabled checks that with roaming disabled, a peer keeps its configured
+// endpoint when packets arrive from elsewhere, and roams again once it is enabled.
+func TestRoamingDisabled(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+	endpoint := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+	roamed := endpoint()
+
+	const configured = "127.0.0.1:9999"
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "endpoint", configured)); err != nil {
+		t.Fatal(err)
+	}
+	dev.SetRoamingDisabled(true)
+	pair.Send(t, Ping, nil)
+	if got := endpoint(); got != configured {
+		t.Errorf("endpoint = %s after a packet from %s with roaming disabled, want %s", got, roamed, configured)
+	}
+
+	dev.SetRoamingDisabled(false)
+	pair.Send(t, Ping, nil)
+	if got := endpoint(); got != roamed {
+		t.Errorf("endpoint = %s after roaming was enabled, want %s", got, roamed)
+	}
+}
+
+func TestListenPortRange(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+
+	// Occupy the first port of the range, so that the device must skip it.
+	busy, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	lo := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+	hi := lo + 2
+	if lo > hi {
+		t.Skipf("port %d is too close to the end of the port space", lo)
+	}
+	if err := dev.SetListenPortRange(lo, hi); err != nil {
+		t.Fatal(err)
+	}
+	port := dev.ListenPort()
+	if port <= lo || port > hi {
+		t.Fatalf("ListenPort = %d, want in %d-%d", port, lo+1, hi)
+	}
+	// The peer finds the device at its new port.
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(dev.staticIdentity.publicKey[:]),
+		"endpoint", fmt.Sprintf("127.0.0.1:%d", port),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+
+	if err := dev.SetListenPortRange(hi, lo); err == nil {
+		t.Error("inverted range accepted")
+	}
+	if err := dev.SetListenPortRange(0, hi); err == nil {
+		t.Error("range starting at port 0 accepted")
+	}
+	if got := dev.ListenPort(); got != port {
+		t.Errorf("ListenPort = %d after rejected ranges, want %d", got, port)
+	}
+}
+
+func TestTUNWriteTimeout(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	if err := dev.SetTUNWriteTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing reads the TUN, so the write of the ping times out.
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	for deadline := time.Now().Add(5 * time.Second); dev.TUNWriteStalls() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled TUN write not dropped")
+		}
+	}
+	if got := dev.TUNWriteStalls(); got != 1 {
+		t.Errorf("TUNWriteStalls = %d, want 1", got)
+	}
+	if got := dev.Counters().TUNWriteStalls; got != 1 {
+		t.Errorf("Counters().TUNWriteStalls = %d, want 1", got)
+	}
+	dev.logLimiter.Lock()
+	logged := dev.logLimiter.kinds[logKey{format: "TUN device write stalled for %v, dropped %d packets"}] != nil
+	dev.logLimiter.Unlock()
+	if !logged {
+		t.Error("stall not logged")
+	}
+	// The device carries on once the TUN is read again.
+	pair.Send(t, Ping, nil)
+
+	other := NewDevice(tuntest.DiscardDevice(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer other.Close()
+	if err := other.SetTUNWriteTimeout(time.Second); err == nil {
+		t.Error("write timeout set on a TUN without write deadlines")
+	}
+}
+
+// TestTUNWriteTimeoutDisable turns the TUN write timeout off while packets are
+// being written, and checks that no deadline is left behind to fail later writes.
+func TestTUNWriteTimeoutDisable(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	if err := dev.SetTUNWriteTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ping := tuntest.Ping(pair[1].ip, pair[0].ip)
+		for {
+			select {
+			case pair[0].tun.Outbound <- ping:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-pair[1].tun.Inbound:
+			case <-done:
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := dev.SetTUNWriteTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	wg.Wait()
+	stalls := dev.TUNWriteStalls()
+
+	// With no timeout, a write waits for the TUN to be read, however long that takes.
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping not written to the TUN")
+	}
+	if got := dev.TUNWriteStalls(); got != stalls {
+		t.Errorf("TUNWriteStalls = %d after the timeout was removed, want %d", got, stalls)
+	}
+}
+
 // TestConcurrencySafety does other things concurrently with tunnel use.
 // It is intended to be used with the race detector to catch data races.
 func TestConcurrencySafety(t *testing.T) {
@@ -325,7 +965,16 @@ func BenchmarkLatency(b *testing.B) {
 }
 
 func BenchmarkThroughput(b *testing.B) {
-	pair := genTestPair(b, true)
+	b.Run("batch", func(b *testing.B) {
+		benchmarkThroughput(b, nil)
+	})
+	b.Run("single-packet", func(b *testing.B) {
+		benchmarkThroughput(b, func(d tun.Device) tun.Device { return singlePacketTUN{d} })
+	})
+}
+
+func benchmarkThroughput(b *testing.B, wrapTUN func(tun.Device) tun.Device) {
+	pair := genTestPairWithBinds(b, [2]conn.Bind{conn.NewDefaultBind(), conn.NewDefaultBind()}, wrapTUN)
 
 	// Establish a connection.
 	pair.Send(b, Ping, nil)
@@ -0,0 +1,306 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package devicetest connects pairs of devices for integration tests.
+package devicetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// Timeout is how long ExpectPing, MustPing, MustEcho, AssertPingSucceeds and WaitHandshake
+// wait before failing the test.
+// It allows for one handshake to be retransmitted, as happens when initiations cross.
+const Timeout = 2 * device.RekeyTimeout
+
+// A Node is one of the two devices made by NewPair.
+type Node struct {
+	Device     *device.Device
+	TUN        *tuntest.ChannelTUN
+	PrivateKey device.NoisePrivateKey
+	PublicKey  device.NoisePublicKey
+	IP         netip.Addr // the node's IPv4 tunnel address, routed to it by its peer
+	IP6        netip.Addr // the node's IPv6 tunnel address, routed to it by its peer
+}
+
+type options struct {
+	loopbackUDP bool
+	logLevel    int
+}
+
+// An Option configures NewPair.
+type Option func(*options)
+
+// LoopbackUDP connects the devices over UDP on 127.0.0.1
+// rather than over an in-memory bind.
+func LoopbackUDP() Option {
+	return func(o *options) { o.loopbackUDP = true }
+}
+
+// LogLevel sets the level the devices log at. The default is device.LogLevelVerbose.
+func LogLevel(level int) Option {
+	return func(o *options) { o.logLevel = level }
+}
+
+// NewPair returns two devices that are up and peered with each other.
+// Node a has the tunnel addresses 1.0.0.1 and fd00::1, and node b has
+// 1.0.0.2 and fd00::2. The devices are closed when the test completes.
+func NewPair(tb testing.TB, opts ...Option) (a, b *Node) {
+	tb.Helper()
+	o := options{logLevel: device.LogLevelVerbose}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var binds [2]conn.Bind
+	if o.loopbackUDP {
+		binds[0], binds[1] = conn.NewDefaultBind(), conn.NewDefaultBind()
+	} else {
+		binds = bindtest.NewChannelBinds()
+	}
+
+	var nodes [2]*Node
+	for i := range nodes {
+		n := &Node{
+			TUN: tuntest.NewChannelTUN(),
+			IP:  netip.AddrFrom4([4]byte{1, 0, 0, byte(i + 1)}),
+			IP6: netip.AddrFrom16([16]byte{0: 0xfd, 15: byte(i + 1)}),
+		}
+		if _, err := rand.Read(n.PrivateKey[:]); err != nil {
+			tb.Fatalf("unable to generate private key: %v", err)
+		}
+		pub, err := curve25519.X25519(n.PrivateKey[:], curve25519.Basepoint)
+		if err != nil {
+			tb.Fatalf("unable to derive public key: %v", err)
+		}
+		copy(n.PublicKey[:], pub)
+		n.Device = device.NewDevice(n.TUN.TUN(), binds[i], device.NewLogger(o.logLevel, fmt.Sprintf("dev%d: ", i)))
+		tb.Cleanup(n.Device.Close)
+		nodes[i] = n
+	}
+
+	for i, n := range nodes {
+		peer := nodes[i^1]
+		if err := n.Device.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=0\nreplace_peers=true\n"+
+			"public_key=%s\nprotocol_version=1\nreplace_allowed_ips=true\nallowed_ip=%v\nallowed_ip=%v\n",
+			hex.EncodeToString(n.PrivateKey[:]),
+			hex.EncodeToString(peer.PublicKey[:]),
+			netip.PrefixFrom(peer.IP, 32), netip.PrefixFrom(peer.IP6, 128),
+		)); err != nil {
+			tb.Fatalf("failed to configure device %d: %v", i, err)
+		}
+		if err := n.Device.Up(); err != nil {
+			tb.Fatalf("failed to bring up device %d: %v", i, err)
+		}
+	}
+	for i, n := range nodes {
+		peer := nodes[i^1]
+		if err := n.Device.IpcSet(fmt.Sprintf("public_key=%s\nendpoint=127.0.0.1:%d\n",
+			hex.EncodeToString(peer.PublicKey[:]), peer.Device.ListenPort(),
+		)); err != nil {
+			tb.Fatalf("failed to configure device endpoint %d: %v", i, err)
+		}
+	}
+	return nodes[0], nodes[1]
+}
+
+// SendPing queues an ICMP echo request from one node's IPv4 address to the other's,
+// to be sent once from has a session with to.
+func SendPing(from, to *Node) {
+	from.TUN.Outbound <- tuntest.Ping(to.IP.AsSlice(), from.IP.AsSlice())
+}
+
+// ExpectPing fails the test unless the echo request sent by SendPing
+// arrives intact within Timeout.
+func ExpectPing(tb testing.TB, from, to *Node) {
+	tb.Helper()
+	expect(tb, from, to, tuntest.Ping(to.IP.AsSlice(), from.IP.AsSlice()))
+}
+
+// MustPing sends an ICMP echo request from one node's IPv4 address to the other's,
+// and fails the test unless it arrives intact within Timeout.
+func MustPing(tb testing.TB, from, to *Node) {
+	tb.Helper()
+	SendPing(from, to)
+	ExpectPing(tb, from, to)
+}
+
+// MustPing6 is like MustPing, but sends an ICMPv6 echo request between the nodes' IPv6 addresses.
+func MustPing6(tb testing.TB, from, to *Node) {
+	tb.Helper()
+	msg := tuntest.Ping6(to.IP6, from.IP6)
+	from.TUN.Outbound <- msg
+	expect(tb, from, to, msg)
+}
+
+// pingSeq is the sequence number of the last echo request sent by MustEcho or MustEcho6.
+var pingSeq uint32
+
+// MustEcho sends an ICMP echo request from one node's IPv4 address to the other's,
+// and fails the test unless the reply comes back to the sender within Timeout.
+// The receiving node's TUN must be answering echo requests, as it does
+// after tuntest.EchoResponder. Packets other than the reply are ignored.
+func MustEcho(tb testing.TB, from, to *Node) {
+	tb.Helper()
+	mustEcho(tb, from, to, to.IP, from.IP)
+}
+
+// MustEcho6 is like MustEcho, but sends an ICMPv6 echo request between the nodes' IPv6 addresses.
+func MustEcho6(tb testing.TB, from, to *Node) {
+	tb.Helper()
+	mustEcho(tb, from, to, to.IP6, from.IP6)
+}
+
+func mustEcho(tb testing.TB, from, to *Node, dst, src netip.Addr) {
+	tb.Helper()
+	seq := uint16(atomic.AddUint32(&pingSeq, 1))
+	request := tuntest.PingSeq(dst, src, seq)
+	want := tuntest.MakeEchoReply(request)
+	from.TUN.Outbound <- request
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case got := <-from.TUN.Inbound:
+			if _, gotSeq, err := tuntest.ParseEchoID(got); err != nil || gotSeq != seq || !tuntest.IsEchoReply(got) {
+				continue
+			}
+			if !bytes.Equal(got, want) {
+				tb.Fatalf("echo reply from %v to %v did not transit correctly", dst, src)
+			}
+			return
+		case <-timer.C:
+			tb.Fatalf("no echo reply from %v to %v", dst, src)
+		}
+	}
+}
+
+func expect(tb testing.TB, from, to *Node, msg []byte) {
+	tb.Helper()
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	select {
+	case got := <-to.TUN.Inbound:
+		if !bytes.Equal(got, msg) {
+			tb.Fatalf("ping from %v to %v did not transit correctly", from.IP, to.IP)
+		}
+	case <-timer.C:
+		tb.Fatalf("ping from %v to %v did not transit", from.IP, to.IP)
+	}
+}
+
+// AssertPingSucceeds sends ICMP echo requests from one node's IPv4 address to the other's
+// until one arrives intact, failing the test if none does within Timeout. It resends
+// with exponential backoff rather than waiting once, so that a slow handshake, as under
+// the race detector, does not fail the test. Since the earlier requests may still
+// arrive after it returns, later checks should skip packets they do not expect.
+func AssertPingSucceeds(tb testing.TB, from, to *Node) {
+	tb.Helper()
+	sent := make(map[uint16][]byte)
+	deadline := time.NewTimer(Timeout)
+	defer deadline.Stop()
+	for wait := 50 * time.Millisecond; ; wait *= 2 {
+		seq := uint16(atomic.AddUint32(&pingSeq, 1))
+		msg := tuntest.PingSeq(to.IP, from.IP, seq)
+		sent[seq] = msg
+		select {
+		case from.TUN.Outbound <- msg:
+		case <-deadline.C:
+			tb.Fatalf("ping from %v to %v could not be sent", from.IP, to.IP)
+		}
+		retry := time.NewTimer(wait)
+		for retrying := false; !retrying; {
+			select {
+			case got := <-to.TUN.Inbound:
+				id, gotSeq, err := tuntest.ParseEchoID(got)
+				if err != nil || id != tuntest.PingID || !tuntest.IsEchoRequest(got) || sent[gotSeq] == nil {
+					continue
+				}
+				retry.Stop()
+				if !bytes.Equal(got, sent[gotSeq]) {
+					tb.Fatalf("ping from %v to %v did not transit correctly", from.IP, to.IP)
+				}
+				return
+			case <-retry.C:
+				retrying = true
+			case <-deadline.C:
+				retry.Stop()
+				tb.Fatalf("ping from %v to %v did not transit after %d tries", from.IP, to.IP, len(sent))
+			}
+		}
+	}
+}
+
+// WaitForHandshake waits until dev has completed a handshake with the peer
+// with public key peer, failing the test if that takes longer than timeout.
+func WaitForHandshake(tb testing.TB, dev *device.Device, peer device.NoisePublicKey, timeout time.Duration) {
+	tb.Helper()
+	deadline := time.Now().Add(timeout)
+	for wait := time.Millisecond; ; wait *= 2 {
+		ok, err := dev.PeerConnected(peer, device.RejectAfterTime)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for a handshake with peer %x", peer[:])
+		}
+		if wait > 50*time.Millisecond {
+			wait = 50 * time.Millisecond
+		}
+		time.Sleep(wait)
+	}
+}
+
+// WaitHandshake waits until each node has completed a handshake with the other,
+// failing the test if that takes longer than Timeout.
+func WaitHandshake(tb testing.TB, a, b *Node) {
+	tb.Helper()
+	deadline := time.Now().Add(Timeout)
+	WaitForHandshake(tb, a.Device, b.PublicKey, time.Until(deadline))
+	WaitForHandshake(tb, b.Device, a.PublicKey, time.Until(deadline))
+}
+
+// GenConfig returns a UAPI configuration for a device with a random private key
+// and numPeers peers with random keys, for tests and benchmarks with many peers.
+// Peer i is allowed the address 10.0.0.0 + i + 1 and has an endpoint on 127.0.0.1.
+// It supports up to 1<<24 - 2 peers.
+func GenConfig(tb testing.TB, numPeers int) string {
+	tb.Helper()
+	if numPeers < 0 || numPeers > 1<<24-2 {
+		tb.Fatalf("cannot generate a configuration with %d peers", numPeers)
+	}
+	var b strings.Builder
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		tb.Fatalf("unable to generate private key: %v", err)
+	}
+	fmt.Fprintf(&b, "private_key=%s\nlisten_port=0\nreplace_peers=true\n", hex.EncodeToString(key[:]))
+	for i := 0; i < numPeers; i++ {
+		if _, err := rand.Read(key[:]); err != nil {
+			tb.Fatalf("unable to generate public key: %v", err)
+		}
+		n := i + 1
+		fmt.Fprintf(&b, "public_key=%s\nprotocol_version=1\nendpoint=127.0.0.1:%d\nallowed_ip=10.%d.%d.%d/32\n",
+			hex.EncodeToString(key[:]), 1024+i%(65536-1024), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Exported for the tests in package device_test.
+var GoroutineLeakCheck = goroutineLeakCheck
+
+// CurrentKeypair returns the keypair dev sends to the peer with public key pk under,
+// or nil if there is none.
+func CurrentKeypair(dev *Device, pk NoisePublicKey) *Keypair {
+	peer := dev.LookupPeer(pk)
+	if peer == nil {
+		return nil
+	}
+	return peer.keypairs.Current()
+}
+
+// IsInitiator reports whether kp came from a handshake its device initiated.
+func (kp *Keypair) IsInitiator() bool {
+	return kp.isInitiator
+}
+
+// ExhaustKeypair makes the next message dev sends to the peer with public key pk
+// reach RekeyAfterMessages, and lets dev initiate a handshake with the peer
+// without waiting out RekeyTimeout.
+func ExhaustKeypair(dev *Device, pk NoisePublicKey) {
+	peer := dev.LookupPeer(pk)
+	atomic.StoreUint64(&peer.keypairs.Current().sendNonce, RekeyAfterMessages+1)
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-RekeyTimeout)
+	peer.handshake.mutex.Unlock()
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sync/atomic"
+
+// SetPacketFilter makes the device pass each IP packet going through the tunnel
+// to filter, which returns whether to let it through. Outbound packets are
+// filtered when read from the TUN device, before they are encrypted,
+// and inbound packets once decrypted, before they are written to the TUN device,
+// after the check of their source address against the peer's allowed IPs.
+// Packets that are dropped are counted in the peer's PeerStatus.
+//
+// The filter runs on the data path, once for every packet, in the routines
+// that read from the TUN device and that deliver each peer's packets,
+// so a slow filter slows the tunnel down for all peers or for one.
+// It must be safe for concurrent use, and must not modify or keep packet.
+// A nil filter, the default, lets all packets through, and costs next to nothing.
+func (device *Device) SetPacketFilter(filter func(direction Direction, packet []byte) bool) {
+	device.filter.Lock()
+	defer device.filter.Unlock()
+	if filter == nil {
+		device.filter.enabled.Set(false)
+		return
+	}
+	device.filter.fn.Store(filter)
+	device.filter.enabled.Set(true)
+}
+
+// allowPacket reports whether the packet filter lets a packet to or from peer through,
+// and counts it if not. It is small enough to be inlined, so that
+// it costs only the check of whether to filter when there is no filter.
+func (device *Device) allowPacket(direction Direction, peer *Peer, packet []byte) bool {
+	return !device.filter.enabled.Get() || device.runFilter(direction, peer, packet)
+}
+
+func (device *Device) runFilter(direction Direction, peer *Peer, packet []byte) bool {
+	filter, _ := device.filter.fn.Load().(func(Direction, []byte) bool)
+	if filter == nil || filter(direction, packet) {
+		return true
+	}
+	atomic.AddUint64(&peer.stats.filtered, 1)
+	device.tracePacket(direction, peer, len(packet), TraceDropped, "filtered")
+	return false
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestPacketFilter(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil) // complete the handshake first
+
+	// Drop ICMP packets in both directions.
+	const icmp = 1
+	directions := make(chan Direction, 2)
+	pair[0].dev.SetPacketFilter(func(direction Direction, packet []byte) bool {
+		if packet[0]>>4 == ipv4.Version && packet[9] == icmp {
+			directions <- direction
+			return false
+		}
+		return true
+	})
+	filtered := func() uint64 {
+		return pair[0].dev.PeerStatuses()[0].Filtered
+	}
+	expectDropped := func(want Direction) {
+		t.Helper()
+		select {
+		case direction := <-directions:
+			if direction != want {
+				t.Errorf("filtered a packet going %v, want %v", direction, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ping going %v was not filtered", want)
+		}
+	}
+
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	expectDropped(DirectionInbound)
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	expectDropped(DirectionOutbound)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Error("filtered ping was delivered")
+	case <-pair[1].tun.Inbound:
+		t.Error("filtered ping was sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := filtered(); n != 2 {
+		t.Errorf("Filtered = %d, want 2", n)
+	}
+
+	pair[0].dev.SetPacketFilter(nil)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if n := filtered(); n != 2 {
+		t.Errorf("Filtered = %d after the filter was removed, want 2", n)
+	}
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// FuzzTUNInbound sends arbitrary packets into a device from its TUN,
+// routed to its peer when their destination allows it, and checks that
+// both devices survive them and still pass a ping afterwards.
+func FuzzTUNInbound(f *testing.F) {
+	for _, entry := range tuntest.Corpus() {
+		f.Add(entry.Packet)
+	}
+	pair := genTestPair(f, false)
+	// Route the corpus addresses through the tunnel, so that
+	// well-formed enough packets reach the peer's receive path.
+	pk0 := pair[0].dev.staticIdentity.publicKey
+	pk1 := pair[1].dev.staticIdentity.publicKey
+	for _, route := range []struct {
+		dev  *Device
+		peer NoisePublicKey
+		addr netip.Addr
+	}{
+		{pair[0].dev, pk1, tuntest.CorpusDst4},
+		{pair[0].dev, pk1, tuntest.CorpusDst6},
+		{pair[1].dev, pk0, tuntest.CorpusSrc4},
+		{pair[1].dev, pk0, tuntest.CorpusSrc6},
+	} {
+		if err := route.dev.AddAllowedIP(route.peer, netip.PrefixFrom(route.addr, route.addr.BitLen())); err != nil {
+			f.Fatal(err)
+		}
+	}
+	marker := tuntest.Ping(pair[1].ip, pair[0].ip)
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		timer := time.NewTimer(5 * time.Second)
+		defer timer.Stop()
+		for _, msg := range [][]byte{pkt, marker} {
+			select {
+			case pair[0].tun.Outbound <- msg:
+			case <-timer.C:
+				t.Fatal("device stopped reading from its TUN")
+			}
+		}
+		// Whatever of pkt got through arrives before the marker.
+		for {
+			select {
+			case got := <-pair[1].tun.Inbound:
+				if bytes.Equal(got, marker) {
+					return
+				}
+			case <-timer.C:
+				t.Fatal("ping after the fuzzed packet did not transit")
+			}
+		}
+	})
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetHandshakeBackoff makes the device back off from a peer that does not answer,
+// as one configured with the wrong key at the other end: after rounds handshake
+// initiations in a row go unanswered, it waits twice as long as RekeyTimeout
+// before the next, then twice that, and so on, up to max, rather than sending
+// one every RekeyTimeout for as long as there are packets for the peer.
+// The backoff ends when an authenticated packet arrives from the peer or the
+// peer's configuration is set. Packets for a peer that is backed off stay staged
+// until it sends the next initiation. A rounds of 0, the default, or a max of
+// RekeyTimeout or less, turns backing off off.
+func (device *Device) SetHandshakeBackoff(rounds int, max time.Duration) {
+	device.handshakeBackoff.Lock()
+	defer device.handshakeBackoff.Unlock()
+	device.handshakeBackoff.rounds = rounds
+	device.handshakeBackoff.max = max
+}
+
+// handshakeUnanswered counts an unanswered handshake initiation to the peer,
+// and backs the peer off, if SetHandshakeBackoff says to.
+func (peer *Peer) handshakeUnanswered() {
+	peer.device.handshakeBackoff.RLock()
+	rounds, max := peer.device.handshakeBackoff.rounds, peer.device.handshakeBackoff.max
+	peer.device.handshakeBackoff.RUnlock()
+
+	peer.handshakeBackoff.Lock()
+	defer peer.handshakeBackoff.Unlock()
+	failures := atomic.AddUint32(&peer.handshakeBackoff.failures, 1)
+	if rounds <= 0 || max <= RekeyTimeout || int(failures) < rounds {
+		return
+	}
+	delay := max
+	if shift := int(failures) - rounds + 1; shift < 16 && RekeyTimeout<<shift < max {
+		delay = RekeyTimeout << shift
+	}
+	peer.handshakeBackoff.delay = delay
+	// The initiation was sent RekeyTimeout ago, give or take the jitter.
+	peer.handshakeBackoff.until = time.Now().Add(delay - RekeyTimeout)
+}
+
+// handshakeBackoffWait returns how long the peer is backed off for yet.
+func (peer *Peer) handshakeBackoffWait() time.Duration {
+	if atomic.LoadUint32(&peer.handshakeBackoff.failures) == 0 {
+		return 0
+	}
+	peer.handshakeBackoff.Lock()
+	defer peer.handshakeBackoff.Unlock()
+	return time.Until(peer.handshakeBackoff.until)
+}
+
+// resetHandshakeBackoff ends the peer's backoff, if any.
+func (peer *Peer) resetHandshakeBackoff() {
+	if atomic.LoadUint32(&peer.handshakeBackoff.failures) == 0 {
+		return
+	}
+	peer.handshakeBackoff.Lock()
+	defer peer.handshakeBackoff.Unlock()
+	atomic.StoreUint32(&peer.handshakeBackoff.failures, 0)
+	peer.handshakeBackoff.delay = 0
+	peer.handshakeBackoff.until = time.Time{}
+}
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestHandshakeBackoff counts the initiations a device sends a peer that never
+// answers, firing the retransmission timer itself rather than waiting for it.
+func TestHandshakeBackoff(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	dev.SetHandshakeBackoff(2, 4*RekeyTimeout)
+
+	// The other bind counts the initiations and answers none.
+	fns, _, err := binds[1].Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binds[1].Close()
+	var initiations uint32
+	for _, fn := range fns {
+		go func(fn conn.ReceiveFunc) {
+			buf := make([]byte, MaxMessageSize)
+			for {
+				n, _, err := fn(buf)
+				if err != nil {
+					return
+				}
+				if n > 0 && buf[0] == MessageInitiationType {
+					atomic.AddUint32(&initiations, 1)
+				}
+			}
+		}(fn)
+	}
+	expectInitiations := func(want uint32) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&initiations) < want && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := atomic.LoadUint32(&initiations); got != want {
+			t.Fatalf("%d initiations sent, want %d", got, want)
+		}
+	}
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerSK, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := peerSK.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"listen_port", "0",
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "127.0.0.1:1",
+		"allowed_ip", "10.0.0.2/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+
+	tun.Outbound <- tuntest.Ping(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))
+	expectInitiations(1)
+
+	// round lets RekeyTimeout pass, as far as the peer knows, and lets the
+	// initiation it sent last go unanswered.
+	round := func() {
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Time{}
+		peer.handshake.mutex.Unlock()
+		expiredRetransmitHandshake(peer)
+	}
+	backoff := func() time.Duration {
+		return dev.PeerStatuses()[0].HandshakeBackoff
+	}
+
+	round()
+	expectInitiations(2)
+	if b := backoff(); b != 0 {
+		t.Fatalf("backed off to %v after one unanswered initiation, want not to back off", b)
+	}
+
+	// From the second unanswered initiation, the wait doubles, up to 4*RekeyTimeout.
+	for i, want := range []time.Duration{2 * RekeyTimeout, 4 * RekeyTimeout, 4 * RekeyTimeout} {
+		start := time.Now()
+		round()
+		status := dev.PeerStatuses()[0]
+		if status.HandshakeBackoff != want {
+			t.Errorf("round %d: backed off to %v, want %v", i+2, status.HandshakeBackoff, want)
+		}
+		if ends := status.HandshakeBackoffEnds.Sub(start); ends < want-RekeyTimeout || ends > want {
+			t.Errorf("round %d: backoff ends in %v, want %v", i+2, ends, want-RekeyTimeout)
+		}
+	}
+	expectInitiations(2)
+
+	// A packet for the peer while it is backed off waits for the backoff to end.
+	peer.timers.retransmitHandshake.Del()
+	tun.Outbound <- tuntest.Ping(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))
+	expectInitiations(2)
+	if !peer.handshakeBackoff.deferred.Get() || !peer.timers.retransmitHandshake.IsPending() {
+		t.Fatal("initiation not deferred to the end of the backoff")
+	}
+	peer.timers.retransmitHandshake.Del()
+	peer.handshakeBackoff.Lock()
+	peer.handshakeBackoff.until = time.Now()
+	peer.handshakeBackoff.Unlock()
+	expiredRetransmitHandshake(peer)
+	expectInitiations(3)
+	if b := backoff(); b != 4*RekeyTimeout {
+		t.Errorf("backed off to %v after the deferred initiation, want %v", b, 4*RekeyTimeout)
+	}
+
+	// Setting the peer's configuration ends the backoff.
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "endpoint", "127.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if status := dev.PeerStatuses()[0]; status.HandshakeBackoff != 0 || !status.HandshakeBackoffEnds.IsZero() {
+		t.Errorf("backed off to %v until %v after the peer was configured, want no backoff", status.HandshakeBackoff, status.HandshakeBackoffEnds)
+	}
+}
+
+// TestHandshakeBackoffReset checks that an authenticated packet from a peer
+// ends the backoff from it.
+func TestHandshakeBackoffReset(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair[1].dev.SetHandshakeBackoff(1, 4*RekeyTimeout)
+	pair[1].dev.LookupPeer(pair[1].dev.PeerStatuses()[0].PublicKey).handshakeUnanswered()
+	if b := pair[1].dev.PeerStatuses()[0].HandshakeBackoff; b != 2*RekeyTimeout {
+		t.Fatalf("backed off to %v, want %v", b, 2*RekeyTimeout)
+	}
+
+	// Device 0 initiates the handshake, and its initiation is authenticated.
+	pair.Send(t, Pong, nil)
+	if b := pair[1].dev.PeerStatuses()[0].HandshakeBackoff; b != 0 {
+		t.Errorf("backed off to %v after receiving from the peer, want no backoff", b)
+	}
+}
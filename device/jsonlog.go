@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A jsonRecord is a line written by a Logger made by NewJSONLogger.
+type jsonRecord struct {
+	Time     string  `json:"time"`
+	Level    string  `json:"level"`
+	Event    string  `json:"event"`              // the format of the message, without the peer and error
+	Peer     string  `json:"peer,omitempty"`     // the abbreviated public key of the peer, as in text logs
+	Endpoint string  `json:"endpoint,omitempty"` // the address of the remote end
+	Error    string  `json:"error,omitempty"`    // the error the message is about
+	Duration float64 `json:"duration,omitempty"` // a duration the message reports, in seconds
+	Message  string  `json:"msg"`                // the message as a text Logger would log it
+}
+
+// NewJSONLogger constructs a Logger that writes each line to w as a JSON object,
+// for log pipelines that would otherwise parse text lines. Besides the time,
+// level, and message, each object has the event, which is the format of the message
+// with the peer it is about and any error taken out, so that it is the same
+// for every line of its kind, and the peer, error, and duration, if the message
+// has them, and the endpoint, if passed as a logEndpoint. Fields hold only what the message itself shows, so no more secrets
+// than in a text log: peers appear by their abbreviated public key.
+// It logs at the specified log level and above, which SetLogLevel changes.
+func NewJSONLogger(w io.Writer, level int) *Logger {
+	return newJSONLogger(w, level, time.Now)
+}
+
+func newJSONLogger(w io.Writer, level int, now func() time.Time) *Logger {
+	logger := &Logger{level: new(int32)}
+	*logger.level = int32(level)
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	logf := func(name string, min int32) func(string, ...interface{}) {
+		return func(format string, args ...interface{}) {
+			if atomic.LoadInt32(logger.level) < min {
+				return
+			}
+			record := newJSONRecord(now(), name, format, args)
+			mu.Lock()
+			defer mu.Unlock()
+			enc.Encode(record)
+		}
+	}
+	logger.Verbosef = logf("debug", LogLevelVerbose)
+	logger.Errorf = logf("error", LogLevelError)
+	return logger
+}
+
+func newJSONRecord(now time.Time, level, format string, args []interface{}) *jsonRecord {
+	r := &jsonRecord{
+		Time:    now.UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Event:   format,
+		Message: fmt.Sprintf(format, args...),
+	}
+	// Messages about a peer start with it, as in "%v - Sending handshake initiation".
+	if len(args) > 0 {
+		if peer, ok := args[0].(*Peer); ok {
+			for _, prefix := range []string{"%v - ", "%s - "} {
+				if strings.HasPrefix(r.Event, prefix) {
+					r.Event = r.Event[len(prefix):]
+					r.Peer = strings.TrimSuffix(strings.TrimPrefix(peer.String(), "peer("), ")")
+					break
+				}
+			}
+		}
+	}
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case error:
+			if r.Error == "" {
+				r.Error = arg.Error()
+			}
+		case logEndpoint:
+			if r.Endpoint == "" {
+				r.Endpoint = arg.String()
+			}
+		case time.Duration:
+			if r.Duration == 0 {
+				r.Duration = arg.Seconds()
+			}
+		}
+	}
+	// Messages about an error end with it, as in "Failed to send data packet: %v".
+	if r.Error != "" {
+		for _, suffix := range []string{": %v", ": %w"} {
+			if strings.HasSuffix(r.Event, suffix) && lastError(args) != nil {
+				r.Event = strings.TrimSuffix(r.Event, suffix)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// A logEndpoint is an endpoint passed to a Logger, formatted as its destination
+// address, so that a JSON Logger can tell it from the rest of the message.
+type logEndpoint struct {
+	conn.Endpoint
+}
+
+func (e logEndpoint) String() string {
+	return e.DstToString()
+}
+
+// lastError returns the last argument if it is an error, or nil.
+func lastError(args []interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	err, _ := args[len(args)-1].(error)
+	return err
+}
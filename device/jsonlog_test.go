@@ -0,0 +1,187 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestJSONLoggerGolden(t *testing.T) {
+	now := func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	peer := new(Peer)
+	for i := range peer.handshake.remoteStatic {
+		peer.handshake.remoteStatic[i] = byte(i)
+	}
+	tests := []struct {
+		name string
+		log  func(*Logger)
+		want string
+	}{
+		{
+			"peer",
+			func(l *Logger) { l.Verbosef("%v - Sending keepalive packet", peer) },
+			`{"time":"2021-01-02T03:04:05Z","level":"debug","event":"Sending keepalive packet","peer":"AAEC…dHh8","msg":"peer(AAEC…dHh8) - Sending keepalive packet"}`,
+		},
+		{
+			"peer error",
+			func(l *Logger) {
+				l.Errorf("%v - Failed to send handshake initiation: %v", peer, errors.New("network is unreachable"))
+			},
+			`{"time":"2021-01-02T03:04:05Z","level":"error","event":"Failed to send handshake initiation","peer":"AAEC…dHh8","error":"network is unreachable","msg":"peer(AAEC…dHh8) - Failed to send handshake initiation: network is unreachable"}`,
+		},
+		{
+			"endpoint",
+			func(l *Logger) {
+				l.Verbosef("Received invalid initiation message from %s", logEndpoint{bindtest.ChannelEndpoint(51820)})
+			},
+			`{"time":"2021-01-02T03:04:05Z","level":"debug","event":"Received invalid initiation message from %s","endpoint":"127.0.0.1:51820","msg":"Received invalid initiation message from 127.0.0.1:51820"}`,
+		},
+		{
+			"duration",
+			func(l *Logger) {
+				l.Errorf("TUN device write stalled for %v, dropped %d packets", 1500*time.Millisecond, 3)
+			},
+			`{"time":"2021-01-02T03:04:05Z","level":"error","event":"TUN device write stalled for %v, dropped %d packets","duration":1.5,"msg":"TUN device write stalled for 1.5s, dropped 3 packets"}`,
+		},
+		{
+			"plain",
+			func(l *Logger) {
+				l.Verbosef("Interface state was %s, requested %s, now %s", deviceStateDown, deviceStateUp, deviceStateUp)
+			},
+			`{"time":"2021-01-02T03:04:05Z","level":"debug","event":"Interface state was %s, requested %s, now %s","msg":"Interface state was Down, requested Up, now Up"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(newJSONLogger(&buf, LogLevelVerbose, now))
+			if got := strings.TrimSuffix(buf.String(), "\n"); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LogLevelError)
+	logger.Verbosef("%v - Sending keepalive packet", peer)
+	if buf.Len() != 0 {
+		t.Errorf("logged at the verbose level with the level set to error: %s", buf.String())
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that devices can log to concurrently.
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+// genLoggedPair returns two devices that log to loggers, are peered with
+// each other using the preshared key psk, and have completed a handshake.
+func genLoggedPair(t *testing.T, loggers [2]*Logger, psk NoisePresharedKey) (devs [2]*Device, keys [2]NoisePrivateKey) {
+	t.Helper()
+	for i := range keys {
+		var err error
+		if keys[i], err = newPrivateKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tuns [2]*tuntest.ChannelTUN
+	binds := bindtest.NewChannelBinds()
+	for i := range devs {
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDevice(tuns[i].TUN(), binds[i], loggers[i])
+		t.Cleanup(devs[i].Close)
+		peerKey := keys[i^1].publicKey()
+		if err := devs[i].IpcSet(uapiCfg(
+			"private_key", hex.EncodeToString(keys[i][:]),
+			"listen_port", "0",
+			"public_key", hex.EncodeToString(peerKey[:]),
+			"preshared_key", hex.EncodeToString(psk[:]),
+			"allowed_ip", fmt.Sprintf("1.0.0.%d/32", i^1+1),
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if err := devs[i].Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range devs {
+		peerKey := keys[i^1].publicKey()
+		if err := devs[i].IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(peerKey[:]),
+			"endpoint", fmt.Sprintf("127.0.0.1:%d", devs[i^1].ListenPort()),
+		)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := tuntest.Ping(net.IPv4(1, 0, 0, 2), net.IPv4(1, 0, 0, 1))
+	tuns[0].Outbound <- msg
+	select {
+	case got := <-tuns[1].Inbound:
+		if !bytes.Equal(got, msg) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	return devs, keys
+}
+
+// TestJSONLoggerSecrets runs a handshake between two devices logging in JSON
+// and checks that no private or preshared key appears in the log.
+func TestJSONLoggerSecrets(t *testing.T) {
+	var logs [2]lockedBuffer
+	var psk NoisePresharedKey
+	copy(psk[:], bytes.Repeat([]byte{0x42}, len(psk)))
+	_, keys := genLoggedPair(t, [2]*Logger{
+		NewJSONLogger(&logs[0], LogLevelVerbose),
+		NewJSONLogger(&logs[1], LogLevelVerbose),
+	}, psk)
+
+	secrets := [][]byte{keys[0][:], keys[1][:], psk[:]}
+	for i := range logs {
+		log := logs[i].String()
+		if !strings.Contains(log, `"event":"Sending handshake initiation"`) && !strings.Contains(log, `"event":"Sending handshake response"`) {
+			t.Errorf("device %d logged no handshake:\n%s", i, log)
+		}
+		for _, secret := range secrets {
+			for _, s := range []string{
+				hex.EncodeToString(secret),
+				base64.StdEncoding.EncodeToString(secret),
+				base64.StdEncoding.EncodeToString(secret)[:8],
+			} {
+				if strings.Contains(log, s) {
+					t.Errorf("device %d logged a secret %q:\n%s", i, s, log)
+				}
+			}
+		}
+	}
+}
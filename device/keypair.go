@@ -24,6 +24,7 @@ import (
 
 type Keypair struct {
 	sendNonce    uint64 // accessed atomically
+	receiveCount uint64 // one more than the highest counter received; accessed atomically
 	send         cipher.AEAD
 	receive      cipher.AEAD
 	replayFilter replay.Filter
@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+)
+
+// A previousIdentity is the static key pair being rotated out during a key rotation.
+type previousIdentity struct {
+	privateKey    NoisePrivateKey
+	publicKey     NoisePublicKey
+	cookieChecker CookieChecker // checks the MACs of messages sent to publicKey
+}
+
+// setPreviousStatic precomputes the static-static shared secret of the key
+// being rotated out, or zeroes it if previous is nil.
+// The caller must hold handshake.mutex, with remoteStatic set.
+func (handshake *Handshake) setPreviousStatic(previous *previousIdentity) {
+	if previous == nil {
+		setZero(handshake.previousStaticStatic[:])
+		return
+	}
+	handshake.previousStaticStatic = previous.privateKey.sharedSecret(handshake.remoteStatic)
+}
+
+// BeginKeyRotation makes newKey the device's private key without dropping the
+// sessions of its peers, which can move to the new public key at their own pace:
+// until CompleteKeyRotation, the device accepts handshakes under both the old
+// key and the new one. It initiates handshakes under the key a peer last
+// handshook under, which for peers that have not handshaken since the rotation
+// began is the old one, and retries unanswered initiations under the other.
+// Setting the private key to any other key, as with SetPrivateKey or through
+// the UAPI, ends the rotation. Setting it to the new key again, as re-applying
+// a configuration with wg setconf or CloneConfigTo does, leaves the rotation be.
+func (device *Device) BeginKeyRotation(newKey NoisePrivateKey) error {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	switch {
+	case device.rotation != nil:
+		return errors.New("key rotation already in progress")
+	case device.staticIdentity.privateKey.IsZero():
+		return errors.New("no private key to rotate")
+	case newKey.IsZero():
+		return errors.New("new private key is zero")
+	case newKey.Equals(device.staticIdentity.privateKey):
+		return errors.New("new private key is the current one")
+	}
+
+	previous := &previousIdentity{
+		privateKey: device.staticIdentity.privateKey,
+		publicKey:  device.staticIdentity.publicKey,
+	}
+	previous.cookieChecker.Init(previous.publicKey)
+	device.setPrivateKeyLocked(newKey, previous)
+	device.log.Verbosef("Began key rotation")
+	return nil
+}
+
+// CompleteKeyRotation ends the key rotation begun by BeginKeyRotation,
+// after which the device accepts handshakes only under the new key.
+// The sessions of peers that last handshook under the old key expire,
+// so that they handshake again under the new one.
+// It does nothing if there is no rotation in progress.
+func (device *Device) CompleteKeyRotation() {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	if device.rotation == nil {
+		return
+	}
+	device.rotation = nil
+
+	var expiredPeers []*Peer
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		handshake := &peer.handshake
+		handshake.mutex.Lock()
+		handshake.setPreviousStatic(nil)
+		if handshake.usePrevious {
+			handshake.usePrevious = false
+			expiredPeers = append(expiredPeers, peer)
+		}
+		handshake.mutex.Unlock()
+	}
+	device.peers.RUnlock()
+
+	for _, peer := range expiredPeers {
+		peer.ExpireCurrentKeypairs()
+	}
+	device.log.Verbosef("Completed key rotation")
+}
+
+// macChecker returns the CookieChecker of the key a handshake message
+// was sent to, as told by its mac1, or nil if mac1 is invalid.
+func (device *Device) macChecker(msg []byte) *CookieChecker {
+	if device.cookieChecker.CheckMAC1(msg) {
+		return &device.cookieChecker
+	}
+	device.staticIdentity.RLock()
+	previous := device.rotation
+	device.staticIdentity.RUnlock()
+	if previous != nil && previous.cookieChecker.CheckMAC1(msg) {
+		return &previous.cookieChecker
+	}
+	return nil
+}
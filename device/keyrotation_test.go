@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestKeyRotation rotates the key of device 0 while device 1
+// knows it by its old public key, and checks that device 1 still
+// handshakes with it until the rotation completes, and afterwards
+// only once it knows the new public key.
+func TestKeyRotation(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	oldKey := pair[0].dev.staticIdentity.publicKey
+	newKey, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer0 := pair[1].dev.LookupPeer(oldKey)
+	peer1 := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	handshakes := func() uint64 {
+		return atomic.LoadUint64(&peer1.stats.handshakes)
+	}
+	// expire expires the session of peer, after waiting long enough
+	// for the next handshake not to be taken for a flood.
+	expire := func(peer *Peer) {
+		time.Sleep(HandshakeInitationRate)
+		peer.ExpireCurrentKeypairs()
+	}
+
+	if err := pair[0].dev.BeginKeyRotation(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := pair[0].dev.BeginKeyRotation(newKey); err == nil {
+		t.Error("began a second key rotation")
+	}
+	// Re-applying the new key, as re-applying the configuration does, keeps the rotation.
+	if err := pair[0].dev.IpcSet(uapiCfg("private_key", hex.EncodeToString(newKey[:]))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session carries on, and new handshakes under the old key,
+	// in either direction, still succeed.
+	pair.Send(t, Pong, nil)
+	if n := handshakes(); n != 1 {
+		t.Errorf("beginning the rotation caused a handshake; %d in all", n)
+	}
+	expire(peer0)
+	pair.Send(t, Ping, nil)
+	if n := handshakes(); n != 2 {
+		t.Errorf("%d handshakes after expiring the session of device 1, want 2", n)
+	}
+	expire(peer1)
+	pair.Send(t, Pong, nil)
+	if n := handshakes(); n != 3 {
+		t.Errorf("%d handshakes after expiring the session of device 0, want 3", n)
+	}
+
+	// Once the rotation completes, the old key no longer works.
+	pair[0].dev.CompleteKeyRotation()
+	expire(peer0)
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("ping transited under the old key after the rotation completed")
+	case <-time.After(time.Second):
+	}
+
+	// The new key does.
+	newPublicKey := newKey.publicKey()
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(oldKey[:]),
+		"remove", "true",
+		"public_key", hex.EncodeToString(newPublicKey[:]),
+		"endpoint", fmt.Sprintf("127.0.0.1:%d", pair[0].dev.net.port),
+		"allowed_ip", "1.0.0.1/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	if n := handshakes(); n != 4 {
+		t.Errorf("%d handshakes after moving to the new key, want 4", n)
+	}
+}
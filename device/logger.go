@@ -6,8 +6,10 @@
 package device
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 // A Logger provides logging for a Device.
@@ -18,6 +20,8 @@ import (
 type Logger struct {
 	Verbosef func(format string, args ...interface{})
 	Errorf   func(format string, args ...interface{})
+
+	level *int32 // the level a Logger made by NewLogger logs at, accessed atomically
 }
 
 // Log levels for use with NewLogger.
@@ -33,16 +37,115 @@ func DiscardLogf(format string, args ...interface{}) {}
 // NewLogger constructs a Logger that writes to stdout.
 // It logs at the specified log level and above.
 // It decorates log lines with the log level, date, time, and prepend.
+// A Device using the Logger can change its level with SetLogLevel.
 func NewLogger(level int, prepend string) *Logger {
-	logger := &Logger{DiscardLogf, DiscardLogf}
-	logf := func(prefix string) func(string, ...interface{}) {
-		return log.New(os.Stdout, prefix+": "+prepend, log.Ldate|log.Ltime).Printf
+	logger := &Logger{level: new(int32)}
+	*logger.level = int32(level)
+	logf := func(prefix string, min int32) func(string, ...interface{}) {
+		l := log.New(os.Stdout, prefix+": "+prepend, log.Ldate|log.Ltime)
+		return func(format string, args ...interface{}) {
+			if atomic.LoadInt32(logger.level) >= min {
+				l.Printf(format, args...)
+			}
+		}
+	}
+	logger.Verbosef = logf("DEBUG", LogLevelVerbose)
+	logger.Errorf = logf("ERROR", LogLevelError)
+	return logger
+}
+
+// newDeviceLogger returns the Logger a Device logs to, which passes lines to logger
+// while level allows them. It also skips the levels for which logger has no function.
+func newDeviceLogger(logger *Logger, level *int32) *Logger {
+	gate := func(logf func(string, ...interface{}), min int32) func(string, ...interface{}) {
+		if logf == nil {
+			return DiscardLogf
+		}
+		return func(format string, args ...interface{}) {
+			if atomic.LoadInt32(level) >= min {
+				logf(format, args...)
+			}
+		}
 	}
-	if level >= LogLevelVerbose {
-		logger.Verbosef = logf("DEBUG")
+	return &Logger{
+		Verbosef: gate(logger.Verbosef, LogLevelVerbose),
+		Errorf:   gate(logger.Errorf, LogLevelError),
 	}
-	if level >= LogLevelError {
-		logger.Errorf = logf("ERROR")
+}
+
+// SetLogLevel changes the level the device logs at, to one of LogLevelSilent,
+// LogLevelError, and LogLevelVerbose, without restarting it. Lines below the level
+// are dropped before they are formatted. If the device's Logger was made by NewLogger,
+// its level changes too, so that the Logger can log lines it was not logging before;
+// other Loggers receive every line the level allows, to filter as they like.
+func (device *Device) SetLogLevel(level int) {
+	atomic.StoreInt32(&device.logLevel, int32(level))
+	if device.logger.level != nil {
+		atomic.StoreInt32(device.logger.level, int32(level))
 	}
-	return logger
+}
+
+// LogLevel returns the level the device logs at.
+func (device *Device) LogLevel() int {
+	return int(atomic.LoadInt32(&device.logLevel))
+}
+
+// verbose reports whether the device logs verbose lines, for paths that
+// would otherwise pay for building the arguments of lines that are dropped.
+func (device *Device) verbose() bool {
+	return atomic.LoadInt32(&device.logLevel) >= LogLevelVerbose
+}
+
+// A peerLogger logs lines about a peer, prefixed with the peer,
+// which formats as its abbreviated public key, so that every line
+// about a peer can be told from those about the others.
+// Each peer gets its own in NewPeer. The zero peerLogger, that of
+// a placeholder peer in an IPC operation, discards lines.
+type peerLogger struct {
+	peer *Peer
+}
+
+func (l peerLogger) Verbosef(format string, args ...interface{}) {
+	if l.peer == nil || !l.peer.device.verbose() {
+		return
+	}
+	l.peer.device.log.Verbosef("%v - "+format, append([]interface{}{l.peer}, args...)...)
+}
+
+func (l peerLogger) Errorf(format string, args ...interface{}) {
+	if l.peer == nil || l.peer.device.LogLevel() < LogLevelError {
+		return
+	}
+	l.peer.device.log.Errorf("%v - "+format, append([]interface{}{l.peer}, args...)...)
+}
+
+// limitedVerbosef is Verbosef, rate limited by SetLogRateLimit for the peer alone.
+func (l peerLogger) limitedVerbosef(format string, args ...interface{}) {
+	if l.peer == nil || !l.peer.device.verbose() {
+		return
+	}
+	device := l.peer.device
+	device.limitedLogf(device.log.Verbosef, logKey{format, l.peer}, "%v - "+format, append([]interface{}{l.peer}, args...)...)
+}
+
+// limitedErrorf is Errorf, rate limited by SetLogRateLimit for the peer alone.
+func (l peerLogger) limitedErrorf(format string, args ...interface{}) {
+	if l.peer == nil || l.peer.device.LogLevel() < LogLevelError {
+		return
+	}
+	device := l.peer.device
+	device.limitedLogf(device.log.Errorf, logKey{format, l.peer}, "%v - "+format, append([]interface{}{l.peer}, args...)...)
+}
+
+// parseLogLevel parses the value of the log_level UAPI key.
+func parseLogLevel(value string) (int, error) {
+	switch value {
+	case "silent":
+		return LogLevelSilent, nil
+	case "error":
+		return LogLevelError, nil
+	case "verbose", "debug":
+		return LogLevelVerbose, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", value)
 }
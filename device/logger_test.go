@@ -0,0 +1,197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestCustomLogger checks that a Logger made of plain functions, as used
+// to forward to another logging package, receives the device's messages.
+func TestCustomLogger(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		errors []string
+		lines  []string
+	)
+	capture := func(to *[]string) func(string, ...interface{}) {
+		return func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			*to = append(*to, fmt.Sprintf(format, args...))
+		}
+	}
+	logger := &Logger{Verbosef: capture(&lines), Errorf: capture(&errors)}
+
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], logger)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	log := strings.Join(lines, "\n")
+	for _, want := range []string{"Interface state was Down, requested Up, now Up", "Device closing", "Device closed"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("no %q in the log:\n%s", want, log)
+		}
+	}
+	if len(errors) != 0 {
+		t.Errorf("unexpected errors: %q", errors)
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	logger := &Logger{Verbosef: func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}}
+	dev := NewDevice(tuntest.NilDevice("nil0"), bindtest.NewChannelBinds()[0], logger)
+	defer dev.Close()
+	logged := func(msg string) bool {
+		mu.Lock()
+		lines = lines[:0]
+		mu.Unlock()
+		dev.log.Verbosef("%s", msg)
+		mu.Lock()
+		defer mu.Unlock()
+		return len(lines) == 1 && lines[0] == msg
+	}
+
+	if dev.LogLevel() != LogLevelVerbose {
+		t.Errorf("LogLevel = %d for a custom Logger, want LogLevelVerbose", dev.LogLevel())
+	}
+	if !logged("before") {
+		t.Error("verbose line not logged at LogLevelVerbose")
+	}
+	dev.SetLogLevel(LogLevelError)
+	if logged("while off") {
+		t.Error("verbose line logged at LogLevelError")
+	}
+	if err := dev.IpcSet(uapiCfg("log_level", "verbose")); err != nil {
+		t.Fatal(err)
+	}
+	if !logged("after") {
+		t.Error("verbose line not logged after setting log_level=verbose")
+	}
+	if err := dev.IpcSet(uapiCfg("log_level", "loud")); err == nil {
+		t.Error("unknown log_level accepted")
+	}
+	// Errorf is nil, so errors are dropped rather than crashing the device.
+	dev.log.Errorf("dropped")
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	logger := NewLogger(LogLevelError, "")
+	dev := NewDevice(tuntest.NilDevice("nil0"), bindtest.NewChannelBinds()[0], logger)
+	defer dev.Close()
+	if dev.LogLevel() != LogLevelError {
+		t.Errorf("LogLevel = %d, want the LogLevelError of the Logger", dev.LogLevel())
+	}
+	dev.SetLogLevel(LogLevelVerbose)
+	if level := atomic.LoadInt32(logger.level); level != LogLevelVerbose {
+		t.Errorf("Logger level = %d after SetLogLevel, want LogLevelVerbose", level)
+	}
+}
+
+// BenchmarkVerbosefDisabled measures a verbose line of the receive path
+// while verbose logging is off, which should not allocate.
+func BenchmarkVerbosefDisabled(b *testing.B) {
+	dev := NewDevice(tuntest.NilDevice("nil0"), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	peer := &Peer{device: dev}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if dev.verbose() {
+			dev.log.Verbosef("%v - Receiving keepalive packet", peer)
+		}
+	}
+}
+
+// TestPeerLogger checks that every line two devices log about their peers
+// during a handshake is prefixed with the abbreviated key of the right peer,
+// and that no line has a full public key.
+func TestPeerLogger(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines [2][]string
+	)
+	var loggers [2]*Logger
+	for i := range loggers {
+		i := i
+		logf := func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines[i] = append(lines[i], fmt.Sprintf(format, args...))
+		}
+		loggers[i] = &Logger{Verbosef: logf, Errorf: logf}
+	}
+	devs, keys := genLoggedPair(t, loggers, NoisePresharedKey{})
+
+	// Peers created again get loggers of their own.
+	peerKey := keys[1].publicKey()
+	if err := devs[0].IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(peerKey[:]),
+		"remove", "true",
+		"public_key", hex.EncodeToString(peerKey[:]),
+		"allowed_ip", "1.0.0.2/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if peer := devs[0].LookupPeer(peerKey); peer == nil || peer.log.peer != peer {
+		t.Error("re-created peer does not log as itself")
+	}
+	devs[0].Close()
+	devs[1].Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range lines {
+		peerKey := keys[i^1].publicKey()
+		var name string
+		for _, key := range keys {
+			pk := key.publicKey()
+			b64 := base64.StdEncoding.EncodeToString(pk[:])
+			if pk == peerKey {
+				name = "peer(" + b64[0:4] + "…" + b64[39:43] + ") - "
+			}
+			for _, line := range lines[i] {
+				if strings.Contains(line, b64) || strings.Contains(line, hex.EncodeToString(pk[:])) {
+					t.Errorf("device %d logged a full public key: %q", i, line)
+				}
+			}
+		}
+		for _, line := range lines[i] {
+			if strings.Contains(line, "peer(") && !strings.HasPrefix(line, name) {
+				t.Errorf("device %d logged a line about its peer without %q: %q", i, name, line)
+			}
+		}
+		for _, want := range []string{"Sending handshake", "Received handshake", "Stopping"} {
+			found := false
+			for _, line := range lines[i] {
+				found = found || strings.HasPrefix(line, name+want)
+			}
+			if !found {
+				t.Errorf("device %d logged no %q line about its peer", i, want)
+			}
+		}
+	}
+}
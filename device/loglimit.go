@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// The default rate limit of the log lines of the receive and send paths
+// that a peer or a network can make the device log for every packet.
+const (
+	DefaultLogRate  = 1  // lines per second of each kind
+	DefaultLogBurst = 10 // lines of each kind logged before the rate applies
+)
+
+// A logLimiter rate limits log lines by kind, with a token bucket for each,
+// so that a flood of identical failures does not drown out everything else.
+// The kind of a line is its format string, and the peer it is about, if any,
+// so that one broken peer does not use up the lines of every other.
+type logLimiter struct {
+	sync.Mutex
+	rate      float64 // tokens per second; 0 disables the limiter
+	burst     float64
+	kinds     map[logKey]*logKind
+	now       func() time.Time
+	afterFunc func(time.Duration, func()) // runs a function later, as time.AfterFunc does
+}
+
+type logKey struct {
+	format string
+	peer   *Peer // the peer the line is about, or nil
+}
+
+type logKind struct {
+	tokens     float64
+	last       time.Time // when tokens was last topped up
+	suppressed uint64    // lines dropped since the last one logged
+	summarize  bool      // whether the count of suppressed lines is to be logged
+	logf       func(format string, args ...interface{})
+}
+
+// logSummaryInterval is how long after a line is first dropped its count is
+// logged, if no line of its kind is logged before then, at the least.
+const logSummaryInterval = time.Second
+
+func (l *logLimiter) init() {
+	l.rate, l.burst = DefaultLogRate, DefaultLogBurst
+	l.kinds = make(map[logKey]*logKind)
+	l.now = time.Now
+	l.afterFunc = func(d time.Duration, f func()) { time.AfterFunc(d, f) }
+}
+
+// allow reports whether a line of the given kind may be logged, and if so,
+// how many lines of that kind were dropped since the last one that was.
+// If not, the count of those dropped is logged with logf after a while,
+// unless a line of the kind gets through first.
+func (l *logLimiter) allow(key logKey, logf func(format string, args ...interface{})) (ok bool, suppressed uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	now := l.now()
+	k := l.kinds[key]
+	if k == nil {
+		k = &logKind{tokens: l.burst, last: now}
+		l.kinds[key] = k
+	}
+	k.tokens += now.Sub(k.last).Seconds() * l.rate
+	if k.tokens > l.burst {
+		k.tokens = l.burst
+	}
+	k.last = now
+	if k.tokens < 1 {
+		k.suppressed++
+		k.logf = logf
+		if !k.summarize {
+			k.summarize = true
+			interval := logSummaryInterval
+			if wait := time.Duration(float64(time.Second) / l.rate); wait > interval {
+				interval = wait
+			}
+			l.afterFunc(interval, func() { l.flush(key, k) })
+		}
+		return false, 0
+	}
+	k.tokens--
+	suppressed, k.suppressed = k.suppressed, 0
+	return true, suppressed
+}
+
+// flush logs the count of the lines of kind k dropped since the last one logged, if any.
+func (l *logLimiter) flush(key logKey, k *logKind) {
+	l.Lock()
+	suppressed, logf := k.suppressed, k.logf
+	k.suppressed, k.summarize = 0, false
+	l.Unlock()
+	if suppressed > 0 {
+		key.logSuppressed(logf, suppressed)
+	}
+}
+
+// forget drops the kinds of the lines about peer, which is gone.
+func (l *logLimiter) forget(peer *Peer) {
+	l.Lock()
+	defer l.Unlock()
+	for key := range l.kinds {
+		if key.peer == peer {
+			delete(l.kinds, key)
+		}
+	}
+}
+
+// logSuppressed logs with logf that suppressed lines of the kind were dropped.
+func (key logKey) logSuppressed(logf func(format string, args ...interface{}), suppressed uint64) {
+	if key.peer != nil {
+		logf("%v - Suppressed %d similar messages: %q", key.peer, suppressed, key.format)
+		return
+	}
+	logf("Suppressed %d similar messages: %q", suppressed, key.format)
+}
+
+// SetLogRateLimit limits the log lines that the receive and send paths can log
+// for every packet, such as those about invalid handshake messages, to burst lines
+// of each kind, then perSecond a second, so that a broken peer or a network
+// spraying garbage cannot flood the log. Lines about a peer are limited apart
+// from those about other peers. The count of the lines dropped is logged before
+// the next line of their kind, or a second or so after the first was dropped,
+// whichever comes first. A perSecond of 0 or less removes the limit, and a burst
+// of less than 1 is taken as 1. The default is DefaultLogRate and DefaultLogBurst.
+func (device *Device) SetLogRateLimit(perSecond float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &device.logLimiter
+	l.Lock()
+	defer l.Unlock()
+	l.rate, l.burst = perSecond, float64(burst)
+	l.kinds = make(map[logKey]*logKind)
+}
+
+// limitedVerbosef is device.log.Verbosef, rate limited by SetLogRateLimit.
+func (device *Device) limitedVerbosef(format string, args ...interface{}) {
+	if !device.verbose() {
+		return
+	}
+	device.limitedLogf(device.log.Verbosef, logKey{format: format}, format, args...)
+}
+
+// limitedErrorf is device.log.Errorf, rate limited by SetLogRateLimit.
+func (device *Device) limitedErrorf(format string, args ...interface{}) {
+	if device.LogLevel() < LogLevelError {
+		return
+	}
+	device.limitedLogf(device.log.Errorf, logKey{format: format}, format, args...)
+}
+
+// limitedLogf logs a line of the kind key with logf, if the limit allows it.
+func (device *Device) limitedLogf(logf func(format string, args ...interface{}), key logKey, format string, args ...interface{}) {
+	if ok, suppressed := device.logLimiter.allow(key, logf); ok {
+		if suppressed > 0 {
+			key.logSuppressed(logf, suppressed)
+		}
+		logf(format, args...)
+	}
+}
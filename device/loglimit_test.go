@@ -0,0 +1,182 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var l logLimiter
+	l.init()
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	var flushes []func()
+	l.afterFunc = func(d time.Duration, f func()) {
+		if d != logSummaryInterval {
+			t.Errorf("summary scheduled in %v, want %v", d, logSummaryInterval)
+		}
+		flushes = append(flushes, f)
+	}
+	var summaries []string
+	logf := func(format string, args ...interface{}) {
+		summaries = append(summaries, fmt.Sprintf(format, args...))
+	}
+	a := logKey{format: "a"}
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow(a, logf); ok {
+			allowed++
+		}
+	}
+	if allowed != DefaultLogBurst {
+		t.Errorf("allowed %d of a burst of 100, want %d", allowed, DefaultLogBurst)
+	}
+	if ok, _ := l.allow(logKey{format: "b"}, logf); !ok {
+		t.Error("a line of another kind was suppressed")
+	}
+	if ok, _ := l.allow(logKey{format: "a", peer: &Peer{}}, logf); !ok {
+		t.Error("a line about a peer was suppressed by lines about none")
+	}
+	now = now.Add(time.Second / DefaultLogRate)
+	if ok, suppressed := l.allow(a, logf); !ok || suppressed != 100-DefaultLogBurst {
+		t.Errorf("after refilling, allow = %v, %d, want true, %d", ok, suppressed, 100-DefaultLogBurst)
+	}
+	// The count was logged with the line, so the summary has nothing to log.
+	if len(flushes) != 1 {
+		t.Fatalf("%d summaries scheduled, want 1", len(flushes))
+	}
+	flushes[0]()
+	if len(summaries) != 0 {
+		t.Errorf("summarized %q after the count was logged", summaries)
+	}
+
+	// If the flood stops, the summary logs the count.
+	for i := 0; i < 5; i++ {
+		l.allow(a, logf)
+	}
+	if len(flushes) != 2 {
+		t.Fatalf("%d summaries scheduled, want 2", len(flushes))
+	}
+	flushes[1]()
+	if want := `Suppressed 5 similar messages: "a"`; len(summaries) != 1 || summaries[0] != want {
+		t.Errorf("summarized %q, want %q", summaries, want)
+	}
+
+	l.rate = 0
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow(a, logf); !ok {
+			t.Fatal("line suppressed with the limit removed")
+		}
+	}
+}
+
+// TestSetLogRateLimitBurst checks that a burst of less than 1 does not drop every line.
+func TestSetLogRateLimitBurst(t *testing.T) {
+	dev := NewDevice(tuntest.NilDevice("nil0"), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	dev.SetLogRateLimit(1, 0)
+	if ok, _ := dev.logLimiter.allow(logKey{format: "a"}, DiscardLogf); !ok {
+		t.Error("first line dropped with a burst of 0")
+	}
+}
+
+// TestLogRateLimitFlood floods a device with messages of an unknown type,
+// and checks that it logs a few of them and a count of the others.
+func TestLogRateLimitFlood(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	logger := &Logger{Verbosef: func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}}
+	count := func(prefix string) (n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NilDevice("nil0"), binds[0], logger)
+	defer dev.Close()
+	var now time.Time
+	dev.logLimiter.Lock()
+	dev.logLimiter.now = func() time.Time { return now }
+	dev.logLimiter.Unlock()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := binds[1].Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer binds[1].Close()
+	endpoint, err := binds[1].ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", dev.ListenPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const flood = 1000
+	garbage := make([]byte, MinMessageSize)
+	garbage[0] = 0xff
+	for i := 0; i < flood; i++ {
+		if err := binds[1].Send(garbage, endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The bind queues the packets, so wait for the device to get through them.
+	const kind = "Received message with unknown type"
+	suppressed := func() uint64 {
+		dev.logLimiter.Lock()
+		defer dev.logLimiter.Unlock()
+		if k := dev.logLimiter.kinds[logKey{format: kind}]; k != nil {
+			return k.suppressed
+		}
+		return 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); suppressed() < flood-DefaultLogBurst; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages processed", suppressed()+DefaultLogBurst, flood)
+		}
+	}
+	// Once the time for another line has passed, the next one comes with a count.
+	dev.logLimiter.Lock()
+	now = now.Add(time.Second / DefaultLogRate)
+	dev.logLimiter.Unlock()
+	if err := binds[1].Send(garbage, endpoint); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); count(kind) <= DefaultLogBurst; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing logged once the time for another line had passed")
+		}
+	}
+
+	if n := count(kind); n != DefaultLogBurst+1 {
+		t.Errorf("logged %d of %d messages of an unknown type, want %d", n, flood+1, DefaultLogBurst+1)
+	}
+	want := fmt.Sprintf("Suppressed %d similar messages", flood-DefaultLogBurst)
+	if count(want) != 1 {
+		mu.Lock()
+		t.Errorf("no %q in the log:\n%s", want, strings.Join(lines, "\n"))
+		mu.Unlock()
+	}
+}
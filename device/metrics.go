@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// WritePrometheus writes the device and per-peer counters to w
+// in the Prometheus text exposition format.
+// Peers are labeled with their base64 public key, as in ServeHTTP and wg show,
+// so that the series of different peers never collide and can be joined with others.
+func (device *Device) WritePrometheus(w io.Writer) error {
+	type peerMetrics struct {
+		key           NoisePublicKey
+		label         string
+		rxBytes       uint64
+		txBytes       uint64
+		lastHandshake int64
+
+		initiations, responses, handshakes, failures uint64
+		latency                                      int64
+		queueLengths                                 [queueKinds]int
+	}
+
+	device.peers.RLock()
+	peers := make([]peerMetrics, 0, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		peers = append(peers, peerMetrics{
+			key:           key,
+			label:         base64.StdEncoding.EncodeToString(key[:]),
+			rxBytes:       atomic.LoadUint64(&peer.stats.rxBytes),
+			txBytes:       atomic.LoadUint64(&peer.stats.txBytes),
+			lastHandshake: atomic.LoadInt64(&peer.stats.lastHandshakeNano),
+
+			initiations: atomic.LoadUint64(&peer.stats.handshakeInitiations),
+			responses:   atomic.LoadUint64(&peer.stats.handshakeResponses),
+			handshakes:  atomic.LoadUint64(&peer.stats.handshakes),
+			failures:    atomic.LoadUint64(&peer.stats.handshakeFailures),
+			latency:     atomic.LoadInt64(&peer.stats.handshakeLatencyNano),
+
+			queueLengths: [queueKinds]int{len(peer.queue.staged), len(peer.queue.outbound.c), len(peer.queue.inbound.c)},
+		})
+	}
+	device.peers.RUnlock()
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(peers[i].key[:], peers[j].key[:]) < 0
+	})
+
+	up := 0
+	if device.isUp() {
+		up = 1
+	}
+
+	bw := bufio.NewWriter(w)
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("wireguard_device_up", "gauge", "Whether the device is up.")
+	fmt.Fprintf(bw, "wireguard_device_up %d\n", up)
+	header("wireguard_device_peers", "gauge", "Number of configured peers.")
+	fmt.Fprintf(bw, "wireguard_device_peers %d\n", len(peers))
+
+	header("wireguard_peer_receive_bytes_total", "counter", "Bytes received from the peer.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_receive_bytes_total{peer=%q} %d\n", peer.label, peer.rxBytes)
+	}
+	header("wireguard_peer_transmit_bytes_total", "counter", "Bytes sent to the peer.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_transmit_bytes_total{peer=%q} %d\n", peer.label, peer.txBytes)
+	}
+	header("wireguard_peer_last_handshake_seconds", "gauge", "Unix time of the last completed handshake, or 0 if none.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_last_handshake_seconds{peer=%q} %g\n", peer.label, float64(peer.lastHandshake)/float64(time.Second))
+	}
+	header("wireguard_peer_handshake_initiations_total", "counter", "Handshake initiations sent to the peer.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_handshake_initiations_total{peer=%q} %d\n", peer.label, peer.initiations)
+	}
+	header("wireguard_peer_handshake_responses_total", "counter", "Handshake responses received from the peer.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_handshake_responses_total{peer=%q} %d\n", peer.label, peer.responses)
+	}
+	header("wireguard_peer_handshakes_total", "counter", "Handshakes completed with the peer.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_handshakes_total{peer=%q} %d\n", peer.label, peer.handshakes)
+	}
+	header("wireguard_peer_handshake_failures", "gauge", "Handshake initiations unanswered since the last completed handshake.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_handshake_failures{peer=%q} %d\n", peer.label, peer.failures)
+	}
+	header("wireguard_peer_handshake_latency_seconds", "gauge", "Time from sending the last answered handshake initiation to deriving its keypair.")
+	for _, peer := range peers {
+		fmt.Fprintf(bw, "wireguard_peer_handshake_latency_seconds{peer=%q} %g\n", peer.label, float64(peer.latency)/float64(time.Second))
+	}
+	header("wireguard_peer_queue_packets", "gauge", "Packets in each of the peer's queues.")
+	for _, peer := range peers {
+		for kind := QueueKind(0); kind < queueKinds; kind++ {
+			fmt.Fprintf(bw, "wireguard_peer_queue_packets{peer=%q,queue=%q} %d\n", peer.label, kind, peer.queueLengths[kind])
+		}
+	}
+
+	rate := device.rate.limiter.Stats()
+	header("wireguard_handshake_ratelimit_allowed_total", "counter", "Handshake packets allowed by the rate limiter while under load.")
+	fmt.Fprintf(bw, "wireguard_handshake_ratelimit_allowed_total{family=\"ipv4\"} %d\n", rate.AllowedIPv4)
+	fmt.Fprintf(bw, "wireguard_handshake_ratelimit_allowed_total{family=\"ipv6\"} %d\n", rate.AllowedIPv6)
+	header("wireguard_handshake_ratelimit_denied_total", "counter", "Handshake packets denied by the rate limiter while under load.")
+	fmt.Fprintf(bw, "wireguard_handshake_ratelimit_denied_total{family=\"ipv4\"} %d\n", rate.DeniedIPv4)
+	fmt.Fprintf(bw, "wireguard_handshake_ratelimit_denied_total{family=\"ipv6\"} %d\n", rate.DeniedIPv6)
+
+	header("wireguard_handshake_queue_drops_total", "counter", "Handshake packets dropped because the handshake queue was full.")
+	fmt.Fprintf(bw, "wireguard_handshake_queue_drops_total %d\n", device.HandshakeQueueDrops())
+
+	header("wireguard_tun_write_stalls_total", "counter", "Received packets dropped because writing them to the TUN device timed out.")
+	fmt.Fprintf(bw, "wireguard_tun_write_stalls_total %d\n", device.TUNWriteStalls())
+
+	return bw.Flush()
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	promTypeLine   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram|summary|untyped)$`)
+	promHelpLine   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) .*$`)
+	promSampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*")*\})? (\S+)$`)
+)
+
+// parsePrometheus checks that text is in the Prometheus text exposition format
+// and returns the samples found in it, keyed by metric name.
+func parsePrometheus(t *testing.T, text []byte) map[string][]float64 {
+	t.Helper()
+	samples := make(map[string][]float64)
+	types := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			if m := promTypeLine.FindStringSubmatch(line); m != nil {
+				types[m[1]] = true
+			} else if !promHelpLine.MatchString(line) {
+				t.Errorf("malformed comment line %q", line)
+			}
+			continue
+		}
+		m := promSampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed sample line %q", line)
+			continue
+		}
+		if !types[m[1]] {
+			t.Errorf("sample for %s precedes its TYPE line", m[1])
+		}
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("bad sample value in %q: %v", line, err)
+		}
+		samples[m[1]] = append(samples[m[1]], value)
+	}
+	return samples
+}
+
+func TestWritePrometheus(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var buf bytes.Buffer
+	if err := pair[0].dev.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := parsePrometheus(t, buf.Bytes())
+
+	want := map[string]float64{
+		"wireguard_device_up":    1,
+		"wireguard_device_peers": 1,
+
+		"wireguard_handshake_queue_drops_total": 0,
+		"wireguard_tun_write_stalls_total":      0,
+	}
+	for name, value := range want {
+		if got := samples[name]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %v, want [%v]", name, got, value)
+		}
+	}
+	for _, name := range []string{
+		"wireguard_peer_receive_bytes_total",
+		"wireguard_peer_transmit_bytes_total",
+		"wireguard_peer_last_handshake_seconds",
+		"wireguard_peer_handshakes_total",
+	} {
+		if got := samples[name]; len(got) != 1 || got[0] == 0 {
+			t.Errorf("%s = %v, want one non-zero sample", name, got)
+		}
+	}
+	for _, name := range []string{
+		"wireguard_peer_handshake_initiations_total",
+		"wireguard_peer_handshake_responses_total",
+		"wireguard_peer_handshake_failures",
+		"wireguard_peer_handshake_latency_seconds",
+	} {
+		if got := samples[name]; len(got) != 1 {
+			t.Errorf("%s = %v, want one sample", name, got)
+		}
+	}
+	for _, name := range []string{
+		"wireguard_handshake_ratelimit_allowed_total",
+		"wireguard_handshake_ratelimit_denied_total",
+	} {
+		if got := samples[name]; len(got) != 2 {
+			t.Errorf("%s = %v, want one sample per address family", name, got)
+		}
+	}
+	if got := samples["wireguard_peer_queue_packets"]; len(got) != int(queueKinds) {
+		t.Errorf("wireguard_peer_queue_packets = %v, want one sample per queue", got)
+	}
+	pub := pair[1].dev.staticIdentity.publicKey
+	if label := fmt.Sprintf("{peer=%q}", base64.StdEncoding.EncodeToString(pub[:])); !strings.Contains(buf.String(), label) {
+		t.Errorf("output does not label the peer %s", label)
+	}
+}
@@ -127,6 +127,8 @@ type Handshake struct {
 	remoteStatic              NoisePublicKey           // long term key
 	remoteEphemeral           NoisePublicKey           // ephemeral public key
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
+	previousStaticStatic      [NoisePublicKeySize]byte // precomputed shared secret of the key being rotated out
+	usePrevious               bool                     // whether initiations use the key being rotated out
 	lastTimestamp             tai64n.Timestamp
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
@@ -184,6 +186,18 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
 
+	// during a key rotation, the peer may know either key,
+	// so an initiation left unanswered is retried under the other
+	publicKey, staticStatic := &device.staticIdentity.publicKey, &handshake.precomputedStaticStatic
+	if previous := device.rotation; previous != nil {
+		if handshake.state == handshakeInitiationCreated {
+			handshake.usePrevious = !handshake.usePrevious
+		}
+		if handshake.usePrevious {
+			publicKey, staticStatic = &previous.publicKey, &handshake.previousStaticStatic
+		}
+	}
+
 	// create ephemeral key
 	var err error
 	handshake.hash = InitialHash
@@ -216,18 +230,18 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		ss[:],
 	)
 	aead, _ := chacha20poly1305.New(key[:])
-	aead.Seal(msg.Static[:0], ZeroNonce[:], device.staticIdentity.publicKey[:], handshake.hash[:])
+	aead.Seal(msg.Static[:0], ZeroNonce[:], publicKey[:], handshake.hash[:])
 	handshake.mixHash(msg.Static[:])
 
 	// encrypt timestamp
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	if isZero(staticStatic[:]) {
 		return nil, errZeroECDHResult
 	}
 	KDF2(
 		&handshake.chainKey,
 		&key,
 		handshake.chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		staticStatic[:],
 	)
 	timestamp := tai64n.Now()
 	aead, _ = chacha20poly1305.New(key[:])
@@ -246,7 +260,15 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	return &msg, nil
 }
 
+// ConsumeMessageInitiation consumes msg, sent to the device's current key.
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	return device.consumeMessageInitiation(msg, false)
+}
+
+// consumeMessageInitiation is like ConsumeMessageInitiation, but consumes msg
+// under the key being rotated out if usePrevious, as when its mac1 says it was
+// sent to that key, so that each initiation costs one Diffie-Hellman to open.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, usePrevious bool) *Peer {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
@@ -259,25 +281,22 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
-
 	// decrypt static key
+
 	var err error
-	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
-	ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-	if isZero(ss[:]) {
-		return nil
+	privateKey, publicKey := &device.staticIdentity.privateKey, &device.staticIdentity.publicKey
+	if usePrevious {
+		previous := device.rotation
+		if previous == nil {
+			return nil // the rotation completed since mac1 was checked
+		}
+		privateKey, publicKey = &previous.privateKey, &previous.publicKey
 	}
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
-	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
-	if err != nil {
+	peerPK, ok := openInitiationStatic(msg, privateKey, publicKey, &hash, &chainKey)
+	if !ok {
 		return nil
 	}
-	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
@@ -294,7 +313,11 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	handshake.mutex.RLock()
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	staticStatic := &handshake.precomputedStaticStatic
+	if usePrevious {
+		staticStatic = &handshake.previousStaticStatic
+	}
+	if isZero(staticStatic[:]) {
 		handshake.mutex.RUnlock()
 		return nil
 	}
@@ -302,9 +325,9 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		&chainKey,
 		&key,
 		chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		staticStatic[:],
 	)
-	aead, _ = chacha20poly1305.New(key[:])
+	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
@@ -318,11 +341,11 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
+		peer.log.Verbosef("ConsumeMessageInitiation: handshake replay @ %v", timestamp)
 		return nil
 	}
 	if flood {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
+		peer.log.Verbosef("ConsumeMessageInitiation: handshake flood")
 		return nil
 	}
 
@@ -334,6 +357,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.chainKey = chainKey
 	handshake.remoteIndex = msg.Sender
 	handshake.remoteEphemeral = msg.Ephemeral
+	handshake.usePrevious = usePrevious
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
@@ -351,6 +375,28 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	return peer
 }
 
+// openInitiationStatic decrypts the static key of the initiator from msg,
+// as the device with the static key pair sk and pk, leaving in hash and chainKey
+// the handshake state after it. It reports whether the key decrypted.
+func openInitiationStatic(msg *MessageInitiation, sk *NoisePrivateKey, pk *NoisePublicKey, hash, chainKey *[blake2s.Size]byte) (peerPK NoisePublicKey, ok bool) {
+	mixHash(hash, &InitialHash, pk[:])
+	mixHash(hash, hash, msg.Ephemeral[:])
+	mixKey(chainKey, &InitialChainKey, msg.Ephemeral[:])
+
+	var key [chacha20poly1305.KeySize]byte
+	ss := sk.sharedSecret(msg.Ephemeral)
+	if isZero(ss[:]) {
+		return peerPK, false
+	}
+	KDF2(chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	if _, err := aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:]); err != nil {
+		return peerPK, false
+	}
+	mixHash(hash, hash, msg.Static[:])
+	return peerPK, true
+}
+
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
@@ -463,7 +509,11 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		}()
 
 		func() {
-			ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+			sk := &device.staticIdentity.privateKey
+			if previous := device.rotation; previous != nil && handshake.usePrevious {
+				sk = &previous.privateKey
+			}
+			ss := sk.sharedSecret(msg.Ephemeral)
 			mixKey(&chainKey, &chainKey, ss[:])
 			setZero(ss[:])
 		}()
@@ -37,9 +37,8 @@ func randDevice(t *testing.T) *Device {
 	if err != nil {
 		t.Fatal(err)
 	}
-	tun := tuntest.NewChannelTUN()
 	logger := NewLogger(LogLevelError, "")
-	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), logger)
+	device := NewDevice(tuntest.NilDevice("nil0"), conn.NewDefaultBind(), logger)
 	device.SetPrivateKey(sk)
 	return device
 }
@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/ratelimiter"
+)
+
+// A NoRoutePolicy is what the device does with an outbound packet
+// whose destination is in no peer's allowed IPs.
+type NoRoutePolicy uint32
+
+const (
+	NoRouteSilent NoRoutePolicy = iota // drop it, the default
+	NoRouteReject                      // drop it, and answer it with an ICMP destination unreachable error
+)
+
+const (
+	icmpv4ProtocolNumber  = 1
+	icmpv6ProtocolNumber  = 58
+	ipv6FragmentHeader    = 44
+	icmpv4Unreachable     = 3
+	icmpv4HostUnreachable = 1 // code
+	icmpv6Unreachable     = 1
+	icmpv6NoRoute         = 0 // code
+	icmpHeaderSize        = 8
+	icmpv4MaxErrorSize    = 576  // RFC 1812 section 4.3.2.3
+	icmpv6MaxErrorSize    = 1280 // RFC 4443 section 2.4 (c)
+)
+
+// newNoRouteLimiter returns the limiter of the errors sent for packets without a route:
+// a burst of 6, as the kernel's XRLIM_BURST_FACTOR, then one a second, for each source.
+func newNoRouteLimiter() *ratelimiter.Ratelimiter {
+	return ratelimiter.New(ratelimiter.Options{
+		PacketsPerSecond: 1,
+		Burst:            6,
+		MaxEntries:       4096,
+	})
+}
+
+// SetNoRoutePolicy sets what the device does with outbound packets that no peer's
+// allowed IPs route. With NoRouteReject, it writes back to the TUN device an ICMP
+// host unreachable error, or an ICMPv6 no route to destination error, quoting the
+// packet, as the kernel implementation does, so that the application sending it
+// fails at once rather than timing out. The error comes from the packet's destination,
+// as the device has no address of its own. Errors to each source are limited to
+// a burst of 6, then one a second, and none are sent for ICMP errors, for fragments
+// other than the first, or for packets to or from multicast addresses.
+func (device *Device) SetNoRoutePolicy(policy NoRoutePolicy) {
+	atomic.StoreUint32(&device.noRoute.policy, uint32(policy))
+}
+
+// rejectNoRoute answers packet, which no peer's allowed IPs route,
+// if the policy set by SetNoRoutePolicy says so.
+func (device *Device) rejectNoRoute(packet []byte) {
+	if NoRoutePolicy(atomic.LoadUint32(&device.noRoute.policy)) != NoRouteReject {
+		return
+	}
+	var reply []byte
+	var src netip.Addr
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		reply, src = icmpv4UnreachableFor(packet)
+	case ipv6.Version:
+		reply, src = icmpv6UnreachableFor(packet)
+	}
+	if reply == nil || !device.noRoute.limiter.AllowAddr(src) {
+		return
+	}
+	buf := make([]byte, MessageTransportOffsetContent+len(reply))
+	copy(buf[MessageTransportOffsetContent:], reply)
+	if _, err := device.tun.device.Write(buf, MessageTransportOffsetContent); err != nil {
+		device.log.Verbosef("Failed to write ICMP unreachable error to TUN device: %v", err)
+	}
+}
+
+// icmpv4UnreachableFor returns the ICMP host unreachable error for packet, an IPv4
+// packet at least a minimal header long, and packet's source, or nil if packet
+// should not be answered with an error.
+func icmpv4UnreachableFor(packet []byte) ([]byte, netip.Addr) {
+	headerLen := int(packet[0]&0x0f) * 4
+	if headerLen < ipv4.HeaderLen || headerLen > len(packet) {
+		return nil, netip.Addr{}
+	}
+	if binary.BigEndian.Uint16(packet[6:])&0x1fff != 0 {
+		return nil, netip.Addr{} // not the first fragment
+	}
+	src := netip.AddrFrom4(*(*[4]byte)(packet[IPv4offsetSrc:]))
+	dst := netip.AddrFrom4(*(*[4]byte)(packet[IPv4offsetDst:]))
+	if !unicastAddrs(src, dst) || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return nil, netip.Addr{}
+	}
+	if packet[9] == icmpv4ProtocolNumber && len(packet) > headerLen {
+		switch packet[headerLen] {
+		case 3, 4, 5, 11, 12: // errors, RFC 1122 section 3.2.2
+			return nil, netip.Addr{}
+		}
+	}
+
+	quoted := packet
+	if max := icmpv4MaxErrorSize - ipv4.HeaderLen - icmpHeaderSize; len(quoted) > max {
+		quoted = quoted[:max]
+	}
+	reply := make([]byte, ipv4.HeaderLen+icmpHeaderSize+len(quoted))
+	ip, icmp := reply[:ipv4.HeaderLen], reply[ipv4.HeaderLen:]
+
+	// https://tools.ietf.org/html/rfc792
+	icmp[0] = icmpv4Unreachable
+	icmp[1] = icmpv4HostUnreachable
+	copy(icmp[icmpHeaderSize:], quoted)
+	binary.BigEndian.PutUint16(icmp[2:], internetChecksum(icmp, 0))
+
+	ip[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(ip[IPv4offsetTotalLength:], uint16(len(reply)))
+	ip[8] = 64 // TTL
+	ip[9] = icmpv4ProtocolNumber
+	copy(ip[IPv4offsetSrc:], packet[IPv4offsetDst:IPv4offsetDst+4])
+	copy(ip[IPv4offsetDst:], packet[IPv4offsetSrc:IPv4offsetSrc+4])
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip, 0))
+	return reply, src
+}
+
+// icmpv6UnreachableFor is like icmpv4UnreachableFor, but returns the ICMPv6
+// no route to destination error for packet, an IPv6 packet.
+func icmpv6UnreachableFor(packet []byte) ([]byte, netip.Addr) {
+	src := netip.AddrFrom16(*(*[16]byte)(packet[IPv6offsetSrc:]))
+	dst := netip.AddrFrom16(*(*[16]byte)(packet[IPv6offsetDst:]))
+	if !unicastAddrs(src, dst) {
+		return nil, netip.Addr{}
+	}
+	switch next := packet[6]; {
+	case next == icmpv6ProtocolNumber && len(packet) > ipv6.HeaderLen && packet[ipv6.HeaderLen] < 128:
+		return nil, netip.Addr{} // an error, RFC 4443 section 2.4 (e.1)
+	case next == ipv6FragmentHeader && len(packet) >= ipv6.HeaderLen+8 && binary.BigEndian.Uint16(packet[ipv6.HeaderLen+2:])>>3 != 0:
+		return nil, netip.Addr{} // not the first fragment
+	}
+
+	quoted := packet
+	if max := icmpv6MaxErrorSize - ipv6.HeaderLen - icmpHeaderSize; len(quoted) > max {
+		quoted = quoted[:max]
+	}
+	reply := make([]byte, ipv6.HeaderLen+icmpHeaderSize+len(quoted))
+	ip, icmp := reply[:ipv6.HeaderLen], reply[ipv6.HeaderLen:]
+
+	// https://tools.ietf.org/html/rfc8200 section 3
+	ip[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(ip[IPv6offsetPayloadLength:], uint16(len(icmp)))
+	ip[6] = icmpv6ProtocolNumber
+	ip[7] = 64 // hop limit
+	copy(ip[IPv6offsetSrc:], packet[IPv6offsetDst:IPv6offsetDst+16])
+	copy(ip[IPv6offsetDst:], packet[IPv6offsetSrc:IPv6offsetSrc+16])
+
+	// https://tools.ietf.org/html/rfc4443 section 3.1
+	icmp[0] = icmpv6Unreachable
+	icmp[1] = icmpv6NoRoute
+	copy(icmp[icmpHeaderSize:], quoted)
+	pseudo := make([]byte, 40)
+	copy(pseudo, ip[IPv6offsetSrc:IPv6offsetDst+16])
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(icmp)))
+	pseudo[39] = icmpv6ProtocolNumber
+	binary.BigEndian.PutUint16(icmp[2:], internetChecksum(icmp, ^internetChecksum(pseudo, 0)))
+	return reply, src
+}
+
+// unicastAddrs reports whether src and dst, the addresses of a packet,
+// are such that the packet may be answered with an ICMP error.
+func unicastAddrs(src, dst netip.Addr) bool {
+	return !src.IsUnspecified() && !src.IsMulticast() && !dst.IsMulticast()
+}
+
+// internetChecksum is the checksum of RFC 1071 over buf,
+// continuing from the one's complement sum initial.
+func internetChecksum(buf []byte, initial uint16) uint16 {
+	v := uint32(initial)
+	for i := 0; i+1 < len(buf); i += 2 {
+		v += uint32(binary.BigEndian.Uint16(buf[i:]))
+	}
+	if len(buf)%2 == 1 {
+		v += uint32(buf[len(buf)-1]) << 8
+	}
+	for v > 0xffff {
+		v = v>>16 + v&0xffff
+	}
+	return ^uint16(v)
+}
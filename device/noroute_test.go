@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestNoRouteReject(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	// receive returns the packet the device writes to the TUN device, if any.
+	receive := func() []byte {
+		select {
+		case pkt := <-tun.Inbound:
+			return pkt
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+
+	tun.Outbound <- tuntest.Ping(net.IPv4(10, 9, 9, 9), net.IPv4(10, 0, 0, 1))
+	if pkt := receive(); pkt != nil {
+		t.Fatalf("device answered a packet without a route by default: %x", pkt)
+	}
+
+	dev.SetNoRoutePolicy(NoRouteReject)
+	for _, tt := range []struct {
+		ping     []byte
+		dst, src netip.Addr
+		code     byte
+	}{
+		{tuntest.Ping(net.IPv4(10, 9, 9, 9), net.IPv4(10, 0, 0, 1)), netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.9.9.9"), 1},
+		{tuntest.Ping6(netip.MustParseAddr("fd00::9"), netip.MustParseAddr("fd00::1")), netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::9"), 0},
+	} {
+		tun.Outbound <- tt.ping
+		pkt := receive()
+		if pkt == nil {
+			t.Fatalf("no error for a packet without a route from %v", tt.dst)
+		}
+		dst, src, code, quoted, err := tuntest.ParseUnreachable(pkt)
+		if err != nil {
+			t.Fatalf("error for a packet without a route from %v: %v", tt.dst, err)
+		}
+		if dst != tt.dst || src != tt.src || code != tt.code {
+			t.Errorf("error from %v to %v with code %d, want from %v to %v with code %d", src, dst, code, tt.src, tt.dst, tt.code)
+		}
+		if !bytes.Equal(quoted, tt.ping) {
+			t.Errorf("error quotes %x, want %x", quoted, tt.ping)
+		}
+
+		// Errors are not answered with errors.
+		tun.Outbound <- pkt
+		if pkt := receive(); pkt != nil {
+			t.Errorf("device answered an ICMP error with %x", pkt)
+		}
+	}
+
+	// Errors to one source are limited to a burst of 6.
+	answered := 0
+	for i := 0; i < 10; i++ {
+		tun.Outbound <- tuntest.Ping(net.IPv4(10, 9, 9, 9), net.IPv4(10, 0, 0, 3))
+		if receive() != nil {
+			answered++
+		}
+	}
+	if answered < 6 || answered > 7 { // one more may be allowed as the limit refills
+		t.Errorf("%d errors for 10 packets from one source, want 6", answered)
+	}
+
+	dev.SetNoRoutePolicy(NoRouteSilent)
+	tun.Outbound <- tuntest.Ping(net.IPv4(10, 9, 9, 9), net.IPv4(10, 0, 0, 4))
+	if pkt := receive(); pkt != nil {
+		t.Errorf("device answered a packet without a route after going silent: %x", pkt)
+	}
+}
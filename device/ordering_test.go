@@ -0,0 +1,270 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestOutboundOrdering sends a numbered stream of packets through a pair as fast
+// as the device takes them, while traffic flows the other way too, and checks
+// that every one arrives, in the order they were sent, though the encryption
+// and decryption workers seal and open them in parallel.
+func TestOutboundOrdering(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	addr := func(ip net.IP) netip.Addr {
+		a, _ := netip.AddrFromSlice(ip.To4())
+		return a
+	}
+	src, dst := addr(pair[1].ip), addr(pair[0].ip)
+
+	// Load the workers with a stream from dev0 to dev1, discarded as it arrives.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		load := tuntest.Ping(pair[1].ip, pair[0].ip)
+		for {
+			select {
+			case pair[0].tun.Outbound <- load:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-pair[1].tun.Inbound:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	const n = 4096
+	type result struct {
+		received  int
+		lastSeq   int
+		misorders int
+	}
+	results := make(chan result)
+	go func() {
+		r := result{lastSeq: -1}
+		for r.lastSeq < n-1 {
+			var pkt []byte
+			select {
+			case pkt = <-pair[0].tun.Inbound:
+			case <-time.After(5 * time.Second):
+				results <- r
+				return
+			}
+			_, seq, err := tuntest.ParseEchoID(pkt)
+			if err != nil {
+				continue
+			}
+			if int(seq) <= r.lastSeq {
+				r.misorders++
+			}
+			r.received++
+			r.lastSeq = int(seq)
+		}
+		results <- r
+	}()
+	for seq := 0; seq < n; seq++ {
+		pair[1].tun.Outbound <- tuntest.PingSeq(dst, src, uint16(seq))
+	}
+	r := <-results
+	if r.misorders != 0 {
+		t.Errorf("%d of %d packets arrived out of order", r.misorders, r.received)
+	}
+	if r.received != n {
+		t.Errorf("%d of %d packets arrived", r.received, n)
+	}
+}
+
+// TestSlowPeerIndependence stalls the sender of one peer of a hub, and checks
+// that the hub goes on reading from its TUN device and sending to another peer,
+// and that the stalled peer's packets, held staged, are sent once it catches up.
+func TestSlowPeerIndependence(t *testing.T) {
+	hub, spokes := genHub(t, 2)
+	slow := hub.dev.LookupPeer(spokes[0].dev.staticIdentity.publicKey)
+
+	// The sender waits on the element at the head of its queue until it is unlocked,
+	// as it does for one being sealed. Empty, it is dropped by the spoke.
+	stall := hub.dev.NewOutboundElement()
+	stall.packet = stall.buffer[:0]
+	stall.Lock()
+	slow.queue.outbound.c <- stall
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(stall.Unlock) }
+	t.Cleanup(release) // before the devices close
+
+	send := func(dst testPeer, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case hub.tun.Outbound <- tuntest.Ping(dst.ip, hub.ip):
+			case <-time.After(5 * time.Second):
+				t.Fatalf("hub stopped reading from its TUN device after %d packets", i)
+			}
+		}
+	}
+	count := func(dst testPeer) (received int) {
+		for {
+			select {
+			case <-dst.tun.Inbound:
+				received++
+			case <-time.After(500 * time.Millisecond):
+				return received
+			}
+		}
+	}
+
+	send(spokes[0], QueueOutboundSize+QueueStagedSize)
+	const n = 100
+	send(spokes[1], n)
+	if got := count(spokes[1]); got != n {
+		t.Errorf("%d of %d packets arrived at the other peer while one was stalled", got, n)
+	}
+
+	// Loopback UDP drops some of a burst this size, so count the packets the hub sent.
+	sent := atomic.LoadUint64(&slow.stats.txPackets)
+	release()
+	want := sent + 1 + QueueOutboundSize + QueueStagedSize
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&slow.stats.txPackets) < want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub sent %d of the stalled peer's packets once it caught up, want %d",
+				atomic.LoadUint64(&slow.stats.txPackets)-sent, want-sent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// genHub returns a device, the hub, with n peers, the spokes, each a device
+// connected to it over loopback UDP, with a session established with each.
+// The hub is at 1.0.0.1, and spoke i at 1.0.1.i+1.
+func genHub(tb testing.TB, n int) (hub testPeer, spokes []testPeer) {
+	newNode := func(ip net.IP) testPeer {
+		p := testPeer{tun: tuntest.NewChannelTUN(), ip: ip}
+		p.dev = NewDevice(p.tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+		tb.Cleanup(p.dev.Close)
+		return p
+	}
+	newKey := func() NoisePrivateKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return sk
+	}
+	up := func(p testPeer, cfg string) {
+		if err := p.dev.IpcSet(cfg); err != nil {
+			tb.Fatal(err)
+		}
+		if err := p.dev.Up(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	hubKey := newKey()
+	hubPub := hubKey.publicKey()
+	hub = newNode(net.IPv4(1, 0, 0, 1))
+	up(hub, uapiCfg("private_key", hex.EncodeToString(hubKey[:]), "listen_port", "0"))
+	for i := 0; i < n; i++ {
+		key := newKey()
+		pub := key.publicKey()
+		spoke := newNode(net.IPv4(1, 0, 1, byte(i+1)))
+		up(spoke, uapiCfg(
+			"private_key", hex.EncodeToString(key[:]),
+			"listen_port", "0",
+			"public_key", hex.EncodeToString(hubPub[:]),
+			"endpoint", fmt.Sprintf("127.0.0.1:%d", hub.dev.net.port),
+			"allowed_ip", "1.0.0.1/32",
+		))
+		if err := hub.dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pub[:]),
+			"endpoint", fmt.Sprintf("127.0.0.1:%d", spoke.dev.net.port),
+			"allowed_ip", fmt.Sprintf("%v/32", spoke.ip),
+		)); err != nil {
+			tb.Fatal(err)
+		}
+		spokes = append(spokes, spoke)
+
+		// Establish the session.
+		pair := testPair{spoke, hub}
+		pair.Send(tb, Ping, nil)
+	}
+	return hub, spokes
+}
+
+// BenchmarkThroughputPeers measures how fast a device sends to several peers at once.
+// The peers' packets are sealed by the same encryption workers, but each peer's
+// are sent in order by a routine of its own, so that no peer holds up another,
+// and throughput should grow with the number of peers
+// up to the number of cores.
+func BenchmarkThroughputPeers(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("peers=%d", n), func(b *testing.B) {
+			hub, spokes := genHub(b, n)
+
+			var recv uint64
+			var start time.Time
+			var startOnce sync.Once
+			finished := make(chan time.Duration, 1)
+			done := make(chan struct{})
+			defer close(done)
+			for _, spoke := range spokes {
+				go func(spoke testPeer) {
+					for {
+						select {
+						case <-spoke.tun.Inbound:
+						case <-done:
+							return
+						}
+						startOnce.Do(func() { start = time.Now() })
+						if atomic.AddUint64(&recv, 1) == uint64(b.N) {
+							finished <- time.Since(start)
+						}
+					}
+				}(spoke)
+			}
+
+			pings := make([][]byte, n)
+			for i, spoke := range spokes {
+				pings[i] = tuntest.Ping(spoke.ip, hub.ip)
+			}
+			b.ResetTimer()
+			var sent uint64
+			for i := 0; atomic.LoadUint64(&recv) < uint64(b.N); i++ {
+				sent++
+				hub.tun.Outbound <- pings[i%n]
+			}
+			elapsed := <-finished
+
+			b.ReportMetric(float64(elapsed)/float64(b.N), "ns/op")
+			b.ReportMetric(1-float64(b.N)/float64(sent), "packet-loss")
+		})
+	}
+}
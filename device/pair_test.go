@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/device/devicetest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestTwoDevicePing(t *testing.T) {
+	device.GoroutineLeakCheck(t)
+	a, b := devicetest.NewPair(t, devicetest.LoopbackUDP())
+	devicetest.AssertPingSucceeds(t, a, b)
+	devicetest.WaitForHandshake(t, a.Device, b.PublicKey, devicetest.Timeout)
+	devicetest.WaitForHandshake(t, b.Device, a.PublicKey, devicetest.Timeout)
+	// Only one side answers at a time, so that the other side can read the replies.
+	stop := tuntest.EchoResponder(a.TUN)
+	t.Run("ping 1.0.0.1", func(t *testing.T) {
+		devicetest.MustEcho(t, b, a)
+	})
+	t.Run("ping fd00::1", func(t *testing.T) {
+		devicetest.MustEcho6(t, b, a)
+	})
+	stop()
+	stop = tuntest.EchoResponder(b.TUN)
+	defer stop()
+	t.Run("ping 1.0.0.2", func(t *testing.T) {
+		devicetest.MustEcho(t, a, b)
+	})
+	t.Run("ping fd00::2", func(t *testing.T) {
+		devicetest.MustEcho6(t, a, b)
+	})
+}
+
+func TestSimultaneousHandshake(t *testing.T) {
+	if testing.Short() {
+		t.Skip("may wait for a handshake retransmission")
+	}
+	device.GoroutineLeakCheck(t)
+	a, b := devicetest.NewPair(t)
+	a.TUN.Record(100)
+	b.TUN.Record(100)
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("packets at %v:\n%s", a.IP, a.TUN.FormatHistory())
+			t.Logf("packets at %v:\n%s", b.IP, b.TUN.FormatHistory())
+		}
+	})
+	// Both devices have a packet to send, so both initiate a handshake. If the
+	// initiations cross, the handshake completes only when one is retransmitted.
+	devicetest.SendPing(a, b)
+	devicetest.SendPing(b, a)
+	devicetest.ExpectPing(t, a, b)
+	devicetest.ExpectPing(t, b, a)
+	devicetest.WaitHandshake(t, a, b)
+	devicetest.MustPing(t, a, b)
+	devicetest.MustPing(t, b, a)
+}
+
+func TestRekeyAfterMessages(t *testing.T) {
+	device.GoroutineLeakCheck(t)
+	a, b := devicetest.NewPair(t)
+	devicetest.MustPing(t, a, b)
+
+	// a sent the first ping, so it initiated the handshake and is the one to rekey.
+	old := device.CurrentKeypair(a.Device, b.PublicKey)
+	if old == nil || !old.IsInitiator() {
+		t.Fatal("a did not initiate the first handshake")
+	}
+	device.ExhaustKeypair(a.Device, b.PublicKey)
+	// Wait long enough for the whitened TAI64N timestamp to advance and the
+	// responder's initiation rate limit to pass, or the new initiation looks like a replay.
+	time.Sleep(50 * time.Millisecond)
+
+	devicetest.MustPing(t, a, b)
+	for deadline := time.Now().Add(devicetest.Timeout); device.CurrentKeypair(a.Device, b.PublicKey) == old; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a new keypair")
+		}
+	}
+	devicetest.MustPing(t, a, b)
+	devicetest.MustPing(t, b, a)
+}
+
+func TestGenConfig(t *testing.T) {
+	const numPeers = 1000
+	dev := device.NewDevice(tuntest.NilDevice("nil0"), conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.IpcSet(devicetest.GenConfig(t, numPeers)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(dev.PeerStatuses()); n != numPeers {
+		t.Errorf("configured %d peers, want %d", n, numPeers)
+	}
+	routes := dev.RoutingTable()
+	if len(routes) != numPeers {
+		t.Fatalf("configured %d routes, want %d", len(routes), numPeers)
+	}
+	seen := make(map[device.NoisePublicKey]bool)
+	for _, route := range routes {
+		if route.Prefix.Bits() != 32 || seen[route.PeerPublicKey] {
+			t.Errorf("route %v to %x is not a /32 of its own peer", route.Prefix, route.PeerPublicKey)
+		}
+		seen[route.PeerPublicKey] = true
+	}
+}
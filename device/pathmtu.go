@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	linkMTU        = 1500 // assumed of the path to a peer, as for Ethernet, unless sends show otherwise
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	udpHeaderSize  = 8
+	minPathMTU     = 1280 // the least any IPv6 path carries
+)
+
+// PeerPathMTU returns the MTU of packets that can be sent to the peer with public key pk
+// without the messages carrying them being too large for the path to it: the least of
+// the device's MTU, the assumed link MTU of 1500 less the IP and UDP headers of the
+// peer's endpoint and the transport message overhead, and one byte less than the smallest
+// message the bind has refused to send to it as too large, less that overhead. A peer
+// without an endpoint is taken to have an IPv6 one, whose headers are larger.
+//
+// Each refused message lowers the estimate only to one byte below its size, so it is
+// an upper bound that converges slowly, as ever smaller messages are refused.
+//
+// With a single peer, as for a client of a VPN, the MTU of the TUN device should be
+// set to this, so that the system fragments or refuses larger packets itself rather
+// than the device sending messages that never arrive. The device follows the TUN
+// device's MTU, so lowering it there, after PeerPathMTU drops, is all it takes.
+func (device *Device) PeerPathMTU(pk NoisePublicKey) (int, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return 0, errors.New("no such peer")
+	}
+	return peer.pathMTU(), nil
+}
+
+func (peer *Peer) pathMTU() int {
+	mtu := int(atomic.LoadInt32(&peer.device.tun.mtu))
+	ipHeaderSize := ipv6HeaderSize
+	peer.RLock()
+	if peer.endpoint != nil && peer.endpoint.DstIP().To4() != nil {
+		ipHeaderSize = ipv4HeaderSize
+	}
+	peer.RUnlock()
+	if link := linkMTU - ipHeaderSize - udpHeaderSize - MessageTransportSize; link < mtu {
+		mtu = link
+	}
+	if largest := int(atomic.LoadUint32(&peer.stats.largestSendable)); largest != 0 && largest-MessageTransportSize < mtu {
+		mtu = largest - MessageTransportSize
+	}
+	return mtu
+}
+
+// noteSendError records, if err is the bind refusing a message of size bytes
+// as too large, that only smaller messages can be sent to the peer.
+// It never lowers the path MTU below the minimum of IPv6, as a bound
+// on what one message refused for some other reason can do.
+func (peer *Peer) noteSendError(err error, size int) {
+	if !errors.Is(err, syscall.EMSGSIZE) {
+		return
+	}
+	largest := size - 1
+	if largest < minPathMTU+MessageTransportSize {
+		largest = minPathMTU + MessageTransportSize
+	}
+	for {
+		old := atomic.LoadUint32(&peer.stats.largestSendable)
+		if old != 0 && int(old) <= largest {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&peer.stats.largestSendable, old, uint32(largest)) {
+			peer.log.Verbosef("Messages of %d bytes too large to send; taking the largest sendable to be %d", size, largest)
+			return
+		}
+	}
+}
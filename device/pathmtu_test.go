@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// msgSizeBind refuses to send messages larger than max, as a socket does
+// those larger than the MTU of the interface they would go out of.
+type msgSizeBind struct {
+	conn.Bind
+	max int
+}
+
+func (b *msgSizeBind) Send(buf []byte, ep conn.Endpoint) error {
+	if len(buf) > b.max {
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendmsg", syscall.EMSGSIZE)}
+	}
+	return b.Bind.Send(buf, ep)
+}
+
+func TestPeerPathMTU(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), &msgSizeBind{Bind: bindtest.NewChannelBinds()[0], max: 1400}, NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	tun.SetMTU(1500)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&dev.tun.mtu) != 1500; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("device did not take the MTU of the TUN device")
+		}
+	}
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEndpoint := func(s string) {
+		t.Helper()
+		endpoint, err := conn.NewStdNetBind().ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.Lock()
+		peer.endpoint = endpoint
+		peer.Unlock()
+	}
+	checkMTU := func(want int) {
+		t.Helper()
+		if mtu, err := dev.PeerPathMTU(pk); err != nil || mtu != want {
+			t.Errorf("PeerPathMTU = %d, %v, want %d", mtu, err, want)
+		}
+		if statuses := dev.PeerStatuses(); statuses[0].PathMTU != want {
+			t.Errorf("PeerStatus.PathMTU = %d, want %d", statuses[0].PathMTU, want)
+		}
+	}
+
+	checkMTU(1420) // no endpoint: as for IPv6
+	setEndpoint("127.0.0.1:1000")
+	checkMTU(1440)
+	setEndpoint("[::1]:1000")
+	checkMTU(1420)
+
+	// A message the bind refuses as too large lowers the path MTU below it.
+	if err := peer.SendBuffer(make([]byte, 1420+MessageTransportSize)); err == nil {
+		t.Fatal("bind sent a message larger than it allows")
+	}
+	checkMTU(1420 - 1)
+	if err := peer.SendBuffer(make([]byte, 1460)); err == nil {
+		t.Fatal("bind sent a message larger than it allows")
+	}
+	checkMTU(1420 - 1) // larger than one already refused
+	peer.noteSendError(syscall.ECONNREFUSED, 1000)
+	checkMTU(1420 - 1)
+	if err := peer.SendBuffer(make([]byte, 1401)); err == nil {
+		t.Fatal("bind sent a message larger than it allows")
+	}
+	checkMTU(1400 - MessageTransportSize)
+
+	// The device's own MTU still bounds it.
+	tun.SetMTU(1280)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&dev.tun.mtu) != 1280; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("device did not take the MTU of the TUN device")
+		}
+	}
+	checkMTU(1280)
+
+	if _, err := dev.PeerPathMTU(NoisePublicKey{}); err == nil {
+		t.Error("PeerPathMTU of an unknown peer succeeded")
+	}
+}
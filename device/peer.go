@@ -21,8 +21,11 @@ type Peer struct {
 	keypairs     Keypairs
 	handshake    Handshake
 	device       *Device
+	log          peerLogger // logs lines about this peer
 	endpoint     conn.Endpoint
-	stopping     sync.WaitGroup // routines pending stop
+	candidates   []conn.Endpoint // endpoints to cycle through when handshakes fail
+	candidate    int             // index of the candidate in use
+	stopping     sync.WaitGroup  // routines pending stop
 
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
@@ -32,10 +35,46 @@ type Peer struct {
 	stats struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
+		txPackets         uint64 // messages sent to peer, counted in txBytes
+		rxPackets         uint64 // messages received from peer, counted in rxBytes
 		lastHandshakeNano int64  // nano seconds since epoch
+		filtered          uint64 // packets dropped by the packet filter
+		rateLimited       uint64 // packets dropped by the peer's rate limit
+
+		handshakeInitiations uint64 // handshake initiations sent
+		handshakeResponses   uint64 // handshake responses received
+		handshakes           uint64 // handshakes completed
+		handshakeFailures    uint64 // initiations unanswered since the last completed handshake
+		initiationSentNano   int64  // when the last handshake initiation was sent
+		handshakeLatencyNano int64  // from sending the last answered initiation to deriving its keypair
+		largestSendable      uint32 // one byte less than the smallest message the bind refused as too large, at least 1312, or 0 if it has refused none
+	}
+
+	rateLimit struct {
+		sync.Mutex            // serializes SetPeerRateLimit
+		enabled    AtomicBool // whether either limit is set
+		queue      AtomicBool // PeerRateLimit.Queue
+		rx, tx     byteBucket
+	}
+
+	queuePressure [queueKinds]queuePressure // indexed by QueueKind
+
+	handshakeBackoff struct {
+		sync.Mutex               // protects delay and until, and serializes changes to failures
+		failures   uint32        // initiations unanswered in a row, accessed atomically
+		deferred   AtomicBool    // whether retransmitHandshake is waiting out the backoff, rather than for a response
+		delay      time.Duration // the wait between initiations backed off to, or 0
+		until      time.Time     // no initiation is sent before
+	}
+
+	lastError struct {
+		sync.Mutex
+		err string    // why the peer last failed to connect or to pass a packet, for PeerStatus.LastError
+		at  time.Time // when
 	}
 
 	disableRoaming bool
+	stickyEndpoint bool // received packets leave endpoint alone; set by the sticky_endpoint UAPI key
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -53,9 +92,11 @@ type Peer struct {
 	}
 
 	queue struct {
-		staged   chan *QueueOutboundElement // staged packets before a handshake is available
-		outbound *autodrainingOutboundQueue // sequential ordering of udp transmission
-		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
+		sync.Mutex                              // serializes SendStagedPackets
+		staged       chan *QueueOutboundElement // staged packets before a handshake is available, or room in outbound
+		outbound     *autodrainingOutboundQueue // sequential ordering of udp transmission
+		inbound      *autodrainingInboundQueue  // sequential ordering of tun writing
+		outboundFull AtomicBool                 // whether SendStagedPackets left packets staged for want of room in outbound
 	}
 
 	cookieGenerator             CookieGenerator
@@ -87,6 +128,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
+	peer.log = peerLogger{peer}
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
 	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
@@ -102,6 +144,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	handshake.mutex.Lock()
 	handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(pk)
 	handshake.remoteStatic = pk
+	handshake.setPreviousStatic(device.rotation)
 	handshake.mutex.Unlock()
 
 	// reset endpoint
@@ -137,6 +180,9 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	err := peer.device.net.bind.Send(buffer, peer.endpoint)
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+		atomic.AddUint64(&peer.stats.txPackets, 1)
+	} else {
+		peer.noteSendError(err, len(buffer))
 	}
 	return err
 }
@@ -182,7 +228,7 @@ func (peer *Peer) Start() {
 	}
 
 	device := peer.device
-	device.log.Verbosef("%v - Starting", peer)
+	peer.log.Verbosef("Starting")
 
 	// reset routine state
 	peer.stopping.Wait()
@@ -258,7 +304,7 @@ func (peer *Peer) Stop() {
 		return
 	}
 
-	peer.device.log.Verbosef("%v - Stopping", peer)
+	peer.log.Verbosef("Stopping")
 
 	peer.timersStop()
 	// Signal that RoutineSequentialSender and RoutineSequentialReceiver should exit.
@@ -268,13 +314,27 @@ func (peer *Peer) Stop() {
 	peer.device.queue.encryption.wg.Done() // no more writes to encryption queue from us
 
 	peer.ZeroAndFlushAll()
+	peer.releaseQueuePressure()
 }
 
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
-	if peer.disableRoaming {
+	if peer.disableRoaming || peer.device.roamingDisabled.Get() {
 		return
 	}
 	peer.Lock()
-	peer.endpoint = endpoint
+	if !peer.stickyEndpoint {
+		peer.endpoint = endpoint
+	}
 	peer.Unlock()
 }
+
+// nextCandidateEndpoint switches peer to its next candidate endpoint, if it has several.
+// It must be called with peer locked.
+func (peer *Peer) nextCandidateEndpoint() {
+	if len(peer.candidates) < 2 {
+		return
+	}
+	peer.candidate = (peer.candidate + 1) % len(peer.candidates)
+	peer.endpoint = peer.candidates[peer.candidate]
+	peer.log.Verbosef("Trying candidate endpoint %v", logEndpoint{peer.endpoint})
+}
@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRateLimitDelay is the longest a packet over a peer's transmit limit is held
+// with PeerRateLimit.Queue; one that would wait longer is dropped.
+const maxRateLimitDelay = time.Second
+
+// A PeerRateLimit caps the throughput of a peer's data packets, counted in bytes
+// as they are on the wire, as for RxBytes and TxBytes. Keepalives and handshakes
+// are not limited.
+type PeerRateLimit struct {
+	RxBytesPerSecond uint64 // 0 for no limit
+	TxBytesPerSecond uint64 // 0 for no limit
+	Burst            uint64 // bytes that may pass at once; 0 for one second's worth
+
+	// Queue holds transmitted packets over the limit until it lets them through,
+	// as long as a second, rather than dropping them. Received packets over the limit,
+	// and without Queue, transmitted ones larger than Burst, are always dropped;
+	// holding received packets would hold up those of other peers.
+	Queue bool
+}
+
+// SetPeerRateLimit limits the throughput of the peer with public key pk.
+// Packets over the limit are dropped, or held, and counted in the peer's PeerStatus.
+// The zero PeerRateLimit, the default, removes the limit.
+func (device *Device) SetPeerRateLimit(pk NoisePublicKey, limit PeerRateLimit) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return errors.New("no such peer")
+	}
+	peer.rateLimit.Lock()
+	defer peer.rateLimit.Unlock()
+	peer.rateLimit.rx.set(limit.RxBytesPerSecond, limit.Burst)
+	peer.rateLimit.tx.set(limit.TxBytesPerSecond, limit.Burst)
+	peer.rateLimit.queue.Set(limit.Queue)
+	peer.rateLimit.enabled.Set(limit.RxBytesPerSecond != 0 || limit.TxBytesPerSecond != 0)
+	return nil
+}
+
+// allowReceive reports whether the peer's receive limit lets through
+// a data message of size bytes, and counts it if not.
+func (peer *Peer) allowReceive(size int) bool {
+	if !peer.rateLimit.enabled.Get() {
+		return true
+	}
+	if _, ok := peer.rateLimit.rx.take(size, 0); ok {
+		return true
+	}
+	atomic.AddUint64(&peer.stats.rateLimited, 1)
+	peer.device.tracePacket(DirectionInbound, peer, size, TraceDropped, "rate limited")
+	return false
+}
+
+// allowTransmit is like allowReceive, for the transmit limit. With PeerRateLimit.Queue,
+// a message over the limit is let through if the limit lets it within maxRateLimitDelay,
+// after those let through ahead of it, and notBefore is when it may be sent.
+func (peer *Peer) allowTransmit(size int) (notBefore time.Time, ok bool) {
+	if !peer.rateLimit.enabled.Get() {
+		return time.Time{}, true
+	}
+	maxWait := time.Duration(0)
+	if peer.rateLimit.queue.Get() {
+		maxWait = maxRateLimitDelay
+	}
+	if wait, ok := peer.rateLimit.tx.take(size, maxWait); ok {
+		if wait > 0 {
+			notBefore = time.Now().Add(wait)
+		}
+		return notBefore, true
+	}
+	atomic.AddUint64(&peer.stats.rateLimited, 1)
+	peer.device.tracePacket(DirectionOutbound, peer, size, TraceDropped, "rate limited")
+	return time.Time{}, false
+}
+
+// A byteBucket is a token bucket limiting a rate of bytes. As in the ratelimiter,
+// its tokens are nanoseconds, which accrue with time, and each byte costs
+// the time it takes to pass at the rate.
+type byteBucket struct {
+	sync.Mutex
+	rate      uint64 // bytes per second; 0 for no limit
+	maxTokens int64
+	tokens    int64
+	last      time.Time
+}
+
+// set sets the rate and burst of b, and fills it.
+func (b *byteBucket) set(rate, burst uint64) {
+	b.Lock()
+	defer b.Unlock()
+	b.rate = rate
+	if rate == 0 {
+		return
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	b.maxTokens = int64(float64(burst) / float64(rate) * float64(time.Second))
+	b.tokens = b.maxTokens
+	b.last = time.Now()
+}
+
+// take takes the tokens for n bytes, if there are enough or will be within maxWait,
+// and returns how long until there are. Tokens taken ahead of time are owed,
+// so that those that follow wait their turn.
+func (b *byteBucket) take(n int, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	if b.rate == 0 {
+		return 0, true
+	}
+	now := time.Now()
+	b.tokens += int64(now.Sub(b.last))
+	b.last = now
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+	cost := int64(uint64(n) * uint64(time.Second) / b.rate)
+	if b.tokens < cost {
+		wait = time.Duration(cost - b.tokens)
+		if wait > maxWait {
+			return 0, false
+		}
+	}
+	b.tokens -= cost
+	return wait, true
+}
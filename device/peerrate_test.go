@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestPeerRateLimit checks that a peer with a low byte rate has the packets
+// over it dropped, each way, while another peer of the same device is unaffected.
+func TestPeerRateLimit(t *testing.T) {
+	hub, spokes := genHub(t, 2)
+	keyOf := func(spoke testPeer) NoisePublicKey { return spoke.dev.staticIdentity.publicKey }
+	// Pings are 80 bytes on the wire, so about a dozen fit in the burst.
+	if err := hub.dev.SetPeerRateLimit(keyOf(spokes[0]), PeerRateLimit{RxBytesPerSecond: 1000, TxBytesPerSecond: 1000, Burst: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// count sends n pings from src to dst, and returns how many arrive.
+	count := func(dst, src testPeer, n int) int {
+		for i := 0; i < n; i++ {
+			src.tun.Outbound <- tuntest.Ping(dst.ip, src.ip)
+		}
+		received := 0
+		for {
+			select {
+			case <-dst.tun.Inbound:
+				received++
+			case <-time.After(200 * time.Millisecond):
+				return received
+			}
+		}
+	}
+	const n = 50
+	for _, tt := range []struct {
+		name     string
+		dst, src testPeer
+		limited  bool
+	}{
+		{"to limited peer", spokes[0], hub, true},
+		{"from limited peer", hub, spokes[0], true},
+		{"to unlimited peer", spokes[1], hub, false},
+		{"from unlimited peer", hub, spokes[1], false},
+	} {
+		got := count(tt.dst, tt.src, n)
+		if tt.limited && (got == 0 || got > 20) {
+			t.Errorf("%s: %d of %d pings arrived, want about a dozen", tt.name, got, n)
+		}
+		if !tt.limited && got != n {
+			t.Errorf("%s: %d of %d pings arrived, want all", tt.name, got, n)
+		}
+	}
+
+	for _, status := range hub.dev.PeerStatuses() {
+		switch status.PublicKey {
+		case keyOf(spokes[0]):
+			if status.RateLimited == 0 {
+				t.Error("no packets counted as rate limited for the limited peer")
+			}
+		case keyOf(spokes[1]):
+			if status.RateLimited != 0 {
+				t.Errorf("%d packets counted as rate limited for the unlimited peer", status.RateLimited)
+			}
+		}
+	}
+
+	// With Queue, packets over the limit are held rather than dropped.
+	if err := hub.dev.SetPeerRateLimit(keyOf(spokes[0]), PeerRateLimit{TxBytesPerSecond: 8000, Burst: 800, Queue: true}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if got := count(spokes[0], hub, n); got != n {
+		t.Errorf("with Queue, %d of %d pings arrived, want all", got, n)
+	}
+	// 4000 bytes at 8000 a second, less the burst of 800, take 0.4s.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("with Queue, pings took %v, want them held to the limit", elapsed)
+	}
+
+	if err := hub.dev.SetPeerRateLimit(NoisePublicKey{}, PeerRateLimit{}); err == nil {
+		t.Error("SetPeerRateLimit of an unknown peer succeeded")
+	}
+}
+
+// TestPeerRateLimitQueueSaturated keeps a peer with Queue over its transmit limit
+// and checks that the device goes on sending to another peer meanwhile, and holds
+// none of the limited peer's packets much longer than maxRateLimitDelay.
+func TestPeerRateLimitQueueSaturated(t *testing.T) {
+	hub, spokes := genHub(t, 2)
+	limited, unlimited := spokes[0], spokes[1]
+	if err := hub.dev.SetPeerRateLimit(limited.dev.staticIdentity.publicKey, PeerRateLimit{TxBytesPerSecond: 8000, Queue: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// At 80 bytes a ping, the limit passes 100 a second, after a burst of as many.
+	// Those to the limited peer are more than its queues hold.
+	const n = 100
+	for i := 0; i < 13*n; i++ {
+		dst := limited
+		if i%13 == 0 {
+			dst = unlimited
+		}
+		select {
+		case hub.tun.Outbound <- tuntest.Ping(dst.ip, hub.ip):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("hub stopped reading from its TUN device after %d packets", i)
+		}
+	}
+	sent := time.Now()
+
+	received := 0
+	for received < n {
+		select {
+		case <-unlimited.tun.Inbound:
+			received++
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d pings arrived at the unlimited peer", received, n)
+		}
+	}
+	var last time.Time
+	for {
+		select {
+		case <-limited.tun.Inbound:
+			last = time.Now()
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+	if held := last.Sub(sent); held > maxRateLimitDelay+500*time.Millisecond {
+		t.Errorf("a packet to the limited peer was held %v, want at most about %v", held, maxRateLimitDelay)
+	}
+	for _, status := range hub.dev.PeerStatuses() {
+		if status.PublicKey == limited.dev.staticIdentity.publicKey && status.RateLimited == 0 {
+			t.Error("no packets over the limit were dropped")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// A QueueKind is one of the queues each peer has.
+type QueueKind int
+
+const (
+	QueueStaged   QueueKind = iota // packets read from the TUN device, awaiting a session
+	QueueOutbound                  // packets being encrypted and sent, in order
+	QueueInbound                   // packets being decrypted and written to the TUN device, in order
+	queueKinds
+)
+
+var queueKindNames = [queueKinds]string{"staged", "outbound", "inbound"}
+
+func (kind QueueKind) String() string {
+	return queueKindNames[kind]
+}
+
+// queuePressureInterval is the least time between a queue recovering from pressure
+// and being reported under pressure again, to bound the rate of reports.
+const queuePressureInterval = time.Second
+
+// A queuePressureHook is what SetQueuePressureHook was last called with.
+type queuePressureHook struct {
+	high, low float64
+	fn        func(peer NoisePublicKey, queue QueueKind, level float64)
+}
+
+// queuePressure is whether a queue of a peer is under pressure.
+type queuePressure struct {
+	sync.Mutex               // held while reporting a change, so that reports are in order
+	pressured     AtomicBool // whether the queue was last reported under pressure
+	lastRecovered time.Time
+}
+
+// SetQueuePressureHook makes the device call hook when one of a peer's queues fills
+// to the fraction high of its capacity, as when the peer's network is slow or the
+// peer is gone, and again when it drains to low or the peer stops, so that the
+// application can slow whatever produces its packets. The level passed is the
+// fraction of the queue's capacity in use. A queue is reported under pressure
+// at most once a second. The hook is called synchronously from the data path
+// and must not block. The checks cost nothing when no hook is set, the default,
+// and little when one is: only a change of state does more than compare the
+// queue's length. A nil hook removes it.
+func (device *Device) SetQueuePressureHook(high, low float64, hook func(peer NoisePublicKey, queue QueueKind, level float64)) {
+	device.queuePressure.Lock()
+	defer device.queuePressure.Unlock()
+	if hook == nil {
+		device.queuePressure.enabled.Set(false)
+		return
+	}
+	device.queuePressure.hook.Store(queuePressureHook{high, low, hook})
+	device.queuePressure.enabled.Set(true)
+}
+
+// checkQueuePressure reports a change in the pressure on the peer's queue of the
+// given kind, now holding length elements of capacity, to the hook, if one is set.
+func (peer *Peer) checkQueuePressure(kind QueueKind, length, capacity int) {
+	if !peer.device.queuePressure.enabled.Get() {
+		return
+	}
+	peer.updateQueuePressure(kind, float64(length)/float64(capacity), false)
+}
+
+// releaseQueuePressure reports the recovery of each of the peer's queues
+// that is under pressure, as when the peer stops.
+func (peer *Peer) releaseQueuePressure() {
+	if !peer.device.queuePressure.enabled.Get() {
+		return
+	}
+	capacities := [queueKinds]int{cap(peer.queue.staged), cap(peer.queue.outbound.c), cap(peer.queue.inbound.c)}
+	lengths := [queueKinds]int{len(peer.queue.staged), len(peer.queue.outbound.c), len(peer.queue.inbound.c)}
+	for kind := QueueKind(0); kind < queueKinds; kind++ {
+		peer.updateQueuePressure(kind, float64(lengths[kind])/float64(capacities[kind]), true)
+	}
+}
+
+func (peer *Peer) updateQueuePressure(kind QueueKind, level float64, release bool) {
+	hook, _ := peer.device.queuePressure.hook.Load().(queuePressureHook)
+	if hook.fn == nil {
+		return
+	}
+	p := &peer.queuePressure[kind]
+	pressured := p.pressured.Get()
+	if pressured == (level >= hook.high) && !(pressured && (level <= hook.low || release)) {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	switch pressured = p.pressured.Get(); {
+	case !pressured && level >= hook.high && !release:
+		if now.Sub(p.lastRecovered) < queuePressureInterval {
+			return
+		}
+	case pressured && (level <= hook.low || release):
+		p.lastRecovered = now
+	default:
+		return
+	}
+	p.pressured.Set(!pressured)
+	hook.fn(peer.handshake.remoteStatic, kind, level)
+}
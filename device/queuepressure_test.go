@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestQueuePressure(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	type event struct {
+		queue QueueKind
+		level float64
+	}
+	events := make(chan event, 16)
+	dev.SetQueuePressureHook(0.75, 0.25, func(_ NoisePublicKey, queue QueueKind, level float64) {
+		events <- event{queue, level}
+	})
+
+	// The peer never answers the handshake, so its packets stay staged.
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerSK, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := peerSK.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"listen_port", "0",
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "127.0.0.1:1",
+		"allowed_ip", "10.0.0.2/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := tuntest.Ping(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))
+	for i := 0; i < QueueStagedSize; i++ {
+		tun.Outbound <- ping
+	}
+	select {
+	case e := <-events:
+		if e.queue != QueueStaged || e.level < 0.75 {
+			t.Errorf("pressure on the %v queue at %v, want the staged queue at 0.75 or more", e.queue, e.level)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pressure reported on the staged queue of a blackholed peer")
+	}
+
+	dev.RemovePeer(pk)
+	select {
+	case e := <-events:
+		if e.queue != QueueStaged || e.level > 0.25 {
+			t.Errorf("recovery of the %v queue at %v, want the staged queue at 0.25 or less", e.queue, e.level)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no recovery reported after removing the peer")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected report for the %v queue at %v", e.queue, e.level)
+	default:
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,6 +22,7 @@ import (
 	"golang.org/x/net/ipv6"
 
 	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
 )
 
 type QueueHandshakeElement struct {
@@ -143,12 +147,14 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			value := device.indexTable.Lookup(receiver)
 			keypair := value.keypair
 			if keypair == nil {
+				device.tracePacket(DirectionInbound, nil, size, TraceDropped, "unknown receiver index")
 				continue
 			}
 
 			// check keypair expiry
 
 			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				device.tracePacket(DirectionInbound, value.peer, size, TraceDropped, "expired keypair")
 				continue
 			}
 
@@ -166,9 +172,11 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			// add to decryption queues
 			if peer.isRunning.Get() {
 				peer.queue.inbound.c <- elem
+				peer.checkQueuePressure(QueueInbound, len(peer.queue.inbound.c), cap(peer.queue.inbound.c))
 				device.queue.decryption.c <- elem
 				buffer = device.GetMessageBuffer()
 			} else {
+				device.tracePacket(DirectionInbound, peer, size, TraceDropped, "peer not running")
 				device.PutInboundElement(elem)
 			}
 			continue
@@ -185,19 +193,17 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			okay = len(packet) == MessageCookieReplySize
 
 		default:
-			device.log.Verbosef("Received message with unknown type")
+			device.limitedVerbosef("Received message with unknown type")
 		}
 
 		if okay {
-			select {
-			case device.queue.handshake.c <- QueueHandshakeElement{
+			if device.queue.handshake.enqueue(QueueHandshakeElement{
 				msgType:  msgType,
 				buffer:   buffer,
 				packet:   packet,
 				endpoint: endpoint,
-			}:
+			}, device.PutMessageBuffer) {
 				buffer = device.GetMessageBuffer()
-			default:
 			}
 		}
 	}
@@ -210,6 +216,8 @@ func (device *Device) RoutineDecryption(id int) {
 	device.log.Verbosef("Routine: decryption worker %d - started", id)
 
 	for elem := range device.queue.decryption.c {
+		device.progress(watchdogDecryption)
+
 		// split message into fields
 		counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
 		content := elem.packet[MessageTransportOffsetContent:]
@@ -242,6 +250,8 @@ func (device *Device) RoutineHandshake(id int) {
 	device.log.Verbosef("Routine: handshake worker %d - started", id)
 
 	for elem := range device.queue.handshake.c {
+		device.progress(watchdogHandshake)
+		var checker *CookieChecker // of the key the message was sent to
 
 		// handle cookie fields and ratelimiting
 
@@ -255,7 +265,7 @@ func (device *Device) RoutineHandshake(id int) {
 			reader := bytes.NewReader(elem.packet)
 			err := binary.Read(reader, binary.LittleEndian, &reply)
 			if err != nil {
-				device.log.Verbosef("Failed to decode cookie reply")
+				device.limitedVerbosef("Failed to decode cookie reply")
 				goto skip
 			}
 
@@ -270,9 +280,9 @@ func (device *Device) RoutineHandshake(id int) {
 			// consume reply
 
 			if peer := entry.peer; peer.isRunning.Get() {
-				device.log.Verbosef("Receiving cookie response from %s", elem.endpoint.DstToString())
+				device.log.Verbosef("Receiving cookie response from %s", logEndpoint{elem.endpoint})
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
-					device.log.Verbosef("Could not decrypt invalid cookie response")
+					device.limitedVerbosef("Could not decrypt invalid cookie response")
 				}
 			}
 
@@ -282,8 +292,9 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
-				device.log.Verbosef("Received packet with invalid mac1")
+			checker = device.macChecker(elem.packet)
+			if checker == nil {
+				device.limitedVerbosef("Received packet with invalid mac1")
 				goto skip
 			}
 
@@ -293,14 +304,14 @@ func (device *Device) RoutineHandshake(id int) {
 
 				// verify MAC2 field
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
-					device.SendHandshakeCookie(&elem)
+				if !checker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+					device.sendHandshakeCookie(&elem, checker)
 					goto skip
 				}
 
 				// check ratelimiter
 
-				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+				if addr, _ := netip.AddrFromSlice(elem.endpoint.DstIP()); !device.rate.limiter.AllowAddr(addr) {
 					goto skip
 				}
 			}
@@ -321,15 +332,15 @@ func (device *Device) RoutineHandshake(id int) {
 			reader := bytes.NewReader(elem.packet)
 			err := binary.Read(reader, binary.LittleEndian, &msg)
 			if err != nil {
-				device.log.Errorf("Failed to decode initiation message")
+				device.limitedErrorf("Failed to decode initiation message")
 				goto skip
 			}
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
+			peer := device.consumeMessageInitiation(&msg, checker != &device.cookieChecker)
 			if peer == nil {
-				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+				device.limitedVerbosef("Received invalid initiation message from %s", logEndpoint{elem.endpoint})
 				goto skip
 			}
 
@@ -341,8 +352,9 @@ func (device *Device) RoutineHandshake(id int) {
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
-			device.log.Verbosef("%v - Received handshake initiation", peer)
+			peer.log.Verbosef("Received handshake initiation")
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 			peer.SendHandshakeResponse()
 
@@ -354,7 +366,7 @@ func (device *Device) RoutineHandshake(id int) {
 			reader := bytes.NewReader(elem.packet)
 			err := binary.Read(reader, binary.LittleEndian, &msg)
 			if err != nil {
-				device.log.Errorf("Failed to decode response message")
+				device.limitedErrorf("Failed to decode response message")
 				goto skip
 			}
 
@@ -362,15 +374,21 @@ func (device *Device) RoutineHandshake(id int) {
 
 			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
-				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
+				device.limitedVerbosef("Received invalid response message from %s", logEndpoint{elem.endpoint})
+				// The response names the handshake it answers, and so the peer.
+				if peer := device.indexTable.Lookup(msg.Receiver).peer; peer != nil {
+					peer.setLastError("invalid handshake response")
+				}
 				goto skip
 			}
 
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
-			device.log.Verbosef("%v - Received handshake response", peer)
+			peer.log.Verbosef("Received handshake response")
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			atomic.AddUint64(&peer.stats.rxPackets, 1)
+			atomic.AddUint64(&peer.stats.handshakeResponses, 1)
 
 			// update timers
 
@@ -382,9 +400,13 @@ func (device *Device) RoutineHandshake(id int) {
 			err = peer.BeginSymmetricSession()
 
 			if err != nil {
-				device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
+				peer.log.Errorf("Failed to derive keypair: %v", err)
+				peer.setLastError(fmt.Sprintf("failed to derive keypair: %v", err))
 				goto skip
 			}
+			if sent := atomic.LoadInt64(&peer.stats.initiationSentNano); sent != 0 {
+				atomic.StoreInt64(&peer.stats.handshakeLatencyNano, time.Now().UnixNano()-sent)
+			}
 
 			peer.timersSessionDerived()
 			peer.timersHandshakeComplete()
@@ -398,25 +420,103 @@ func (device *Device) RoutineHandshake(id int) {
 func (peer *Peer) RoutineSequentialReceiver() {
 	device := peer.device
 	defer func() {
-		device.log.Verbosef("%v - Routine: sequential receiver - stopped", peer)
+		peer.log.Verbosef("Routine: sequential receiver - stopped")
 		peer.stopping.Done()
 	}()
-	device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
+	peer.log.Verbosef("Routine: sequential receiver - started")
+
+	// Packets are written to the TUN device in batches, if it takes them,
+	// of however many have arrived by the time the inbound queue is empty.
+	batchSize := 1
+	batchDevice, isBatch := device.tun.device.(tun.BatchDevice)
+	if isBatch {
+		batchSize = tunBatchSize
+	}
+	pending := make([]*QueueInboundElement, 0, batchSize)
+	bufs := make([][]byte, 0, batchSize)
+	freePending := func() {
+		for i, elem := range pending {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutInboundElement(elem)
+			pending[i], bufs[i] = nil, nil
+		}
+		pending, bufs = pending[:0], bufs[:0]
+	}
+	defer freePending()
+	deadlineDevice, _ := device.tun.device.(tun.WriteDeadlineDevice)
+	writePending := func() {
+		// The deadline is the TUN device's, not the write's, so a write with one
+		// holds writeLock from setting it until done, and SetTUNWriteTimeout
+		// cannot clear it in between.
+		timeout := time.Duration(atomic.LoadInt64(&device.tun.writeTimeout))
+		if timeout > 0 && deadlineDevice != nil {
+			device.tun.writeLock.Lock()
+			if timeout = time.Duration(atomic.LoadInt64(&device.tun.writeTimeout)); timeout > 0 {
+				deadlineDevice.SetWriteDeadline(time.Now().Add(timeout))
+			} else {
+				device.tun.writeLock.Unlock()
+			}
+		}
+		var err error
+		written := 0
+		if isBatch {
+			written, err = batchDevice.WriteBatch(bufs, MessageTransportOffsetContent)
+		} else if _, err = device.tun.device.Write(bufs[0], MessageTransportOffsetContent); err == nil {
+			written = 1
+		}
+		if timeout > 0 && deadlineDevice != nil {
+			device.tun.writeLock.Unlock()
+		}
+		if device.tracing() {
+			reason := "TUN write failed"
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				reason = "TUN write stalled"
+			}
+			for i, buf := range bufs {
+				length := len(buf) - MessageTransportOffsetContent
+				if i < written {
+					device.tracePacket(DirectionInbound, peer, length, TraceSent, "")
+				} else {
+					device.tracePacket(DirectionInbound, peer, length, TraceDropped, reason)
+				}
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			atomic.AddUint64(&device.tun.writeStalls, uint64(len(bufs)-written))
+			device.limitedErrorf("TUN device write stalled for %v, dropped %d packets", timeout, len(bufs)-written)
+		} else if err != nil && !device.isClosed() {
+			device.limitedErrorf("Failed to write packet to TUN device: %v", err)
+		}
+		if len(peer.queue.inbound.c) == 0 {
+			err = device.tun.device.Flush()
+			if err != nil {
+				peer.device.log.Errorf("Unable to flush packets: %v", err)
+			}
+		}
+		freePending()
+	}
 
 	for elem := range peer.queue.inbound.c {
 		if elem == nil {
 			return
 		}
-		var err error
+		peer.checkQueuePressure(QueueInbound, len(peer.queue.inbound.c), cap(peer.queue.inbound.c))
+		device.progress(watchdogTUNWrite)
 		elem.Lock()
 		if elem.packet == nil {
 			// decryption failed
+			device.tracePacket(DirectionInbound, peer, 0, TraceDropped, "decryption failed")
+			peer.setLastError("data packet failed to authenticate")
 			goto skip
 		}
 
 		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+			device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "replayed counter")
 			goto skip
 		}
+		if elem.counter >= atomic.LoadUint64(&elem.keypair.receiveCount) {
+			atomic.StoreUint64(&elem.keypair.receiveCount, elem.counter+1)
+		}
 
 		peer.SetEndpointFromPacket(elem.endpoint)
 		if peer.ReceivedWithKeypair(elem.keypair) {
@@ -428,9 +528,13 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketReceived()
 		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+		atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 		if len(elem.packet) == 0 {
-			device.log.Verbosef("%v - Receiving keepalive packet", peer)
+			peer.log.Verbosef("Receiving keepalive packet")
+			goto skip
+		}
+		if !peer.allowReceive(len(elem.packet) + MinMessageSize) {
 			goto skip
 		}
 		peer.timersDataReceived()
@@ -438,54 +542,65 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		switch elem.packet[0] >> 4 {
 		case ipv4.Version:
 			if len(elem.packet) < ipv4.HeaderLen {
+				device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "truncated IPv4 header")
 				goto skip
 			}
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
 			length := binary.BigEndian.Uint16(field)
 			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+				device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "invalid IPv4 length")
 				goto skip
 			}
 			elem.packet = elem.packet[:length]
 			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
 			if device.allowedips.LookupIPv4(src) != peer {
-				device.log.Verbosef("IPv4 packet with disallowed source address from %v", peer)
+				peer.log.limitedVerbosef("IPv4 packet with disallowed source address")
+				device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "source address not allowed")
+				peer.setLastError("packet from a source address not in allowed IPs")
 				goto skip
 			}
 
 		case ipv6.Version:
 			if len(elem.packet) < ipv6.HeaderLen {
+				device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "truncated IPv6 header")
 				goto skip
 			}
 			field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
 			length := binary.BigEndian.Uint16(field)
 			length += ipv6.HeaderLen
 			if int(length) > len(elem.packet) {
+				device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "invalid IPv6 length")
 				goto skip
 			}
 			elem.packet = elem.packet[:length]
 			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
 			if device.allowedips.LookupIPv6(src) != peer {
-				device.log.Verbosef("IPv6 packet with disallowed source address from %v", peer)
+				peer.log.limitedVerbosef("IPv6 packet with disallowed source address")
+				device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "source address not allowed")
+				peer.setLastError("packet from a source address not in allowed IPs")
 				goto skip
 			}
 
 		default:
-			device.log.Verbosef("Packet with invalid IP version from %v", peer)
+			peer.log.limitedVerbosef("Packet with invalid IP version")
+			device.tracePacket(DirectionInbound, peer, len(elem.packet), TraceDropped, "unknown IP version")
 			goto skip
 		}
 
-		_, err = device.tun.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
-		if err != nil && !device.isClosed() {
-			device.log.Errorf("Failed to write packet to TUN device: %v", err)
-		}
-		if len(peer.queue.inbound.c) == 0 {
-			err = device.tun.device.Flush()
-			if err != nil {
-				peer.device.log.Errorf("Unable to flush packets: %v", err)
-			}
+		if !device.allowPacket(DirectionInbound, peer, elem.packet) {
+			goto skip
 		}
+
+		pending = append(pending, elem)
+		bufs = append(bufs, elem.buffer[:MessageTransportOffsetContent+len(elem.packet)])
+		elem = nil
 	skip:
-		device.PutMessageBuffer(elem.buffer)
-		device.PutInboundElement(elem)
+		if elem != nil {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutInboundElement(elem)
+		}
+		if len(pending) > 0 && (len(pending) == cap(pending) || len(peer.queue.inbound.c) == 0) {
+			writePending()
+		}
 	}
 }
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// A RouteWarning describes a configuration problem that does not stop the device,
+// but is likely to lose traffic.
+type RouteWarning struct {
+	Peer    NoisePublicKey // the peer the warning is about
+	Message string
+}
+
+func (w RouteWarning) String() string {
+	return fmt.Sprintf("peer %x: %s", w.Peer[:], w.Message)
+}
+
+// CheckPeerReturnRoutes warns about each address in expected, which maps peers
+// to the tunnel addresses they are expected to send from, that the device's allowed IPs
+// do not route back to that peer. The device drops packets from such an address,
+// as it drops traffic from a peer whose source is outside the peer's allowed IPs,
+// and sends replies to it elsewhere or nowhere. Since the device cannot know which
+// addresses its peers use, the caller supplies them, for instance from the
+// interface addresses in the configurations it generated for them.
+// Warnings are sorted by peer, then in the order of the peer's addresses.
+func (device *Device) CheckPeerReturnRoutes(expected map[NoisePublicKey][]netip.Addr) []RouteWarning {
+	device.ipcMutex.RLock()
+	defer device.ipcMutex.RUnlock()
+
+	keys := make([]NoisePublicKey, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	var warnings []RouteWarning
+	for _, key := range keys {
+		peer := device.LookupPeer(key)
+		if peer == nil {
+			warnings = append(warnings, RouteWarning{key, "no such peer"})
+			continue
+		}
+		for _, addr := range expected[key] {
+			addr = addr.Unmap()
+			var owner *Peer
+			switch {
+			case addr.Is4():
+				owner = device.allowedips.LookupIPv4(addr.AsSlice())
+			case addr.Is6():
+				owner = device.allowedips.LookupIPv6(addr.AsSlice())
+			default:
+				warnings = append(warnings, RouteWarning{key, fmt.Sprintf("invalid address %v", addr)})
+				continue
+			}
+			switch owner {
+			case peer:
+			case nil:
+				warnings = append(warnings, RouteWarning{key, fmt.Sprintf("%v is not in the peer's allowed IPs", addr)})
+			default:
+				warnings = append(warnings, RouteWarning{key, fmt.Sprintf("%v is routed to %v instead", addr, owner)})
+			}
+		}
+	}
+	return warnings
+}
+
+// A Route is a prefix of the device's allowed IPs, and the peer it routes to.
+type Route struct {
+	Prefix        netip.Prefix
+	PeerPublicKey NoisePublicKey
+}
+
+// RoutingTable returns the routes the device currently has, taken from
+// its allowed IPs, for reconciling them with the routes of the system.
+// Routes are sorted by peer, then in the order of the peer's allowed IPs in UAPI output.
+func (device *Device) RoutingTable() []Route {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	keys := make([]NoisePublicKey, 0, len(device.peers.keyMap))
+	for key := range device.peers.keyMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	var routes []Route
+	for _, key := range keys {
+		device.allowedips.EntriesForPeer(device.peers.keyMap[key], func(ip net.IP, cidr uint) bool {
+			addr, ok := netip.AddrFromSlice(ip)
+			if ok {
+				routes = append(routes, Route{netip.PrefixFrom(addr.Unmap(), int(cidr)), key})
+			}
+			return true
+		})
+	}
+	return routes
+}
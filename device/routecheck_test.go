@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCheckPeerReturnRoutes(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(other[:]), "allowed_ip", "10.0.0.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	var unknown NoisePublicKey
+
+	for _, test := range []struct {
+		name     string
+		expected map[NoisePublicKey][]netip.Addr
+		want     []string // substrings of each warning's message, in order
+	}{
+		{"covered", map[NoisePublicKey][]netip.Addr{pk: {netip.MustParseAddr("1.0.0.2")}}, nil},
+		{"missing /32", map[NoisePublicKey][]netip.Addr{pk: {netip.MustParseAddr("1.0.0.3")}}, []string{"1.0.0.3 is not in the peer's allowed IPs"}},
+		{"missing IPv6", map[NoisePublicKey][]netip.Addr{pk: {netip.MustParseAddr("1.0.0.2"), netip.MustParseAddr("fd00::2")}}, []string{"fd00::2 is not"}},
+		{"other peer", map[NoisePublicKey][]netip.Addr{pk: {netip.MustParseAddr("10.0.0.5")}}, []string{"10.0.0.5 is routed to peer("}},
+		{"unknown peer", map[NoisePublicKey][]netip.Addr{unknown: {netip.MustParseAddr("1.0.0.2")}}, []string{"no such peer"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			warnings := dev.CheckPeerReturnRoutes(test.expected)
+			if len(warnings) != len(test.want) {
+				t.Fatalf("got warnings %v, want %d", warnings, len(test.want))
+			}
+			for i, w := range warnings {
+				if !strings.Contains(w.Message, test.want[i]) {
+					t.Errorf("warning %d = %q, want it to contain %q", i, w.Message, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(other[:]),
+		"allowed_ip", "10.0.0.0/24",
+		"allowed_ip", "fd00::/64",
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[netip.Prefix]NoisePublicKey{
+		netip.MustParsePrefix("1.0.0.2/32"):  pk,
+		netip.MustParsePrefix("10.0.0.0/24"): other,
+		netip.MustParsePrefix("fd00::/64"):   other,
+	}
+	routes := dev.RoutingTable()
+	if len(routes) != len(want) {
+		t.Fatalf("got routes %v, want %d", routes, len(want))
+	}
+	for _, route := range routes {
+		owner, ok := want[route.Prefix]
+		if !ok {
+			t.Errorf("unexpected route to %v", route.Prefix)
+		} else if owner != route.PeerPublicKey {
+			t.Errorf("%v routes to the wrong peer", route.Prefix)
+		}
+	}
+}
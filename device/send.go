@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"sync"
@@ -18,6 +19,8 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+
+	"golang.zx2c4.com/wireguard/tun"
 )
 
 /* Outbound flow
@@ -46,11 +49,12 @@ import (
 
 type QueueOutboundElement struct {
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+	buffer    *[MaxMessageSize]byte // slice holding the packet data
+	packet    []byte                // slice of "buffer" (always!)
+	nonce     uint64                // nonce for encryption
+	keypair   *Keypair              // keypair for encryption
+	peer      *Peer                 // related peer
+	notBefore time.Time             // when a peer's transmit rate limit lets the packet be sent
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -58,6 +62,7 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.buffer = device.GetMessageBuffer()
 	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
+	elem.notBefore = time.Time{}
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -80,7 +85,7 @@ func (peer *Peer) SendKeepalive() {
 		elem := peer.device.NewOutboundElement()
 		select {
 		case peer.queue.staged <- elem:
-			peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
+			peer.log.Verbosef("Sending keepalive packet")
 		default:
 			peer.device.PutMessageBuffer(elem.buffer)
 			peer.device.PutOutboundElement(elem)
@@ -106,14 +111,24 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
+	if wait := peer.handshakeBackoffWait(); wait > 0 {
+		peer.handshake.mutex.Unlock()
+		// Send it when the backoff ends, unless the timer will see to it anyway.
+		if peer.timersActive() && !peer.timers.retransmitHandshake.IsPending() {
+			peer.handshakeBackoff.deferred.Set(true)
+			peer.timers.retransmitHandshake.Mod(wait)
+		}
+		return nil
+	}
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
+	peer.log.Verbosef("Sending handshake initiation")
 
 	msg, err := peer.device.CreateMessageInitiation(peer)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to create initiation message: %v", peer, err)
+		peer.log.Errorf("Failed to create initiation message: %v", err)
+		peer.setLastError(fmt.Sprintf("failed to create handshake initiation: %v", err))
 		return err
 	}
 
@@ -126,9 +141,14 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
+	peer.handshakeBackoff.deferred.Set(false)
+	atomic.StoreInt64(&peer.stats.initiationSentNano, time.Now().UnixNano())
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+		peer.log.Errorf("Failed to send handshake initiation: %v", err)
+		peer.setLastError(fmt.Sprintf("failed to send handshake initiation: %v", err))
+	} else {
+		atomic.AddUint64(&peer.stats.handshakeInitiations, 1)
 	}
 	peer.timersHandshakeInitiated()
 
@@ -140,11 +160,12 @@ func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Verbosef("%v - Sending handshake response", peer)
+	peer.log.Verbosef("Sending handshake response")
 
 	response, err := peer.device.CreateMessageResponse(peer)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to create response message: %v", peer, err)
+		peer.log.Errorf("Failed to create response message: %v", err)
+		peer.setLastError(fmt.Sprintf("failed to create handshake response: %v", err))
 		return err
 	}
 
@@ -156,7 +177,8 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	err = peer.BeginSymmetricSession()
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
+		peer.log.Errorf("Failed to derive keypair: %v", err)
+		peer.setLastError(fmt.Sprintf("failed to derive keypair: %v", err))
 		return err
 	}
 
@@ -166,16 +188,23 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake response: %v", peer, err)
+		peer.log.Errorf("Failed to send handshake response: %v", err)
+		peer.setLastError(fmt.Sprintf("failed to send handshake response: %v", err))
 	}
 	return err
 }
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
-	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
+	return device.sendHandshakeCookie(initiatingElem, &device.cookieChecker)
+}
+
+// sendHandshakeCookie is SendHandshakeCookie with the CookieChecker
+// of the key the handshake message was sent to.
+func (device *Device) sendHandshakeCookie(initiatingElem *QueueHandshakeElement, checker *CookieChecker) error {
+	device.log.Verbosef("Sending cookie response for denied handshake message for %v", logEndpoint{initiatingElem.endpoint})
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
-	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
+	reply, err := checker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
 		device.log.Errorf("Failed to create cookie reply: %v", err)
 		return err
@@ -213,19 +242,44 @@ func (device *Device) RoutineReadFromTUN() {
 
 	device.log.Verbosef("Routine: TUN reader - started")
 
-	var elem *QueueOutboundElement
+	batchSize := 1
+	batchDevice, isBatch := device.tun.device.(tun.BatchDevice)
+	if isBatch {
+		batchSize = tunBatchSize
+	}
+	elems := make([]*QueueOutboundElement, batchSize)
+	bufs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	peers := make(map[*Peer]struct{})
+	defer func() {
+		for _, elem := range elems {
+			if elem != nil {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+		}
+	}()
 
 	for {
-		if elem != nil {
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+		for i, elem := range elems {
+			if elem == nil {
+				elem = device.NewOutboundElement()
+				elems[i] = elem
+			}
+			bufs[i] = elem.buffer[:]
 		}
-		elem = device.NewOutboundElement()
 
-		// read packet
+		// read packets
 
 		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		var n int
+		var err error
+		if isBatch {
+			n, err = batchDevice.ReadBatch(bufs, sizes, offset)
+		} else {
+			sizes[0], err = device.tun.device.Read(bufs[0], offset)
+			n = 1
+		}
 
 		if err != nil {
 			if !device.isClosed() {
@@ -234,59 +288,87 @@ func (device *Device) RoutineReadFromTUN() {
 				}
 				go device.Close()
 			}
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
-			continue
+		for i := 0; i < n; i++ {
+			if peer := device.stagePacketFromTUN(elems[i], offset, sizes[i]); peer != nil {
+				elems[i] = nil
+				peers[peer] = struct{}{}
+			}
+		}
+		for peer := range peers {
+			peer.SendStagedPackets()
+			delete(peers, peer)
 		}
+	}
+}
 
-		elem.packet = elem.buffer[offset : offset+size]
+// stagePacketFromTUN stages the packet of size bytes at offset in elem's buffer
+// for the peer it is routed to, and returns that peer, which then owns elem.
+// It returns nil if the packet is invalid or has nowhere to go.
+func (device *Device) stagePacketFromTUN(elem *QueueOutboundElement, offset, size int) *Peer {
+	if size == 0 || size > MaxContentSize {
+		device.tracePacket(DirectionOutbound, nil, size, TraceDropped, "invalid size")
+		return nil
+	}
 
-		// lookup peer
+	elem.packet = elem.buffer[offset : offset+size]
 
-		var peer *Peer
-		switch elem.packet[0] >> 4 {
-		case ipv4.Version:
-			if len(elem.packet) < ipv4.HeaderLen {
-				continue
-			}
-			dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
-			peer = device.allowedips.LookupIPv4(dst)
+	// lookup peer
 
-		case ipv6.Version:
-			if len(elem.packet) < ipv6.HeaderLen {
-				continue
-			}
-			dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
-			peer = device.allowedips.LookupIPv6(dst)
-
-		default:
-			device.log.Verbosef("Received packet with unknown IP version")
+	var peer *Peer
+	switch elem.packet[0] >> 4 {
+	case ipv4.Version:
+		if len(elem.packet) < ipv4.HeaderLen {
+			device.tracePacket(DirectionOutbound, nil, size, TraceDropped, "truncated IPv4 header")
+			return nil
 		}
+		dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+		peer = device.allowedips.LookupIPv4(dst)
 
-		if peer == nil {
-			continue
-		}
-		if peer.isRunning.Get() {
-			peer.StagePacket(elem)
-			elem = nil
-			peer.SendStagedPackets()
+	case ipv6.Version:
+		if len(elem.packet) < ipv6.HeaderLen {
+			device.tracePacket(DirectionOutbound, nil, size, TraceDropped, "truncated IPv6 header")
+			return nil
 		}
+		dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+		peer = device.allowedips.LookupIPv6(dst)
+
+	default:
+		device.limitedVerbosef("Received packet with unknown IP version")
+		device.tracePacket(DirectionOutbound, nil, size, TraceDropped, "unknown IP version")
+		return nil
+	}
+
+	if peer == nil {
+		device.tracePacket(DirectionOutbound, nil, size, TraceDropped, "no peer for destination")
+		device.rejectNoRoute(elem.packet)
+		return nil
+	}
+	if !peer.isRunning.Get() {
+		device.tracePacket(DirectionOutbound, peer, size, TraceDropped, "peer not running")
+		return nil
+	}
+	if !device.allowPacket(DirectionOutbound, peer, elem.packet) {
+		return nil
 	}
+	device.tracePacket(DirectionOutbound, peer, size, TraceStaged, "")
+	peer.StagePacket(elem)
+	return peer
 }
 
 func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
 	for {
 		select {
 		case peer.queue.staged <- elem:
+			peer.checkQueuePressure(QueueStaged, len(peer.queue.staged), cap(peer.queue.staged))
 			return
 		default:
 		}
 		select {
 		case tooOld := <-peer.queue.staged:
+			peer.device.tracePacket(DirectionOutbound, peer, len(tooOld.packet), TraceDropped, "staged queue full")
 			peer.device.PutMessageBuffer(tooOld.buffer)
 			peer.device.PutOutboundElement(tooOld)
 		default:
@@ -295,6 +377,8 @@ func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
 }
 
 func (peer *Peer) SendStagedPackets() {
+	peer.queue.Lock()
+	defer peer.queue.Unlock()
 top:
 	if len(peer.queue.staged) == 0 || !peer.device.isUp() {
 		return
@@ -307,6 +391,17 @@ top:
 	}
 
 	for {
+		// A full sequential queue means the peer's sender is behind. Rather than wait
+		// for it, which would hold up reading from the TUN device for every other peer,
+		// leave the packets staged; the sender sends them on as it catches up.
+		if len(peer.queue.outbound.c) >= cap(peer.queue.outbound.c) {
+			peer.queue.outboundFull.Set(true)
+			if len(peer.queue.outbound.c) >= cap(peer.queue.outbound.c) {
+				peer.checkQueuePressure(QueueStaged, len(peer.queue.staged), cap(peer.queue.staged))
+				return
+			}
+		}
+
 		select {
 		case elem := <-peer.queue.staged:
 			elem.peer = peer
@@ -316,19 +411,43 @@ top:
 				peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
 				goto top
 			}
+			if len(elem.packet) != 0 {
+				// Take the rate limit's tokens as the packet is queued, rather than sent,
+				// so that its wait counts those held ahead of it.
+				size := MessageTransportSize + len(elem.packet) + calculatePaddingSize(len(elem.packet), int(atomic.LoadInt32(&peer.device.tun.mtu)))
+				notBefore, ok := peer.allowTransmit(size)
+				if !ok {
+					peer.device.PutMessageBuffer(elem.buffer)
+					peer.device.PutOutboundElement(elem)
+					continue
+				}
+				elem.notBefore = notBefore
+			}
 
 			elem.keypair = keypair
 			elem.Lock()
 
-			// add to parallel and sequential queue
-			if peer.isRunning.Get() {
-				peer.queue.outbound.c <- elem
+			// Add to the sequential queue, which keeps the peer's packets in order
+			// while the encryption workers seal them in parallel, then to the parallel one.
+			// Only Stop adds to the sequential queue other than here, with the peer
+			// no longer running, so there is room for the packet unless it is stopping.
+			if !peer.isRunning.Get() {
+				peer.device.tracePacket(DirectionOutbound, peer, len(elem.packet), TraceDropped, "peer not running")
+				peer.device.PutMessageBuffer(elem.buffer)
+				peer.device.PutOutboundElement(elem)
+				continue
+			}
+			select {
+			case peer.queue.outbound.c <- elem:
+				peer.checkQueuePressure(QueueOutbound, len(peer.queue.outbound.c), cap(peer.queue.outbound.c))
 				peer.device.queue.encryption.c <- elem
-			} else {
+			default:
+				peer.device.tracePacket(DirectionOutbound, peer, len(elem.packet), TraceDropped, "peer not running")
 				peer.device.PutMessageBuffer(elem.buffer)
 				peer.device.PutOutboundElement(elem)
 			}
 		default:
+			peer.checkQueuePressure(QueueStaged, len(peer.queue.staged), cap(peer.queue.staged))
 			return
 		}
 	}
@@ -341,6 +460,7 @@ func (peer *Peer) FlushStagedPackets() {
 			peer.device.PutMessageBuffer(elem.buffer)
 			peer.device.PutOutboundElement(elem)
 		default:
+			peer.checkQueuePressure(QueueStaged, len(peer.queue.staged), cap(peer.queue.staged))
 			return
 		}
 	}
@@ -374,6 +494,8 @@ func (device *Device) RoutineEncryption(id int) {
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
 	for elem := range device.queue.encryption.c {
+		device.progress(watchdogEncryption)
+
 		// populate header fields
 		header := elem.buffer[:MessageTransportHeaderSize]
 
@@ -410,15 +532,20 @@ func (device *Device) RoutineEncryption(id int) {
 func (peer *Peer) RoutineSequentialSender() {
 	device := peer.device
 	defer func() {
-		defer device.log.Verbosef("%v - Routine: sequential sender - stopped", peer)
+		defer peer.log.Verbosef("Routine: sequential sender - stopped")
 		peer.stopping.Done()
 	}()
-	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
+	peer.log.Verbosef("Routine: sequential sender - started")
 
 	for elem := range peer.queue.outbound.c {
 		if elem == nil {
 			return
 		}
+		peer.checkQueuePressure(QueueOutbound, len(peer.queue.outbound.c), cap(peer.queue.outbound.c))
+		if peer.queue.outboundFull.Swap(false) {
+			peer.SendStagedPackets()
+		}
+		device.progress(watchdogSend)
 		elem.Lock()
 		if !peer.isRunning.Get() {
 			// peer has been stopped; return re-usable elems to the shared pool.
@@ -431,6 +558,9 @@ func (peer *Peer) RoutineSequentialSender() {
 			device.PutOutboundElement(elem)
 			continue
 		}
+		if wait := time.Until(elem.notBefore); wait > 0 {
+			time.Sleep(wait)
+		}
 
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketSent()
@@ -441,12 +571,15 @@ func (peer *Peer) RoutineSequentialSender() {
 		if len(elem.packet) != MessageKeepaliveSize {
 			peer.timersDataSent()
 		}
+		length := len(elem.packet)
 		device.PutMessageBuffer(elem.buffer)
 		device.PutOutboundElement(elem)
 		if err != nil {
-			device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
+			device.tracePacket(DirectionOutbound, peer, length, TraceDropped, "send failed")
+			peer.log.limitedErrorf("Failed to send data packet: %v", err)
 			continue
 		}
+		device.tracePacket(DirectionOutbound, peer, length, TraceSent, "")
 
 		peer.keepKeyFreshSending()
 	}
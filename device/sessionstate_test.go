@@ -0,0 +1,178 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tai64n"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// A sessionKind is whether a peer has a session, and whether it is replacing it.
+type sessionKind int
+
+const (
+	sessionNone        sessionKind = iota // no session packets can be sent with
+	sessionEstablished                    // a session, and no handshake under way
+	sessionRekeying                       // a session, and a handshake under way to replace it
+)
+
+func (k sessionKind) String() string {
+	return [...]string{"none", "established", "rekeying"}[k]
+}
+
+// A sessionState is a snapshot of a peer's session, for tests to assert on.
+type sessionState struct {
+	kind          sessionKind
+	age           time.Duration // since the current keypair was created
+	sendNonce     uint64        // of the current keypair
+	lastHandshake time.Time
+}
+
+// peerSessionState returns the state of the session with the peer with public key pk.
+// A session whose keypair has reached RejectAfterTime or RejectAfterMessages is
+// taken to be none, as packets can no longer be sent with it.
+func (device *Device) peerSessionState(pk NoisePublicKey) (state sessionState) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return state
+	}
+	if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+		state.lastHandshake = time.Unix(0, nano)
+	}
+
+	peer.keypairs.RLock()
+	current, next := peer.keypairs.current, peer.keypairs.loadNext()
+	peer.keypairs.RUnlock()
+	if current == nil {
+		return state
+	}
+	state.age = time.Since(current.created)
+	state.sendNonce = atomic.LoadUint64(&current.sendNonce)
+	if state.age >= RejectAfterTime || state.sendNonce >= RejectAfterMessages {
+		return state
+	}
+
+	peer.handshake.mutex.RLock()
+	handshaking := peer.handshake.state != handshakeZeroed
+	peer.handshake.mutex.RUnlock()
+	state.kind = sessionEstablished
+	if handshaking || next != nil {
+		state.kind = sessionRekeying
+	}
+	return state
+}
+
+// ageSession makes the peer's current session look as if it had been created
+// age ago. Rather than set the time on the keypair, which the sequential sender
+// may still be reading, it replaces the keypair with an aged copy.
+func ageSession(peer *Peer, age time.Duration) {
+	peer.keypairs.Lock()
+	defer peer.keypairs.Unlock()
+	aged := *peer.keypairs.current
+	aged.created = time.Now().Add(-age)
+	peer.keypairs.current = &aged
+}
+
+// cutBind drops the handshake initiations sent through it while it is cut,
+// as a link that is down would, and counts them.
+type cutBind struct {
+	conn.Bind
+	cut     AtomicBool
+	dropped uint32 // initiations dropped, accessed atomically
+}
+
+func (b *cutBind) Send(buf []byte, ep conn.Endpoint) error {
+	if b.cut.Get() {
+		if len(buf) > 0 && buf[0] == MessageInitiationType {
+			atomic.AddUint32(&b.dropped, 1)
+		}
+		return nil
+	}
+	return b.Bind.Send(buf, ep)
+}
+
+// TestSessionStateRekey follows the session of the initiator of a pair through
+// a rekey: once its session is older than RekeyAfterTime, sending on it starts
+// a handshake, which completes when the responder can answer it.
+func TestSessionStateRekey(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	cut := &cutBind{Bind: binds[1]}
+	binds[1] = cut
+	pair := genTestPairWithBinds(t, binds, nil)
+	pk0 := pair[0].dev.staticIdentity.publicKey
+	if state := pair[1].dev.peerSessionState(pk0); state.kind != sessionNone {
+		t.Fatalf("before any traffic, state = %v, want none", state.kind)
+	}
+	pair.Send(t, Ping, nil)
+	first := pair[1].dev.peerSessionState(pk0)
+	if first.kind != sessionEstablished || first.lastHandshake.IsZero() || first.sendNonce != 1 {
+		t.Fatalf("after a ping, state = %+v, want established with one message sent", first)
+	}
+
+	// Cut the initiator off, so that the rekey is not answered, and age its
+	// session past RekeyAfterTime. Dropped as it is sent, the initiation cannot
+	// reach the responder later, and make the one retried look like a replay.
+	cut.cut.Set(true)
+	peer := pair[1].dev.LookupPeer(pk0)
+	ageSession(peer, RekeyAfterTime+time.Second)
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitFor := func(ok func() bool) bool {
+		for deadline := time.Now().Add(5 * time.Second); !ok(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				return false
+			}
+		}
+		return true
+	}
+	waitForState := func(want sessionKind, ok func(sessionState) bool) (state sessionState) {
+		t.Helper()
+		if !waitFor(func() bool {
+			state = pair[1].dev.peerSessionState(pk0)
+			return state.kind == want && ok(state)
+		}) {
+			t.Fatalf("state = %+v, want %v", state, want)
+		}
+		return state
+	}
+	rekeying := waitForState(sessionRekeying, func(s sessionState) bool { return true })
+	if rekeying.age < RekeyAfterTime || !rekeying.lastHandshake.Equal(first.lastHandshake) {
+		t.Errorf("while rekeying, state = %+v, want the old session", rekeying)
+	}
+	if !waitFor(func() bool { return atomic.LoadUint32(&cut.dropped) != 0 }) {
+		t.Fatal("no handshake initiation was sent")
+	}
+
+	// Reconnect the initiator, and have the retransmit timer retry the initiation now
+	// rather than after RekeyTimeout. The responder takes an initiation for a replay
+	// if its coarse stamp is no later than that of the last it accepted, or for
+	// a flood if it comes within HandshakeInitationRate of it, so first wait those out.
+	cut.cut.Set(false)
+	responder := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	waitFor(func() bool {
+		responder.handshake.mutex.RLock()
+		defer responder.handshake.mutex.RUnlock()
+		return tai64n.Now().After(responder.handshake.lastTimestamp) &&
+			time.Since(responder.handshake.lastInitiationConsumption) > HandshakeInitationRate
+	})
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	peer.timers.retransmitHandshake.Mod(0)
+	rekeyed := waitForState(sessionEstablished, func(s sessionState) bool { return s.lastHandshake.After(first.lastHandshake) })
+	if rekeyed.age >= RekeyAfterTime {
+		t.Errorf("after the rekey, state = %+v, want a new session", rekeyed)
+	}
+	pair.Send(t, Ping, nil)
+}
@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// A PeerStatus is a snapshot of a peer's traffic counters.
+type PeerStatus struct {
+	PublicKey     NoisePublicKey
+	RxBytes       uint64    // bytes received from the peer
+	TxBytes       uint64    // bytes sent to the peer
+	RxPackets     uint64    // messages received from the peer, counted in RxBytes
+	TxPackets     uint64    // messages sent to the peer, counted in TxBytes
+	LastHandshake time.Time // zero if there has been no handshake
+	Filtered      uint64    // packets to or from the peer dropped by the packet filter
+	RateLimited   uint64    // packets to or from the peer dropped by its rate limit
+	PathMTU       int       // the MTU of packets the path to the peer carries, as from PeerPathMTU
+	LastError     string    // why the peer last failed to connect or to pass a packet, or empty if it has not
+	LastErrorTime time.Time // when; zero if LastError is empty
+
+	HandshakeInitiations uint64        // handshake initiations sent to the peer
+	HandshakeResponses   uint64        // handshake responses received from the peer
+	Handshakes           uint64        // handshakes completed, as initiator or responder
+	HandshakeFailures    uint64        // initiations unanswered since the last completed handshake
+	HandshakeLatency     time.Duration // from sending the last answered initiation to deriving its keypair; zero if none
+	HandshakeBackoff     time.Duration // the wait between initiations the peer is backed off to, as by SetHandshakeBackoff; zero if none
+	HandshakeBackoffEnds time.Time     // when the next initiation may be sent; zero if the peer is not backed off
+
+	// When the peer's keypairs were created, or zero for those it does not have.
+	// The current keypair is the one packets are sent with, the previous one
+	// is kept for packets still in flight, and the next one awaits confirmation
+	// from the initiator of the handshake that derived it.
+	CurrentKeypairCreated  time.Time
+	PreviousKeypairCreated time.Time
+	NextKeypairCreated     time.Time
+	CurrentKeypairExpires  time.Time // when the current keypair reaches RejectAfterTime
+
+	// The message counters of the current keypair: the number of messages sent with it,
+	// and one more than the highest counter received with it. Either is rejected
+	// at RejectAfterMessages, so the headroom left is RejectAfterMessages minus it.
+	SendCounter    uint64
+	ReceiveCounter uint64
+}
+
+// PeerStatuses returns a snapshot of the counters of each peer, sorted by public key.
+func (device *Device) PeerStatuses() []PeerStatus {
+	device.peers.RLock()
+	statuses := make([]PeerStatus, 0, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		status := PeerStatus{
+			PublicKey:   key,
+			RxBytes:     atomic.LoadUint64(&peer.stats.rxBytes),
+			TxBytes:     atomic.LoadUint64(&peer.stats.txBytes),
+			RxPackets:   atomic.LoadUint64(&peer.stats.rxPackets),
+			TxPackets:   atomic.LoadUint64(&peer.stats.txPackets),
+			Filtered:    atomic.LoadUint64(&peer.stats.filtered),
+			RateLimited: atomic.LoadUint64(&peer.stats.rateLimited),
+			PathMTU:     peer.pathMTU(),
+
+			HandshakeInitiations: atomic.LoadUint64(&peer.stats.handshakeInitiations),
+			HandshakeResponses:   atomic.LoadUint64(&peer.stats.handshakeResponses),
+			Handshakes:           atomic.LoadUint64(&peer.stats.handshakes),
+			HandshakeFailures:    atomic.LoadUint64(&peer.stats.handshakeFailures),
+			HandshakeLatency:     time.Duration(atomic.LoadInt64(&peer.stats.handshakeLatencyNano)),
+		}
+		peer.keypairs.RLock()
+		if current := peer.keypairs.current; current != nil {
+			status.CurrentKeypairCreated = current.created
+			status.CurrentKeypairExpires = current.created.Add(RejectAfterTime)
+			status.SendCounter = atomic.LoadUint64(&current.sendNonce)
+			status.ReceiveCounter = atomic.LoadUint64(&current.receiveCount)
+		}
+		if previous := peer.keypairs.previous; previous != nil {
+			status.PreviousKeypairCreated = previous.created
+		}
+		if next := peer.keypairs.loadNext(); next != nil {
+			status.NextKeypairCreated = next.created
+		}
+		peer.keypairs.RUnlock()
+		if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+			status.LastHandshake = time.Unix(0, nano)
+		}
+		peer.handshakeBackoff.Lock()
+		status.HandshakeBackoff, status.HandshakeBackoffEnds = peer.handshakeBackoff.delay, peer.handshakeBackoff.until
+		peer.handshakeBackoff.Unlock()
+		peer.lastError.Lock()
+		status.LastError, status.LastErrorTime = peer.lastError.err, peer.lastError.at
+		peer.lastError.Unlock()
+		statuses = append(statuses, status)
+	}
+	device.peers.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return bytes.Compare(statuses[i].PublicKey[:], statuses[j].PublicKey[:]) < 0
+	})
+	return statuses
+}
+
+// setLastError records err as why the peer last failed,
+// as a handshake timing out or a packet failing to authenticate.
+func (peer *Peer) setLastError(err string) {
+	peer.lastError.Lock()
+	peer.lastError.err = err
+	peer.lastError.at = time.Now()
+	peer.lastError.Unlock()
+}
+
+// A PeerRate is the throughput of a peer between two PeerStatus snapshots.
+type PeerRate struct {
+	PublicKey       NoisePublicKey
+	RxBitsPerSecond float64
+	TxBitsPerSecond float64
+}
+
+// RateBetween returns the throughput of each peer in cur since prev, taken interval
+// earlier, in the order of cur. A counter that went backwards, as when the peer was
+// removed and added again, is taken to have restarted from zero, as is the counter
+// of a peer that is not in prev. It returns nil if interval is not positive.
+func RateBetween(prev, cur []PeerStatus, interval time.Duration) []PeerRate {
+	if interval <= 0 {
+		return nil
+	}
+	before := make(map[NoisePublicKey]PeerStatus, len(prev))
+	for _, status := range prev {
+		before[status.PublicKey] = status
+	}
+	rate := func(prev, cur uint64) float64 {
+		if cur < prev {
+			prev = 0
+		}
+		return float64(cur-prev) * 8 / interval.Seconds()
+	}
+	rates := make([]PeerRate, len(cur))
+	for i, status := range cur {
+		old := before[status.PublicKey]
+		rates[i] = PeerRate{
+			PublicKey:       status.PublicKey,
+			RxBitsPerSecond: rate(old.RxBytes, status.RxBytes),
+			TxBitsPerSecond: rate(old.TxBytes, status.TxBytes),
+		}
+	}
+	return rates
+}
@@ -0,0 +1,206 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestRateBetween(t *testing.T) {
+	a, b, c := NoisePublicKey{1}, NoisePublicKey{2}, NoisePublicKey{3}
+	prev := []PeerStatus{
+		{PublicKey: a, RxBytes: 1000, TxBytes: 2000},
+		{PublicKey: b, RxBytes: 5000, TxBytes: 5000},
+	}
+	cur := []PeerStatus{
+		{PublicKey: a, RxBytes: 2000, TxBytes: 2000}, // normal deltas
+		{PublicKey: b, RxBytes: 0, TxBytes: 500},     // reset, then some traffic
+		{PublicKey: c, RxBytes: 250, TxBytes: 0},     // new peer
+	}
+	want := []PeerRate{
+		{a, 4000, 0},
+		{b, 0, 2000},
+		{c, 1000, 0},
+	}
+	got := RateBetween(prev, cur, 2*time.Second)
+	if len(got) != len(want) {
+		t.Fatalf("got %d rates, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rate %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := RateBetween(prev, cur, 0); got != nil {
+		t.Errorf("rates over a zero interval = %+v, want nil", got)
+	}
+}
+
+func TestPeerStatuses(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	statuses := pair[0].dev.PeerStatuses()
+	if len(statuses) != 1 {
+		t.Fatalf("got %d statuses, want 1", len(statuses))
+	}
+	status := statuses[0]
+	if status.PublicKey != pair[1].dev.staticIdentity.publicKey {
+		t.Error("status is for the wrong peer")
+	}
+	if status.TxBytes == 0 || status.RxBytes == 0 || status.LastHandshake.IsZero() {
+		t.Errorf("after a ping, got %+v, want traffic both ways and a handshake", status)
+	}
+}
+
+// TestHandshakeStats loses the first handshake initiation of a pair of devices,
+// and checks the handshake counters once the retransmission gets through.
+func TestHandshakeStats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a handshake retransmission")
+	}
+	binds := bindtest.NewChannelBinds()
+	impaired := bindtest.NewImpairedBind(binds[1], bindtest.Impairment{
+		Seed: 165, // drops the first packet, then the next six get through
+		Drop: 0.5,
+	})
+	binds[1] = impaired
+	pair := genTestPairWithBinds(t, binds, nil)
+
+	// Device 1 initiates the handshake, and keeps the ping staged until it completes.
+	start := time.Now()
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	select {
+	case <-pair[0].tun.Inbound:
+	case <-time.After(2 * RekeyTimeout):
+		t.Fatalf("ping did not transit: %+v", impaired.Stats())
+	}
+	if stats := impaired.Stats(); stats.Dropped != 1 {
+		t.Fatalf("lost %d packets, want 1", stats.Dropped)
+	}
+
+	initiator := pair[1].dev.PeerStatuses()[0]
+	if initiator.HandshakeInitiations != 2 || initiator.HandshakeResponses != 1 || initiator.Handshakes != 1 {
+		t.Errorf("initiator sent %d initiations, received %d responses and completed %d handshakes, want 2, 1 and 1",
+			initiator.HandshakeInitiations, initiator.HandshakeResponses, initiator.Handshakes)
+	}
+	if initiator.HandshakeFailures != 0 {
+		t.Errorf("initiator has %d consecutive failures after completing a handshake", initiator.HandshakeFailures)
+	}
+	// The latency is that of the retransmission, not of the lost initiation.
+	if latency := initiator.HandshakeLatency; latency <= 0 || latency >= time.Since(start)-RekeyTimeout {
+		t.Errorf("initiator handshake latency = %v, want less than the retransmission took", latency)
+	}
+
+	responder := pair[0].dev.PeerStatuses()[0]
+	if responder.HandshakeInitiations != 0 || responder.HandshakeResponses != 0 || responder.Handshakes != 1 || responder.HandshakeLatency != 0 {
+		t.Errorf("responder handshake stats = %+v, want only one completed handshake", responder)
+	}
+}
+
+// TestPeerLastError checks that a peer whose endpoint never answers
+// reports the handshake timing out as its last error.
+func TestPeerLastError(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a handshake retransmission")
+	}
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerSK, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := peerSK.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"private_key", hex.EncodeToString(sk[:]),
+		"listen_port", "0",
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "127.0.0.1:1",
+		"allowed_ip", "10.0.0.2/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if status := dev.PeerStatuses()[0]; status.LastError != "" || !status.LastErrorTime.IsZero() {
+		t.Fatalf("new peer has last error %q at %v", status.LastError, status.LastErrorTime)
+	}
+
+	start := time.Now()
+	tun.Outbound <- tuntest.Ping(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))
+	var status PeerStatus
+	for deadline := time.Now().Add(2 * RekeyTimeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if status = dev.PeerStatuses()[0]; status.LastError != "" {
+			break
+		}
+	}
+	if !strings.HasPrefix(status.LastError, "handshake did not complete") {
+		t.Fatalf("last error = %q, want a handshake timeout", status.LastError)
+	}
+	if status.LastErrorTime.Before(start.Add(RekeyTimeout)) {
+		t.Errorf("last error at %v, before the handshake could time out", status.LastErrorTime.Sub(start))
+	}
+}
+
+// TestKeypairStats checks the keypair times and counters of a peer,
+// and that they move on to the new keypair when the initiator rekeys.
+func TestKeypairStats(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// dev1 sent the first ping, so it initiated the handshake and is the one to rekey.
+	before := pair[1].dev.PeerStatuses()[0]
+	if before.CurrentKeypairCreated.IsZero() || !before.PreviousKeypairCreated.IsZero() || !before.NextKeypairCreated.IsZero() {
+		t.Fatalf("after the first handshake, keypairs created at %v, %v and %v, want only a current one",
+			before.CurrentKeypairCreated, before.PreviousKeypairCreated, before.NextKeypairCreated)
+	}
+	if want := before.CurrentKeypairCreated.Add(RejectAfterTime); !before.CurrentKeypairExpires.Equal(want) {
+		t.Errorf("CurrentKeypairExpires = %v, want %v", before.CurrentKeypairExpires, want)
+	}
+	if before.SendCounter != 1 || before.ReceiveCounter != 1 {
+		t.Errorf("SendCounter, ReceiveCounter = %d, %d, want 1, 1", before.SendCounter, before.ReceiveCounter)
+	}
+
+	// Force a rekey, as in TestRekeyAfterMessages.
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	old := peer.keypairs.Current()
+	atomic.StoreUint64(&old.sendNonce, RekeyAfterMessages+1)
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-RekeyTimeout)
+	peer.handshake.mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	pair.Send(t, Ping, nil)
+	for deadline := time.Now().Add(5 * time.Second); peer.keypairs.Current() == old; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a new keypair")
+		}
+	}
+
+	after := pair[1].dev.PeerStatuses()[0]
+	if !after.CurrentKeypairCreated.After(before.CurrentKeypairCreated) {
+		t.Errorf("current keypair created at %v after the rekey, want after %v", after.CurrentKeypairCreated, before.CurrentKeypairCreated)
+	}
+	if !after.PreviousKeypairCreated.Equal(before.CurrentKeypairCreated) {
+		t.Errorf("previous keypair created at %v, want the time of the old current one, %v", after.PreviousKeypairCreated, before.CurrentKeypairCreated)
+	}
+	if after.SendCounter >= RekeyAfterMessages {
+		t.Errorf("SendCounter = %d, want that of the new keypair", after.SendCounter)
+	}
+}
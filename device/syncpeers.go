@@ -0,0 +1,179 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// A PeerConfig is the configuration SyncPeers gives a peer.
+type PeerConfig struct {
+	PublicKey           NoisePublicKey
+	PresharedKey        NoisePresharedKey
+	Endpoint            string // as for the endpoint UAPI key; empty leaves the endpoint alone
+	StickyEndpoint      bool   // keep Endpoint rather than roam to wherever packets come from
+	PersistentKeepalive uint16 // in seconds; 0 turns it off, as does the peer having no endpoint
+	AllowedIPs          []netip.Prefix
+}
+
+// A SyncResult lists the peers SyncPeers added, removed and updated, by public key.
+type SyncResult struct {
+	Added   []NoisePublicKey
+	Removed []NoisePublicKey
+	Updated []NoisePublicKey
+}
+
+// SyncPeers makes the device's peers those in desired, changing only what differs:
+// it adds the peers it does not have, removes those not in desired, and updates
+// those whose configuration differs. It leaves other peers alone, so their sessions
+// carry on, as do those of the peers it updates. The changes are made as one
+// IPC operation, so no other configuration is interleaved with them, but like any
+// IPC operation they stop at the first error, leaving the changes so far in place.
+// A peer with no endpoint, configured or learned, gets no persistent keepalive
+// until a later sync finds it has one.
+func (device *Device) SyncPeers(desired []PeerConfig) (SyncResult, error) {
+	var result SyncResult
+	want := make(map[NoisePublicKey]*PeerConfig, len(desired))
+	for i := range desired {
+		cfg := &desired[i]
+		if want[cfg.PublicKey] != nil {
+			return result, fmt.Errorf("duplicate peer %x", cfg.PublicKey[:])
+		}
+		want[cfg.PublicKey] = cfg
+	}
+
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	// Endpoints are compared as the bind formats them.
+	endpoints := make([]string, len(desired))
+	device.net.RLock()
+	for i := range desired {
+		if desired[i].Endpoint == "" {
+			continue
+		}
+		if endpoint, err := device.net.bind.ParseEndpoint(desired[i].Endpoint); err == nil {
+			endpoints[i] = endpoint.DstToString()
+		}
+	}
+	device.net.RUnlock()
+
+	var b strings.Builder
+	device.peers.RLock()
+	for key := range device.peers.keyMap {
+		if want[key] == nil {
+			result.Removed = append(result.Removed, key)
+		}
+	}
+	for i := range desired {
+		cfg := &desired[i]
+		peer := device.peers.keyMap[cfg.PublicKey]
+		if cfg.PersistentKeepalive != 0 && cfg.Endpoint == "" && !peer.hasEndpoint() {
+			// A keepalive needs an endpoint to go to; without one, it only starts
+			// handshakes that cannot be sent. Leave it off until the peer connects.
+			noKeepalive := *cfg
+			noKeepalive.PersistentKeepalive = 0
+			cfg = &noKeepalive
+		}
+		if peer == nil {
+			result.Added = append(result.Added, cfg.PublicKey)
+			cfg.writeUAPI(&b, true, true, true, true)
+			continue
+		}
+		psk, endpoint, keepalive, allowedIPs := device.peerDiffers(peer, cfg, endpoints[i])
+		if psk || endpoint || keepalive || allowedIPs {
+			result.Updated = append(result.Updated, cfg.PublicKey)
+			cfg.writeUAPI(&b, psk, endpoint, keepalive, allowedIPs)
+		}
+	}
+	device.peers.RUnlock()
+	for _, key := range result.Removed {
+		fmt.Fprintf(&b, "public_key=%x\nremove=true\n", key[:])
+	}
+
+	for _, keys := range [][]NoisePublicKey{result.Added, result.Removed, result.Updated} {
+		sort.Slice(keys, func(i, j int) bool {
+			return string(keys[i][:]) < string(keys[j][:])
+		})
+	}
+	if b.Len() == 0 {
+		return result, nil
+	}
+	return result, device.ipcSetLocked(strings.NewReader(b.String()))
+}
+
+// peerDiffers reports which parts of peer's configuration differ from cfg,
+// whose endpoint, as the bind formats it, is wantEndpoint. The endpoint differs
+// if its stickiness does; otherwise, one that cfg leaves alone never differs,
+// and one that does not parse always does, so that setting it reports the error.
+func (device *Device) peerDiffers(peer *Peer, cfg *PeerConfig, wantEndpoint string) (psk, endpoint, keepalive, allowedIPs bool) {
+	peer.handshake.mutex.RLock()
+	psk = subtle.ConstantTimeCompare(peer.handshake.presharedKey[:], cfg.PresharedKey[:]) != 1
+	peer.handshake.mutex.RUnlock()
+
+	peer.RLock()
+	if cfg.Endpoint != "" {
+		endpoint = wantEndpoint == "" || peer.endpoint == nil || peer.endpoint.DstToString() != wantEndpoint
+	}
+	endpoint = endpoint || peer.stickyEndpoint != cfg.StickyEndpoint
+	peer.RUnlock()
+
+	keepalive = atomic.LoadUint32(&peer.persistentKeepaliveInterval) != uint32(device.persistentKeepalive(cfg.PersistentKeepalive))
+
+	want := make(map[netip.Prefix]bool, len(cfg.AllowedIPs))
+	for _, prefix := range cfg.AllowedIPs {
+		want[prefix.Masked()] = true
+	}
+	have := 0
+	device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+		addr, _ := netip.AddrFromSlice(ip)
+		have++
+		allowedIPs = !want[netip.PrefixFrom(addr.Unmap(), int(cidr))]
+		return !allowedIPs
+	})
+	allowedIPs = allowedIPs || have != len(want)
+	return
+}
+
+// hasEndpoint reports whether peer, if not nil, has an endpoint to send to,
+// whether configured or learned from the packets it sent.
+func (peer *Peer) hasEndpoint() bool {
+	if peer == nil {
+		return false
+	}
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.endpoint != nil
+}
+
+// writeUAPI writes the UAPI lines that set the given parts of cfg's peer.
+func (cfg *PeerConfig) writeUAPI(b *strings.Builder, psk, endpoint, keepalive, allowedIPs bool) {
+	fmt.Fprintf(b, "public_key=%x\n", cfg.PublicKey[:])
+	if psk {
+		fmt.Fprintf(b, "preshared_key=%x\n", cfg.PresharedKey[:])
+	}
+	if endpoint {
+		if cfg.Endpoint != "" {
+			fmt.Fprintf(b, "endpoint=%s\n", cfg.Endpoint)
+		}
+		fmt.Fprintf(b, "sticky_endpoint=%t\n", cfg.StickyEndpoint)
+	}
+	if keepalive {
+		fmt.Fprintf(b, "persistent_keepalive_interval=%d\n", cfg.PersistentKeepalive)
+	}
+	if allowedIPs {
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, prefix := range cfg.AllowedIPs {
+			fmt.Fprintf(b, "allowed_ip=%v\n", prefix.Masked())
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestSyncPeers(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	var keys [4]NoisePublicKey
+	for i := range keys {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = sk.publicKey()
+	}
+	prefix := netip.MustParsePrefix
+	peers := []PeerConfig{
+		{PublicKey: keys[0], Endpoint: "127.0.0.1:1000", AllowedIPs: []netip.Prefix{prefix("10.0.0.1/32")}},
+		{PublicKey: keys[1], Endpoint: "127.0.0.1:1001", AllowedIPs: []netip.Prefix{prefix("10.0.0.2/32")}},
+		{PublicKey: keys[2], PersistentKeepalive: 25, AllowedIPs: []netip.Prefix{prefix("10.0.0.3/32")}},
+	}
+	result, err := dev.SyncPeers(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SyncResult{Added: sortedKeys(keys[:3]...)}); !reflect.DeepEqual(result, want) {
+		t.Errorf("first sync = %+v, want %+v", result, want)
+	}
+	before := make(map[NoisePublicKey]*Peer)
+	for _, key := range keys[:3] {
+		before[key] = dev.LookupPeer(key)
+	}
+
+	// Keep peer 0 as it is, give peer 1 another allowed IP, remove peer 2 and add peer 3.
+	peers[1].AllowedIPs = append(peers[1].AllowedIPs, prefix("10.0.1.0/24"))
+	peers[2] = PeerConfig{PublicKey: keys[3], AllowedIPs: []netip.Prefix{prefix("10.0.0.4/32")}}
+	result, err = dev.SyncPeers(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SyncResult{Added: []NoisePublicKey{keys[3]}, Removed: []NoisePublicKey{keys[2]}, Updated: []NoisePublicKey{keys[1]}}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("second sync = %+v, want %+v", result, want)
+	}
+	for _, key := range keys[:2] {
+		if dev.LookupPeer(key) != before[key] {
+			t.Errorf("peer %x was replaced rather than kept", key[:4])
+		}
+	}
+	if dev.LookupPeer(keys[2]) != nil || dev.LookupPeer(keys[3]) == nil {
+		t.Error("peer 2 was not replaced by peer 3")
+	}
+	var routes []Route
+	for _, route := range dev.RoutingTable() {
+		if route.PeerPublicKey == keys[1] {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) != 2 {
+		t.Errorf("peer 1 has routes %v, want 10.0.0.2/32 and 10.0.1.0/24", routes)
+	}
+
+	// Syncing to the same peers changes nothing.
+	result, err = dev.SyncPeers(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, SyncResult{}) {
+		t.Errorf("sync without changes = %+v, want nothing", result)
+	}
+
+	if _, err := dev.SyncPeers([]PeerConfig{peers[0], peers[0]}); err == nil {
+		t.Error("sync with a duplicate peer succeeded")
+	}
+}
+
+// TestSyncPeersKeepalive checks that SyncPeers leaves the persistent keepalive
+// of a peer off while it has no endpoint to send keepalives to.
+func TestSyncPeersKeepalive(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []PeerConfig{{PublicKey: sk.publicKey(), PersistentKeepalive: 25}}
+	keepalive := func() uint32 {
+		return atomic.LoadUint32(&dev.LookupPeer(peers[0].PublicKey).persistentKeepaliveInterval)
+	}
+	if _, err := dev.SyncPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	if got := keepalive(); got != 0 {
+		t.Errorf("peer without an endpoint has keepalive %d, want 0", got)
+	}
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(config, "\n") {
+		if strings.HasPrefix(line, "persistent_keepalive_interval=") && line != "persistent_keepalive_interval=0" {
+			t.Errorf("IpcGet of a peer without an endpoint has %q", line)
+		}
+	}
+
+	// Once the peer has an endpoint, even one set other than by SyncPeers, the keepalive is turned on.
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(peers[0].PublicKey[:]), "endpoint", "127.0.0.1:1000")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := dev.SyncPeers(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 1 || keepalive() != 25 {
+		t.Errorf("peer with an endpoint has keepalive %d after %+v, want 25", keepalive(), result)
+	}
+}
+
+// TestSyncPeersKeepaliveMinimum checks that a keepalive raised to the device's
+// minimum does not make every later sync update the peer.
+func TestSyncPeersKeepaliveMinimum(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	dev.SetMinPersistentKeepalive(10)
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []PeerConfig{{PublicKey: sk.publicKey(), Endpoint: "127.0.0.1:1000", PersistentKeepalive: 5}}
+	if _, err := dev.SyncPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadUint32(&dev.LookupPeer(peers[0].PublicKey).persistentKeepaliveInterval); got != 10 {
+		t.Errorf("peer has keepalive %d, want the minimum of 10", got)
+	}
+	result, err := dev.SyncPeers(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 || len(result.Removed) != 0 || len(result.Updated) != 0 {
+		t.Errorf("second identical sync changed %+v", result)
+	}
+}
+
+// sortedKeys returns a sorted copy of keys.
+func sortedKeys(keys ...NoisePublicKey) []NoisePublicKey {
+	keys = append([]NoisePublicKey(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool {
+		return string(keys[i][:]) < string(keys[j][:])
+	})
+	return keys
+}
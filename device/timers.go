@@ -8,6 +8,7 @@
 package device
 
 import (
+	"fmt"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -75,8 +76,16 @@ func (peer *Peer) timersActive() bool {
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
+	if peer.handshakeBackoff.deferred.Swap(false) {
+		// The backoff is over; no initiation went unanswered.
+		peer.SendHandshakeInitiation(true)
+		return
+	}
+	atomic.AddUint64(&peer.stats.handshakeFailures, 1)
+	peer.handshakeUnanswered()
 	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+		peer.log.Verbosef("Handshake did not complete after %d attempts, giving up", MaxTimerHandshakes+2)
+		peer.setLastError(fmt.Sprintf("handshake did not complete after %d attempts", MaxTimerHandshakes+2))
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -95,13 +104,17 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 	} else {
 		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+		peer.log.Verbosef("Handshake did not complete after %d seconds, retrying (try %d)", int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+		peer.setLastError(fmt.Sprintf("handshake did not complete after %d seconds", int(RekeyTimeout.Seconds())))
 
-		/* We clear the endpoint address src address, in case this is the cause of trouble. */
+		/* We clear the endpoint address src address, in case this is the cause of trouble,
+		 * and move on to the next candidate endpoint, in case the peer is no longer there.
+		 */
 		peer.Lock()
 		if peer.endpoint != nil {
 			peer.endpoint.ClearSrc()
 		}
+		peer.nextCandidateEndpoint()
 		peer.Unlock()
 
 		peer.SendHandshakeInitiation(true)
@@ -119,7 +132,7 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	peer.log.Verbosef("Retrying handshake because we stopped hearing back after %d seconds", int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
 	if peer.endpoint != nil {
@@ -131,7 +144,7 @@ func expiredNewHandshake(peer *Peer) {
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((RejectAfterTime * 3).Seconds()))
+	peer.log.Verbosef("Removing all keys, since we haven't received a new one in %d seconds", int((RejectAfterTime * 3).Seconds()))
 	peer.ZeroAndFlushAll()
 }
 
@@ -171,6 +184,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
 	}
+	peer.resetHandshakeBackoff()
 }
 
 /* Should be called after a handshake initiation message is sent. */
@@ -188,6 +202,8 @@ func (peer *Peer) timersHandshakeComplete() {
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	atomic.AddUint64(&peer.stats.handshakes, 1)
+	atomic.StoreUint64(&peer.stats.handshakeFailures, 0)
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
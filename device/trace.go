@@ -0,0 +1,173 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Direction is the way a packet is going through the device.
+type Direction int
+
+const (
+	DirectionOutbound Direction = iota // read from the TUN device, to be sent to a peer
+	DirectionInbound                   // received from a peer, to be written to the TUN device
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionOutbound:
+		return "outbound"
+	case DirectionInbound:
+		return "inbound"
+	}
+	return "unknown"
+}
+
+// A TraceDecision is what the device did with a traced packet.
+type TraceDecision int
+
+const (
+	TraceStaged  TraceDecision = iota // queued for a peer until it has a session to send it with
+	TraceSent                         // sent to the peer, or written to the TUN device
+	TraceDropped                      // dropped, for the reason in the TraceEvent
+)
+
+func (d TraceDecision) String() string {
+	switch d {
+	case TraceStaged:
+		return "staged"
+	case TraceSent:
+		return "sent"
+	case TraceDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// A TraceEvent records a decision the device made about a packet.
+type TraceEvent struct {
+	Time      time.Time
+	Direction Direction
+	Peer      NoisePublicKey // the peer the packet is to or from, or zero if there is none
+	Decision  TraceDecision
+	Reason    string // why the packet was dropped
+
+	// Length is the size of the packet when the decision was made: that of
+	// the transport message for outbound packets sent to a peer and inbound
+	// packets dropped before they were decrypted, and that of the IP packet
+	// otherwise, or zero for inbound packets that failed to decrypt.
+	// Outbound keepalives, which have no IP packet, are traced only when sent;
+	// inbound keepalives are not traced.
+	Length int
+}
+
+// SetTraceHook makes the device call hook with an event for each decision
+// it makes about a packet in the send and receive pipelines: staging a packet
+// for a peer, sending it on, or dropping it. It is for debugging, as the hook
+// is called on the data path, for every packet. It must be safe for concurrent
+// use and return quickly; a TraceRing collects events for later inspection.
+// A nil hook, the default, stops the tracing, which then costs next to nothing.
+func (device *Device) SetTraceHook(hook func(TraceEvent)) {
+	device.trace.Lock()
+	defer device.trace.Unlock()
+	if hook == nil {
+		device.trace.enabled.Set(false)
+		return
+	}
+	device.trace.hook.Store(hook)
+	device.trace.enabled.Set(true)
+}
+
+// tracing reports whether a trace hook is set.
+func (device *Device) tracing() bool {
+	return device.trace.enabled.Get()
+}
+
+// tracePacket passes an event to the trace hook, if one is set.
+// The peer may be nil. It is small enough to be inlined, so that
+// it costs only the check of whether to trace when there is no hook.
+func (device *Device) tracePacket(direction Direction, peer *Peer, length int, decision TraceDecision, reason string) {
+	if device.tracing() {
+		device.emitTrace(direction, peer, length, decision, reason)
+	}
+}
+
+func (device *Device) emitTrace(direction Direction, peer *Peer, length int, decision TraceDecision, reason string) {
+	hook, _ := device.trace.hook.Load().(func(TraceEvent))
+	if hook == nil {
+		return
+	}
+	ev := TraceEvent{
+		Time:      time.Now(),
+		Direction: direction,
+		Length:    length,
+		Decision:  decision,
+		Reason:    reason,
+	}
+	if peer != nil {
+		ev.Peer = peer.handshake.remoteStatic
+	}
+	hook(ev)
+}
+
+// A TraceRing keeps the latest events passed to its Record method,
+// which can be given to SetTraceHook.
+type TraceRing struct {
+	total  int64 // events recorded, accessed atomically; first for 64-bit alignment
+	mu     sync.Mutex
+	events []TraceEvent
+	next   int // index in events of the next event to record
+}
+
+// NewTraceRing returns a TraceRing that keeps the latest size events.
+func NewTraceRing(size int) *TraceRing {
+	if size < 1 {
+		size = 1
+	}
+	return &TraceRing{events: make([]TraceEvent, 0, size)}
+}
+
+// Record adds an event to the ring, replacing the oldest if it is full.
+func (r *TraceRing) Record(ev TraceEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) < cap(r.events) {
+		r.events = append(r.events, ev)
+	} else {
+		r.events[r.next] = ev
+	}
+	r.next = (r.next + 1) % cap(r.events)
+	atomic.AddInt64(&r.total, 1)
+}
+
+// Events returns the events in the ring, oldest first.
+func (r *TraceRing) Events() []TraceEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]TraceEvent, 0, len(r.events))
+	if len(r.events) == cap(r.events) {
+		events = append(events, r.events[r.next:]...)
+		return append(events, r.events[:r.next]...)
+	}
+	return append(events, r.events...)
+}
+
+// Total returns the number of events recorded, including those no longer in the ring.
+func (r *TraceRing) Total() int64 {
+	return atomic.LoadInt64(&r.total)
+}
+
+// Reset removes all events from the ring.
+func (r *TraceRing) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = r.events[:0]
+	r.next = 0
+	atomic.StoreInt64(&r.total, 0)
+}
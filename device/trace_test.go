@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestTraceRing(t *testing.T) {
+	r := NewTraceRing(3)
+	for i := 1; i <= 5; i++ {
+		r.Record(TraceEvent{Length: i})
+	}
+	events := r.Events()
+	if len(events) != 3 || events[0].Length != 3 || events[1].Length != 4 || events[2].Length != 5 {
+		t.Errorf("events = %+v, want those of length 3, 4 and 5", events)
+	}
+	if total := r.Total(); total != 5 {
+		t.Errorf("Total() = %d, want 5", total)
+	}
+	r.Reset()
+	if events := r.Events(); len(events) != 0 || r.Total() != 0 {
+		t.Errorf("after Reset, events = %+v, total = %d", events, r.Total())
+	}
+}
+
+// TestTracePing checks the events traced for a ping between a pair of devices:
+// the sender stages the packet until it has a session, then sends it,
+// and the receiver writes it to its TUN device.
+func TestTracePing(t *testing.T) {
+	pair := genTestPair(t, false)
+	var rings [2]*TraceRing
+	for i := range pair {
+		rings[i] = NewTraceRing(16)
+		pair[i].dev.SetTraceHook(rings[i].Record)
+	}
+	pair.Send(t, Ping, nil)
+
+	// The hooks may be called after the ping has come out of the TUN device.
+	wait := func(r *TraceRing, n int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); r.Total() < n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("traced %d events, want %d", r.Total(), n)
+			}
+		}
+	}
+	wait(rings[1], 2)
+	wait(rings[0], 1)
+
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	mtu := int(atomic.LoadInt32(&pair[1].dev.tun.mtu))
+	transport := MessageTransportSize + len(ping) + calculatePaddingSize(len(ping), mtu)
+	pk0, pk1 := pair[0].dev.staticIdentity.publicKey, pair[1].dev.staticIdentity.publicKey
+	want := [2][]TraceEvent{
+		{
+			{Direction: DirectionInbound, Peer: pk1, Length: len(ping), Decision: TraceSent},
+		},
+		{
+			{Direction: DirectionOutbound, Peer: pk0, Length: len(ping), Decision: TraceStaged},
+			{Direction: DirectionOutbound, Peer: pk0, Length: transport, Decision: TraceSent},
+		},
+	}
+	for i, r := range rings {
+		got := r.Events()
+		if len(got) != len(want[i]) {
+			t.Errorf("device %d traced %+v, want %+v", i, got, want[i])
+			continue
+		}
+		for j, ev := range got {
+			if ev.Time.IsZero() {
+				t.Errorf("device %d event %d has no time", i, j)
+			}
+			ev.Time = time.Time{}
+			if ev != want[i][j] {
+				t.Errorf("device %d event %d = %+v, want %+v", i, j, ev, want[i][j])
+			}
+		}
+	}
+
+	// Packets to addresses of no peer are dropped, and
+	// with the hook removed, nothing is traced.
+	stray := tuntest.Ping(net.IPv4(1, 0, 0, 3), pair[1].ip)
+	pair[1].tun.Outbound <- stray
+	wait(rings[1], 3)
+	if ev := rings[1].Events()[2]; ev.Decision != TraceDropped || ev.Reason != "no peer for destination" || ev.Peer != (NoisePublicKey{}) {
+		t.Errorf("stray packet traced as %+v", ev)
+	}
+	pair[1].dev.SetTraceHook(nil)
+	pair.Send(t, Ping, nil)
+	if total := rings[1].Total(); total != 3 {
+		t.Errorf("traced %d events after the hook was removed, want 3", total)
+	}
+}
@@ -14,41 +14,68 @@ import (
 
 const DefaultMTU = 1420
 
+// tunBatchSize is the most packets read or written in one call
+// to a tun.BatchDevice.
+const tunBatchSize = 32
+
 func (device *Device) RoutineTUNEventReader() {
 	device.log.Verbosef("Routine: event worker - started")
 
-	for event := range device.tun.device.Events() {
-		if event&tun.EventMTUUpdate != 0 {
-			mtu, err := device.tun.device.MTU()
-			if err != nil {
-				device.log.Errorf("Failed to load updated MTU of device: %v", err)
-				continue
-			}
-			if mtu < 0 {
-				device.log.Errorf("MTU not updated to negative value: %v", mtu)
-				continue
-			}
-			var tooLarge string
-			if mtu > MaxContentSize {
-				tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxContentSize)
-				mtu = MaxContentSize
-			}
-			old := atomic.SwapInt32(&device.tun.mtu, int32(mtu))
-			if int(old) != mtu {
-				device.log.Verbosef("MTU updated: %v%s", mtu, tooLarge)
+	if detailed, ok := device.tun.device.(tun.DetailedEventDevice); ok {
+		for event := range detailed.EventsDetailed() {
+			device.handleTUNEvent(event)
+		}
+	} else {
+		for event := range device.tun.device.Events() {
+			detail := tun.DetailedEvent{Event: event}
+			if event&tun.EventMTUUpdate != 0 {
+				mtu, err := device.tun.device.MTU()
+				if err != nil {
+					device.log.Errorf("Failed to load updated MTU of device: %v", err)
+					continue
+				}
+				detail.MTU = mtu
 			}
+			device.handleTUNEvent(detail)
 		}
+	}
+
+	device.log.Verbosef("Routine: event worker - stopped")
+}
 
-		if event&tun.EventUp != 0 {
-			device.log.Verbosef("Interface up requested")
-			device.Up()
+func (device *Device) handleTUNEvent(event tun.DetailedEvent) {
+	if event.Event&tun.EventError != 0 {
+		if !device.isClosed() {
+			device.log.Errorf("TUN device failed: %v", event.Err)
+			go device.Close()
 		}
+		return
+	}
 
-		if event&tun.EventDown != 0 {
-			device.log.Verbosef("Interface down requested")
-			device.Down()
+	if event.Event&tun.EventMTUUpdate != 0 {
+		mtu := event.MTU
+		if mtu < 0 {
+			device.log.Errorf("MTU not updated to negative value: %v", mtu)
+			return
+		}
+		var tooLarge string
+		if mtu > MaxContentSize {
+			tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxContentSize)
+			mtu = MaxContentSize
+		}
+		old := atomic.SwapInt32(&device.tun.mtu, int32(mtu))
+		if int(old) != mtu {
+			device.log.Verbosef("MTU updated: %v%s", mtu, tooLarge)
 		}
 	}
 
-	device.log.Verbosef("Routine: event worker - stopped")
+	if event.Event&tun.EventUp != 0 {
+		device.log.Verbosef("Interface up requested")
+		device.Up()
+	}
+
+	if event.Event&tun.EventDown != 0 {
+		device.log.Verbosef("Interface down requested")
+		device.Down()
+	}
 }
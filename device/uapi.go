@@ -110,6 +110,9 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			if peer.endpoint != nil {
 				sendf("endpoint=%s", peer.endpoint.DstToString())
 			}
+			if peer.stickyEndpoint {
+				sendf("sticky_endpoint=true")
+			}
 
 			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
 			secs := nano / time.Second.Nanoseconds()
@@ -141,10 +144,16 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 	device.ipcMutex.Lock()
 	defer device.ipcMutex.Unlock()
+	return device.ipcSetLocked(r)
+}
 
+// ipcSetLocked is IpcSetOperation with device.ipcMutex held.
+func (device *Device) ipcSetLocked(r io.Reader) (err error) {
 	defer func() {
 		if err != nil {
 			device.log.Errorf("%v", err)
+		} else {
+			atomic.AddUint64(&device.stats.configGeneration, 1)
 		}
 	}()
 
@@ -158,12 +167,11 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 			// Blank line means terminate operation.
 			return nil
 		}
-		parts := strings.Split(line, "=")
-		if len(parts) != 2 {
-			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, found %d =-separated parts, want 2", line, len(parts))
+		// Only the first = separates the key from the value, which may contain more.
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, found no =", line)
 		}
-		key := parts[0]
-		value := parts[1]
 
 		if key == "public_key" {
 			if deviceConfig {
@@ -213,11 +221,19 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse listen_port: %w", err)
 		}
 
+		// a port matching the current one is a no-op, so as not to
+		// disturb established NAT mappings with a needless rebind
+		device.net.Lock()
+		if port != 0 && uint16(port) == device.net.port {
+			device.net.Unlock()
+			break
+		}
+
 		// update port and rebind
 		device.log.Verbosef("UAPI: Updating listen port")
 
-		device.net.Lock()
 		device.net.port = uint16(port)
+		device.net.portRange = [2]uint16{}
 		device.net.Unlock()
 
 		if err := device.BindUpdate(); err != nil {
@@ -235,6 +251,14 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "log_level":
+		level, err := parseLogLevel(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating log level")
+		device.SetLogLevel(level)
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
@@ -257,7 +281,12 @@ type ipcSetPeer struct {
 }
 
 func (peer *ipcSetPeer) handlePostConfig() {
-	if peer.Peer != nil && !peer.dummy && peer.Peer.device.isUp() {
+	if peer.Peer == nil || peer.dummy {
+		return
+	}
+	// The new configuration may be what the peer was missing.
+	peer.resetHandshakeBackoff()
+	if peer.Peer.device.isUp() {
 		peer.SendStagedPackets()
 	}
 }
@@ -287,7 +316,7 @@ func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to create new peer: %w", err)
 		}
-		device.log.Verbosef("%v - UAPI: Created", peer.Peer)
+		peer.log.Verbosef("UAPI: Created")
 	}
 	return nil
 }
@@ -311,14 +340,14 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set remove, invalid value: %v", value)
 		}
 		if !peer.dummy {
-			device.log.Verbosef("%v - UAPI: Removing", peer.Peer)
+			peer.log.Verbosef("UAPI: Removing")
 			device.RemovePeer(peer.handshake.remoteStatic)
 		}
 		peer.Peer = &Peer{}
 		peer.dummy = true
 
 	case "preshared_key":
-		device.log.Verbosef("%v - UAPI: Updating preshared key", peer.Peer)
+		peer.log.Verbosef("UAPI: Updating preshared key")
 
 		peer.handshake.mutex.Lock()
 		err := peer.handshake.presharedKey.FromHex(value)
@@ -329,7 +358,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		}
 
 	case "endpoint":
-		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
+		peer.log.Verbosef("UAPI: Updating endpoint")
 		endpoint, err := device.net.bind.ParseEndpoint(value)
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
@@ -337,14 +366,34 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		peer.Lock()
 		defer peer.Unlock()
 		peer.endpoint = endpoint
+		peer.candidates = nil
+
+	case "sticky_endpoint":
+		// pin the endpoint, rather than roaming to wherever packets come from
+		var sticky bool
+		switch value {
+		case "true":
+			sticky = true
+		case "false":
+		default:
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set sticky endpoint, invalid value: %v", value)
+		}
+		peer.log.Verbosef("UAPI: Updating sticky endpoint")
+		peer.Lock()
+		defer peer.Unlock()
+		peer.stickyEndpoint = sticky
 
 	case "persistent_keepalive_interval":
-		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
+		peer.log.Verbosef("UAPI: Updating persistent keepalive interval")
 
 		secs, err := strconv.ParseUint(value, 10, 16)
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set persistent keepalive interval: %w", err)
 		}
+		if min := device.persistentKeepalive(uint16(secs)); min != uint16(secs) {
+			peer.log.Verbosef("UAPI: Raising persistent keepalive interval from %d to the minimum of %d", secs, min)
+			secs = uint64(min)
+		}
 
 		old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, uint32(secs))
 
@@ -359,7 +408,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		}
 
 	case "replace_allowed_ips":
-		device.log.Verbosef("%v - UAPI: Removing all allowedips", peer.Peer)
+		peer.log.Verbosef("UAPI: Removing all allowedips")
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace allowedips, invalid value: %v", value)
 		}
@@ -369,7 +418,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		device.allowedips.RemoveByPeer(peer.Peer)
 
 	case "allowed_ip":
-		device.log.Verbosef("%v - UAPI: Adding allowedip", peer.Peer)
+		peer.log.Verbosef("UAPI: Adding allowedip")
 
 		_, network, err := net.ParseCIDR(value)
 		if err != nil {
@@ -405,6 +454,37 @@ func (device *Device) IpcSet(uapiConf string) error {
 	return device.IpcSetOperation(strings.NewReader(uapiConf))
 }
 
+// CloneConfigTo replaces the configuration of other with that of device,
+// including the current endpoints of its peers.
+// The private key is copied only if copyPrivateKey is set.
+// The listen port is left as it is, since it belongs to other's host.
+func (device *Device) CloneConfigTo(other *Device, copyPrivateKey bool) error {
+	if other == device {
+		return errors.New("cannot clone device configuration onto itself")
+	}
+	cfg, err := device.IpcGet()
+	if err != nil {
+		return err
+	}
+
+	buf := new(strings.Builder)
+	buf.WriteString("replace_peers=true\nfwmark=0\n")
+	for _, line := range strings.Split(cfg, "\n") {
+		key, _, _ := strings.Cut(line, "=")
+		switch key {
+		case "", "listen_port", "last_handshake_time_sec", "last_handshake_time_nsec", "tx_bytes", "rx_bytes":
+			continue
+		case "private_key":
+			if !copyPrivateKey {
+				continue
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return other.IpcSet(buf.String())
+}
+
 func (device *Device) IpcHandle(socket net.Conn) {
 	defer socket.Close()
 
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// A UAPIPolicy says which operations ApplyUAPI accepts beyond well-formed ones.
+// The zero UAPIPolicy is the strictest.
+type UAPIPolicy struct {
+	AllowClearPrivateKey bool // allow setting a zero private_key, which stops all handshakes
+	AllowReplacePeers    bool // allow replace_peers, which removes every peer not in the stream
+}
+
+// SetUAPIPolicy sets the policy that ApplyUAPI enforces.
+// It does not affect IpcSet and IpcSetOperation, which accept any operation.
+func (device *Device) SetUAPIPolicy(policy UAPIPolicy) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	device.uapiPolicy = policy
+}
+
+// ApplyUAPI is a guarded IpcSetOperation. It reads the whole "set" operation from r,
+// and applies it only if every line is well formed and allowed by the policy
+// set by SetUAPIPolicy, so that a bad stream is rejected before anything changes.
+// Errors that depend on the system rather than the stream, such as a listen_port
+// already in use, can still stop the operation part way through.
+func (device *Device) ApplyUAPI(r io.Reader) error {
+	device.ipcMutex.RLock()
+	policy := device.uapiPolicy
+	device.ipcMutex.RUnlock()
+
+	var set bytes.Buffer
+	deviceConfig := true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, found no =", line)
+		}
+		var err error
+		switch {
+		case key == "public_key":
+			deviceConfig = false
+			var pk NoisePublicKey
+			if err := pk.FromHex(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "invalid public_key: %w", err)
+			}
+		case deviceConfig:
+			err = device.checkDeviceLine(policy, key, value)
+		default:
+			err = device.checkPeerLine(key, value)
+		}
+		if err != nil {
+			return err
+		}
+		set.WriteString(line)
+		set.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
+	}
+	return device.IpcSetOperation(&set)
+}
+
+func (device *Device) checkDeviceLine(policy UAPIPolicy, key, value string) error {
+	switch key {
+	case "private_key":
+		var sk NoisePrivateKey
+		if err := sk.FromMaybeZeroHex(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid private_key: %w", err)
+		}
+		if sk.IsZero() && !policy.AllowClearPrivateKey {
+			return ipcErrorf(ipc.IpcErrorInvalid, "clearing private_key is not allowed by policy")
+		}
+	case "listen_port":
+		if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid listen_port: %w", err)
+		}
+	case "fwmark":
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid fwmark: %w", err)
+		}
+	case "log_level":
+		if _, err := parseLogLevel(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid log_level: %w", err)
+		}
+	case "replace_peers":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid replace_peers value: %v", value)
+		}
+		if !policy.AllowReplacePeers {
+			return ipcErrorf(ipc.IpcErrorInvalid, "replace_peers is not allowed by policy")
+		}
+	default:
+		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
+	}
+	return nil
+}
+
+func (device *Device) checkPeerLine(key, value string) error {
+	switch key {
+	case "update_only", "remove", "replace_allowed_ips":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid %s value: %v", key, value)
+		}
+	case "preshared_key":
+		var psk NoisePresharedKey
+		if err := psk.FromHex(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid preshared_key: %w", err)
+		}
+	case "endpoint":
+		device.net.RLock()
+		_, err := device.net.bind.ParseEndpoint(value)
+		device.net.RUnlock()
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid endpoint %v: %w", value, err)
+		}
+	case "sticky_endpoint":
+		if value != "true" && value != "false" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid sticky_endpoint value: %v", value)
+		}
+	case "persistent_keepalive_interval":
+		if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid persistent_keepalive_interval: %w", err)
+		}
+	case "allowed_ip":
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid allowed_ip: %w", err)
+		}
+	case "protocol_version":
+		if value != "1" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %v", value)
+		}
+	default:
+		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
+	}
+	return nil
+}
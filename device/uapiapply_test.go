@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestApplyUAPI(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peerKey := hex.EncodeToString(pk[:])
+
+	apply := func(cfg string) error {
+		return dev.ApplyUAPI(strings.NewReader(cfg))
+	}
+	get := func() string {
+		t.Helper()
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	if err := apply(uapiCfg(
+		"public_key", peerKey,
+		"persistent_keepalive_interval", "25",
+		"allowed_ip", "10.0.0.0/8",
+	)); err != nil {
+		t.Fatalf("well-formed set: %v", err)
+	}
+	before := get()
+	for _, want := range []string{"persistent_keepalive_interval=25\n", "allowed_ip=10.0.0.0/8\n"} {
+		if !strings.Contains(before, want) {
+			t.Errorf("set was not applied, missing %q:\n%s", want, before)
+		}
+	}
+
+	for _, cfg := range []string{
+		// Every line but the last would apply.
+		uapiCfg("public_key", peerKey, "allowed_ip", "10.1.0.0/16", "allowed_ip", "10.2.0.0/33"),
+		uapiCfg("listen_port", "0", "public_key", peerKey, "remove", "true", "endpoint", "nowhere"),
+		uapiCfg("public_key", peerKey, "replace_allowed_ips", "true", "listen_port", "0"),
+		uapiCfg("fwmark", "1", "public_key", "not a key"),
+		"public_key=" + peerKey + "\nremove\n",
+		// Rejected by the default policy.
+		uapiCfg("replace_peers", "true"),
+		uapiCfg("private_key", strings.Repeat("00", NoisePrivateKeySize)),
+	} {
+		if err := apply(cfg); err == nil {
+			t.Errorf("ApplyUAPI(%q) succeeded", cfg)
+		}
+		if after := get(); after != before {
+			t.Errorf("ApplyUAPI(%q) changed the configuration:\n%s", cfg, after)
+			before = after
+		}
+	}
+
+	dev.SetUAPIPolicy(UAPIPolicy{AllowReplacePeers: true})
+	if err := apply(uapiCfg("replace_peers", "true")); err != nil {
+		t.Errorf("replace_peers allowed by policy: %v", err)
+	}
+	if cfg := get(); strings.Contains(cfg, "public_key=") {
+		t.Errorf("replace_peers was not applied:\n%s", cfg)
+	}
+}
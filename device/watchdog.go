@@ -0,0 +1,155 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of routine whose progress the watchdog follows,
+// indexing device.stats.progress.
+const (
+	watchdogEncryption = iota
+	watchdogDecryption
+	watchdogHandshake
+	watchdogSend     // the peers' sequential senders
+	watchdogTUNWrite // the peers' sequential receivers, which write to the TUN device
+	watchdogStages
+)
+
+var watchdogNames = [watchdogStages]string{"encryption", "decryption", "handshake", "send", "TUN write"}
+
+// progress records that a routine of the given kind took an element from its queue.
+func (device *Device) progress(stage int) {
+	atomic.AddUint64(&device.stats.progress[stage], 1)
+}
+
+// A WatchdogQueue is the state of the queue of one kind of routine.
+type WatchdogQueue struct {
+	Name         string    // "encryption", "decryption", "handshake", "send" or "TUN write"
+	Pending      int       // elements in the queue, or in the queues of all peers
+	Capacity     int       // room in the queue, or in the queues of all peers
+	LastProgress time.Time // when the routines were last seen to take an element
+	Stalled      bool      // whether elements are pending without progress for the threshold
+}
+
+// A WatchdogReport is the state of the device's queues when the watchdog
+// found one of them stalled.
+type WatchdogReport struct {
+	Time   time.Time
+	Queues []WatchdogQueue
+}
+
+func (r WatchdogReport) String() string {
+	var b strings.Builder
+	for i, q := range r.Queues {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s %d/%d", q.Name, q.Pending, q.Capacity)
+		if q.Stalled {
+			fmt.Fprintf(&b, " stalled for %v", r.Time.Sub(q.LastProgress).Round(time.Millisecond))
+		}
+	}
+	return b.String()
+}
+
+// SetWatchdog starts a watchdog that checks every interval that the device's
+// routines are making progress, and calls report when those of some kind have had
+// packets pending for threshold without taking any, as when one of them is wedged.
+// It calls report once for each such stall, from its own goroutine, which is all
+// it would block; with report nil, it logs the report as an error instead.
+// The data path only counts the packets it takes, and the watchdog only samples
+// the counts, so that it cannot hold up the data path itself.
+// An interval that is not positive stops the watchdog, which is the default.
+func (device *Device) SetWatchdog(interval, threshold time.Duration, report func(WatchdogReport)) {
+	device.watchdog.Lock()
+	defer device.watchdog.Unlock()
+	if device.watchdog.stop != nil {
+		close(device.watchdog.stop)
+		device.watchdog.stop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	if report == nil {
+		report = func(r WatchdogReport) {
+			device.log.Errorf("Watchdog: no progress for %v with packets pending: %v", threshold, r)
+		}
+	}
+	stop := make(chan struct{})
+	device.watchdog.stop = stop
+	go device.runWatchdog(interval, threshold, report, stop)
+}
+
+func (device *Device) runWatchdog(interval, threshold time.Duration, report func(WatchdogReport), stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last [watchdogStages]uint64
+	var lastProgress [watchdogStages]time.Time
+	var stalled [watchdogStages]bool
+	now := time.Now()
+	for i := range last {
+		last[i] = atomic.LoadUint64(&device.stats.progress[i])
+		lastProgress[i] = now
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-device.closed:
+			return
+		case now = <-ticker.C:
+		}
+
+		queues := device.watchdogQueues()
+		fire := false
+		for i := range queues {
+			q := &queues[i]
+			if progress := atomic.LoadUint64(&device.stats.progress[i]); progress != last[i] {
+				last[i] = progress
+				lastProgress[i] = now
+			}
+			q.LastProgress = lastProgress[i]
+			q.Stalled = q.Pending > 0 && now.Sub(q.LastProgress) >= threshold
+			if q.Stalled && !stalled[i] {
+				fire = true
+			}
+			stalled[i] = q.Stalled
+		}
+		if fire {
+			report(WatchdogReport{Time: now, Queues: queues[:]})
+		}
+	}
+}
+
+// watchdogQueues returns the occupancy of the device's queues. It leaves out
+// those of the peers if it would have to wait for the peers' lock.
+func (device *Device) watchdogQueues() (queues [watchdogStages]WatchdogQueue) {
+	for i := range queues {
+		queues[i].Name = watchdogNames[i]
+	}
+	queues[watchdogEncryption].Pending = len(device.queue.encryption.c)
+	queues[watchdogEncryption].Capacity = cap(device.queue.encryption.c)
+	queues[watchdogDecryption].Pending = len(device.queue.decryption.c)
+	queues[watchdogDecryption].Capacity = cap(device.queue.decryption.c)
+	queues[watchdogHandshake].Pending = len(device.queue.handshake.c)
+	queues[watchdogHandshake].Capacity = cap(device.queue.handshake.c)
+	if device.peers.TryRLock() {
+		for _, peer := range device.peers.keyMap {
+			queues[watchdogSend].Pending += len(peer.queue.outbound.c)
+			queues[watchdogSend].Capacity += cap(peer.queue.outbound.c)
+			queues[watchdogTUNWrite].Pending += len(peer.queue.inbound.c)
+			queues[watchdogTUNWrite].Capacity += cap(peer.queue.inbound.c)
+		}
+		device.peers.RUnlock()
+	}
+	return queues
+}
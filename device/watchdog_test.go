@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// TestWatchdog wedges the sequential receiver of a device with a packet filter
+// that blocks, and checks that the watchdog reports the TUN write routines stalled.
+func TestWatchdog(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	wedged := make(chan struct{})
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) }) // runs before the devices close
+	pair[0].dev.SetPacketFilter(func(direction Direction, packet []byte) bool {
+		if direction == DirectionInbound {
+			select {
+			case wedged <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		return true
+	})
+	reports := make(chan WatchdogReport, 1)
+	pair[0].dev.SetWatchdog(10*time.Millisecond, 100*time.Millisecond, func(r WatchdogReport) {
+		select {
+		case reports <- r:
+		default:
+		}
+	})
+
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair[1].tun.Outbound <- ping
+	select {
+	case <-wedged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet did not reach the filter")
+	}
+	pair[1].tun.Outbound <- ping
+
+	select {
+	case r := <-reports:
+		var stalled []string
+		for _, q := range r.Queues {
+			if q.Stalled {
+				stalled = append(stalled, q.Name)
+			}
+		}
+		if len(stalled) != 1 || stalled[0] != "TUN write" {
+			t.Errorf("stalled queues %v, want TUN write: %v", stalled, r)
+		}
+		if !strings.Contains(r.String(), "TUN write 1/") {
+			t.Errorf("report %q does not show the pending packet", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not report the wedged receiver")
+	}
+
+	pair[0].dev.SetWatchdog(0, 0, nil)
+	select {
+	case r := <-reports:
+		t.Errorf("watchdog reported after it was stopped: %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,6 +1,6 @@
 module golang.zx2c4.com/wireguard
 
-go 1.16
+go 1.18
 
 require (
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
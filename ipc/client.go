@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A UAPIError is the nonzero errno a device answered an operation with,
+// one of the IpcError constants for wireguard-go.
+type UAPIError struct {
+	Errno int64
+}
+
+func (e *UAPIError) Error() string {
+	return fmt.Sprintf("UAPI operation failed with errno %d", e.Errno)
+}
+
+// A UAPIClient drives a device over its UAPI socket, as the wg tool does.
+// Its operations must not be called concurrently.
+type UAPIClient struct {
+	// Timeout bounds each operation, including reading the answer;
+	// zero means no limit.
+	Timeout time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewUAPIClient returns a UAPIClient that drives the device at the other end of conn.
+func NewUAPIClient(conn net.Conn) *UAPIClient {
+	return &UAPIClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Close closes the connection to the device.
+func (c *UAPIClient) Close() error {
+	return c.conn.Close()
+}
+
+// Get returns the device's configuration, as Device.IpcGet does:
+// one key=value line for each setting, each ending in a newline.
+func (c *UAPIClient) Get() (string, error) {
+	var b strings.Builder
+	err := c.do("get=1\n\n", &b)
+	return b.String(), err
+}
+
+// Set applies uapiConf, key=value lines as for Device.IpcSet, to the device.
+// The lines may not include a blank one, which would end the operation early.
+func (c *UAPIClient) Set(uapiConf string) error {
+	uapiConf = strings.TrimRight(uapiConf, "\n")
+	if strings.Contains(uapiConf, "\n\n") {
+		return errors.New("UAPI configuration contains a blank line")
+	}
+	if uapiConf != "" {
+		uapiConf += "\n"
+	}
+	return c.do("set=1\n"+uapiConf+"\n", nil)
+}
+
+// do sends request and reads the answer, copying lines
+// other than the errno to out, if not nil.
+func (c *UAPIClient) do(request string, out *strings.Builder) error {
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	var errno int64
+	haveErrno := false
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "errno=") {
+			value := line[len("errno="):]
+			if errno, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("invalid UAPI errno %q", value)
+			}
+			haveErrno = true
+			continue
+		}
+		if out != nil {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+	if !haveErrno {
+		return errors.New("UAPI answer has no errno")
+	}
+	if errno == 0 {
+		return nil
+	}
+	return &UAPIError{Errno: errno}
+}
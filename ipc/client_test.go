@@ -0,0 +1,111 @@
+//go:build linux || darwin || freebsd || openbsd
+// +build linux darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// listenUAPI serves the UAPI of dev on a socket in a temporary directory,
+// as main does, and returns a client connected to it.
+func listenUAPI(t *testing.T, dev *device.Device) *ipc.UAPIClient {
+	path := filepath.Join(t.TempDir(), "wg0.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ipc.NewUAPIClient(conn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestUAPIClient(t *testing.T) {
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], device.NewLogger(device.LogLevelSilent, ""))
+	defer dev.Close()
+	client := listenUAPI(t, dev)
+	client.Timeout = 5 * time.Second
+
+	const peer = "public_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a\n"
+	err := client.Set("private_key=a8dac1d8a70a751f0f699fb14ba1cff7b79cf4fbd8f09f44c6e6a90d0369604f\n" +
+		"listen_port=0\n" + peer +
+		"allowed_ip=10.0.0.2/32\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Get() = %q, want %q as from IpcGet", got, want)
+	}
+	for _, line := range []string{peer, "allowed_ip=10.0.0.2/32\n"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("Get() = %q, want it to include %q", got, line)
+		}
+	}
+
+	// Errors carry the device's errno, and leave the connection usable.
+	err = client.Set("listen_port=not a port\n")
+	var uapiErr *ipc.UAPIError
+	if !errors.As(err, &uapiErr) || uapiErr.Errno != ipc.IpcErrorInvalid {
+		t.Errorf("Set with an invalid port returned %v, want errno %d", err, ipc.IpcErrorInvalid)
+	}
+	if err := client.Set("a=1\n\nb=2"); err == nil {
+		t.Error("Set with a blank line succeeded")
+	}
+	if _, err := client.Get(); err != nil {
+		t.Errorf("Get after a failed Set: %v", err)
+	}
+}
+
+func TestUAPIClientTimeout(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	go func() {
+		// Read the request, and never answer.
+		var buf [64]byte
+		server.Read(buf[:])
+	}()
+	client := ipc.NewUAPIClient(conn)
+	defer client.Close()
+	client.Timeout = 50 * time.Millisecond
+	if _, err := client.Get(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Get from a device that does not answer returned %v, want a timeout", err)
+	}
+}
@@ -32,6 +32,15 @@ func sockPath(iface string) string {
 	return fmt.Sprintf("%s/%s.sock", socketDirectory, iface)
 }
 
+// UAPIDial connects to the UAPI socket of the device with the given name.
+func UAPIDial(name string) (*UAPIClient, error) {
+	conn, err := net.Dial("unix", sockPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return NewUAPIClient(conn), nil
+}
+
 func UAPIOpen(name string) (*os.File, error) {
 	if err := os.MkdirAll(socketDirectory, 0755); err != nil {
 		return nil, err
@@ -61,11 +61,24 @@ func init() {
 	}
 }
 
+func pipePath(name string) string {
+	return `\\.\pipe\ProtectedPrefix\Administrators\WireGuard\` + name
+}
+
+// UAPIDial connects to the UAPI named pipe of the device with the given name.
+func UAPIDial(name string) (*UAPIClient, error) {
+	conn, err := winpipe.Dial(pipePath(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewUAPIClient(conn), nil
+}
+
 func UAPIListen(name string) (net.Listener, error) {
 	config := winpipe.ListenConfig{
 		SecurityDescriptor: UAPISecurityDescriptor,
 	}
-	listener, err := winpipe.Listen(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`+name, &config)
+	listener, err := winpipe.Listen(pipePath(name), &config)
 	if err != nil {
 		return nil, err
 	}
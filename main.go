@@ -144,6 +144,9 @@ func main() {
 		logLevel,
 		fmt.Sprintf("(%s) ", interfaceName),
 	)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		logger = device.NewJSONLogger(os.Stdout, logLevel)
+	}
 
 	logger.Verbosef("Starting wireguard-go version %s", Version)
 
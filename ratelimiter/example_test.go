@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package ratelimiter_test
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ratelimiter"
+)
+
+// This example drives a Ratelimiter with a simulated clock,
+// showing a source exhaust its burst and then earn tokens back over time.
+func Example_simulatedClock() {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	rate := ratelimiter.New(ratelimiter.Options{
+		PacketsPerSecond: 10,
+		Burst:            3,
+		TimeNow:          func() time.Time { return now },
+	})
+	defer rate.Close()
+
+	src := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 4; i++ {
+		fmt.Println("burst:", rate.AllowAddr(src))
+	}
+
+	// At 10 packets per second, each packet costs a tenth of a second of refill.
+	now = now.Add(100 * time.Millisecond)
+	fmt.Println("after 100ms:", rate.AllowAddr(src))
+	fmt.Println("right after:", rate.AllowAddr(src))
+
+	// Once idle for longer than its lifetime, the source is forgotten.
+	now = now.Add(2 * time.Second)
+	fmt.Println("all collected:", rate.Cleanup())
+
+	// Output:
+	// burst: true
+	// burst: true
+	// burst: true
+	// burst: false
+	// after 100ms: true
+	// right after: false
+	// all collected: true
+}
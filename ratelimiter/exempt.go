@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package ratelimiter
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sort"
+)
+
+// An exemptSet is a sorted list of disjoint address ranges.
+// IPv4 addresses are stored in their IPv4-mapped IPv6 form,
+// so that both families can share a single list.
+type exemptSet []addrRange
+
+type addrRange struct {
+	first, last uint128
+}
+
+type uint128 struct {
+	hi, lo uint64
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func uint128FromAddr(ip netip.Addr) uint128 {
+	b := ip.As16()
+	return uint128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+// lastAddr returns the last address in the range covered by prefix.
+func lastAddr(prefix netip.Prefix) uint128 {
+	u := uint128FromAddr(prefix.Addr())
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	switch {
+	case bits < 64:
+		u.hi |= ^uint64(0) >> bits
+		u.lo = ^uint64(0)
+	case bits < 128:
+		u.lo |= ^uint64(0) >> (bits - 64)
+	}
+	return u
+}
+
+func newExemptSet(prefixes []netip.Prefix) exemptSet {
+	set := make(exemptSet, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if !prefix.IsValid() {
+			continue
+		}
+		prefix = prefix.Masked()
+		set = append(set, addrRange{uint128FromAddr(prefix.Addr()), lastAddr(prefix)})
+	}
+	sort.Slice(set, func(i, j int) bool {
+		return set[i].first.less(set[j].first)
+	})
+
+	// merge overlapping ranges
+	merged := set[:0]
+	for _, r := range set {
+		if n := len(merged); n > 0 && !merged[n-1].last.less(r.first) {
+			if merged[n-1].last.less(r.last) {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func (set exemptSet) contains(ip netip.Addr) bool {
+	u := uint128FromAddr(ip)
+	// find the first range starting after ip; ip can only be in the one before it
+	i := sort.Search(len(set), func(i int) bool {
+		return u.less(set[i].first)
+	})
+	return i > 0 && !set[i-1].last.less(u)
+}
+
+// SetExempt replaces the set of prefixes whose sources are exempt from rate limiting.
+// Packets from exempt sources are always allowed and never create entries.
+// IPv4 prefixes also match IPv4-mapped IPv6 addresses. A nil list exempts nothing.
+func (rate *Ratelimiter) SetExempt(prefixes []netip.Prefix) {
+	rate.exempt.Store(newExemptSet(prefixes))
+}
+
+func (rate *Ratelimiter) isExempt(ip netip.Addr) bool {
+	set, _ := rate.exempt.Load().(exemptSet)
+	return len(set) != 0 && set.contains(ip)
+}
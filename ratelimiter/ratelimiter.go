@@ -6,164 +6,515 @@
 package ratelimiter
 
 import (
+	"math/rand"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	packetsPerSecond   = 20
-	packetsBurstable   = 5
-	garbageCollectTime = time.Second
-	packetCost         = 1000000000 / packetsPerSecond
-	maxTokens          = packetCost * packetsBurstable
+	packetsPerSecond = 20
+	packetsBurstable = 5
+	entryLifetime    = time.Second
+	ipv6PrefixLen    = 64
+	onDeniedInterval = time.Minute
+
+	// Every sweepEvery calls to Allow, sweepBatch entries of one shard
+	// are checked for staleness, each shard in turn.
+	sweepEvery = 16
+	sweepBatch = 16
+)
+
+// Options configures a Ratelimiter.
+// Zero values select the defaults of 20 packets per second,
+// a burst of 5 packets, collection of entries idle for more than a second,
+// and IPv6 sources bucketed by /64, as in the kernel implementation.
+type Options struct {
+	PacketsPerSecond int64         // sustained rate allowed per source
+	Burst            int64         // number of packets a source may send back-to-back
+	EntryLifetime    time.Duration // how long a source must be idle before its entry is collected
+	IPv6PrefixLen    int           // IPv6 addresses sharing this many leading bits count as one source
+
+	// MaxEntries bounds the number of sources tracked at once, 0 for no bound.
+	MaxEntries int
+	// Overflow selects what happens to a new source once MaxEntries sources are tracked.
+	Overflow OverflowPolicy
+
+	// OnDenied, if non-nil, is called with the current Stats when a packet is denied,
+	// but at most once per OnDeniedInterval, which defaults to a minute.
+	// It is called synchronously from Allow and must not block.
+	OnDenied         func(Stats)
+	OnDeniedInterval time.Duration
+
+	// TimeNow, if non-nil, replaces time.Now as the Ratelimiter's clock.
+	// It decides both token refill and which entries are idle enough to collect.
+	TimeNow func() time.Time
+}
+
+// Stats counts the decisions made by a Ratelimiter.
+type Stats struct {
+	AllowedIPv4 uint64
+	AllowedIPv6 uint64
+	DeniedIPv4  uint64
+	DeniedIPv6  uint64
+}
+
+// Allowed returns the number of packets allowed from sources of either family.
+func (s Stats) Allowed() uint64 {
+	return s.AllowedIPv4 + s.AllowedIPv6
+}
+
+// Denied returns the number of packets denied from sources of either family.
+func (s Stats) Denied() uint64 {
+	return s.DeniedIPv4 + s.DeniedIPv6
+}
+
+// An OverflowPolicy decides how a Ratelimiter with Options.MaxEntries
+// handles packets from a new source once it is tracking as many sources as it may.
+type OverflowPolicy int
+
+const (
+	// OverflowEvict evicts a source that has not sent packets recently to make room,
+	// preferring one that shares an internal shard with the new source.
+	OverflowEvict OverflowPolicy = iota
+	// OverflowDeny rate limits new sources until room is made by collecting idle entries.
+	OverflowDeny
 )
 
+// shardCount is the number of independently locked tables a Ratelimiter
+// spreads its entries over. It must be a power of two.
+const shardCount = 16
+
 type RatelimiterEntry struct {
-	mu       sync.Mutex
-	lastTime time.Time
-	tokens   int64
+	mu         sync.Mutex
+	lastTime   time.Time
+	tokens     int64
+	referenced bool // used since the clock hand last passed, protected by mu
+
+	// protected by the shard's mu
+	key   [net.IPv6len]byte // table key; IPv4 keys occupy the first four bytes
+	ipv4  bool              // whether the entry is in tableIPv4
+	index int               // position in the shard's clock
+}
+
+type ratelimiterShard struct {
+	mu        sync.RWMutex
+	tableIPv4 map[[net.IPv4len]byte]*RatelimiterEntry
+	tableIPv6 map[[net.IPv6len]byte]*RatelimiterEntry
+
+	// Entries are also kept in clock, which is walked by sweep to collect idle entries
+	// and, when bounded by Options.MaxEntries, swept by hand to find an entry
+	// to evict (the CLOCK algorithm).
+	clock []*RatelimiterEntry
+	hand  int
+	sweep int
 }
 
 type Ratelimiter struct {
-	mu      sync.RWMutex
+	// These fields are accessed atomically and so must be 64-bit aligned,
+	// which Go guarantees for the first words of an allocated struct.
+	entries      int64     // number of entries across all shards
+	calls        uint64    // number of calls to allow, to pace sweeping
+	allowed      [2]uint64 // indexed by family, 0 for IPv4 and 1 for IPv6
+	denied       [2]uint64
+	lastOnDenied int64 // time of the last OnDenied call in nanoseconds, 0 if none
+
+	mu      sync.RWMutex // protects the fields below against Init
 	timeNow func() time.Time
+	opts    Options
 
-	stopReset chan struct{} // send to reset, close to stop
-	tableIPv4 map[[net.IPv4len]byte]*RatelimiterEntry
-	tableIPv6 map[[net.IPv6len]byte]*RatelimiterEntry
+	packetCost int64
+	maxTokens  int64
+	seed       uint32 // randomizes shard selection
+
+	exempt atomic.Value // exemptSet of sources that are never limited
+	shards [shardCount]ratelimiterShard
 }
 
-func (rate *Ratelimiter) Close() {
-	rate.mu.Lock()
-	defer rate.mu.Unlock()
+// New returns an initialized Ratelimiter enforcing the rates given by opts.
+// The zero Ratelimiter, once Init is called, is equivalent to New(Options{}).
+func New(opts Options) *Ratelimiter {
+	rate := &Ratelimiter{opts: opts}
+	rate.Init()
+	return rate
+}
 
-	if rate.stopReset != nil {
-		close(rate.stopReset)
-	}
+// Close does nothing. Idle entries are collected by Allow as it goes,
+// so a Ratelimiter has no background work to stop.
+func (rate *Ratelimiter) Close() {
 }
 
+// Init resets the Ratelimiter.
+// It must not be called concurrently with Allow.
 func (rate *Ratelimiter) Init() {
 	rate.mu.Lock()
 	defer rate.mu.Unlock()
 
-	if rate.timeNow == nil {
+	if rate.opts.TimeNow != nil {
+		rate.timeNow = rate.opts.TimeNow
+	} else if rate.timeNow == nil {
 		rate.timeNow = time.Now
 	}
 
-	// stop any ongoing garbage collection routine
-	if rate.stopReset != nil {
-		close(rate.stopReset)
-	}
-
-	rate.stopReset = make(chan struct{})
-	rate.tableIPv4 = make(map[[net.IPv4len]byte]*RatelimiterEntry)
-	rate.tableIPv6 = make(map[[net.IPv6len]byte]*RatelimiterEntry)
-
-	stopReset := rate.stopReset // store in case Init is called again.
-
-	// Start garbage collection routine.
-	go func() {
-		ticker := time.NewTicker(time.Second)
-		ticker.Stop()
-		for {
-			select {
-			case _, ok := <-stopReset:
-				ticker.Stop()
-				if !ok {
-					return
-				}
-				ticker = time.NewTicker(time.Second)
-			case <-ticker.C:
-				if rate.cleanup() {
-					ticker.Stop()
-				}
+	if rate.opts.PacketsPerSecond <= 0 {
+		rate.opts.PacketsPerSecond = packetsPerSecond
+	}
+	if rate.opts.Burst <= 0 {
+		rate.opts.Burst = packetsBurstable
+	}
+	if rate.opts.EntryLifetime <= 0 {
+		rate.opts.EntryLifetime = entryLifetime
+	}
+	if rate.opts.IPv6PrefixLen <= 0 || rate.opts.IPv6PrefixLen > 8*net.IPv6len {
+		rate.opts.IPv6PrefixLen = ipv6PrefixLen
+	}
+	if rate.opts.OnDeniedInterval <= 0 {
+		rate.opts.OnDeniedInterval = onDeniedInterval
+	}
+	rate.packetCost = time.Second.Nanoseconds() / rate.opts.PacketsPerSecond
+	rate.maxTokens = rate.packetCost * rate.opts.Burst
+	rate.seed = rand.Uint32()
+
+	for i := range rate.shards {
+		shard := &rate.shards[i]
+		shard.mu.Lock()
+		shard.tableIPv4 = make(map[[net.IPv4len]byte]*RatelimiterEntry)
+		shard.tableIPv6 = make(map[[net.IPv6len]byte]*RatelimiterEntry)
+		shard.clock = nil
+		shard.hand = 0
+		shard.sweep = 0
+		shard.mu.Unlock()
+	}
+	atomic.StoreInt64(&rate.entries, 0)
+	atomic.StoreUint64(&rate.calls, 0)
+	for i := range rate.allowed {
+		atomic.StoreUint64(&rate.allowed[i], 0)
+		atomic.StoreUint64(&rate.denied[i], 0)
+	}
+	atomic.StoreInt64(&rate.lastOnDenied, 0)
+
+}
+
+// Cleanup removes the entries of sources that have been idle for longer
+// than Options.EntryLifetime and reports whether no entries remain.
+// Allow removes idle entries a few at a time as it goes,
+// so Cleanup need only be called to collect them all at once.
+func (rate *Ratelimiter) Cleanup() (empty bool) {
+	rate.mu.RLock()
+	defer rate.mu.RUnlock()
+
+	now := rate.timeNow()
+	for i := range rate.shards {
+		shard := &rate.shards[i]
+		shard.mu.Lock()
+		// Walk backwards so that removal, which moves the last entry
+		// into the removed one's place, only moves entries already seen.
+		for j := len(shard.clock) - 1; j >= 0; j-- {
+			if rate.idle(shard.clock[j], now) {
+				rate.remove(shard, shard.clock[j])
 			}
 		}
-	}()
+		shard.mu.Unlock()
+	}
+
+	return atomic.LoadInt64(&rate.entries) == 0
 }
 
-func (rate *Ratelimiter) cleanup() (empty bool) {
-	rate.mu.Lock()
-	defer rate.mu.Unlock()
+// maybeSweep checks a batch of entries of one shard for idleness,
+// if it is this call's turn to do so, moving to the next shard each time.
+func (rate *Ratelimiter) maybeSweep() {
+	calls := atomic.AddUint64(&rate.calls, 1)
+	if calls%sweepEvery != 0 {
+		return
+	}
+	shard := &rate.shards[(calls/sweepEvery)%shardCount]
+	now := rate.timeNow()
+	shard.mu.Lock()
+	for i := 0; i < sweepBatch && len(shard.clock) > 0; i++ {
+		if shard.sweep >= len(shard.clock) {
+			shard.sweep = 0
+		}
+		entry := shard.clock[shard.sweep]
+		if rate.idle(entry, now) {
+			// the last entry takes its place, to be checked next
+			rate.remove(shard, entry)
+		} else {
+			shard.sweep++
+		}
+	}
+	shard.mu.Unlock()
+}
 
-	for key, entry := range rate.tableIPv4 {
-		entry.mu.Lock()
-		if rate.timeNow().Sub(entry.lastTime) > garbageCollectTime {
-			delete(rate.tableIPv4, key)
+// idle reports whether entry has been idle for longer than Options.EntryLifetime.
+func (rate *Ratelimiter) idle(entry *RatelimiterEntry, now time.Time) bool {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return now.Sub(entry.lastTime) > rate.opts.EntryLifetime
+}
+
+// remove removes entry from the shard.
+// The caller must hold shard.mu.
+func (rate *Ratelimiter) remove(shard *ratelimiterShard, entry *RatelimiterEntry) {
+	unlink(shard, entry)
+	atomic.AddInt64(&rate.entries, -1)
+}
+
+// unlink removes entry from the shard without uncounting it from rate.entries.
+// The caller must hold shard.mu.
+func unlink(shard *ratelimiterShard, entry *RatelimiterEntry) {
+	if entry.ipv4 {
+		delete(shard.tableIPv4, *(*[net.IPv4len]byte)(entry.key[:net.IPv4len]))
+	} else {
+		delete(shard.tableIPv6, entry.key)
+	}
+	last := len(shard.clock) - 1
+	shard.clock[entry.index] = shard.clock[last]
+	shard.clock[entry.index].index = entry.index
+	shard.clock[last] = nil
+	shard.clock = shard.clock[:last]
+	if shard.hand >= len(shard.clock) {
+		shard.hand = 0
+	}
+}
+
+// makeRoom counts one more entry, to be added to the shard, in rate.entries,
+// evicting an entry if needed and allowed, and reports whether it succeeded.
+// The caller must hold shard.mu.
+func (rate *Ratelimiter) makeRoom(shard *ratelimiterShard) bool {
+	if rate.opts.MaxEntries <= 0 {
+		atomic.AddInt64(&rate.entries, 1)
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(&rate.entries)
+		if n >= int64(rate.opts.MaxEntries) {
+			break
+		}
+		if atomic.CompareAndSwapInt64(&rate.entries, n, n+1) {
+			return true
 		}
-		entry.mu.Unlock()
+	}
+	if rate.opts.Overflow == OverflowDeny {
+		return false
 	}
 
-	for key, entry := range rate.tableIPv6 {
-		entry.mu.Lock()
-		if rate.timeNow().Sub(entry.lastTime) > garbageCollectTime {
-			delete(rate.tableIPv6, key)
+	// The new entry takes the place of the evicted one in rate.entries.
+	if len(shard.clock) > 0 {
+		evict(shard)
+		return true
+	}
+	// Evict from another shard instead. Waiting for its lock while holding
+	// this one's could deadlock against a caller doing the opposite,
+	// so shards that are busy are skipped.
+	start := atomic.LoadUint64(&rate.calls)
+	for i := uint64(0); i < shardCount; i++ {
+		other := &rate.shards[(start+i)%shardCount]
+		if other == shard || !other.mu.TryLock() {
+			continue
 		}
+		if len(other.clock) > 0 {
+			evict(other)
+			other.mu.Unlock()
+			return true
+		}
+		other.mu.Unlock()
+	}
+	return false
+}
+
+// evict unlinks an entry of the shard that was not used recently.
+// The shard must not be empty. The caller must hold shard.mu.
+func evict(shard *ratelimiterShard) {
+	// Advance the hand, giving a second chance to recently used entries,
+	// until it finds one that was not. This takes at most one full turn.
+	for {
+		entry := shard.clock[shard.hand]
+		entry.mu.Lock()
+		referenced := entry.referenced
+		entry.referenced = false
 		entry.mu.Unlock()
+		if !referenced {
+			unlink(shard, entry)
+			return
+		}
+		shard.hand = (shard.hand + 1) % len(shard.clock)
 	}
+}
 
-	return len(rate.tableIPv4) == 0 && len(rate.tableIPv6) == 0
+// shard returns the shard responsible for key.
+func (rate *Ratelimiter) shard(key []byte) *ratelimiterShard {
+	// FNV-1a
+	h := 2166136261 ^ rate.seed
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return &rate.shards[h&(shardCount-1)]
 }
 
+// maskIPv6 clears all but the leading bits of key.
+func maskIPv6(key *[net.IPv6len]byte, bits int) {
+	for i := range key {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			key[i] &= 0xff << (8 - bits)
+			bits = 0
+		default:
+			key[i] = 0
+		}
+	}
+}
+
+// Allow is like AllowAddr, but takes a net.IP.
 func (rate *Ratelimiter) Allow(ip net.IP) bool {
+	return rate.AllowN(ip, 1)
+}
+
+// AllowN is like AllowAddrN, but takes a net.IP.
+func (rate *Ratelimiter) AllowN(ip net.IP, n int) bool {
+	addr, _ := netip.AddrFromSlice(ip)
+	return rate.AllowAddrN(addr, n)
+}
+
+// AllowAddr reports whether a packet from ip is within its rate limit,
+// and if so, charges the packet against it.
+// IPv4 addresses are limited individually, IPv6 addresses by prefix.
+// IPv4-mapped IPv6 addresses are treated as IPv4 addresses.
+func (rate *Ratelimiter) AllowAddr(ip netip.Addr) bool {
+	return rate.AllowAddrN(ip, 1)
+}
+
+// AllowAddrN is like AllowAddr, but charges an operation as costly as n packets.
+// Either the whole cost is charged or, if ip lacks the tokens, none of it.
+// A cost of more than Options.Burst packets is always denied, as is a cost below 1.
+// Each call counts as one decision in Stats.
+func (rate *Ratelimiter) AllowAddrN(ip netip.Addr, n int) bool {
+	IPv4 := ip.Is4() || ip.Is4In6()
+	family := 1
+	if IPv4 {
+		family = 0
+	}
+	if rate.allow(ip, IPv4, n) {
+		atomic.AddUint64(&rate.allowed[family], 1)
+		return true
+	}
+	atomic.AddUint64(&rate.denied[family], 1)
+	if rate.opts.OnDenied != nil {
+		rate.notifyDenied()
+	}
+	return false
+}
+
+// Stats returns a snapshot of the decisions made since Init.
+func (rate *Ratelimiter) Stats() Stats {
+	return Stats{
+		AllowedIPv4: atomic.LoadUint64(&rate.allowed[0]),
+		AllowedIPv6: atomic.LoadUint64(&rate.allowed[1]),
+		DeniedIPv4:  atomic.LoadUint64(&rate.denied[0]),
+		DeniedIPv6:  atomic.LoadUint64(&rate.denied[1]),
+	}
+}
+
+// notifyDenied calls the OnDenied callback, unless it was called too recently.
+func (rate *Ratelimiter) notifyDenied() {
+	now := rate.timeNow().UnixNano()
+	last := atomic.LoadInt64(&rate.lastOnDenied)
+	if last != 0 && now-last < rate.opts.OnDeniedInterval.Nanoseconds() {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&rate.lastOnDenied, last, now) {
+		rate.opts.OnDenied(rate.Stats())
+	}
+}
+
+func (rate *Ratelimiter) allow(ip netip.Addr, IPv4 bool, n int) bool {
 	var entry *RatelimiterEntry
 	var keyIPv4 [net.IPv4len]byte
 	var keyIPv6 [net.IPv6len]byte
+	var shard *ratelimiterShard
 
-	// lookup entry
-
-	IPv4 := ip.To4()
-	IPv6 := ip.To16()
+	if rate.isExempt(ip) {
+		return true
+	}
+	rate.maybeSweep()
+	if n < 1 || int64(n) > rate.opts.Burst {
+		return false
+	}
+	cost := int64(n) * rate.packetCost
 
-	rate.mu.RLock()
+	// lookup entry
 
-	if IPv4 != nil {
-		copy(keyIPv4[:], IPv4)
-		entry = rate.tableIPv4[keyIPv4]
+	if IPv4 {
+		keyIPv4 = ip.Unmap().As4()
+		shard = rate.shard(keyIPv4[:])
+		shard.mu.RLock()
+		entry = shard.tableIPv4[keyIPv4]
 	} else {
-		copy(keyIPv6[:], IPv6)
-		entry = rate.tableIPv6[keyIPv6]
+		keyIPv6 = ip.As16()
+		maskIPv6(&keyIPv6, rate.opts.IPv6PrefixLen)
+		shard = rate.shard(keyIPv6[:])
+		shard.mu.RLock()
+		entry = shard.tableIPv6[keyIPv6]
 	}
 
-	rate.mu.RUnlock()
+	shard.mu.RUnlock()
 
 	// make new entry if not found
 
 	if entry == nil {
+		var existing *RatelimiterEntry
 		entry = new(RatelimiterEntry)
-		entry.tokens = maxTokens - packetCost
+		entry.tokens = rate.maxTokens - cost
 		entry.lastTime = rate.timeNow()
-		rate.mu.Lock()
-		if IPv4 != nil {
-			rate.tableIPv4[keyIPv4] = entry
-			if len(rate.tableIPv4) == 1 && len(rate.tableIPv6) == 0 {
-				rate.stopReset <- struct{}{}
-			}
+		shard.mu.Lock()
+		if IPv4 {
+			existing = shard.tableIPv4[keyIPv4]
 		} else {
-			rate.tableIPv6[keyIPv6] = entry
-			if len(rate.tableIPv6) == 1 && len(rate.tableIPv4) == 0 {
-				rate.stopReset <- struct{}{}
+			existing = shard.tableIPv6[keyIPv6]
+		}
+		if existing == nil {
+			if !rate.makeRoom(shard) {
+				shard.mu.Unlock()
+				return false
 			}
+			if IPv4 {
+				shard.tableIPv4[keyIPv4] = entry
+				copy(entry.key[:], keyIPv4[:])
+				entry.ipv4 = true
+			} else {
+				shard.tableIPv6[keyIPv6] = entry
+				entry.key = keyIPv6
+			}
+			entry.index = len(shard.clock)
+			shard.clock = append(shard.clock, entry)
 		}
-		rate.mu.Unlock()
-		return true
+		shard.mu.Unlock()
+		if existing == nil {
+			return true
+		}
+		// another packet from the same source got here first
+		entry = existing
 	}
 
 	// add tokens to entry
 
 	entry.mu.Lock()
+	entry.referenced = true
 	now := rate.timeNow()
 	entry.tokens += now.Sub(entry.lastTime).Nanoseconds()
 	entry.lastTime = now
-	if entry.tokens > maxTokens {
-		entry.tokens = maxTokens
+	if entry.tokens > rate.maxTokens {
+		entry.tokens = rate.maxTokens
 	}
 
 	// subtract cost of packet
 
-	if entry.tokens > packetCost {
-		entry.tokens -= packetCost
+	if entry.tokens >= cost {
+		entry.tokens -= cost
 		entry.mu.Unlock()
 		return true
 	}
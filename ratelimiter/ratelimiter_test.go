@@ -6,7 +6,12 @@
 package ratelimiter
 
 import (
+	"fmt"
+	"math/rand"
 	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,6 +22,18 @@ type result struct {
 	wait    time.Duration
 }
 
+// tableSizes returns the number of IPv4 and IPv6 entries in rate.
+func tableSizes(rate *Ratelimiter) (v4, v6 int) {
+	for i := range rate.shards {
+		shard := &rate.shards[i]
+		shard.mu.RLock()
+		v4 += len(shard.tableIPv4)
+		v6 += len(shard.tableIPv6)
+		shard.mu.RUnlock()
+	}
+	return
+}
+
 func TestRatelimiter(t *testing.T) {
 	var rate Ratelimiter
 	var expectedResults []result
@@ -92,16 +109,9 @@ func TestRatelimiter(t *testing.T) {
 	rate.timeNow = func() time.Time {
 		return now
 	}
-	defer func() {
-		// Lock to avoid data race with cleanup goroutine from Init.
-		rate.mu.Lock()
-		defer rate.mu.Unlock()
-
-		rate.timeNow = time.Now
-	}()
 	timeSleep := func(d time.Duration) {
 		now = now.Add(d + 1)
-		rate.cleanup()
+		rate.Cleanup()
 	}
 
 	rate.Init()
@@ -117,3 +127,559 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func TestRatelimiterOptions(t *testing.T) {
+	now := time.Now()
+	timeSleep := func(d time.Duration) {
+		now = now.Add(d + 1)
+	}
+	newRatelimiter := func(opts Options) *Ratelimiter {
+		opts.TimeNow = func() time.Time {
+			return now
+		}
+		rate := New(opts)
+		t.Cleanup(rate.Close)
+		return rate
+	}
+
+	slow := newRatelimiter(Options{})
+	fast := newRatelimiter(Options{PacketsPerSecond: 1000, Burst: 50})
+
+	burst := func(rate *Ratelimiter, ip net.IP) (n int) {
+		for {
+			timeSleep(0)
+			if !rate.Allow(ip) {
+				return n
+			}
+			n++
+		}
+	}
+
+	ip := net.ParseIP("192.168.1.1")
+	for _, text := range []string{"initial burst", "burst after refill"} {
+		if n := burst(slow, ip); n != packetsBurstable {
+			t.Errorf("%s: default ratelimiter allowed %d packets, want %d", text, n, packetsBurstable)
+		}
+		if n := burst(fast, ip); n != 50 {
+			t.Errorf("%s: configured ratelimiter allowed %d packets, want %d", text, n, 50)
+		}
+		timeSleep(time.Second)
+	}
+
+	// Drain both, then wait long enough for the configured ratelimiter
+	// to refill a single packet, but not the default one.
+	burst(slow, ip)
+	burst(fast, ip)
+	timeSleep(time.Millisecond)
+	if slow.Allow(ip) {
+		t.Error("default ratelimiter allowed packet after 1ms")
+	}
+	if !fast.Allow(ip) {
+		t.Error("configured ratelimiter denied packet after 1ms")
+	}
+}
+
+func TestRatelimiterAddrMatchesIP(t *testing.T) {
+	var rate Ratelimiter
+	rate.Init()
+	defer rate.Close()
+
+	// IPv4-mapped IPv6 addresses share the entry of the IPv4 address.
+	ips := []net.IP{
+		net.ParseIP("192.168.1.1"),
+		net.ParseIP("::ffff:192.168.1.1"),
+	}
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.168.1.1"),
+		netip.MustParseAddr("::ffff:192.168.1.1"),
+	}
+	allowed := 0
+	for i := 0; i < packetsBurstable*2; i++ {
+		if rate.Allow(ips[i%len(ips)]) {
+			allowed++
+		}
+		if rate.AllowAddr(addrs[i%len(addrs)]) {
+			allowed++
+		}
+	}
+	if allowed >= packetsBurstable*2 {
+		t.Errorf("allowed %d packets from a single source, want fewer than %d", allowed, packetsBurstable*2)
+	}
+	if v4, v6 := tableSizes(&rate); v4 != 1 || v6 != 0 {
+		t.Errorf("got %d IPv4 and %d IPv6 entries, want 1 and 0", v4, v6)
+	}
+}
+
+func BenchmarkAllowAddr(b *testing.B) {
+	var rate Ratelimiter
+	rate.Init()
+	defer rate.Close()
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.168.1.1"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rate.AllowAddr(addrs[i%len(addrs)])
+	}
+}
+
+func TestRatelimiterIPv6Prefix(t *testing.T) {
+	exhaust := func(rate *Ratelimiter, ip netip.Addr) {
+		for rate.AllowAddr(ip) {
+		}
+	}
+
+	tests := []struct {
+		opts   Options
+		a, b   string
+		shared bool
+	}{
+		{Options{}, "2001:db8:a:b::1", "2001:db8:a:b:ffff:ffff:ffff:fffe", true},
+		{Options{}, "2001:db8:a:b::1", "2001:db8:a:c::1", false},
+		{Options{IPv6PrefixLen: 56}, "2001:db8:a:b::1", "2001:db8:a:c::1", true},
+		{Options{IPv6PrefixLen: 56}, "2001:db8:a:b::1", "2001:db8:a:10b::1", false},
+		{Options{IPv6PrefixLen: 128}, "2001:db8:a:b::1", "2001:db8:a:b::2", false},
+	}
+	for _, tt := range tests {
+		rate := New(tt.opts)
+		a, b := netip.MustParseAddr(tt.a), netip.MustParseAddr(tt.b)
+		exhaust(rate, a)
+		if shared := !rate.AllowAddr(b); shared != tt.shared {
+			t.Errorf("IPv6PrefixLen=%d: %s and %s share a bucket: %v, want %v", tt.opts.IPv6PrefixLen, a, b, shared, tt.shared)
+		}
+		rate.Close()
+	}
+}
+
+// TestRatelimiterConcurrency mixes Allow, cleanup and Close.
+// It is intended to be used with the race detector.
+func TestRatelimiterConcurrency(t *testing.T) {
+	rate := New(Options{EntryLifetime: time.Nanosecond})
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rate.AllowAddr(netip.AddrFrom4([4]byte{10, byte(i), byte(n >> 8), byte(n)}))
+				rate.AllowAddr(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i), byte(n >> 8), byte(n)}))
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rate.Cleanup()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	rate.Close()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
+
+func TestRatelimiterShardsLimitPerSource(t *testing.T) {
+	now := time.Now()
+	rate := New(Options{TimeNow: func() time.Time { return now }})
+	defer rate.Close()
+
+	// With the clock stopped, every source gets its burst and no more,
+	// however many other sources are being limited concurrently.
+	const sources = 256
+	var wg sync.WaitGroup
+	allowed := make([]int, sources)
+	for i := 0; i < sources; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+			for j := 0; j < 2*packetsBurstable; j++ {
+				if rate.AllowAddr(ip) {
+					allowed[i]++
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, n := range allowed {
+		if n != packetsBurstable {
+			t.Errorf("source %d: allowed %d packets, want %d", i, n, packetsBurstable)
+		}
+	}
+
+	used := 0
+	for i := range rate.shards {
+		if len(rate.shards[i].tableIPv4) != 0 {
+			used++
+		}
+	}
+	if used < shardCount/2 {
+		t.Errorf("%d sources spread over only %d of %d shards", sources, used, shardCount)
+	}
+}
+
+func BenchmarkAllowParallel(b *testing.B) {
+	rate := New(Options{})
+	defer rate.Close()
+
+	var id uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		g := atomic.AddUint32(&id, 1)
+		var n uint32
+		for pb.Next() {
+			// Mostly unique sources, as in a handshake flood.
+			n++
+			rate.AllowAddr(netip.AddrFrom4([4]byte{byte(g), byte(n >> 16), byte(n >> 8), byte(n)}))
+		}
+	})
+}
+
+func TestRatelimiterMaxEntries(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowEvict, OverflowDeny} {
+		const maxEntries = 100
+		now := time.Now()
+		rate := New(Options{
+			MaxEntries: maxEntries,
+			Overflow:   policy,
+			TimeNow: func() time.Time {
+				return now
+			},
+		})
+
+		legit := netip.MustParseAddr("192.168.1.1")
+		if !rate.AllowAddr(legit) {
+			t.Fatalf("policy %d: first packet from legitimate source denied", policy)
+		}
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 100000; i++ {
+			var b [4]byte
+			rnd.Read(b[:])
+			rate.AllowAddr(netip.AddrFrom4(b))
+			if i%20 == 0 {
+				// The legitimate source sends at exactly its permitted rate.
+				now = now.Add(time.Second/packetsPerSecond + 1)
+				if !rate.AllowAddr(legit) {
+					t.Fatalf("policy %d: packet %d from legitimate source denied", policy, i)
+				}
+			}
+			if v4, v6 := tableSizes(rate); v4+v6 > maxEntries {
+				t.Fatalf("policy %d: %d entries after %d packets, want at most %d", policy, v4+v6, i, maxEntries)
+			}
+		}
+		rate.Close()
+	}
+}
+
+func TestRatelimiterMaxEntriesBelowShards(t *testing.T) {
+	const maxEntries = shardCount / 4
+	const sources = 4 * shardCount
+	for _, policy := range []OverflowPolicy{OverflowEvict, OverflowDeny} {
+		rate := New(Options{MaxEntries: maxEntries, Overflow: policy})
+		allowed := 0
+		for i := 0; i < sources; i++ {
+			if rate.AllowAddr(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})) {
+				allowed++
+			}
+		}
+		want := sources
+		if policy == OverflowDeny {
+			want = maxEntries
+		}
+		if allowed != want {
+			t.Errorf("policy %d: %d of %d new sources allowed, want %d", policy, allowed, sources, want)
+		}
+		if v4, v6 := tableSizes(rate); v4+v6 != maxEntries || rate.Len() != maxEntries {
+			t.Errorf("policy %d: %d entries in tables and %d counted, want %d", policy, v4+v6, rate.Len(), maxEntries)
+		}
+		rate.Close()
+	}
+}
+
+func TestRatelimiterStats(t *testing.T) {
+	now := time.Now()
+	var notified []Stats
+	rate := New(Options{
+		OnDenied: func(s Stats) {
+			notified = append(notified, s)
+		},
+		OnDeniedInterval: time.Second,
+		TimeNow: func() time.Time {
+			return now
+		},
+	})
+	defer rate.Close()
+
+	v4 := netip.MustParseAddr("192.168.1.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+
+	// Without time passing, a new source gets its burst and no more.
+	const sent = 20
+	const allowed = packetsBurstable
+	for i := 0; i < sent; i++ {
+		rate.AllowAddr(v4)
+		rate.AllowAddr(v6)
+	}
+	want := Stats{
+		AllowedIPv4: allowed,
+		AllowedIPv6: allowed,
+		DeniedIPv4:  sent - allowed,
+		DeniedIPv6:  sent - allowed,
+	}
+	if got := rate.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if got := rate.Stats().Denied(); got != 2*(sent-allowed) {
+		t.Errorf("Stats().Denied() = %d, want %d", got, 2*(sent-allowed))
+	}
+	if len(notified) != 1 || notified[0].Denied() != 1 {
+		t.Fatalf("OnDenied called with %+v, want a single call after the first denial", notified)
+	}
+
+	now = now.Add(time.Second)
+	for i := 0; i < sent; i++ {
+		rate.AllowAddr(v4)
+	}
+	if len(notified) != 2 {
+		t.Errorf("OnDenied called %d times after its interval passed, want 2", len(notified))
+	}
+}
+
+func TestRatelimiterExempt(t *testing.T) {
+	rate := New(Options{})
+	defer rate.Close()
+
+	// allowsBurst reports whether rate allows more than a burst of packets from ip.
+	allowsBurst := func(ip string) bool {
+		addr := netip.MustParseAddr(ip)
+		for i := 0; i < 2*packetsBurstable; i++ {
+			if !rate.AllowAddr(addr) {
+				return false
+			}
+		}
+		return true
+	}
+
+	rate.SetExempt([]netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.128/25"),
+		netip.MustParsePrefix("2001:db8:1::/48"),
+	})
+	tests := []struct {
+		ip     string
+		exempt bool
+	}{
+		{"10.2.3.4", true},
+		{"::ffff:10.2.3.4", true},
+		{"11.0.0.1", false},
+		{"192.168.1.200", true},
+		{"192.168.1.100", false},
+		{"2001:db8:1:ffff::1", true},
+		{"2001:db8:2::1", false},
+	}
+	for _, tt := range tests {
+		if got := allowsBurst(tt.ip); got != tt.exempt {
+			t.Errorf("%s exempt = %v, want %v", tt.ip, got, tt.exempt)
+		}
+	}
+	v4, v6 := tableSizes(rate)
+	if v4 != 2 || v6 != 1 {
+		t.Errorf("got %d IPv4 and %d IPv6 entries, want entries only for the 3 non-exempt sources", v4, v6)
+	}
+
+	// Replace the list at runtime.
+	rate.SetExempt([]netip.Prefix{netip.MustParsePrefix("11.0.0.0/8")})
+	if allowsBurst("10.200.0.1") {
+		t.Error("10.200.0.1 still exempt after replacing the list")
+	}
+	if !allowsBurst("11.0.0.2") {
+		t.Error("11.0.0.2 not exempt after replacing the list")
+	}
+	rate.SetExempt(nil)
+	if allowsBurst("11.0.0.3") {
+		t.Error("11.0.0.3 still exempt after clearing the list")
+	}
+}
+
+func TestRatelimiterEntryLifetime(t *testing.T) {
+	for _, lifetime := range []time.Duration{0, 5 * time.Second} {
+		now := time.Now()
+		rate := New(Options{
+			EntryLifetime: lifetime,
+			TimeNow: func() time.Time {
+				return now
+			},
+		})
+		if lifetime == 0 {
+			lifetime = entryLifetime
+		}
+
+		rate.AllowAddr(netip.MustParseAddr("192.168.1.1"))
+		rate.AllowAddr(netip.MustParseAddr("2001:db8::1"))
+		now = now.Add(lifetime)
+		if rate.Cleanup() {
+			t.Errorf("lifetime %v: entries collected after being idle for exactly their lifetime", lifetime)
+		}
+		if v4, v6 := tableSizes(rate); v4 != 1 || v6 != 1 {
+			t.Errorf("lifetime %v: tables have %d and %d entries, want 1 and 1", lifetime, v4, v6)
+		}
+		now = now.Add(1)
+		if !rate.Cleanup() {
+			t.Errorf("lifetime %v: entries survived being idle for longer than their lifetime", lifetime)
+		}
+		rate.Close()
+	}
+}
+
+func TestRatelimiterSweep(t *testing.T) {
+	now := time.Now()
+	rate := New(Options{TimeNow: func() time.Time { return now }})
+	defer rate.Close()
+
+	const sources = 10000
+	for i := 0; i < sources; i++ {
+		rate.AllowAddr(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}))
+		rate.AllowAddr(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 8), byte(i)}))
+	}
+	if v4, v6 := tableSizes(rate); v4 != sources || v6 != sources {
+		t.Fatalf("tables have %d and %d entries, want %d each", v4, v6, sources)
+	}
+
+	// Once they fall idle, a single other source's traffic is enough to sweep them all out,
+	// after a number of packets proportional to the number of entries.
+	now = now.Add(entryLifetime + 1)
+	active := netip.MustParseAddr("192.168.1.1")
+	for i := 0; i < 4*sources*sweepEvery/sweepBatch; i++ {
+		now = now.Add(time.Second / packetsPerSecond)
+		rate.AllowAddr(active)
+	}
+	if v4, v6 := tableSizes(rate); v4 != 1 || v6 != 0 {
+		t.Errorf("tables have %d and %d entries after sweeping, want 1 and 0", v4, v6)
+	}
+	if n := atomic.LoadInt64(&rate.entries); n != 1 {
+		t.Errorf("entry count is %d, want 1", n)
+	}
+}
+
+func BenchmarkAllowSweep(b *testing.B) {
+	for _, idle := range []int{0, 1000, 100000} {
+		b.Run(fmt.Sprintf("idle=%d", idle), func(b *testing.B) {
+			now := time.Now()
+			rate := New(Options{TimeNow: func() time.Time { return now }})
+			defer rate.Close()
+			for i := 0; i < idle; i++ {
+				rate.AllowAddr(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}))
+			}
+			now = now.Add(entryLifetime + 1)
+
+			// New sources arrive while the idle ones are being swept.
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rate.AllowAddr(netip.AddrFrom4([4]byte{172, byte(i >> 16), byte(i >> 8), byte(i)}))
+			}
+		})
+	}
+}
+
+func TestRatelimiterAllowN(t *testing.T) {
+	now := time.Now()
+	rate := New(Options{TimeNow: func() time.Time { return now }})
+	defer rate.Close()
+
+	const cost = time.Second / packetsPerSecond
+	ip := net.ParseIP("192.168.1.1")
+	for i, step := range []struct {
+		advance time.Duration
+		n       int
+		allowed bool
+	}{
+		{0, 2, true},                // new source starts with a full bucket: 5 - 2 = 3 left
+		{0, 2, true},                // 1 left
+		{0, 2, false},               // 1 is not enough for 2; nothing is charged
+		{0, 1, true},                // but is for 1, which takes the last token
+		{cost, 1, true},             // refilled to 1, none left
+		{2*cost - 1, 2, false},      // a nanosecond short of 2
+		{1, 2, true},                // but not a nanosecond more
+		{time.Second, 6, false},     // more than the burst never fits
+		{0, 0, false},               // nor does nothing
+		{0, packetsBurstable, true}, // a full bucket pays its whole size
+		{0, 1, false},
+	} {
+		now = now.Add(step.advance)
+		if got := rate.AllowN(ip, step.n); got != step.allowed {
+			t.Errorf("step %d: AllowN(%d) = %v, want %v", i, step.n, got, step.allowed)
+		}
+	}
+	if got, want := rate.Stats().Allowed(), uint64(6); got != want {
+		t.Errorf("allowed %d calls, want %d", got, want)
+	}
+}
+
+func TestRatelimiterSnapshot(t *testing.T) {
+	start := time.Now()
+	now := start
+	rate := New(Options{TimeNow: func() time.Time { return now }})
+	defer rate.Close()
+
+	const cost = time.Second / packetsPerSecond
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("2001:db8:1:2::5")
+	c := netip.MustParseAddr("192.0.2.3")
+	rate.AllowAddr(a) // 4 of 5 left
+	now = now.Add(cost / 5)
+	for i := 0; i < 3; i++ {
+		rate.AllowAddr(b) // 2 of 5 left
+	}
+	now = now.Add(cost / 5)
+	rate.AllowAddr(c) // 4 of 5 left
+
+	if n := rate.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	want := []BucketInfo{
+		{netip.PrefixFrom(c, 32), 4.0 / 5, start.Add(2 * cost / 5)},
+		{netip.MustParsePrefix("2001:db8:1:2::/64"), 2.2 / 5, start.Add(cost / 5)},
+		{netip.PrefixFrom(a, 32), 4.4 / 5, start},
+	}
+	for _, limit := range []int{-1, 3, 2, 0} {
+		got := rate.Snapshot(limit)
+		n := len(want)
+		if limit >= 0 && limit < n {
+			n = limit
+		}
+		if len(got) != n {
+			t.Errorf("Snapshot(%d) returned %d buckets, want %d", limit, len(got), n)
+			continue
+		}
+		for i := range got {
+			if got[i].Source != want[i].Source || !got[i].LastSeen.Equal(want[i].LastSeen) ||
+				got[i].Tokens < want[i].Tokens-1e-9 || got[i].Tokens > want[i].Tokens+1e-9 {
+				t.Errorf("Snapshot(%d)[%d] = %+v, want %+v", limit, i, got[i], want[i])
+			}
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if got := rate.Snapshot(-1); len(got) != 3 || got[0].Tokens != 1 {
+		t.Errorf("Snapshot after an hour = %+v, want 3 full buckets", got)
+	}
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package ratelimiter
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// BucketInfo describes the state of one source tracked by a Ratelimiter.
+type BucketInfo struct {
+	Source   netip.Prefix // an IPv4 address, or an IPv6 prefix of Options.IPv6PrefixLen bits
+	Tokens   float64      // tokens available now, as a fraction of a full burst
+	LastSeen time.Time    // time of the source's last packet
+}
+
+// Len returns the number of sources currently tracked.
+func (rate *Ratelimiter) Len() int {
+	return int(atomic.LoadInt64(&rate.entries))
+}
+
+// Snapshot returns the state of at most limit of the sources currently tracked,
+// the most recently seen first. A negative limit returns all of them.
+func (rate *Ratelimiter) Snapshot(limit int) []BucketInfo {
+	rate.mu.RLock()
+	defer rate.mu.RUnlock()
+
+	now := rate.timeNow()
+	var buckets []BucketInfo
+	for i := range rate.shards {
+		shard := &rate.shards[i]
+		shard.mu.RLock()
+		for _, entry := range shard.clock {
+			var source netip.Prefix
+			if entry.ipv4 {
+				source = netip.PrefixFrom(netip.AddrFrom4(*(*[net.IPv4len]byte)(entry.key[:net.IPv4len])), 8*net.IPv4len)
+			} else {
+				source = netip.PrefixFrom(netip.AddrFrom16(entry.key), rate.opts.IPv6PrefixLen)
+			}
+			entry.mu.Lock()
+			tokens := entry.tokens + now.Sub(entry.lastTime).Nanoseconds()
+			lastSeen := entry.lastTime
+			entry.mu.Unlock()
+			if tokens > rate.maxTokens {
+				tokens = rate.maxTokens
+			}
+			buckets = append(buckets, BucketInfo{
+				Source:   source,
+				Tokens:   float64(tokens) / float64(rate.maxTokens),
+				LastSeen: lastSeen,
+			})
+		}
+		shard.mu.RUnlock()
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].LastSeen.After(buckets[j].LastSeen)
+	})
+	if limit >= 0 && len(buckets) > limit {
+		buckets = buckets[:limit]
+	}
+	return buckets
+}
@@ -0,0 +1,206 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options, from
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptEndOfOpt      = 0
+	pcapngOptIfName        = 2
+	pcapngLinkTypeRaw      = 101 // LINKTYPE_RAW: IPv4 or IPv6, no link-layer header
+	pcapngInterfaceRead    = 0   // interface ID of packets read from the device
+	pcapngInterfaceWritten = 1   // interface ID of packets written to the device
+)
+
+// captureFlushInterval is how long captured packets may sit in the buffer.
+var captureFlushInterval = time.Second
+
+type captureDevice struct {
+	Device
+
+	mu         sync.Mutex // protects the fields below
+	w          *bufio.Writer
+	err        error       // first error writing the capture, after which capturing stops
+	flushTimer *time.Timer // flushes the buffer, armed while it holds packets
+	flushing   bool        // whether flushTimer is armed
+	closed     bool
+	scratch    []byte
+}
+
+// NewCaptureDevice wraps inner, writing every packet read from or written to it
+// to w as a pcapng capture. Packets read from inner, which are headed into the tunnel,
+// are recorded on an interface named "read", and packets written to inner,
+// which came out of the tunnel, on an interface named "write".
+//
+// The capture is buffered, and flushed within a second of each packet captured,
+// and when the device is closed. Closing the device does not close w.
+// An error writing to w stops the capture but not the device;
+// Close returns it if inner closes cleanly. If w is nil, NewCaptureDevice returns inner.
+//
+// The returned device is a BatchDevice, capturing each packet of a batch, and
+// is a WriteDeadlineDevice if inner is. It implements no other optional interface.
+func NewCaptureDevice(inner Device, w io.Writer) Device {
+	if w == nil {
+		return inner
+	}
+	c := &captureDevice{
+		Device: inner,
+		w:      bufio.NewWriter(w),
+	}
+	c.writeHeader()
+	return forwardWriteDeadline(c, inner)
+}
+
+func (c *captureDevice) writeHeader() {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[14:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+	c.write(shb)
+	for _, name := range []string{"read", "write"} {
+		idb := make([]byte, 16)
+		binary.LittleEndian.PutUint32(idb[0:], pcapngInterfaceDesc)
+		binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+		idb = appendPcapngOption(idb, pcapngOptIfName, []byte(name))
+		idb = appendPcapngOption(idb, pcapngOptEndOfOpt, nil)
+		idb = append(idb, 0, 0, 0, 0) // trailing block length
+		binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+		binary.LittleEndian.PutUint32(idb[len(idb)-4:], uint32(len(idb)))
+		c.write(idb)
+	}
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(b[len(b)-4:], code)
+	binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+// pad4 returns the number of bytes needed to pad n to a multiple of 4.
+func pad4(n int) int {
+	return -n & 3
+}
+
+// write writes b to the capture, unless an earlier write failed.
+// c.mu must be held, or c not yet shared.
+func (c *captureDevice) write(b []byte) {
+	if c.err == nil {
+		_, c.err = c.w.Write(b)
+	}
+}
+
+func (c *captureDevice) capture(iface uint32, packet []byte) {
+	ts := uint64(time.Now().UnixMicro())
+	length := 28 + len(packet) + pad4(len(packet)) + 4
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.closed {
+		return
+	}
+	if cap(c.scratch) < length {
+		c.scratch = make([]byte, length)
+	}
+	epb := c.scratch[:length]
+	binary.LittleEndian.PutUint32(epb[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(length))
+	binary.LittleEndian.PutUint32(epb[8:], iface)
+	binary.LittleEndian.PutUint32(epb[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[24:], uint32(len(packet)))
+	n := copy(epb[28:], packet)
+	for i := 28 + n; i < length-4; i++ {
+		epb[i] = 0
+	}
+	binary.LittleEndian.PutUint32(epb[length-4:], uint32(length))
+	c.write(epb)
+	if !c.flushing {
+		c.flushing = true
+		if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(captureFlushInterval, c.timedFlush)
+		} else {
+			c.flushTimer.Reset(captureFlushInterval)
+		}
+	}
+}
+
+// timedFlush flushes the packets captured since the last flush.
+func (c *captureDevice) timedFlush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushing = false
+	if c.err == nil && !c.closed {
+		c.err = c.w.Flush()
+	}
+}
+
+func (c *captureDevice) Read(buf []byte, offset int) (int, error) {
+	n, err := c.Device.Read(buf, offset)
+	if n > 0 {
+		c.capture(pcapngInterfaceRead, buf[offset:offset+n])
+	}
+	return n, err
+}
+
+func (c *captureDevice) Write(buf []byte, offset int) (int, error) {
+	n, err := c.Device.Write(buf, offset)
+	if err == nil {
+		c.capture(pcapngInterfaceWritten, buf[offset:])
+	}
+	return n, err
+}
+
+func (c *captureDevice) ReadBatch(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := readBatch(c.Device, bufs, sizes, offset)
+	for i := 0; i < n; i++ {
+		c.capture(pcapngInterfaceRead, bufs[i][offset:offset+sizes[i]])
+	}
+	return n, err
+}
+
+func (c *captureDevice) WriteBatch(bufs [][]byte, offset int) (int, error) {
+	n, err := writeBatch(c.Device, bufs, offset)
+	for i := 0; i < n; i++ {
+		c.capture(pcapngInterfaceWritten, bufs[i][offset:])
+	}
+	return n, err
+}
+
+func (c *captureDevice) Close() error {
+	err := c.Device.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	if c.err == nil && !c.closed {
+		c.err = c.w.Flush()
+	}
+	c.closed = true
+	if err == nil {
+		err = c.err
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevice reads packets from reads and records the packets written to it.
+type fakeDevice struct {
+	reads   [][]byte
+	written [][]byte
+}
+
+func (d *fakeDevice) File() *os.File { return nil }
+func (d *fakeDevice) Read(buf []byte, offset int) (int, error) {
+	if len(d.reads) == 0 {
+		return 0, os.ErrClosed
+	}
+	n := copy(buf[offset:], d.reads[0])
+	d.reads = d.reads[1:]
+	return n, nil
+}
+func (d *fakeDevice) Write(buf []byte, offset int) (int, error) {
+	d.written = append(d.written, append([]byte{}, buf[offset:]...))
+	return len(buf) - offset, nil
+}
+func (d *fakeDevice) Flush() error          { return nil }
+func (d *fakeDevice) MTU() (int, error)     { return 1420, nil }
+func (d *fakeDevice) Name() (string, error) { return "fake", nil }
+func (d *fakeDevice) Events() chan Event    { return nil }
+func (d *fakeDevice) Close() error          { return nil }
+
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+func parsePcapng(t *testing.T, b []byte) (blocks []pcapngBlock) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block header: %x", b)
+		}
+		typ, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if length%4 != 0 || length < 12 || int(length) > len(b) {
+			t.Fatalf("block of type %#x has bad length %d", typ, length)
+		}
+		if trailer := binary.LittleEndian.Uint32(b[length-4:]); trailer != length {
+			t.Fatalf("block of type %#x has length %d but trailing length %d", typ, length, trailer)
+		}
+		blocks = append(blocks, pcapngBlock{typ, b[8 : length-4]})
+		b = b[length:]
+	}
+	return blocks
+}
+
+func TestCaptureDevice(t *testing.T) {
+	inner := &fakeDevice{reads: [][]byte{[]byte("hello"), []byte("four")}}
+	out := new(bytes.Buffer)
+	dev := NewCaptureDevice(inner, out)
+
+	const offset = 16
+	buf := make([]byte, 64)
+	start := time.Now()
+	if n, err := dev.Read(buf, offset); err != nil || n != 5 {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	copy(buf[offset:], "reply!")
+	if _, err := dev.Write(buf[:offset+6], offset); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dev.Read(buf, offset); err != nil || n != 4 {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	if _, err := dev.Read(buf, offset); err == nil {
+		t.Fatal("Read succeeded with no packets left")
+	}
+	if len(inner.written) != 1 || string(inner.written[0]) != "reply!" {
+		t.Errorf("inner device was written %q", inner.written)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now()
+
+	blocks := parsePcapng(t, out.Bytes())
+	if len(blocks) != 6 {
+		t.Fatalf("got %d blocks, want 6", len(blocks))
+	}
+	shb := blocks[0]
+	if shb.typ != pcapngSectionHeader || binary.LittleEndian.Uint32(shb.body) != pcapngByteOrderMagic ||
+		binary.LittleEndian.Uint16(shb.body[4:]) != 1 {
+		t.Errorf("bad section header block: %#x %x", shb.typ, shb.body)
+	}
+	for i, name := range []string{"read", "write"} {
+		idb := blocks[1+i]
+		want := []byte{pcapngLinkTypeRaw, 0, 0, 0, 0, 0, 0, 0, pcapngOptIfName, 0, byte(len(name)), 0}
+		want = append(want, name...)
+		want = append(want, make([]byte, pad4(len(name)))...)
+		want = append(want, 0, 0, 0, 0)
+		if idb.typ != pcapngInterfaceDesc || !bytes.Equal(idb.body, want) {
+			t.Errorf("bad interface description block %d: %#x %x", i, idb.typ, idb.body)
+		}
+	}
+	for i, want := range []struct {
+		iface  uint32
+		packet string
+	}{
+		{pcapngInterfaceRead, "hello"},
+		{pcapngInterfaceWritten, "reply!"},
+		{pcapngInterfaceRead, "four"},
+	} {
+		epb := blocks[3+i]
+		if epb.typ != pcapngEnhancedPacket {
+			t.Errorf("block %d has type %#x, want an enhanced packet block", 3+i, epb.typ)
+			continue
+		}
+		iface := binary.LittleEndian.Uint32(epb.body)
+		ts := int64(binary.LittleEndian.Uint32(epb.body[4:]))<<32 | int64(binary.LittleEndian.Uint32(epb.body[8:]))
+		captured, original := binary.LittleEndian.Uint32(epb.body[12:]), binary.LittleEndian.Uint32(epb.body[16:])
+		packet := epb.body[20:]
+		if iface != want.iface || captured != uint32(len(want.packet)) || original != captured ||
+			len(packet) != len(want.packet)+pad4(len(want.packet)) || string(packet[:captured]) != want.packet {
+			t.Errorf("packet %d: got interface %d, lengths %d/%d, data %q; want interface %d, %q",
+				i, iface, captured, original, packet, want.iface, want.packet)
+		}
+		if ts < start.UnixMicro() || ts > end.UnixMicro() {
+			t.Errorf("packet %d: timestamp %v not between %v and %v", i, time.UnixMicro(ts), start, end)
+		}
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestCaptureDeviceWriterError(t *testing.T) {
+	inner := &fakeDevice{reads: [][]byte{make([]byte, 8192)}}
+	dev := NewCaptureDevice(inner, errWriter{})
+	if n, err := dev.Read(make([]byte, 8192), 0); n != 8192 || err != nil {
+		t.Errorf("Read = %d, %v; capture errors should not fail the device", n, err)
+	}
+	if err := dev.Close(); err == nil {
+		t.Error("Close did not report the capture error")
+	}
+}
+
+func TestCaptureDeviceNilWriter(t *testing.T) {
+	inner := new(fakeDevice)
+	if dev := NewCaptureDevice(inner, nil); dev != Device(inner) {
+		t.Errorf("NewCaptureDevice(inner, nil) = %T, want inner", dev)
+	}
+}
+
+// fakeBatchDevice is a fakeDevice that reads and writes in batches
+// and records its write deadline.
+type fakeBatchDevice struct {
+	fakeDevice
+	deadline time.Time
+}
+
+func (d *fakeBatchDevice) ReadBatch(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	for ; n < len(bufs) && len(d.reads) > 0; n++ {
+		sizes[n], _ = d.Read(bufs[n], offset)
+	}
+	if n == 0 {
+		return 0, os.ErrClosed
+	}
+	return n, nil
+}
+
+func (d *fakeBatchDevice) WriteBatch(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		d.Write(buf, offset)
+	}
+	return len(bufs), nil
+}
+
+func (d *fakeBatchDevice) SetWriteDeadline(t time.Time) error {
+	d.deadline = t
+	return nil
+}
+
+func TestCaptureDeviceBatch(t *testing.T) {
+	if _, ok := NewCaptureDevice(new(fakeDevice), new(bytes.Buffer)).(WriteDeadlineDevice); ok {
+		t.Error("capture of a device without write deadlines has them")
+	}
+
+	inner := &fakeBatchDevice{fakeDevice: fakeDevice{reads: [][]byte{[]byte("one"), []byte("two")}}}
+	out := new(bytes.Buffer)
+	dev := NewCaptureDevice(inner, out)
+	batch, ok := dev.(BatchDevice)
+	if !ok {
+		t.Fatal("capture device is not a BatchDevice")
+	}
+	deadline, ok := dev.(WriteDeadlineDevice)
+	if !ok {
+		t.Fatal("capture of a device with write deadlines lacks them")
+	}
+	want := time.Now().Add(time.Second)
+	if err := deadline.SetWriteDeadline(want); err != nil || !inner.deadline.Equal(want) {
+		t.Errorf("SetWriteDeadline = %v, inner deadline %v, want %v", err, inner.deadline, want)
+	}
+
+	bufs := [][]byte{make([]byte, 16), make([]byte, 16), make([]byte, 16)}
+	sizes := make([]int, len(bufs))
+	if n, err := batch.ReadBatch(bufs, sizes, 4); n != 2 || err != nil {
+		t.Fatalf("ReadBatch = %d, %v", n, err)
+	}
+	if n, err := batch.WriteBatch([][]byte{[]byte("....three")}, 4); n != 1 || err != nil {
+		t.Fatalf("WriteBatch = %d, %v", n, err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []string
+	for _, block := range parsePcapng(t, out.Bytes()) {
+		if block.typ == pcapngEnhancedPacket {
+			packets = append(packets, string(block.body[20:20+binary.LittleEndian.Uint32(block.body[12:])]))
+		}
+	}
+	if len(packets) != 3 || packets[0] != "one" || packets[1] != "two" || packets[2] != "three" {
+		t.Errorf("captured %q, want one, two and three", packets)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func TestCaptureDeviceTimedFlush(t *testing.T) {
+	defer func(interval time.Duration) { captureFlushInterval = interval }(captureFlushInterval)
+	captureFlushInterval = 10 * time.Millisecond
+
+	inner := &fakeDevice{reads: [][]byte{[]byte("last")}}
+	out := new(syncBuffer)
+	dev := NewCaptureDevice(inner, out)
+	defer dev.Close()
+	if _, err := dev.Read(make([]byte, 16), 0); err != nil {
+		t.Fatal(err)
+	}
+	// No more traffic comes, and the device stays open.
+	for deadline := time.Now().Add(5 * time.Second); len(parsePcapng(t, out.Bytes())) < 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("captured packet was not flushed")
+		}
+	}
+}
@@ -0,0 +1,260 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	ipv4HeaderLen        = 20
+	ipv6HeaderLen        = 40
+	icmpHeaderLen        = 8
+	ipv4FlagDF           = 0x40 // in byte 6 of the IPv4 header
+	protoICMPv4          = 1
+	protoICMPv6          = 58
+	icmpv4DestUnreach    = 3
+	icmpv4CodeFragNeeded = 4 // code of icmpv4DestUnreach
+	icmpv6PacketTooBig   = 2
+	icmpv4MaxErrorLen    = 576  // RFC 1812 section 4.3.2.3
+	icmpv6MaxErrorLen    = 1280 // RFC 4443 section 2.4 (c)
+	ipv6MinMTU           = 1280
+	icmpErrorTTL         = 64
+	mtuGuardReplyOffset  = 16 // headroom left for the inner device's own headers, such as Linux's packet information
+)
+
+type mtuGuard struct {
+	Device
+	mtu    int32 // accessed atomically
+	events chan Event
+}
+
+// NewMTUGuard wraps inner, dropping packets read from it that are larger than mtu
+// and writing back to inner, toward their sender, the ICMP error that a router
+// would send in their place: an ICMPv4 Fragmentation Needed for an IPv4 packet
+// with the Don't Fragment bit set, or an ICMPv6 Packet Too Big for an IPv6 packet.
+// Both advertise the MTU, so that path MTU discovery converges on it.
+// IPv4 packets that may be fragmented are passed through.
+//
+// When inner reports an EventMTUUpdate, the guard adopts inner's new MTU.
+//
+// The returned device is a BatchDevice, guarding each packet of a batch, and
+// is a WriteDeadlineDevice if inner is. It implements no other optional interface.
+func NewMTUGuard(inner Device, mtu int) Device {
+	g := &mtuGuard{
+		Device: inner,
+		mtu:    int32(mtu),
+	}
+	if events := inner.Events(); events != nil {
+		g.events = make(chan Event)
+		go g.routineEvents(events)
+	}
+	return forwardWriteDeadline(g, inner)
+}
+
+func (g *mtuGuard) routineEvents(events chan Event) {
+	defer close(g.events)
+	for event := range events {
+		if event&EventMTUUpdate != 0 {
+			if mtu, err := g.Device.MTU(); err == nil && mtu > 0 {
+				atomic.StoreInt32(&g.mtu, int32(mtu))
+			}
+		}
+		g.events <- event
+	}
+}
+
+func (g *mtuGuard) Events() chan Event {
+	return g.events
+}
+
+func (g *mtuGuard) MTU() (int, error) {
+	return int(atomic.LoadInt32(&g.mtu)), nil
+}
+
+func (g *mtuGuard) Read(buf []byte, offset int) (int, error) {
+	for {
+		n, err := g.Device.Read(buf, offset)
+		if err != nil || g.pass(buf[offset:offset+n]) {
+			return n, err
+		}
+	}
+}
+
+func (g *mtuGuard) ReadBatch(bufs [][]byte, sizes []int, offset int) (int, error) {
+	for {
+		n, err := readBatch(g.Device, bufs, sizes, offset)
+		// Move the packets that pass down over those that do not.
+		// The packets stay in the buffers they were read into, as callers
+		// may keep other state per buffer.
+		passed := 0
+		for i := 0; i < n; i++ {
+			if !g.pass(bufs[i][offset : offset+sizes[i]]) {
+				continue
+			}
+			if passed != i {
+				copy(bufs[passed][offset:], bufs[i][offset:offset+sizes[i]])
+				sizes[passed] = sizes[i]
+			}
+			passed++
+		}
+		if passed > 0 || err != nil {
+			return passed, err
+		}
+	}
+}
+
+func (g *mtuGuard) WriteBatch(bufs [][]byte, offset int) (int, error) {
+	return writeBatch(g.Device, bufs, offset)
+}
+
+// pass reports whether pkt, read from the inner device, fits the MTU or may be fragmented.
+// If not, it writes back the ICMP error due, if any.
+func (g *mtuGuard) pass(pkt []byte) bool {
+	mtu := int(atomic.LoadInt32(&g.mtu))
+	if len(pkt) <= mtu {
+		return true
+	}
+	reply, drop := packetTooBig(pkt, mtu)
+	if drop && reply != nil {
+		// Best effort, as for any ICMP error.
+		g.Device.Write(reply, mtuGuardReplyOffset)
+	}
+	return !drop
+}
+
+// packetTooBig returns the ICMP error to send in response to pkt, which is larger than mtu,
+// preceded by mtuGuardReplyOffset bytes of headroom, and whether pkt should be dropped.
+// It returns a nil reply for packets that should be dropped silently.
+func packetTooBig(pkt []byte, mtu int) (reply []byte, drop bool) {
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < ipv4HeaderLen {
+			return nil, true
+		}
+		if pkt[6]&ipv4FlagDF == 0 {
+			return nil, false
+		}
+		headerLen := int(pkt[0]&0x0f) * 4
+		if headerLen < ipv4HeaderLen || headerLen > len(pkt) ||
+			isICMPError(pkt[9], pkt[headerLen:], protoICMPv4) || !isUnicast4(pkt[12:16]) {
+			return nil, true
+		}
+		return icmpv4FragNeededReply(pkt, mtu), true
+	case 6:
+		if len(pkt) < ipv6HeaderLen || isICMPError(pkt[6], pkt[ipv6HeaderLen:], protoICMPv6) || !isUnicast6(pkt[8:24]) {
+			return nil, true
+		}
+		if mtu < ipv6MinMTU {
+			mtu = ipv6MinMTU
+		}
+		return icmpv6PacketTooBigReply(pkt, mtu), true
+	default:
+		return nil, true
+	}
+}
+
+// isICMPError reports whether body, the payload of an IP packet of protocol proto,
+// is an error message of icmpProto, ICMPv4 or ICMPv6, to which no ICMP error may be sent.
+func isICMPError(proto byte, body []byte, icmpProto byte) bool {
+	if proto != icmpProto || len(body) == 0 {
+		return false
+	}
+	if icmpProto == protoICMPv6 {
+		return body[0] < 128 // RFC 4443 section 2.1
+	}
+	switch body[0] {
+	case 3, 4, 5, 11, 12: // RFC 1122 section 3.2.2
+		return true
+	}
+	return false
+}
+
+func isUnicast4(addr []byte) bool {
+	return addr[0] != 0 && addr[0] < 224 && !(addr[0] == 255 && addr[1] == 255 && addr[2] == 255 && addr[3] == 255)
+}
+
+func isUnicast6(addr []byte) bool {
+	if addr[0] == 0xff {
+		return false
+	}
+	for _, b := range addr {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// icmpv4FragNeededReply returns an ICMPv4 Destination Unreachable, Fragmentation Needed
+// from pkt's destination to its source, quoting as much of pkt as fits.
+func icmpv4FragNeededReply(pkt []byte, mtu int) []byte {
+	quote := pkt
+	if max := icmpv4MaxErrorLen - ipv4HeaderLen - icmpHeaderLen; len(quote) > max {
+		quote = quote[:max]
+	}
+	reply := make([]byte, mtuGuardReplyOffset+ipv4HeaderLen+icmpHeaderLen+len(quote))
+	ip := reply[mtuGuardReplyOffset:]
+	ip[0] = 4<<4 | ipv4HeaderLen/4
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+	ip[8] = icmpErrorTTL
+	ip[9] = protoICMPv4
+	copy(ip[12:16], pkt[16:20])
+	copy(ip[16:20], pkt[12:16])
+	binary.BigEndian.PutUint16(ip[10:], ^onesComplementSum(ip[:ipv4HeaderLen], 0))
+
+	icmp := ip[ipv4HeaderLen:]
+	icmp[0] = icmpv4DestUnreach
+	icmp[1] = icmpv4CodeFragNeeded
+	binary.BigEndian.PutUint16(icmp[6:], uint16(mtu)) // RFC 1191 section 4
+	copy(icmp[icmpHeaderLen:], quote)
+	binary.BigEndian.PutUint16(icmp[2:], ^onesComplementSum(icmp, 0))
+	return reply
+}
+
+// icmpv6PacketTooBigReply returns an ICMPv6 Packet Too Big
+// from pkt's destination to its source, quoting as much of pkt as fits.
+func icmpv6PacketTooBigReply(pkt []byte, mtu int) []byte {
+	quote := pkt
+	if max := icmpv6MaxErrorLen - ipv6HeaderLen - icmpHeaderLen; len(quote) > max {
+		quote = quote[:max]
+	}
+	reply := make([]byte, mtuGuardReplyOffset+ipv6HeaderLen+icmpHeaderLen+len(quote))
+	ip := reply[mtuGuardReplyOffset:]
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(icmpHeaderLen+len(quote)))
+	ip[6] = protoICMPv6
+	ip[7] = icmpErrorTTL
+	copy(ip[8:24], pkt[24:40])
+	copy(ip[24:40], pkt[8:24])
+
+	icmp := ip[ipv6HeaderLen:]
+	icmp[0] = icmpv6PacketTooBig
+	binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+	copy(icmp[icmpHeaderLen:], quote)
+	// The checksum covers a pseudo-header of the addresses, length and next header.
+	sum := onesComplementSum(ip[8:40], 0)
+	sum = onesComplementSum([]byte{0, 0, byte(len(icmp) >> 8), byte(len(icmp)), 0, 0, 0, protoICMPv6}, sum)
+	binary.BigEndian.PutUint16(icmp[2:], ^onesComplementSum(icmp, sum))
+	return reply
+}
+
+// onesComplementSum adds the 16-bit words of b to initial in ones' complement arithmetic,
+// as for the Internet checksum of RFC 1071. An odd length is padded with a zero byte.
+func onesComplementSum(b []byte, initial uint16) uint16 {
+	sum := uint32(initial)
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
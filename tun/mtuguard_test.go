@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// sum16 is the RFC 1071 ones' complement sum of the concatenation of chunks.
+func sum16(chunks ...[]byte) uint16 {
+	var b []byte
+	for _, chunk := range chunks {
+		b = append(b, chunk...)
+	}
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// setDF sets the Don't Fragment bit of an IPv4 packet and fixes its header checksum.
+func setDF(pkt []byte) {
+	pkt[6] |= 0x40
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:], ^sum16(pkt[:20]))
+}
+
+func TestMTUGuard(t *testing.T) {
+	const mtu = 1280
+	src4, dst4 := netip.MustParseAddrPort("192.0.2.1:1234"), netip.MustParseAddrPort("198.51.100.1:53")
+	src6, dst6 := netip.MustParseAddrPort("[2001:db8::1]:1234"), netip.MustParseAddrPort("[2001:db8::2]:53")
+	big := make([]byte, 1400)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	df4 := tuntest.UDP4(src4, dst4, big)
+	setDF(df4)
+	small4 := tuntest.UDP4(src4, dst4, []byte("small"))
+
+	c := tuntest.NewChannelTUN()
+	guard := tun.NewMTUGuard(c.TUN(), mtu)
+	defer guard.Close()
+
+	read := func() []byte {
+		t.Helper()
+		buf := make([]byte, 2000)
+		n, err := guard.Read(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	t.Run("IPv4 DF", func(t *testing.T) {
+		go func() {
+			c.Outbound <- df4
+			c.Outbound <- small4
+		}()
+		replies := make(chan []byte, 1)
+		go func() { replies <- <-c.Inbound }()
+		if got := read(); !bytes.Equal(got, small4) {
+			t.Errorf("Read returned a %d-byte packet, want the small one", len(got))
+		}
+		reply := <-replies
+
+		if len(reply) != 576 || reply[0] != 0x45 || reply[9] != 1 || sum16(reply[:20]) != 0xffff ||
+			int(binary.BigEndian.Uint16(reply[2:])) != len(reply) {
+			t.Fatalf("bad IPv4 header: %x", reply[:20])
+		}
+		if !bytes.Equal(reply[12:16], df4[16:20]) || !bytes.Equal(reply[16:20], df4[12:16]) {
+			t.Errorf("reply is from %v to %v, want the reverse of the original", reply[12:16], reply[16:20])
+		}
+		icmp := reply[20:]
+		if icmp[0] != 3 || icmp[1] != 4 || binary.BigEndian.Uint16(icmp[6:]) != mtu || sum16(icmp) != 0xffff {
+			t.Errorf("bad ICMP header: %x", icmp[:8])
+		}
+		if quote := icmp[8:]; !bytes.Equal(quote, df4[:len(quote)]) {
+			t.Error("ICMP error does not quote the start of the original packet")
+		}
+	})
+
+	t.Run("IPv4 may fragment", func(t *testing.T) {
+		pkt := tuntest.UDP4(src4, dst4, big)
+		go func() { c.Outbound <- pkt }()
+		if got := read(); !bytes.Equal(got, pkt) {
+			t.Error("oversized packet without DF was not passed through")
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		pkt := tuntest.UDP6(src6, dst6, big)
+		small := tuntest.UDP6(src6, dst6, []byte("small"))
+		go func() {
+			c.Outbound <- pkt
+			c.Outbound <- small
+		}()
+		replies := make(chan []byte, 1)
+		go func() { replies <- <-c.Inbound }()
+		if got := read(); !bytes.Equal(got, small) {
+			t.Errorf("Read returned a %d-byte packet, want the small one", len(got))
+		}
+		reply := <-replies
+
+		if len(reply) != 1280 || reply[0]>>4 != 6 || reply[6] != 58 ||
+			int(binary.BigEndian.Uint16(reply[4:])) != len(reply)-40 {
+			t.Fatalf("bad IPv6 header: %x", reply[:40])
+		}
+		if !bytes.Equal(reply[8:24], pkt[24:40]) || !bytes.Equal(reply[24:40], pkt[8:24]) {
+			t.Error("reply addresses are not the reverse of the original")
+		}
+		icmp := reply[40:]
+		pseudo := []byte{0, 0, byte(len(icmp) >> 8), byte(len(icmp)), 0, 0, 0, 58}
+		if icmp[0] != 2 || icmp[1] != 0 || binary.BigEndian.Uint32(icmp[4:]) != mtu ||
+			sum16(reply[8:40], pseudo, icmp) != 0xffff {
+			t.Errorf("bad ICMPv6 header: %x", icmp[:8])
+		}
+		if quote := icmp[8:]; !bytes.Equal(quote, pkt[:len(quote)]) {
+			t.Error("ICMPv6 error does not quote the start of the original packet")
+		}
+	})
+
+	t.Run("MTU update", func(t *testing.T) {
+		<-guard.Events() // the initial EventUp
+		c.SetMTU(1500)
+		select {
+		case event := <-guard.Events():
+			if event&tun.EventMTUUpdate == 0 {
+				t.Errorf("got event %v, want EventMTUUpdate", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("EventMTUUpdate was not passed on")
+		}
+		if got, _ := guard.MTU(); got != 1500 {
+			t.Errorf("MTU = %d after update, want 1500", got)
+		}
+		go func() { c.Outbound <- df4 }()
+		if got := read(); !bytes.Equal(got, df4) {
+			t.Error("packet within the new MTU was not passed through")
+		}
+	})
+}
+
+func TestMTUGuardBatch(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("192.0.2.1:1234"), netip.MustParseAddrPort("198.51.100.1:53")
+	big := tuntest.UDP4(src, dst, make([]byte, 1400))
+	setDF(big)
+	small := tuntest.UDP4(src, dst, []byte("small"))
+
+	c := tuntest.NewChannelTUN()
+	guard := tun.NewMTUGuard(c.TUN(), 1280)
+	defer guard.Close()
+	if _, ok := guard.(tun.WriteDeadlineDevice); !ok {
+		t.Error("guard of a device with write deadlines lacks them")
+	}
+	batch, ok := guard.(tun.BatchDevice)
+	if !ok {
+		t.Fatal("guard is not a BatchDevice")
+	}
+
+	go func() {
+		c.Outbound <- big
+		c.Outbound <- small
+		c.Outbound <- small
+	}()
+	replies := make(chan []byte, 1)
+	go func() { replies <- <-c.Inbound }()
+	bufs := [][]byte{make([]byte, 2000), make([]byte, 2000), make([]byte, 2000)}
+	sizes := make([]int, len(bufs))
+	for got := 0; got < 2; {
+		n, err := batch.ReadBatch(bufs, sizes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if !bytes.Equal(bufs[i][:sizes[i]], small) {
+				t.Fatalf("ReadBatch returned a %d-byte packet at %d, want the small one", sizes[i], i)
+			}
+		}
+		got += n
+	}
+	if reply := <-replies; len(reply) != 576 || reply[9] != 1 {
+		t.Errorf("oversized packet got a %d-byte reply of protocol %d, want a 576-byte ICMP error", len(reply), reply[9])
+	}
+}
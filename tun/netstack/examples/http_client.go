@@ -1,3 +1,4 @@
+//go:build ignore
 // +build ignore
 
 /* SPDX-License-Identifier: MIT
@@ -10,8 +11,8 @@ package main
 import (
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"net/netip"
 
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
@@ -20,12 +21,12 @@ import (
 
 func main() {
 	tun, tnet, err := netstack.CreateNetTUN(
-		[]net.IP{net.ParseIP("192.168.4.29")},
-		[]net.IP{net.ParseIP("8.8.8.8")},
+		[]netip.Addr{netip.MustParseAddr("192.168.4.29")},
 		1420)
 	if err != nil {
 		log.Panic(err)
 	}
+	tnet.SetDNSServers([]netip.Addr{netip.MustParseAddr("8.8.8.8")})
 	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelVerbose, ""))
 	dev.IpcSet(`private_key=a8dac1d8a70a751f0f699fb14ba1cff7b79cf4fbd8f09f44c6e6a90d0369604f
 public_key=25123c5dcd3328ff645e4f2a3fce0d754400d3887a0cb7c56f0267e20fbf3c5b
@@ -1,11 +1,19 @@
 module golang.zx2c4.com/wireguard/tun/netstack
 
-go 1.16
+go 1.18
 
 require (
 	golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6
-	golang.org/x/sys v0.0.0-20210423185535-09eb48e85fd7 // indirect
-	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba // indirect
 	golang.zx2c4.com/wireguard v0.0.0-20210424170727-c9db4b7aaa22
 	gvisor.dev/gvisor v0.0.0-20210506004418-fbfeba3024f0
 )
+
+require (
+	github.com/google/btree v1.0.0 // indirect
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83 // indirect
+	golang.org/x/sys v0.0.0-20210423185535-09eb48e85fd7 // indirect
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba // indirect
+)
+
+// Build and test against the device in this tree, not a published version of it.
+replace golang.zx2c4.com/wireguard => ../..
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// genNetPair creates two Devices on netstack TUNs, connected by in-memory binds,
+// and returns their *Nets. The first has address 10.0.0.1, the second 10.0.0.2.
+func genNetPair(t *testing.T) [2]*Net {
+	const (
+		sk1 = "087ec6e14bbed210e7215cdc73468dfa23f080a1bfb8665b2fd809bd99d28379"
+		pk1 = "f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c"
+		sk2 = "003ed5d73b55806c30de3f8a7bdab38af13539220533055e635690b8b87ad641"
+		pk2 = "c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28"
+	)
+	cfgs := [2]string{
+		fmt.Sprintf("private_key=%s\nlisten_port=1\npublic_key=%s\nallowed_ip=10.0.0.2/32\nendpoint=127.0.0.1:2\n", sk1, pk2),
+		fmt.Sprintf("private_key=%s\nlisten_port=2\npublic_key=%s\nallowed_ip=10.0.0.1/32\nendpoint=127.0.0.1:1\n", sk2, pk1),
+	}
+	binds := bindtest.NewChannelBinds()
+	var nets [2]*Net
+	for i := range nets {
+		tun, tnet, err := CreateNetTUN([]netip.Addr{netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)})}, 1420)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev := device.NewDevice(tun, binds[i], device.NewLogger(device.LogLevelError, fmt.Sprintf("dev%d: ", i)))
+		if err := dev.IpcSet(cfgs[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(dev.Close)
+		nets[i] = tnet
+	}
+	return nets
+}
+
+func TestHTTPOverTunnel(t *testing.T) {
+	nets := genNetPair(t)
+
+	listener, err := nets[0].Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const body = "Hello from userspace TCP!"
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := http.Client{
+		Transport: &http.Transport{DialContext: nets[1].DialContext},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*device.RekeyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://10.0.0.1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(got) != body {
+		t.Errorf("got %s %q, want %q", resp.Status, got, body)
+	}
+}
+
+func TestListen(t *testing.T) {
+	tun, tnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	for _, tt := range []struct {
+		network, address string
+		ok               bool
+	}{
+		{"tcp", ":80", true},
+		{"tcp4", "10.0.0.1:81", true},
+		{"udp", ":80", false},
+		{"tcp6", "10.0.0.1:82", false},
+		{"tcp", "10.0.0.1:http", false},
+		{"tcp", "10.0.0.1", false},
+	} {
+		l, err := tnet.Listen(tt.network, tt.address)
+		if (err == nil) != tt.ok {
+			t.Errorf("Listen(%q, %q) = %v, want ok %v", tt.network, tt.address, err, tt.ok)
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
@@ -38,7 +39,7 @@ type netTun struct {
 	events         chan tun.Event
 	incomingPacket chan buffer.VectorisedView
 	mtu            int
-	dnsServers     []net.IP
+	dnsServers     []net.IP // set by SetDNSServers
 	hasV4, hasV6   bool
 }
 type endpoint netTun
@@ -90,7 +91,10 @@ func (*endpoint) ARPHardwareType() header.ARPHardwareType {
 func (e *endpoint) AddHeader(tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
 }
 
-func CreateNetTUN(localAddresses, dnsServers []net.IP, mtu int) (tun.Device, *Net, error) {
+// CreateNetTUN returns a tun.Device backed by an in-memory gVisor network stack
+// with the given local addresses, and a *Net for opening sockets on that stack.
+// Nothing is read from or written to the host's network.
+func CreateNetTUN(localAddresses []netip.Addr, mtu int) (tun.Device, *Net, error) {
 	opts := stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
@@ -100,7 +104,6 @@ func CreateNetTUN(localAddresses, dnsServers []net.IP, mtu int) (tun.Device, *Ne
 		stack:          stack.New(opts),
 		events:         make(chan tun.Event, 10),
 		incomingPacket: make(chan buffer.VectorisedView),
-		dnsServers:     dnsServers,
 		mtu:            mtu,
 	}
 	tcpipErr := dev.stack.CreateNIC(1, (*endpoint)(dev))
@@ -108,18 +111,21 @@ func CreateNetTUN(localAddresses, dnsServers []net.IP, mtu int) (tun.Device, *Ne
 		return nil, nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
 	}
 	for _, ip := range localAddresses {
-		if ip4 := ip.To4(); ip4 != nil {
-			tcpipErr = dev.stack.AddAddress(1, ipv4.ProtocolNumber, tcpip.Address(ip4))
+		ip = ip.Unmap()
+		if ip.Is4() {
+			tcpipErr = dev.stack.AddAddress(1, ipv4.ProtocolNumber, tcpip.Address(ip.AsSlice()))
 			if tcpipErr != nil {
-				return nil, nil, fmt.Errorf("AddAddress(%v): %v", ip4, tcpipErr)
+				return nil, nil, fmt.Errorf("AddAddress(%v): %v", ip, tcpipErr)
 			}
 			dev.hasV4 = true
-		} else {
-			tcpipErr = dev.stack.AddAddress(1, ipv6.ProtocolNumber, tcpip.Address(ip))
+		} else if ip.Is6() {
+			tcpipErr = dev.stack.AddAddress(1, ipv6.ProtocolNumber, tcpip.Address(ip.AsSlice()))
 			if tcpipErr != nil {
-				return nil, nil, fmt.Errorf("AddAddress(%v): %v", ip4, tcpipErr)
+				return nil, nil, fmt.Errorf("AddAddress(%v): %v", ip, tcpipErr)
 			}
 			dev.hasV6 = true
+		} else {
+			return nil, nil, fmt.Errorf("invalid local address %v", ip)
 		}
 	}
 	if dev.hasV4 {
@@ -246,6 +252,56 @@ func (net *Net) DialUDP(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
 	return gonet.DialUDP(net.stack, lfa, rfa, pn)
 }
 
+// Listen announces on the stack's address, as net.Listen does.
+// The network must be "tcp", "tcp4" or "tcp6".
+// If the host in address is empty, Listen listens on all of the stack's addresses.
+func (tnet *Net) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errNumericPort}
+	}
+	var fa tcpip.FullAddress
+	pn := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber)
+	if host != "" {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+		}
+		fa, pn = convertToFullAddr(net.IP(ip.AsSlice()), int(port))
+	} else {
+		fa = tcpip.FullAddress{NIC: 1, Port: uint16(port)}
+		if network == "tcp6" || (network == "tcp" && tnet.hasV6 && !tnet.hasV4) {
+			pn = ipv6.ProtocolNumber
+		}
+	}
+	if (network == "tcp4" && pn != ipv4.ProtocolNumber) || (network == "tcp6" && pn != ipv6.ProtocolNumber) {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errNoSuitableAddress}
+	}
+	l, err := gonet.ListenTCP(tnet.stack, fa, pn)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetDNSServers sets the servers used by LookupHost and by DialContext to resolve names.
+// It must be called before either is used.
+func (tnet *Net) SetDNSServers(servers []netip.Addr) {
+	tnet.dnsServers = make([]net.IP, 0, len(servers))
+	for _, ip := range servers {
+		tnet.dnsServers = append(tnet.dnsServers, net.IP(ip.Unmap().AsSlice()))
+	}
+}
+
 var (
 	errNoSuchHost                   = errors.New("no such host")
 	errLameReferral                 = errors.New("lame referral")
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// rwcHeadroom is the space left before each packet passed to a Device by the
+	// ReadWriteCloser adapter, for headers the Device adds, such as Linux's packet information.
+	rwcHeadroom = 16
+	// rwcMaxPacketSize is the largest packet the ReadWriteCloser adapter reads.
+	rwcMaxPacketSize = 65535
+)
+
+type deviceRWC struct {
+	dev Device
+
+	readMu  sync.Mutex // protects readBuf
+	readBuf []byte
+
+	writeMu  sync.Mutex // protects writeBuf
+	writeBuf []byte
+}
+
+// NewReadWriteCloser returns an io.ReadWriteCloser that reads and writes
+// one packet of d per call, hiding the offset of d's Read and Write.
+// A Read into a buffer too small for the packet returns io.ErrShortBuffer,
+// and the packet is lost. Close closes d.
+// The adapter does not read d's events.
+func NewReadWriteCloser(d Device) io.ReadWriteCloser {
+	return &deviceRWC{dev: d}
+}
+
+func (rwc *deviceRWC) Read(p []byte) (int, error) {
+	rwc.readMu.Lock()
+	defer rwc.readMu.Unlock()
+	if rwc.readBuf == nil {
+		rwc.readBuf = make([]byte, rwcHeadroom+rwcMaxPacketSize)
+	}
+	n, err := rwc.dev.Read(rwc.readBuf, rwcHeadroom)
+	if err != nil {
+		return 0, err
+	}
+	if n > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, rwc.readBuf[rwcHeadroom:rwcHeadroom+n]), nil
+}
+
+func (rwc *deviceRWC) Write(p []byte) (int, error) {
+	rwc.writeMu.Lock()
+	defer rwc.writeMu.Unlock()
+	if cap(rwc.writeBuf) < rwcHeadroom+len(p) {
+		rwc.writeBuf = make([]byte, rwcHeadroom+len(p))
+	}
+	buf := rwc.writeBuf[:rwcHeadroom+len(p)]
+	copy(buf[rwcHeadroom:], p)
+	return rwc.dev.Write(buf, rwcHeadroom)
+}
+
+func (rwc *deviceRWC) Close() error {
+	return rwc.dev.Close()
+}
+
+type rwcDevice struct {
+	rwc       io.ReadWriteCloser
+	mtu       int
+	events    chan Event
+	closeOnce sync.Once
+}
+
+// NewReadWriteCloserDevice returns a Device that reads and writes packets
+// with rwc, which must carry one packet per Read and Write call.
+// The Device reports the fixed MTU mtu, and an EventUp on creation;
+// it reports no other events. Close closes rwc.
+func NewReadWriteCloserDevice(rwc io.ReadWriteCloser, mtu int) Device {
+	d := &rwcDevice{
+		rwc:    rwc,
+		mtu:    mtu,
+		events: make(chan Event, 1),
+	}
+	d.events <- EventUp
+	return d
+}
+
+func (d *rwcDevice) File() *os.File { return nil }
+
+func (d *rwcDevice) Read(buf []byte, offset int) (int, error) {
+	return d.rwc.Read(buf[offset:])
+}
+
+func (d *rwcDevice) Write(buf []byte, offset int) (int, error) {
+	return d.rwc.Write(buf[offset:])
+}
+
+func (d *rwcDevice) Flush() error          { return nil }
+func (d *rwcDevice) MTU() (int, error)     { return d.mtu, nil }
+func (d *rwcDevice) Name() (string, error) { return "rwc", nil }
+func (d *rwcDevice) Events() chan Event    { return d.events }
+func (d *rwcDevice) Close() error {
+	err := d.rwc.Close()
+	d.closeOnce.Do(func() {
+		close(d.events)
+	})
+	return err
+}
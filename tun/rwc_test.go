@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// pipeRWC is a packet stream over a pair of pipes. Each Write stays a single
+// Read on the other end as long as packets are small and read one at a time.
+type pipeRWC struct {
+	r *os.File
+	w *os.File
+}
+
+func (p pipeRWC) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p pipeRWC) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p pipeRWC) Close() error {
+	err1, err2 := p.r.Close(), p.w.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// newPipeRWCs returns two packet streams connected to each other.
+func newPipeRWCs(t *testing.T) (a, b pipeRWC) {
+	ar, bw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	br, aw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pipeRWC{ar, aw}, pipeRWC{br, bw}
+}
+
+func TestReadWriteCloserChannelTUN(t *testing.T) {
+	c := tuntest.NewChannelTUN()
+	rwc := tun.NewReadWriteCloser(c.TUN())
+
+	go func() {
+		if n, err := rwc.Write([]byte("to inbound")); n != len("to inbound") || err != nil {
+			t.Errorf("Write = %d, %v", n, err)
+		}
+	}()
+	if got := <-c.Inbound; string(got) != "to inbound" {
+		t.Errorf("Inbound got %q", got)
+	}
+
+	go func() { c.Outbound <- []byte("from outbound") }()
+	buf := make([]byte, 100)
+	if n, err := rwc.Read(buf); err != nil || string(buf[:n]) != "from outbound" {
+		t.Errorf("Read = %q, %v", buf[:n], err)
+	}
+
+	go func() { c.Outbound <- []byte("too long") }()
+	if _, err := rwc.Read(buf[:3]); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Read into a short buffer = %v, want io.ErrShortBuffer", err)
+	}
+
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Read(buf); err == nil {
+		t.Error("Read after Close succeeded")
+	}
+}
+
+func TestReadWriteCloserDevice(t *testing.T) {
+	a, b := newPipeRWCs(t)
+	defer b.Close()
+	dev := tun.NewReadWriteCloserDevice(a, 1280)
+
+	if mtu, err := dev.MTU(); mtu != 1280 || err != nil {
+		t.Errorf("MTU = %d, %v", mtu, err)
+	}
+	if event := <-dev.Events(); event != tun.EventUp {
+		t.Errorf("first event = %v, want EventUp", event)
+	}
+
+	const offset = 4
+	pkt := []byte("packet")
+	if n, err := dev.Write(append(make([]byte, offset), pkt...), offset); n != len(pkt) || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+	buf := make([]byte, 100)
+	if n, err := b.Read(buf); err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Errorf("pipe got %q, %v; want %q", buf[:n], err, pkt)
+	}
+
+	if _, err := b.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dev.Read(buf, offset); err != nil || !bytes.Equal(buf[offset:offset+n], pkt) {
+		t.Errorf("Read = %q, %v; want %q", buf[offset:offset+n], err, pkt)
+	}
+
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-dev.Events(); ok {
+		t.Error("events not closed by Close")
+	}
+	if _, err := dev.Read(buf, offset); err == nil {
+		t.Error("Read after Close succeeded")
+	}
+}
+
+// TestReadWriteCloserRoundTrip adapts a pipe to a Device and back.
+func TestReadWriteCloserRoundTrip(t *testing.T) {
+	a, b := newPipeRWCs(t)
+	defer b.Close()
+	rwc := tun.NewReadWriteCloser(tun.NewReadWriteCloserDevice(a, 1280))
+	defer rwc.Close()
+
+	buf := make([]byte, 100)
+	for _, pkt := range []string{"one", "two"} {
+		if _, err := rwc.Write([]byte(pkt)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := b.Read(buf); err != nil || string(buf[:n]) != pkt {
+			t.Errorf("pipe got %q, %v; want %q", buf[:n], err, pkt)
+		}
+		if _, err := b.Write([]byte(pkt)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := rwc.Read(buf); err != nil || string(buf[:n]) != pkt {
+			t.Errorf("Read = %q, %v; want %q", buf[:n], err, pkt)
+		}
+	}
+}
@@ -6,7 +6,10 @@
 package tun
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"time"
 )
 
 type Event int
@@ -15,6 +18,7 @@ const (
 	EventUp = 1 << iota
 	EventDown
 	EventMTUUpdate
+	EventError // the device failed and can no longer be used; only sent on EventsDetailed
 )
 
 type Device interface {
@@ -27,3 +31,73 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// A BatchDevice is a Device that can read and write several packets per call.
+// Callers should use ReadBatch and WriteBatch in preference to Read and Write
+// when a Device implements them.
+type BatchDevice interface {
+	Device
+	// ReadBatch reads one or more packets into bufs, each starting at offset,
+	// storing their sizes in sizes, which must be as long as bufs.
+	// It blocks until at least one packet is available, and returns the number read.
+	ReadBatch(bufs [][]byte, sizes []int, offset int) (n int, err error)
+	// WriteBatch writes the packets in bufs, each starting at offset,
+	// and returns the number written, stopping at the first error.
+	WriteBatch(bufs [][]byte, offset int) (n int, err error)
+}
+
+// A DetailedEvent is an Event together with the data that goes with it.
+type DetailedEvent struct {
+	Event Event
+	MTU   int   // the new MTU, if Event includes EventMTUUpdate
+	Err   error // why the device failed, if Event includes EventError
+}
+
+// A DetailedEventDevice is a Device that can report events with their data,
+// so that the reader need not call MTU after an EventMTUUpdate, racing further
+// changes, and can learn of failures. A reader should use only one of Events and
+// EventsDetailed, preferring EventsDetailed; the same events are delivered on whichever
+// is used, except that EventError is never delivered on Events.
+type DetailedEventDevice interface {
+	Device
+	EventsDetailed() chan DetailedEvent // returns a constant channel of events with their data
+}
+
+// The range of MTUs that SetMTU accepts: the smallest MTU IPv4 allows,
+// and the largest that fits the 16-bit length of an IP packet.
+const (
+	MinMTU = 68
+	MaxMTU = 65535
+)
+
+// ErrInvalidMTU is wrapped by the errors SetMTU returns for an MTU outside [MinMTU, MaxMTU].
+var ErrInvalidMTU = errors.New("MTU out of range")
+
+// An MTUSetter is a Device whose MTU can be changed while it is in use.
+// The device reports the change with an EventMTUUpdate, so that readers
+// of its events react to it as to a change made by other means.
+type MTUSetter interface {
+	Device
+	// SetMTU sets the MTU of the device. Its error wraps ErrInvalidMTU
+	// if mtu is out of range, and satisfies errors.Is(err, os.ErrPermission)
+	// if the caller is not allowed to change the MTU.
+	SetMTU(mtu int) error
+}
+
+// CheckMTU returns an error wrapping ErrInvalidMTU if mtu is outside [MinMTU, MaxMTU].
+func CheckMTU(mtu int) error {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return fmt.Errorf("%w: %d", ErrInvalidMTU, mtu)
+	}
+	return nil
+}
+
+// A WriteDeadlineDevice is a Device whose writes can be given a deadline,
+// so that a writer is not blocked forever by an interface that stopped draining.
+type WriteDeadlineDevice interface {
+	Device
+	// SetWriteDeadline makes Write and WriteBatch calls that are blocked at t,
+	// or made after it, fail with an error wrapping os.ErrDeadlineExceeded.
+	// A zero t removes the deadline.
+	SetWriteDeadline(t time.Time) error
+}
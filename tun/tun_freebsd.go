@@ -413,6 +413,14 @@ func (tun *NativeTun) setMTU(n int) error {
 	return nil
 }
 
+// SetMTU sets the MTU of the interface. The route listener reports the change as an EventMTUUpdate.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	if err := CheckMTU(mtu); err != nil {
+		return err
+	}
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
 	if err != nil {
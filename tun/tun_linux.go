@@ -257,6 +257,14 @@ func (tun *NativeTun) setMTU(n int) error {
 	return nil
 }
 
+// SetMTU sets the MTU of the interface. The netlink listener reports the change as an EventMTUUpdate.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	if err := CheckMTU(mtu); err != nil {
+		return err
+	}
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	name, err := tun.Name()
 	if err != nil {
@@ -383,6 +391,71 @@ func (tun *NativeTun) Read(buf []byte, offset int) (n int, err error) {
 	return
 }
 
+// ReadBatch reads the first packet as Read does, blocking until it arrives,
+// and then reads any more that are already queued, until bufs is full.
+// The TUN driver returns one packet per read(2), so readv(2) would not help;
+// the saving is in waiting on the poller once per batch rather than once per packet.
+func (tun *NativeTun) ReadBatch(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+	sizes[0], err = tun.Read(bufs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	n = 1
+	rc, err := tun.tunFile.SyscallConn()
+	if err != nil {
+		return n, nil
+	}
+	rc.Read(func(fd uintptr) bool {
+		for n < len(bufs) {
+			buf := bufs[n][offset:]
+			if !tun.nopi {
+				buf = bufs[n][offset-4:]
+			}
+			m, err := unix.Read(int(fd), buf)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil || m < 0 {
+				// Most likely EAGAIN. Any other error will be
+				// returned by the next Read.
+				break
+			}
+			if !tun.nopi {
+				if m < 4 {
+					m = 0
+				} else {
+					m -= 4
+				}
+			}
+			sizes[n] = m
+			n++
+		}
+		return true // don't wait for more
+	})
+	return n, nil
+}
+
+// WriteBatch does not batch: it writes each packet with its own write(2),
+// as Write does, since the TUN driver takes one packet per write.
+func (tun *NativeTun) WriteBatch(bufs [][]byte, offset int) (n int, err error) {
+	for _, buf := range bufs {
+		if _, err = tun.Write(buf, offset); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// SetWriteDeadline sets the deadline of the TUN file's writes,
+// which the runtime poller enforces, as it does for sockets.
+func (tun *NativeTun) SetWriteDeadline(t time.Time) error {
+	return tun.tunFile.SetWriteDeadline(t)
+}
+
 func (tun *NativeTun) Events() chan Event {
 	return tun.events
 }
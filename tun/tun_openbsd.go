@@ -295,12 +295,20 @@ func (tun *NativeTun) setMTU(n int) error {
 	)
 
 	if errno != 0 {
-		return fmt.Errorf("failed to set MTU on %s", tun.name)
+		return fmt.Errorf("failed to set MTU on %s: %w", tun.name, errno)
 	}
 
 	return nil
 }
 
+// SetMTU sets the MTU of the interface. The route listener reports the change as an EventMTUUpdate.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	if err := CheckMTU(mtu); err != nil {
+		return err
+	}
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	// open datagram socket
 
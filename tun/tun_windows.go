@@ -155,6 +155,17 @@ func (tun *NativeTun) ForceMTU(mtu int) {
 	}
 }
 
+// SetMTU sets the MTU the device reports, as ForceMTU does, sending an EventMTUUpdate
+// if it changed. Wintun adapters have no MTU of their own, so the MTU of the interface's
+// IP configuration is left to the caller, which sets it along with the addresses.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	if err := CheckMTU(mtu); err != nil {
+		return err
+	}
+	tun.ForceMTU(mtu)
+	return nil
+}
+
 // Note: Read() and Write() assume the caller comes only from a single thread; there's no locking.
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// The addresses of the packets in the Corpus. They are in the documentation ranges,
+// so tests that want the packets routed must add them to their peers' allowed IPs.
+var (
+	CorpusDst4 = netip.MustParseAddr("192.0.2.1")
+	CorpusSrc4 = netip.MustParseAddr("192.0.2.2")
+	CorpusDst6 = netip.MustParseAddr("2001:db8::1")
+	CorpusSrc6 = netip.MustParseAddr("2001:db8::2")
+)
+
+// A CorpusEntry is a labeled packet of the Corpus.
+type CorpusEntry struct {
+	Name   string
+	Packet []byte
+}
+
+// Corpus returns a fresh set of malformed and boundary-case IPv4 and IPv6 packets,
+// from CorpusSrc4 to CorpusDst4 and from CorpusSrc6 to CorpusDst6, for fuzzing and
+// regression-testing code that handles packets from an untrusted source. It starts with
+// well-formed echo requests, from which the rest are derived.
+func Corpus() []CorpusEntry {
+	ping4 := PingSeq(CorpusDst4, CorpusSrc4, 1)
+	ping6 := PingSeq(CorpusDst6, CorpusSrc6, 1)
+
+	ipv4HeaderOnly := genIP(icmpv4ProtocolNumber, nil, CorpusDst4, CorpusSrc4)
+	ipv6HeaderOnly := genIP(icmpv6ProtocolNumber, nil, CorpusDst6, CorpusSrc6)
+	max4 := genIP(udpProtocolNumber, make([]byte, 65535-ipv4Size), CorpusDst4, CorpusSrc4)
+	max6 := genIP(udpProtocolNumber, make([]byte, 65535), CorpusDst6, CorpusSrc6)
+
+	return []CorpusEntry{
+		{"ipv4 echo request", ping4},
+		{"ipv6 echo request", ping6},
+		{"empty", nil},
+		{"one byte ipv4", []byte{4<<4 | ipv4Size/4}},
+		{"one byte ipv6", []byte{6 << 4}},
+		{"ipv4 truncated header", TruncateAt(ping4, ipv4Size-1)},
+		{"ipv6 truncated header", TruncateAt(ping6, ipv6Size-1)},
+		{"ipv4 truncated payload", TruncateAt(ping4, len(ping4)-1)},
+		{"ipv6 truncated payload", TruncateAt(ping6, len(ping6)-1)},
+		{"version 0", SetVersion(ping4, 0)},
+		{"version 5", SetVersion(ping4, 5)},
+		{"version 15", SetVersion(ping6, 15)},
+		{"ipv4 with version 6", SetVersion(ping4, 6)},
+		{"ipv6 with version 4", SetVersion(ping6, 4)},
+		{"ipv4 header length 0", setIPv4HeaderLength(ping4, 0)},
+		{"ipv4 header length 4", setIPv4HeaderLength(ping4, 4)},
+		{"ipv4 header length past end", setIPv4HeaderLength(TruncateAt(ping4, ipv4Size+4), 15)},
+		{"ipv4 total length too large", setLength(ping4, 2, 0xffff)},
+		{"ipv4 total length too small", setLength(ping4, 2, ipv4Size-1)},
+		{"ipv6 payload length too large", setLength(ping6, 4, 0xffff)},
+		{"ipv4 zero-length payload", ipv4HeaderOnly},
+		{"ipv6 zero-length payload", ipv6HeaderOnly},
+		{"ipv4 maximum size", max4},
+		{"ipv6 maximum size", max6},
+		{"ipv4 corrupt header checksum", CorruptChecksum(ping4)},
+		{"ipv6 corrupt icmpv6 checksum", CorruptChecksum(ping6)},
+	}
+}
+
+// TruncateAt returns a copy of the first n bytes of pkt, or of all of pkt if it is shorter.
+func TruncateAt(pkt []byte, n int) []byte {
+	if n > len(pkt) {
+		n = len(pkt)
+	}
+	return append([]byte{}, pkt[:n]...)
+}
+
+// CorruptChecksum returns a copy of pkt with a checksum flipped: for IPv4, the header
+// checksum, and for IPv6, which has none, the checksum of the ICMPv6, TCP or UDP packet
+// it carries. A pkt too short to have the checksum is returned unchanged.
+func CorruptChecksum(pkt []byte) []byte {
+	pkt = append([]byte{}, pkt...)
+	at := -1
+	switch {
+	case len(pkt) >= ipv4Size && pkt[0]>>4 == 4:
+		at = 10
+	case len(pkt) >= ipv6Size && pkt[0]>>4 == 6:
+		switch pkt[6] {
+		case icmpv6ProtocolNumber:
+			at = ipv6Size + 2
+		case udpProtocolNumber:
+			at = ipv6Size + 6
+		case tcpProtocolNumber:
+			at = ipv6Size + 16
+		}
+	}
+	if at >= 0 && at+2 <= len(pkt) {
+		pkt[at] ^= 0xff
+		pkt[at+1] ^= 0xff
+	}
+	return pkt
+}
+
+// SetVersion returns a copy of pkt with the version in its first byte set to version,
+// leaving the rest unchanged. An empty pkt is returned unchanged.
+func SetVersion(pkt []byte, version byte) []byte {
+	pkt = append([]byte{}, pkt...)
+	if len(pkt) > 0 {
+		pkt[0] = version<<4 | pkt[0]&0x0f
+	}
+	return pkt
+}
+
+// setIPv4HeaderLength returns a copy of pkt with its IPv4 header length set to words 32-bit words.
+func setIPv4HeaderLength(pkt []byte, words byte) []byte {
+	pkt = append([]byte{}, pkt...)
+	pkt[0] = pkt[0]&0xf0 | words&0x0f
+	return pkt
+}
+
+// setLength returns a copy of pkt with the 16-bit length at offset set to length.
+// It does not update checksums.
+func setLength(pkt []byte, offset int, length uint16) []byte {
+	pkt = append([]byte{}, pkt...)
+	binary.BigEndian.PutUint16(pkt[offset:], length)
+	return pkt
+}
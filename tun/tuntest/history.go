@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Direction is the way a packet crossed a ChannelTUN.
+type Direction int
+
+const (
+	DirInbound  Direction = iota // written by the device, received from Inbound
+	DirOutbound                  // sent on Outbound, read by the device
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirInbound:
+		return "inbound"
+	case DirOutbound:
+		return "outbound"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// A Record is a packet recorded by a ChannelTUN.
+type Record struct {
+	Time      time.Time // when the packet crossed the TUN
+	Direction Direction
+	Packet    []byte
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s %-8s %s", r.Time.Format("15:04:05.000000"), r.Direction, Summarize(r.Packet))
+}
+
+type history struct {
+	mu      sync.Mutex // protects the fields below
+	max     int        // the most records kept per direction; 0 when not recording
+	records [2][]Record
+}
+
+// Record makes c record a copy of each packet that crosses it from now on, in either direction,
+// keeping the last max packets of each direction. Recording happens as each packet is
+// handed over, and does not change when Inbound and Outbound block.
+func (c *ChannelTUN) Record(max int) {
+	c.history.mu.Lock()
+	defer c.history.mu.Unlock()
+	c.history.max = max
+}
+
+// History returns the recorded packets that crossed c in direction dir, oldest first.
+func (c *ChannelTUN) History(dir Direction) []Record {
+	c.history.mu.Lock()
+	defer c.history.mu.Unlock()
+	return append([]Record(nil), c.history.records[dir]...)
+}
+
+// FormatHistory returns the recorded packets of both directions, one per line,
+// in the order they crossed c, for use in failure messages.
+func (c *ChannelTUN) FormatHistory() string {
+	records := append(c.History(DirInbound), c.History(DirOutbound)...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	var b strings.Builder
+	for _, r := range records {
+		fmt.Fprintln(&b, r)
+	}
+	return b.String()
+}
+
+func (c *ChannelTUN) record(dir Direction, pkt []byte) {
+	h := &c.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.max <= 0 {
+		return
+	}
+	records := h.records[dir]
+	if len(records) >= h.max {
+		records = append(records[:0], records[len(records)-h.max+1:]...)
+	}
+	h.records[dir] = append(records, Record{
+		Time:      time.Now(),
+		Direction: dir,
+		Packet:    append([]byte(nil), pkt...),
+	})
+}
+
+// Summarize describes pkt in one line: its protocol, source and destination,
+// and for echo requests and replies, their identifier and sequence number.
+func Summarize(pkt []byte) string {
+	proto, dst, src, body, err := parseIP(pkt)
+	if err != nil {
+		return fmt.Sprintf("invalid packet (%v), %d bytes", err, len(pkt))
+	}
+	switch proto {
+	case icmpv4ProtocolNumber, icmpv6ProtocolNumber:
+		name := "ICMP"
+		if proto == icmpv6ProtocolNumber {
+			name = "ICMPv6"
+		}
+		if id, seq, err := ParseEchoID(pkt); err == nil {
+			kind := "request"
+			if IsEchoReply(pkt) {
+				kind = "reply"
+			}
+			return fmt.Sprintf("%s %v→%v echo %s id %d seq %d", name, src, dst, kind, id, seq)
+		}
+		if len(body) > 0 {
+			return fmt.Sprintf("%s %v→%v type %d", name, src, dst, body[0])
+		}
+		return fmt.Sprintf("%s %v→%v", name, src, dst)
+	case tcpProtocolNumber, udpProtocolNumber:
+		name := "TCP"
+		if proto == udpProtocolNumber {
+			name = "UDP"
+		}
+		if len(body) >= 4 {
+			return fmt.Sprintf("%s %v:%d→%v:%d, %d bytes", name,
+				src, binary.BigEndian.Uint16(body[0:]), dst, binary.BigEndian.Uint16(body[2:]), len(pkt))
+		}
+		return fmt.Sprintf("%s %v→%v, %d bytes", name, src, dst, len(pkt))
+	default:
+		return fmt.Sprintf("protocol %d %v→%v, %d bytes", proto, src, dst, len(pkt))
+	}
+}
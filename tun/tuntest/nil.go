@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+type nilDevice struct {
+	name      string
+	events    chan tun.Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NilDevice returns a TUN device with the given name and no traffic, for devices that
+// are only configured, never used. It never reports an event, so a device using it
+// stays down unless Up is called. Reads block until the TUN is closed,
+// and writes are discarded.
+func NilDevice(name string) tun.Device {
+	return newNilDevice(name)
+}
+
+// DiscardDevice returns a TUN device that reports EventUp, so that a device using it
+// comes up as soon as it is created, but otherwise has no traffic. Reads block until
+// the TUN is closed, and writes succeed immediately and are discarded, which makes it
+// a sink for benchmarks of the receive path.
+func DiscardDevice() tun.Device {
+	t := newNilDevice("discard")
+	t.events <- tun.EventUp
+	return t
+}
+
+func newNilDevice(name string) *nilDevice {
+	return &nilDevice{
+		name:   name,
+		events: make(chan tun.Event, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *nilDevice) File() *os.File { return nil }
+
+func (t *nilDevice) Read(data []byte, offset int) (int, error) {
+	<-t.closed
+	return 0, os.ErrClosed
+}
+
+func (t *nilDevice) Write(data []byte, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	default:
+		return len(data) - offset, nil
+	}
+}
+
+var _ tun.BatchDevice = (*nilDevice)(nil)
+
+// ReadBatch blocks until the TUN is closed, as Read does.
+func (t *nilDevice) ReadBatch(bufs [][]byte, sizes []int, offset int) (int, error) {
+	<-t.closed
+	return 0, os.ErrClosed
+}
+
+// WriteBatch discards the packets, as Write does.
+func (t *nilDevice) WriteBatch(bufs [][]byte, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	default:
+		return len(bufs), nil
+	}
+}
+
+func (t *nilDevice) Flush() error           { return nil }
+func (t *nilDevice) MTU() (int, error)      { return DefaultMTU, nil }
+func (t *nilDevice) Name() (string, error)  { return t.name, nil }
+func (t *nilDevice) Events() chan tun.Event { return t.events }
+func (t *nilDevice) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
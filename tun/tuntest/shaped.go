@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// A Clock tells the time and waits, so that tests can replace the real ones.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// A FakeClock is a Clock whose time moves only when it is told to.
+// Sleep returns immediately, having advanced the time by the duration slept.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Advance moves the time forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// ShapingStats counts what a ShapedTUN did to the packets passing through it,
+// in both directions.
+type ShapingStats struct {
+	Packets uint64 // packets read from or written to the inner device, or dropped
+	Delayed uint64 // packets held back until the bucket had room for them
+	Dropped uint64
+}
+
+// A ShapedTUN wraps a tun.Device, limiting the rate of packets read from it
+// and the rate of packets written to it, each with its own token bucket.
+type ShapedTUN struct {
+	tun.Device
+
+	// Drop makes the ShapedTUN drop packets that exceed the rate,
+	// rather than delaying them until they fit. Writes of dropped packets succeed.
+	Drop bool
+	// Clock is the clock used to refill the buckets and to delay packets.
+	// NewShapedTUN sets it to the real clock.
+	Clock Clock
+
+	read, write tokenBucket
+
+	mu    sync.Mutex // protects stats
+	stats ShapingStats
+}
+
+// NewShapedTUN returns a ShapedTUN that lets through bitsPerSecond in each direction,
+// allowing bursts of up to burst bytes. Drop and Clock must be set, if at all,
+// before the ShapedTUN is used.
+func NewShapedTUN(inner tun.Device, bitsPerSecond int, burst int) *ShapedTUN {
+	s := &ShapedTUN{
+		Device: inner,
+		Clock:  realClock{},
+	}
+	for _, b := range []*tokenBucket{&s.read, &s.write} {
+		b.rate = float64(bitsPerSecond) / 8
+		b.burst = float64(burst)
+		b.tokens = b.burst
+	}
+	return s
+}
+
+// Stats returns what the ShapedTUN has done so far.
+func (s *ShapedTUN) Stats() ShapingStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *ShapedTUN) Read(buf []byte, offset int) (int, error) {
+	for {
+		n, err := s.Device.Read(buf, offset)
+		if err != nil {
+			return n, err
+		}
+		if s.shape(&s.read, n) {
+			return n, nil
+		}
+	}
+}
+
+func (s *ShapedTUN) Write(buf []byte, offset int) (int, error) {
+	if !s.shape(&s.write, len(buf)-offset) {
+		return len(buf) - offset, nil
+	}
+	return s.Device.Write(buf, offset)
+}
+
+// shape takes size bytes from b, waiting for them to be available
+// unless s.Drop is set, and reports whether the packet may pass.
+func (s *ShapedTUN) shape(b *tokenBucket, size int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := s.Clock.Now()
+	b.refill(now)
+
+	s.mu.Lock()
+	s.stats.Packets++
+	switch {
+	case b.tokens >= float64(size):
+	case s.Drop:
+		s.stats.Dropped++
+		s.mu.Unlock()
+		return false
+	default:
+		s.stats.Delayed++
+	}
+	s.mu.Unlock()
+
+	b.tokens -= float64(size)
+	if b.tokens < 0 {
+		// The time slept refills the deficit at the next refill.
+		s.Clock.Sleep(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+	}
+	return true
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex // held while a packet waits, so that packets pass in order
+	rate   float64    // bytes per second
+	burst  float64    // bytes
+	tokens float64    // bytes available, negative while a packet waits
+	last   time.Time  // when tokens was last refilled
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// TCPFlags are the control bits of a TCP segment.
+type TCPFlags uint8
+
+const (
+	TCPFIN TCPFlags = 1 << iota
+	TCPSYN
+	TCPRST
+	TCPPSH
+	TCPACK
+	TCPURG
+)
+
+const (
+	udpSize = 8
+	tcpSize = 20
+)
+
+// UDP4 returns an IPv4 packet carrying a UDP datagram from src to dst,
+// which must be IPv4 addresses.
+func UDP4(src, dst netip.AddrPort, payload []byte) []byte {
+	mustBeFamily(4, src, dst)
+	return genUDP(src, dst, payload)
+}
+
+// UDP6 returns an IPv6 packet carrying a UDP datagram from src to dst,
+// which must be IPv6 addresses.
+func UDP6(src, dst netip.AddrPort, payload []byte) []byte {
+	mustBeFamily(6, src, dst)
+	return genUDP(src, dst, payload)
+}
+
+// TCP4 returns an IPv4 packet carrying a TCP segment from src to dst,
+// which must be IPv4 addresses, with the given flags and sequence number.
+func TCP4(src, dst netip.AddrPort, flags TCPFlags, seq uint32, payload []byte) []byte {
+	mustBeFamily(4, src, dst)
+	return genTCP(src, dst, flags, seq, payload)
+}
+
+// TCP6 returns an IPv6 packet carrying a TCP segment from src to dst,
+// which must be IPv6 addresses, with the given flags and sequence number.
+func TCP6(src, dst netip.AddrPort, flags TCPFlags, seq uint32, payload []byte) []byte {
+	mustBeFamily(6, src, dst)
+	return genTCP(src, dst, flags, seq, payload)
+}
+
+func mustBeFamily(version int, src, dst netip.AddrPort) {
+	for _, a := range []netip.Addr{src.Addr(), dst.Addr()} {
+		if (version == 4) != a.Is4() {
+			panic(fmt.Sprintf("tuntest: %v is not an IPv%d address", a, version))
+		}
+	}
+}
+
+func genUDP(src, dst netip.AddrPort, payload []byte) []byte {
+	const (
+		udpLengthOffset   = 4
+		udpChecksumOffset = 6
+	)
+
+	// https://tools.ietf.org/html/rfc768
+	udp := make([]byte, udpSize+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[udpLengthOffset:], uint16(len(udp)))
+	copy(udp[udpSize:], payload)
+	chksum := checksum(udp, pseudoHeaderSum(dst.Addr(), src.Addr(), udpProtocolNumber, len(udp)))
+	if chksum == 0 {
+		chksum = 0xffff // zero means no checksum
+	}
+	binary.BigEndian.PutUint16(udp[udpChecksumOffset:], chksum)
+
+	return genIP(udpProtocolNumber, udp, dst.Addr(), src.Addr())
+}
+
+func genTCP(src, dst netip.AddrPort, flags TCPFlags, seq uint32, payload []byte) []byte {
+	const (
+		tcpSeqOffset      = 4
+		tcpFlagsOffset    = 13
+		tcpWindowOffset   = 14
+		tcpChecksumOffset = 16
+		window            = 65535
+	)
+
+	// https://tools.ietf.org/html/rfc793 section 3.1
+	tcp := make([]byte, tcpSize+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[tcpSeqOffset:], seq)
+	tcp[12] = (tcpSize / 4) << 4 // data offset
+	tcp[tcpFlagsOffset] = byte(flags)
+	binary.BigEndian.PutUint16(tcp[tcpWindowOffset:], window)
+	copy(tcp[tcpSize:], payload)
+	chksum := checksum(tcp, pseudoHeaderSum(dst.Addr(), src.Addr(), tcpProtocolNumber, len(tcp)))
+	binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], chksum)
+
+	return genIP(tcpProtocolNumber, tcp, dst.Addr(), src.Addr())
+}
+
+// A Transport is a UDP datagram or TCP segment parsed by ParseTransport.
+type Transport struct {
+	Protocol byte // 6 for TCP, 17 for UDP
+	Src, Dst netip.AddrPort
+	Flags    TCPFlags // TCP only
+	Seq      uint32   // TCP only
+	Payload  []byte
+}
+
+// ParseTransport checks that pkt is an IPv4 or IPv6 packet carrying UDP or TCP,
+// such as those made by UDP4, UDP6, TCP4 and TCP6, with valid lengths and checksums,
+// and returns its five-tuple and payload.
+func ParseTransport(pkt []byte) (Transport, error) {
+	var t Transport
+	proto, dst, src, body, err := parseIP(pkt)
+	if err != nil {
+		return t, err
+	}
+	t.Protocol = proto
+	switch proto {
+	case udpProtocolNumber:
+		if len(body) < udpSize || int(binary.BigEndian.Uint16(body[4:])) != len(body) {
+			return t, errors.New("bad UDP length")
+		}
+		if binary.BigEndian.Uint16(body[6:]) == 0 && dst.Is4() {
+			// no checksum, which only IPv4 allows
+		} else if checksum(body, pseudoHeaderSum(dst, src, proto, len(body))) != 0 {
+			return t, errors.New("bad UDP checksum")
+		}
+		t.Payload = body[udpSize:]
+	case tcpProtocolNumber:
+		if len(body) < tcpSize {
+			return t, errors.New("bad TCP length")
+		}
+		dataOffset := int(body[12]>>4) * 4
+		if dataOffset < tcpSize || dataOffset > len(body) {
+			return t, errors.New("bad TCP data offset")
+		}
+		if checksum(body, pseudoHeaderSum(dst, src, proto, len(body))) != 0 {
+			return t, errors.New("bad TCP checksum")
+		}
+		t.Flags = TCPFlags(body[13])
+		t.Seq = binary.BigEndian.Uint32(body[4:])
+		t.Payload = body[dataOffset:]
+	default:
+		return t, errors.New("not UDP or TCP")
+	}
+	t.Src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[0:]))
+	t.Dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[2:]))
+	return t, nil
+}
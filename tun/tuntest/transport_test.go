@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestTransportRoundTrip(t *testing.T) {
+	src4, dst4 := netip.MustParseAddrPort("192.0.2.1:1337"), netip.MustParseAddrPort("198.51.100.2:53")
+	src6, dst6 := netip.MustParseAddrPort("[fd00::1]:1337"), netip.MustParseAddrPort("[fd00::2]:443")
+	for _, test := range []struct {
+		name     string
+		pkt      []byte
+		proto    byte
+		src, dst netip.AddrPort
+		flags    TCPFlags
+		seq      uint32
+		payload  []byte
+	}{
+		{"UDP4", UDP4(src4, dst4, []byte("hello")), 17, src4, dst4, 0, 0, []byte("hello")},
+		{"UDP4 odd length", UDP4(src4, dst4, []byte("odd")), 17, src4, dst4, 0, 0, []byte("odd")},
+		{"UDP6", UDP6(src6, dst6, []byte("hello")), 17, src6, dst6, 0, 0, []byte("hello")},
+		{"UDP6 empty", UDP6(src6, dst6, nil), 17, src6, dst6, 0, 0, nil},
+		{"TCP4 SYN", TCP4(src4, dst4, TCPSYN, 1000, nil), 6, src4, dst4, TCPSYN, 1000, nil},
+		{"TCP4 data", TCP4(src4, dst4, TCPPSH|TCPACK, 1001, []byte("data")), 6, src4, dst4, TCPPSH | TCPACK, 1001, []byte("data")},
+		{"TCP6 SYN", TCP6(src6, dst6, TCPSYN, 7, nil), 6, src6, dst6, TCPSYN, 7, nil},
+		{"TCP6 FIN", TCP6(src6, dst6, TCPFIN|TCPACK, 8, []byte("bye")), 6, src6, dst6, TCPFIN | TCPACK, 8, []byte("bye")},
+	} {
+		got, err := ParseTransport(test.pkt)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got.Protocol != test.proto || got.Src != test.src || got.Dst != test.dst ||
+			got.Flags != test.flags || got.Seq != test.seq || !bytes.Equal(got.Payload, test.payload) {
+			t.Errorf("%s: parsed %+v", test.name, got)
+		}
+
+		// Check the checksums independently of checksum and pseudoHeaderSum.
+		var body, pseudo []byte
+		if test.src.Addr().Is4() {
+			if sum := onesComplementSum(test.pkt[:20]); sum != 0xffff {
+				t.Errorf("%s: IPv4 header sums to %#04x, want 0xffff", test.name, sum)
+			}
+			body = test.pkt[20:]
+			pseudo = []byte{0, test.proto, byte(len(body) >> 8), byte(len(body))}
+		} else {
+			body = test.pkt[40:]
+			pseudo = []byte{0, 0, byte(len(body) >> 8), byte(len(body)), 0, 0, 0, test.proto}
+		}
+		s, d := test.src.Addr().AsSlice(), test.dst.Addr().AsSlice()
+		if sum := onesComplementSum(s, d, pseudo, body); sum != 0xffff {
+			t.Errorf("%s: segment and pseudo-header sum to %#04x, want 0xffff", test.name, sum)
+		}
+
+		corrupt := append([]byte{}, test.pkt...)
+		corrupt[len(corrupt)-1] ^= 0x01
+		if _, err := ParseTransport(corrupt); err == nil {
+			t.Errorf("%s: ParseTransport accepted a corrupted packet", test.name)
+		}
+	}
+
+	if _, err := ParseTransport(Ping6(dst6.Addr(), src6.Addr())); err == nil {
+		t.Error("ParseTransport accepted an ICMPv6 echo")
+	}
+}
+
+func TestTransportWrongFamily(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("UDP4 accepted IPv6 addresses")
+		}
+	}()
+	UDP4(netip.MustParseAddrPort("[fd00::1]:1"), netip.MustParseAddrPort("[fd00::2]:2"), nil)
+}
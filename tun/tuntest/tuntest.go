@@ -7,22 +7,42 @@ package tuntest
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"net/netip"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.zx2c4.com/wireguard/tun"
 )
 
+// PingID is the ICMP echo identifier of the echo requests made by Ping, Ping6 and PingSeq.
+const PingID = 1337
+
 func Ping(dst, src net.IP) []byte {
-	localPort := uint16(1337)
-	seq := uint16(0)
+	return genICMPv4(icmpv4Echo, PingID, 0, pingPayload(), dst, src)
+}
 
-	payload := make([]byte, 4)
-	binary.BigEndian.PutUint16(payload[0:], localPort)
-	binary.BigEndian.PutUint16(payload[2:], seq)
+// Ping6 is like Ping, but generates an ICMPv6 echo request.
+func Ping6(dst, src netip.Addr) []byte {
+	return genICMPv6(icmpv6Echo, PingID, 0, pingPayload(), dst, src)
+}
 
-	return genICMPv4(payload, dst, src)
+// PingSeq is like Ping or Ping6, depending on the family of dst and src,
+// but the echo request has sequence number seq, so that its reply can be told apart
+// from those to other requests. ParseEchoID extracts the sequence number.
+func PingSeq(dst, src netip.Addr, seq uint16) []byte {
+	if src.Is4() {
+		return genICMPv4(icmpv4Echo, PingID, seq, pingPayload(), dst.AsSlice(), src.AsSlice())
+	}
+	return genICMPv6(icmpv6Echo, PingID, seq, pingPayload(), dst, src)
+}
+
+func pingPayload() []byte {
+	return []byte("wireguard-go ping")
 }
 
 // Checksum is the "internet checksum" from https://tools.ietf.org/html/rfc1071.
@@ -40,13 +60,10 @@ func checksum(buf []byte, initial uint16) uint16 {
 	return ^uint16(v)
 }
 
-func genICMPv4(payload []byte, dst, src net.IP) []byte {
+func genICMPv4(typ byte, id, seq uint16, payload []byte, dst, src net.IP) []byte {
 	const (
-		icmpv4ProtocolNumber = 1
-		icmpv4Echo           = 8
 		icmpv4ChecksumOffset = 2
 		icmpv4Size           = 8
-		ipv4Size             = 20
 		ipv4TotalLenOffset   = 2
 		ipv4ChecksumOffset   = 10
 		ttl                  = 65
@@ -59,9 +76,12 @@ func genICMPv4(payload []byte, dst, src net.IP) []byte {
 	icmpv4 := pkt[ipv4Size : ipv4Size+icmpv4Size]
 
 	// https://tools.ietf.org/html/rfc792
-	icmpv4[0] = icmpv4Echo // type
-	icmpv4[1] = 0          // code
-	chksum := ^checksum(icmpv4, checksum(payload, 0))
+	icmpv4[0] = typ // type
+	icmpv4[1] = 0   // code
+	binary.BigEndian.PutUint16(icmpv4[4:], id)
+	binary.BigEndian.PutUint16(icmpv4[6:], seq)
+	copy(pkt[headerSize:], payload)
+	chksum := checksum(pkt[ipv4Size:], 0)
 	binary.BigEndian.PutUint16(icmpv4[icmpv4ChecksumOffset:], chksum)
 
 	// https://tools.ietf.org/html/rfc760 section 3.1
@@ -72,31 +92,319 @@ func genICMPv4(payload []byte, dst, src net.IP) []byte {
 	ip[9] = icmpv4ProtocolNumber
 	copy(ip[12:], src.To4())
 	copy(ip[16:], dst.To4())
-	chksum = ^checksum(ip[:], 0)
+	chksum = checksum(ip[:], 0)
 	binary.BigEndian.PutUint16(ip[ipv4ChecksumOffset:], chksum)
 
-	copy(pkt[headerSize:], payload)
 	return pkt
 }
 
+const (
+	icmpv4ProtocolNumber = 1
+	tcpProtocolNumber    = 6
+	udpProtocolNumber    = 17
+	icmpv6ProtocolNumber = 58
+	icmpv4Echo           = 8
+	icmpv4EchoReply      = 0
+	icmpv6Echo           = 128
+	icmpv6EchoReply      = 129
+	icmpv4Unreachable    = 3
+	icmpv6Unreachable    = 1
+	ipv4Size             = 20
+	ipv6Size             = 40
+)
+
+// pseudoHeaderSum returns the one's complement sum of the IPv4 or IPv6 pseudo-header
+// covered by the checksum of an upper-layer packet of the given protocol and length.
+func pseudoHeaderSum(dst, src netip.Addr, proto byte, length int) uint16 {
+	var pseudo []byte
+	if src.Is4() {
+		pseudo = make([]byte, 12)
+		s, d := src.As4(), dst.As4()
+		copy(pseudo[0:], s[:])
+		copy(pseudo[4:], d[:])
+		pseudo[9] = proto
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(length))
+	} else {
+		pseudo = make([]byte, 40)
+		s, d := src.As16(), dst.As16()
+		copy(pseudo[0:], s[:])
+		copy(pseudo[16:], d[:])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(length))
+		pseudo[39] = proto
+	}
+	return ^checksum(pseudo, 0)
+}
+
+// genIP returns an IPv4 or IPv6 packet, depending on the family of src and dst,
+// carrying body as its upper-layer packet of protocol proto.
+func genIP(proto byte, body []byte, dst, src netip.Addr) []byte {
+	const (
+		ipv4TotalLenOffset   = 2
+		ipv4ChecksumOffset   = 10
+		ipv6PayloadLenOffset = 4
+		ttl                  = 65
+	)
+
+	if src.Is4() {
+		// https://tools.ietf.org/html/rfc791 section 3.1
+		pkt := make([]byte, ipv4Size+len(body))
+		ip := pkt[:ipv4Size]
+		s, d := src.As4(), dst.As4()
+		ip[0] = (4 << 4) | (ipv4Size / 4)
+		binary.BigEndian.PutUint16(ip[ipv4TotalLenOffset:], uint16(len(pkt)))
+		ip[8] = ttl
+		ip[9] = proto
+		copy(ip[12:], s[:])
+		copy(ip[16:], d[:])
+		binary.BigEndian.PutUint16(ip[ipv4ChecksumOffset:], checksum(ip, 0))
+		copy(pkt[ipv4Size:], body)
+		return pkt
+	}
+
+	// https://tools.ietf.org/html/rfc8200 section 3
+	pkt := make([]byte, ipv6Size+len(body))
+	ip := pkt[:ipv6Size]
+	s, d := src.As16(), dst.As16()
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[ipv6PayloadLenOffset:], uint16(len(body)))
+	ip[6] = proto
+	ip[7] = ttl
+	copy(ip[8:], s[:])
+	copy(ip[24:], d[:])
+	copy(pkt[ipv6Size:], body)
+	return pkt
+}
+
+// parseIP checks the lengths and, for IPv4, the header checksum of pkt,
+// and returns its protocol, addresses and upper-layer packet.
+func parseIP(pkt []byte) (proto byte, dst, src netip.Addr, body []byte, err error) {
+	if len(pkt) == 0 {
+		return 0, dst, src, nil, errors.New("empty packet")
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		headerLen := int(pkt[0]&0x0f) * 4
+		if headerLen < ipv4Size || len(pkt) < headerLen || int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return 0, dst, src, nil, errors.New("bad IPv4 length")
+		}
+		if checksum(pkt[:headerLen], 0) != 0 {
+			return 0, dst, src, nil, errors.New("bad IPv4 header checksum")
+		}
+		dst = netip.AddrFrom4(*(*[4]byte)(pkt[16:20]))
+		src = netip.AddrFrom4(*(*[4]byte)(pkt[12:16]))
+		return pkt[9], dst, src, pkt[headerLen:], nil
+	case 6:
+		if len(pkt) < ipv6Size || int(binary.BigEndian.Uint16(pkt[4:])) != len(pkt)-ipv6Size {
+			return 0, dst, src, nil, errors.New("bad IPv6 length")
+		}
+		dst = netip.AddrFrom16(*(*[16]byte)(pkt[24:40]))
+		src = netip.AddrFrom16(*(*[16]byte)(pkt[8:24]))
+		return pkt[6], dst, src, pkt[ipv6Size:], nil
+	default:
+		return 0, dst, src, nil, errors.New("unknown IP version")
+	}
+}
+
+func genICMPv6(typ byte, id, seq uint16, payload []byte, dst, src netip.Addr) []byte {
+	const (
+		icmpv6ChecksumOffset = 2
+		icmpv6Size           = 8
+	)
+
+	icmpv6 := make([]byte, icmpv6Size+len(payload))
+
+	// https://tools.ietf.org/html/rfc4443 section 4.1
+	icmpv6[0] = typ // type
+	icmpv6[1] = 0   // code
+	binary.BigEndian.PutUint16(icmpv6[4:], id)
+	binary.BigEndian.PutUint16(icmpv6[6:], seq)
+	copy(icmpv6[icmpv6Size:], payload)
+	chksum := checksum(icmpv6, pseudoHeaderSum(dst, src, icmpv6ProtocolNumber, len(icmpv6)))
+	binary.BigEndian.PutUint16(icmpv6[icmpv6ChecksumOffset:], chksum)
+
+	return genIP(icmpv6ProtocolNumber, icmpv6, dst, src)
+}
+
+// ParseEcho checks that pkt is an ICMP or ICMPv6 echo request,
+// such as those made by Ping and Ping6, with valid lengths and checksums,
+// and returns its destination and source addresses.
+func ParseEcho(pkt []byte) (dst, src netip.Addr, err error) {
+	dst, src, icmp, err := parseICMP(pkt)
+	if err != nil {
+		return dst, src, err
+	}
+	if !isEchoType(icmp, dst, icmpv4Echo, icmpv6Echo) {
+		return dst, src, errors.New("not an echo request")
+	}
+	return dst, src, nil
+}
+
+// IsEchoRequest reports whether pkt is a well-formed ICMP or ICMPv6 echo request.
+func IsEchoRequest(pkt []byte) bool {
+	_, _, err := ParseEcho(pkt)
+	return err == nil
+}
+
+// IsEchoReply reports whether pkt is a well-formed ICMP or ICMPv6 echo reply.
+func IsEchoReply(pkt []byte) bool {
+	dst, _, icmp, err := parseICMP(pkt)
+	return err == nil && isEchoType(icmp, dst, icmpv4EchoReply, icmpv6EchoReply)
+}
+
+// ParseEchoID returns the identifier and sequence number of pkt,
+// which must be a well-formed ICMP or ICMPv6 echo request or reply.
+func ParseEchoID(pkt []byte) (id, seq uint16, err error) {
+	dst, _, icmp, err := parseICMP(pkt)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isEchoType(icmp, dst, icmpv4Echo, icmpv6Echo) && !isEchoType(icmp, dst, icmpv4EchoReply, icmpv6EchoReply) {
+		return 0, 0, errors.New("not an echo request or reply")
+	}
+	return binary.BigEndian.Uint16(icmp[4:]), binary.BigEndian.Uint16(icmp[6:]), nil
+}
+
+// ParseUnreachable checks that pkt is an ICMP or ICMPv6 destination unreachable error,
+// with valid lengths and checksums, and returns its addresses, its code, and the
+// packet it quotes, or as much of it as the error carries.
+func ParseUnreachable(pkt []byte) (dst, src netip.Addr, code byte, quoted []byte, err error) {
+	dst, src, icmp, err := parseICMP(pkt)
+	if err != nil {
+		return dst, src, 0, nil, err
+	}
+	typ := byte(icmpv6Unreachable)
+	if dst.Is4() {
+		typ = icmpv4Unreachable
+	}
+	if icmp[0] != typ {
+		return dst, src, 0, nil, errors.New("not a destination unreachable error")
+	}
+	return dst, src, icmp[1], icmp[8:], nil
+}
+
+// MakeEchoReply returns the reply to request, an ICMP or ICMPv6 echo request,
+// as the destination would send it: with the addresses swapped, the type changed
+// to echo reply, and the checksums updated. It returns nil if request is not
+// a well-formed echo request.
+func MakeEchoReply(request []byte) []byte {
+	dst, src, icmp, err := parseICMP(request)
+	if err != nil || !isEchoType(icmp, dst, icmpv4Echo, icmpv6Echo) {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(icmp[4:])
+	seq := binary.BigEndian.Uint16(icmp[6:])
+	payload := icmp[8:]
+	if dst.Is4() {
+		return genICMPv4(icmpv4EchoReply, id, seq, payload, src.AsSlice(), dst.AsSlice())
+	}
+	return genICMPv6(icmpv6EchoReply, id, seq, payload, src, dst)
+}
+
+// EchoResponder starts a goroutine that answers each echo request
+// written by the device to c, as MakeEchoReply would, by reading it from c's Inbound
+// and sending the reply to c's Outbound. Other packets are discarded, so while it runs,
+// nothing else should read from Inbound. It returns a function that stops the goroutine
+// and waits for it to exit. The goroutine also exits when c is closed.
+func EchoResponder(c *ChannelTUN) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			var pkt []byte
+			select {
+			case <-done:
+				return
+			case <-c.closed:
+				return
+			case pkt = <-c.Inbound:
+			}
+			reply := MakeEchoReply(pkt)
+			if reply == nil {
+				continue
+			}
+			select {
+			case <-done:
+				return
+			case <-c.closed:
+				return
+			case c.Outbound <- reply:
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
+
+// parseICMP checks the lengths and checksums of pkt, an ICMP or ICMPv6 packet,
+// and returns its addresses and ICMP message, which is at least a header long.
+func parseICMP(pkt []byte) (dst, src netip.Addr, icmp []byte, err error) {
+	proto, dst, src, icmp, err := parseIP(pkt)
+	if err != nil {
+		return dst, src, nil, err
+	}
+	switch {
+	case dst.Is4() && proto == icmpv4ProtocolNumber:
+		if checksum(icmp, 0) != 0 {
+			return dst, src, nil, errors.New("bad ICMP checksum")
+		}
+	case dst.Is6() && proto == icmpv6ProtocolNumber:
+		if checksum(icmp, pseudoHeaderSum(dst, src, proto, len(icmp))) != 0 {
+			return dst, src, nil, errors.New("bad ICMPv6 checksum")
+		}
+	default:
+		return dst, src, nil, errors.New("not ICMP")
+	}
+	if len(icmp) < 8 {
+		return dst, src, nil, errors.New("short ICMP message")
+	}
+	return dst, src, icmp, nil
+}
+
+// isEchoType reports whether icmp, an ICMP message sent to dst, has type v4Type
+// if dst is an IPv4 address or v6Type if it is an IPv6 one, and code 0.
+func isEchoType(icmp []byte, dst netip.Addr, v4Type, v6Type byte) bool {
+	typ := v6Type
+	if dst.Is4() {
+		typ = v4Type
+	}
+	return icmp[0] == typ && icmp[1] == 0
+}
+
 type ChannelTUN struct {
 	Inbound  chan []byte // incoming packets, closed on TUN close
 	Outbound chan []byte // outbound packets, blocks forever on TUN close
 
-	closed chan struct{}
-	events chan tun.Event
-	tun    chTun
+	writeDeadline int64 // in Unix nanoseconds, or 0 for none; accessed atomically
+	mtu           int32 // accessed atomically
+	closed        chan struct{}
+	events        chan tun.DetailedEvent
+	mu            sync.RWMutex // held for reading while sending on events, and for writing while closing it
+	tun           chTun
+
+	legacyOnce   sync.Once
+	legacyEvents chan tun.Event // events without their data, for readers of Events
+
+	history history
 }
 
+// eventBacklog is the number of events that may be injected before the device reads them
+// without InjectEvent blocking.
+const eventBacklog = 16
+
 func NewChannelTUN() *ChannelTUN {
 	c := &ChannelTUN{
 		Inbound:  make(chan []byte),
 		Outbound: make(chan []byte),
+		mtu:      DefaultMTU,
 		closed:   make(chan struct{}),
-		events:   make(chan tun.Event, 1),
+		events:   make(chan tun.DetailedEvent, eventBacklog),
 	}
 	c.tun.c = c
-	c.events <- tun.EventUp
+	c.events <- tun.DetailedEvent{Event: tun.EventUp}
 	return c
 }
 
@@ -104,6 +412,39 @@ func (c *ChannelTUN) TUN() tun.Device {
 	return &c.tun
 }
 
+// InjectEvent delivers event to the reader of the TUN's events, as if the interface had
+// changed state. If event includes EventMTUUpdate, the current MTU goes with it.
+// Up to a small backlog of events are buffered; beyond that, InjectEvent
+// blocks until the reader catches up. It does nothing once the TUN is closed.
+func (c *ChannelTUN) InjectEvent(event tun.Event) {
+	detail := tun.DetailedEvent{Event: event}
+	if event&tun.EventMTUUpdate != 0 {
+		detail.MTU = int(atomic.LoadInt32(&c.mtu))
+	}
+	c.InjectDetailedEvent(detail)
+}
+
+// InjectDetailedEvent is like InjectEvent, but delivers event with the data given in it.
+func (c *ChannelTUN) InjectDetailedEvent(event tun.DetailedEvent) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	select {
+	case <-c.closed:
+	case c.events <- event:
+	}
+}
+
+// InjectError injects an EventError carrying err, as if the interface had failed.
+func (c *ChannelTUN) InjectError(err error) {
+	c.InjectDetailedEvent(tun.DetailedEvent{Event: tun.EventError, Err: err})
+}
+
+// SetMTU changes the MTU reported by the TUN and injects an EventMTUUpdate.
+func (c *ChannelTUN) SetMTU(mtu int) {
+	atomic.StoreInt32(&c.mtu, int32(mtu))
+	c.InjectEvent(tun.EventMTUUpdate)
+}
+
 type chTun struct {
 	c *ChannelTUN
 }
@@ -115,6 +456,7 @@ func (t *chTun) Read(data []byte, offset int) (int, error) {
 	case <-t.c.closed:
 		return 0, os.ErrClosed
 	case msg := <-t.c.Outbound:
+		t.c.record(DirOutbound, msg)
 		return copy(data[offset:], msg), nil
 	}
 }
@@ -122,27 +464,121 @@ func (t *chTun) Read(data []byte, offset int) (int, error) {
 // Write is called by the wireguard device to deliver a packet for routing.
 func (t *chTun) Write(data []byte, offset int) (int, error) {
 	if offset == -1 {
+		// Close closed first, to release any InjectEvent blocked on a full events.
 		close(t.c.closed)
+		t.c.mu.Lock()
 		close(t.c.events)
+		t.c.mu.Unlock()
 		return 0, io.EOF
 	}
 	msg := make([]byte, len(data)-offset)
 	copy(msg, data[offset:])
+	var expired <-chan time.Time
+	if deadline := atomic.LoadInt64(&t.c.writeDeadline); deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+		expired = timer.C
+	}
 	select {
 	case <-t.c.closed:
 		return 0, os.ErrClosed
 	case t.c.Inbound <- msg:
+		t.c.record(DirInbound, msg)
 		return len(data) - offset, nil
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// SetWriteDeadline makes writes that find no reader on Inbound by t fail.
+func (t *chTun) SetWriteDeadline(deadline time.Time) error {
+	var nano int64
+	if !deadline.IsZero() {
+		nano = deadline.UnixNano()
+	}
+	atomic.StoreInt64(&t.c.writeDeadline, nano)
+	return nil
+}
+
+var (
+	_ tun.BatchDevice         = (*chTun)(nil)
+	_ tun.DetailedEventDevice = (*chTun)(nil)
+)
+
+// ReadBatch reads the first packet as Read does, and then any more
+// that are ready to be received from Outbound without waiting.
+func (t *chTun) ReadBatch(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	if len(bufs) == 0 {
+		return 0, nil
 	}
+	sizes[0], err = t.Read(bufs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	for n = 1; n < len(bufs); n++ {
+		select {
+		case msg := <-t.c.Outbound:
+			t.c.record(DirOutbound, msg)
+			sizes[n] = copy(bufs[n][offset:], msg)
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// WriteBatch writes each packet as Write does.
+func (t *chTun) WriteBatch(bufs [][]byte, offset int) (n int, err error) {
+	for _, buf := range bufs {
+		if _, err = t.Write(buf, offset); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
 }
 
 const DefaultMTU = 1420
 
-func (t *chTun) Flush() error           { return nil }
-func (t *chTun) MTU() (int, error)      { return DefaultMTU, nil }
-func (t *chTun) Name() (string, error)  { return "loopbackTun1", nil }
-func (t *chTun) Events() chan tun.Event { return t.c.events }
+func (t *chTun) Flush() error          { return nil }
+func (t *chTun) MTU() (int, error)     { return int(atomic.LoadInt32(&t.c.mtu)), nil }
+func (t *chTun) Name() (string, error) { return "loopbackTun1", nil }
 func (t *chTun) Close() error {
 	t.Write(nil, -1)
 	return nil
 }
+
+// SetMTU checks mtu, then changes it as ChannelTUN.SetMTU does.
+func (t *chTun) SetMTU(mtu int) error {
+	if err := tun.CheckMTU(mtu); err != nil {
+		return err
+	}
+	t.c.SetMTU(mtu)
+	return nil
+}
+
+// Events returns the events without their data. The first call starts a goroutine
+// that converts them, which exits when the TUN is closed, dropping any unread events.
+func (t *chTun) Events() chan tun.Event {
+	t.c.legacyOnce.Do(func() {
+		t.c.legacyEvents = make(chan tun.Event)
+		go func() {
+			defer close(t.c.legacyEvents)
+			for event := range t.c.events {
+				if event.Event &^= tun.EventError; event.Event == 0 {
+					continue
+				}
+				select {
+				case <-t.c.closed:
+					return
+				case t.c.legacyEvents <- event.Event:
+				}
+			}
+		}()
+	})
+	return t.c.legacyEvents
+}
+
+func (t *chTun) EventsDetailed() chan tun.DetailedEvent {
+	return t.c.events
+}
@@ -0,0 +1,481 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tuntest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// onesComplementSum is a deliberately naive RFC 1071 sum, written separately
+// from checksum so that the two do not share mistakes.
+func onesComplementSum(chunks ...[]byte) uint16 {
+	var b []byte
+	for _, chunk := range chunks {
+		b = append(b, chunk...)
+	}
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var sum uint64
+	for i := 0; i < len(b); i += 2 {
+		sum += uint64(b[i])<<8 | uint64(b[i+1])
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+func TestPingChecksums(t *testing.T) {
+	pkt := Ping(net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2))
+	if sum := onesComplementSum(pkt[:20]); sum != 0xffff {
+		t.Errorf("IPv4 header sums to %#04x, want 0xffff", sum)
+	}
+	if sum := onesComplementSum(pkt[20:]); sum != 0xffff {
+		t.Errorf("ICMP message sums to %#04x, want 0xffff", sum)
+	}
+
+	dst, src := netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")
+	pkt = Ping6(dst, src)
+	d, s := dst.As16(), src.As16()
+	icmp := pkt[40:]
+	pseudo := []byte{0, 0, 0, byte(len(icmp)), 0, 0, 0, 58}
+	if sum := onesComplementSum(s[:], d[:], pseudo, icmp); sum != 0xffff {
+		t.Errorf("ICMPv6 message and pseudo-header sum to %#04x, want 0xffff", sum)
+	}
+}
+
+func TestParseEcho(t *testing.T) {
+	for _, test := range []struct {
+		dst, src netip.Addr
+		pkt      []byte
+	}{
+		{
+			netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"),
+			Ping(net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)),
+		},
+		{
+			netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2"),
+			Ping6(netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")),
+		},
+	} {
+		dst, src, err := ParseEcho(test.pkt)
+		if err != nil || dst != test.dst || src != test.src {
+			t.Errorf("ParseEcho = %v, %v, %v; want %v, %v, nil", dst, src, err, test.dst, test.src)
+		}
+		for i := range test.pkt {
+			if test.dst.Is6() && (i >= 1 && i <= 3 || i == 7) {
+				continue // traffic class, flow label and hop limit are not checksummed
+			}
+			corrupt := append([]byte{}, test.pkt...)
+			corrupt[i] ^= 0x10
+			if _, _, err := ParseEcho(corrupt); err == nil {
+				t.Errorf("ParseEcho accepted %v echo with byte %d corrupted", test.dst, i)
+			}
+		}
+	}
+}
+
+func TestMakeEchoReply(t *testing.T) {
+	for _, addrs := range [][2]netip.Addr{
+		{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+		{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")},
+	} {
+		dst, src := addrs[0], addrs[1]
+		request := PingSeq(dst, src, 42)
+		if !IsEchoRequest(request) || IsEchoReply(request) {
+			t.Errorf("%v: request not recognized as one", dst)
+		}
+		reply := MakeEchoReply(request)
+		if !IsEchoReply(reply) || IsEchoRequest(reply) {
+			t.Fatalf("%v: reply not recognized as one", dst)
+		}
+		if _, rdst, rsrc, _, _ := parseIP(reply); rdst != src || rsrc != dst {
+			t.Errorf("reply from %v to %v, want from %v to %v", rsrc, rdst, dst, src)
+		}
+		for _, pkt := range [][]byte{request, reply} {
+			if id, seq, err := ParseEchoID(pkt); id != PingID || seq != 42 || err != nil {
+				t.Errorf("ParseEchoID = %d, %d, %v; want %d, 42, nil", id, seq, err, PingID)
+			}
+		}
+		if got := MakeEchoReply(reply); got != nil {
+			t.Errorf("%v: MakeEchoReply accepted a reply", dst)
+		}
+	}
+}
+
+func TestEchoResponder(t *testing.T) {
+	c := NewChannelTUN()
+	dev := c.TUN()
+	defer dev.Close()
+	stop := EchoResponder(c)
+	defer stop()
+
+	dst, src := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	buf := make([]byte, 1500)
+	for _, pkt := range [][]byte{[]byte("stray"), PingSeq(dst, src, 7)} {
+		if _, err := dev.Write(pkt, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := dev.Read(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, seq, err := ParseEchoID(buf[:n]); !IsEchoReply(buf[:n]) || id != PingID || seq != 7 || err != nil {
+		t.Errorf("read %x, want the echo reply with sequence number 7", buf[:n])
+	}
+}
+
+func TestChannelTUNBatch(t *testing.T) {
+	c := NewChannelTUN()
+	dev := c.TUN().(tun.BatchDevice)
+	defer dev.Close()
+
+	const offset = 4
+	packets := []string{"one", "two", "three"}
+	bufs := make([][]byte, len(packets))
+	for i, p := range packets {
+		bufs[i] = append(make([]byte, offset), p...)
+	}
+	go func() {
+		if n, err := dev.WriteBatch(bufs, offset); n != len(bufs) || err != nil {
+			t.Errorf("WriteBatch = %d, %v", n, err)
+		}
+	}()
+	for _, want := range packets {
+		if got := <-c.Inbound; string(got) != want {
+			t.Errorf("Inbound got %q, want %q", got, want)
+		}
+	}
+
+	go func() { c.Outbound <- []byte("out") }()
+	sizes := make([]int, len(bufs))
+	n, err := dev.ReadBatch(bufs, sizes, offset)
+	if err != nil || n < 1 || string(bufs[0][offset:offset+sizes[0]]) != "out" {
+		t.Errorf("ReadBatch = %d, %v, first packet %q", n, err, bufs[0][offset:offset+sizes[0]])
+	}
+}
+
+func TestNilDevices(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		dev    tun.Device
+		events []tun.Event
+	}{
+		{"NilDevice", NilDevice("nil0"), nil},
+		{"DiscardDevice", DiscardDevice(), []tun.Event{tun.EventUp}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dev := test.dev
+			if n, err := dev.Write(make([]byte, 24), 4); n != 20 || err != nil {
+				t.Errorf("Write = %d, %v; want 20, nil", n, err)
+			}
+			batchDev, ok := dev.(tun.BatchDevice)
+			if !ok {
+				t.Fatal("not a tun.BatchDevice")
+			}
+			if n, err := batchDev.WriteBatch([][]byte{make([]byte, 24), make([]byte, 24)}, 4); n != 2 || err != nil {
+				t.Errorf("WriteBatch = %d, %v; want 2, nil", n, err)
+			}
+			readErr := make(chan error, 2)
+			go func() {
+				_, err := dev.Read(make([]byte, DefaultMTU), 0)
+				readErr <- err
+			}()
+			go func() {
+				_, err := batchDev.ReadBatch([][]byte{make([]byte, DefaultMTU)}, make([]int, 1), 0)
+				readErr <- err
+			}()
+			select {
+			case err := <-readErr:
+				t.Fatalf("Read returned %v before Close", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+			if err := dev.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				select {
+				case err := <-readErr:
+					if !errors.Is(err, os.ErrClosed) {
+						t.Errorf("Read after Close = %v, want os.ErrClosed", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("Close did not unblock Read")
+				}
+			}
+			var events []tun.Event
+			for event := range dev.Events() {
+				events = append(events, event)
+			}
+			if !reflect.DeepEqual(events, test.events) {
+				t.Errorf("events = %v, want %v", events, test.events)
+			}
+			if _, err := dev.Write(make([]byte, 24), 4); err == nil {
+				t.Error("Write after Close succeeded")
+			}
+			if _, err := batchDev.WriteBatch([][]byte{make([]byte, 24)}, 4); err == nil {
+				t.Error("WriteBatch after Close succeeded")
+			}
+			if err := dev.Close(); err != nil {
+				t.Errorf("second Close = %v", err)
+			}
+		})
+	}
+}
+
+func TestChannelTUNEvents(t *testing.T) {
+	c := NewChannelTUN()
+	dev := c.TUN().(tun.DetailedEventDevice)
+	if event := <-dev.EventsDetailed(); event.Event != tun.EventUp {
+		t.Errorf("first event = %v, want EventUp", event)
+	}
+	c.SetMTU(1300)
+	if event := <-dev.EventsDetailed(); event.Event != tun.EventMTUUpdate || event.MTU != 1300 {
+		t.Errorf("after SetMTU(1300), got %+v", event)
+	}
+	setter := dev.(tun.MTUSetter)
+	if err := setter.SetMTU(1280); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-dev.EventsDetailed(); event.Event != tun.EventMTUUpdate || event.MTU != 1280 {
+		t.Errorf("after MTUSetter.SetMTU(1280), got %+v", event)
+	}
+	for _, mtu := range []int{0, tun.MinMTU - 1, tun.MaxMTU + 1} {
+		if err := setter.SetMTU(mtu); !errors.Is(err, tun.ErrInvalidMTU) {
+			t.Errorf("SetMTU(%d) = %v, want ErrInvalidMTU", mtu, err)
+		}
+	}
+	if mtu, _ := dev.MTU(); mtu != 1280 {
+		t.Errorf("MTU = %d after invalid SetMTUs, want 1280", mtu)
+	}
+	dev.Close()
+
+	c = NewChannelTUN()
+	legacy := c.TUN()
+	defer legacy.Close()
+	if event := <-legacy.Events(); event != tun.EventUp {
+		t.Errorf("first event = %v, want EventUp", event)
+	}
+	c.InjectError(errors.New("failed"))
+	c.InjectEvent(tun.EventDown)
+	if event := <-legacy.Events(); event != tun.EventDown {
+		t.Errorf("got %v after an error and EventDown, want only EventDown", event)
+	}
+}
+
+func TestShapedTUN(t *testing.T) {
+	const (
+		bitsPerSecond = 1000000
+		burst         = 1500
+		size          = 1250 // takes 10ms at 1 Mbit/s
+		count         = 10
+	)
+	perPacket := time.Duration(size * 8 * int64(time.Second) / bitsPerSecond)
+
+	c := NewChannelTUN()
+	shaped := NewShapedTUN(c.TUN(), bitsPerSecond, burst)
+	clock := NewFakeClock(time.Unix(0, 0))
+	shaped.Clock = clock
+	defer shaped.Close()
+	go func() {
+		for range c.Inbound {
+		}
+	}()
+
+	// The first packet fits in the burst, leaving 250 bytes;
+	// each of the rest waits for the bucket to refill.
+	pkt := make([]byte, size)
+	start := clock.Now()
+	var sent []time.Duration
+	for i := 0; i < count; i++ {
+		if _, err := shaped.Write(pkt, 0); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, clock.Now().Sub(start))
+	}
+	if want := time.Duration(size-(burst-size)) * perPacket / size; sent[1] < want-time.Microsecond || sent[1] > want+time.Microsecond {
+		t.Errorf("second packet sent after %v, want %v", sent[1], want)
+	}
+	for i := 2; i < count; i++ {
+		if gap := sent[i] - sent[i-1]; gap < perPacket*99/100 || gap > perPacket*101/100 {
+			t.Errorf("packet %d sent %v after the one before, want %v", i, gap, perPacket)
+		}
+	}
+	if stats := shaped.Stats(); stats.Packets != count || stats.Delayed != count-1 || stats.Dropped != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			c.Outbound <- pkt
+		}
+	}()
+	before := clock.Now()
+	buf := make([]byte, size)
+	for i := 0; i < 2; i++ {
+		if n, err := shaped.Read(buf, 0); n != size || err != nil {
+			t.Fatalf("Read = %d, %v", n, err)
+		}
+	}
+	// Reads have their own bucket, which has been full all along.
+	if took := clock.Now().Sub(before); took > perPacket {
+		t.Errorf("reading two packets took %v, want at most %v", took, perPacket)
+	}
+}
+
+func TestShapedTUNDrop(t *testing.T) {
+	c := NewChannelTUN()
+	shaped := NewShapedTUN(c.TUN(), 1000000, 1500)
+	clock := NewFakeClock(time.Unix(0, 0))
+	shaped.Clock = clock
+	shaped.Drop = true
+	defer shaped.Close()
+	received := make(chan []byte, 10)
+	go func() {
+		for pkt := range c.Inbound {
+			received <- pkt
+		}
+	}()
+
+	pkt := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		if n, err := shaped.Write(pkt, 0); n != len(pkt) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	clock.Advance(8 * time.Millisecond) // 1000 bytes at 1 Mbit/s
+	if _, err := shaped.Write(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		<-received
+	}
+	select {
+	case <-received:
+		t.Error("a packet that exceeded the rate was written")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if stats := shaped.Stats(); stats.Packets != 4 || stats.Dropped != 2 || stats.Delayed != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	c := NewChannelTUN()
+	dev := c.TUN()
+	defer dev.Close()
+	c.Record(2)
+
+	dst, src := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	written := make(chan error)
+	go func() {
+		for seq := uint16(1); seq <= 3; seq++ {
+			_, err := dev.Write(PingSeq(dst, src, seq), 0)
+			written <- err
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if h := c.History(DirInbound); len(h) != 0 {
+		t.Errorf("packet recorded before it was received: %v", h)
+	}
+	for i := 0; i < 3; i++ {
+		<-c.Inbound
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() { c.Outbound <- MakeEchoReply(PingSeq(dst, src, 3)) }()
+	if _, err := dev.Read(make([]byte, DefaultMTU), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	inbound := c.History(DirInbound)
+	if len(inbound) != 2 {
+		t.Fatalf("recorded %d inbound packets, want the last 2", len(inbound))
+	}
+	for i, r := range inbound {
+		if _, seq, _ := ParseEchoID(r.Packet); seq != uint16(i+2) || r.Direction != DirInbound {
+			t.Errorf("inbound record %d is %v, want echo request seq %d", i, r, i+2)
+		}
+	}
+	if outbound := c.History(DirOutbound); len(outbound) != 1 || !IsEchoReply(outbound[0].Packet) {
+		t.Errorf("outbound history = %v, want one echo reply", outbound)
+	}
+	got := c.FormatHistory()
+	for _, want := range []string{
+		"inbound  ICMP 192.0.2.2→192.0.2.1 echo request id 1337 seq 2\n",
+		"inbound  ICMP 192.0.2.2→192.0.2.1 echo request id 1337 seq 3\n",
+		"outbound ICMP 192.0.2.1→192.0.2.2 echo reply id 1337 seq 3\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("FormatHistory() = %q, missing %q", got, want)
+		}
+	}
+	if i, j := strings.Index(got, "seq 2"), strings.Index(got, "reply"); i > j {
+		t.Errorf("FormatHistory() out of order:\n%s", got)
+	}
+}
+
+func TestCorpus(t *testing.T) {
+	names := make(map[string]bool)
+	var v4, v6 int
+	for _, entry := range Corpus() {
+		if names[entry.Name] {
+			t.Errorf("duplicate corpus entry %q", entry.Name)
+		}
+		names[entry.Name] = true
+		if len(entry.Packet) > 0 {
+			switch entry.Packet[0] >> 4 {
+			case 4:
+				v4++
+			case 6:
+				v6++
+			}
+		}
+		_, _, err := ParseEcho(entry.Packet)
+		if wellFormed := strings.HasSuffix(entry.Name, "echo request"); (err == nil) != wellFormed {
+			t.Errorf("%s: ParseEcho = %v", entry.Name, err)
+		}
+	}
+	if v4 < 5 || v6 < 5 {
+		t.Errorf("corpus has %d IPv4 and %d IPv6 packets, want both families", v4, v6)
+	}
+}
+
+func TestCorpusGenerators(t *testing.T) {
+	ping := PingSeq(CorpusDst4, CorpusSrc4, 1)
+	orig := append([]byte{}, ping...)
+
+	if got := TruncateAt(ping, 3); len(got) != 3 || &got[0] == &ping[0] {
+		t.Errorf("TruncateAt(ping, 3) = %v, want a 3-byte copy", got)
+	}
+	if got := TruncateAt(ping, len(ping)+1); len(got) != len(ping) {
+		t.Errorf("TruncateAt past the end returned %d bytes, want %d", len(got), len(ping))
+	}
+	if got := SetVersion(ping, 9); got[0] != 9<<4|ipv4Size/4 {
+		t.Errorf("SetVersion(ping, 9) first byte = %#x", got[0])
+	}
+	for _, pkt := range [][]byte{ping, PingSeq(CorpusDst6, CorpusSrc6, 1)} {
+		if _, _, err := ParseEcho(CorruptChecksum(pkt)); err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("ParseEcho of a corrupted checksum = %v, want a checksum error", err)
+		}
+	}
+	if !bytes.Equal(ping, orig) {
+		t.Error("a generator modified its input")
+	}
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"time"
+)
+
+// readBatch reads packets from d into bufs as ReadBatch does,
+// using Read to read a single packet if d is not a BatchDevice.
+func readBatch(d Device, bufs [][]byte, sizes []int, offset int) (int, error) {
+	if batch, ok := d.(BatchDevice); ok {
+		return batch.ReadBatch(bufs, sizes, offset)
+	}
+	n, err := d.Read(bufs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+// writeBatch writes the packets in bufs to d as WriteBatch does,
+// using Write for each in turn if d is not a BatchDevice.
+func writeBatch(d Device, bufs [][]byte, offset int) (int, error) {
+	if batch, ok := d.(BatchDevice); ok {
+		return batch.WriteBatch(bufs, offset)
+	}
+	for i, buf := range bufs {
+		if _, err := d.Write(buf, offset); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+// A writeDeadlineForwarder adds the SetWriteDeadline of the device
+// that a wrapper wraps to the wrapper.
+type writeDeadlineForwarder struct {
+	BatchDevice
+	inner WriteDeadlineDevice
+}
+
+func (d writeDeadlineForwarder) SetWriteDeadline(t time.Time) error {
+	return d.inner.SetWriteDeadline(t)
+}
+
+// forwardWriteDeadline returns wrapper, which wraps inner,
+// made a WriteDeadlineDevice if inner is one.
+func forwardWriteDeadline(wrapper BatchDevice, inner Device) Device {
+	if deadline, ok := inner.(WriteDeadlineDevice); ok {
+		return writeDeadlineForwarder{wrapper, deadline}
+	}
+	return wrapper
+}